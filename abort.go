@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+// SessionAbort is the frame the server sends when it releases a session on
+// its side, e.g. because the subscriber hung up. Its root element is
+// ABORT_FRAME.
+type SessionAbort struct {
+	XMLName   xml.Name
+	RequestID string `xml:"requestId"`
+	MSISDN    string `xml:"msisdn"`
+	Reason    string `xml:"reason"`
+}
+
+// Cause of the context of a menu API call cancelled by a SessionAbort
+var errSessionAborted = errors.New("session aborted by the server")
+
+// menuCall is a menu API call in flight, cancelled if its session is aborted
+type menuCall struct {
+	cancel context.CancelCauseFunc
+}
+
+// menuCallKey identifies a menu API call in flight: a retransmission or a
+// quick second input on the same session makes another call of its own
+type menuCallKey struct {
+	requestID string
+	input     string
+}
+
+// Menu API calls in flight, keyed by menuCallKey
+var inflightMenuCalls sync.Map
+
+// trackMenuCall returns a context for the menu API call answering input on
+// requestID that handleSessionAbort can cancel, and the function to call
+// once it is over
+func trackMenuCall(ctx context.Context, requestID, input string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	call := &menuCall{cancel: cancel}
+	key := menuCallKey{requestID, input}
+	inflightMenuCalls.Store(key, call)
+	return ctx, func() {
+		inflightMenuCalls.CompareAndDelete(key, call)
+		cancel(nil)
+	}
+}
+
+// cancelMenuCalls cancels the menu API calls in flight for requestID
+func cancelMenuCalls(requestID string, cause error) {
+	inflightMenuCalls.Range(func(key, call any) bool {
+		if key.(menuCallKey).requestID == requestID && inflightMenuCalls.CompareAndDelete(key, call) {
+			call.(*menuCall).cancel(cause)
+		}
+		return true
+	})
+}
+
+// handleSessionAbort ends the session a SessionAbort frame names,
+// cancelling its menu API calls in flight. Nothing is sent back.
+func handleSessionAbort(header, body []byte, conn net.Conn) {
+	var abort SessionAbort
+	if err := xml.Unmarshal(body, &abort); err != nil || abort.RequestID == "" {
+		logUnparsedFrame(header, body, conn, fmt.Sprintf("invalid %s: %v", AppConfig().AbortFrame, err))
+		return
+	}
+
+	stats.SessionsAborted.Add(1)
+	AppLogger.Info("[conn %s] Server aborted session %s of %s (reason %q)", connLabel(conn), abort.RequestID, abort.MSISDN, abort.Reason)
+
+	cancelMenuCalls(abort.RequestID, errSessionAborted)
+	endSession(abort.RequestID)
+}
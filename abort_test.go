@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+func TestSessionAbortCancelsMenuCall(t *testing.T) {
+	withLinkUp(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.ResponseBudget = 5 * time.Second
+	})
+	called := make(chan struct{})
+	cancelled := make(chan error, 1)
+	withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client going away once the body is read
+		io.Copy(io.Discard, r.Body)
+		close(called)
+		select {
+		case <-r.Context().Done():
+			cancelled <- r.Context().Err()
+		case <-time.After(3 * time.Second):
+			cancelled <- errors.New("not cancelled")
+			writeMenu(w, "Too late", true)
+		}
+	})
+
+	c := &captureConn{}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		serve(t, c, testRequest("ABORT1", "2348030000060", "123", ""))
+	}()
+
+	select {
+	case <-called:
+	case <-time.After(2 * time.Second):
+		t.Fatal("menu API never called")
+	}
+	if _, ok := Sessions.Get("ABORT1"); !ok {
+		t.Fatal("session not open during the menu API call")
+	}
+
+	aborted := stats.SessionsAborted.Load()
+	body := []byte("<USSDAbort><requestId>ABORT1</requestId><msisdn>2348030000060</msisdn><reason>subscriber hung up</reason></USSDAbort>")
+	processServerMessage(aggregatorFrame("ABORT1", body)[:frameHeaderSize], body, c)
+
+	if err := <-cancelled; !errors.Is(err, context.Canceled) {
+		t.Errorf("menu API call ended with %v, want it cancelled", err)
+	}
+	select {
+	case <-served:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request still being handled after the abort")
+	}
+
+	if _, ok := Sessions.Get("ABORT1"); ok {
+		t.Error("session still open after the abort")
+	}
+	if got := stats.SessionsAborted.Load() - aborted; got != 1 {
+		t.Errorf("sessions_aborted grew by %d, want 1", got)
+	}
+	if frames := c.frames(t); len(frames) != 0 {
+		t.Errorf("sent %d frames for an aborted session: %q", len(frames), frames)
+	}
+}
+
+func TestMenuCallsTrackedPerInput(t *testing.T) {
+	first, untrackFirst := trackMenuCall(context.Background(), "ABORT2", "1")
+	second, untrackSecond := trackMenuCall(context.Background(), "ABORT2", "2")
+	defer untrackSecond()
+
+	// The first call ending leaves the second cancellable
+	untrackFirst()
+	if first.Err() == nil {
+		t.Error("first call not released once over")
+	}
+	cancelMenuCalls("ABORT2", errSessionAborted)
+	if cause := context.Cause(second); !errors.Is(cause, errSessionAborted) {
+		t.Errorf("second call ended with %v, want it aborted", cause)
+	}
+}
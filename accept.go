@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+)
+
+// Values for MENU_CONTENT_TYPE_CHECK
+const (
+	contentTypeCheckLenient = "lenient" // fail XML answers only
+	contentTypeCheckStrict  = "strict"  // fail any answer MENU_API_ACCEPT did not ask for
+)
+
+// Returned when the menu API answers in a media type MenuAPIAccept did not
+// ask for, e.g. XML from a backend defaulting to it
+var errUnexpectedContentType = errors.New("menu API answered with an unexpected content type")
+
+// parseAccept returns the media types of an Accept header, without their
+// parameters (such as q)
+func parseAccept(accept string) ([]string, error) {
+	var types []string
+	for _, part := range strings.Split(accept, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		mediaType, _, err := mime.ParseMediaType(part)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", strings.TrimSpace(part), err)
+		}
+		types = append(types, mediaType)
+	}
+	if len(types) == 0 {
+		return nil, fmt.Errorf("no media type")
+	}
+	return types, nil
+}
+
+// checkContentType returns an error wrapping errUnexpectedContentType when
+// contentType, that of a menu API response, matches none of the media
+// types of accept and, unless strict, is XML. Many backends label their
+// JSON loosely (text/plain, text/html), so only XML is taken for the wrong
+// format by default. A response without one is given the benefit of the
+// doubt.
+func checkContentType(accept, contentType string, strict bool) error {
+	if contentType == "" {
+		return nil
+	}
+	got, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("%w: %q, want %s", errUnexpectedContentType, contentType, accept)
+	}
+	if !strict && !isXMLMediaType(got) {
+		return nil
+	}
+	types, _ := parseAccept(accept)
+	for _, want := range types {
+		wantType, wantSub, _ := strings.Cut(want, "/")
+		gotType, gotSub, _ := strings.Cut(got, "/")
+		if (wantType == "*" || wantType == gotType) && (wantSub == "*" || wantSub == gotSub) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s, want %s", errUnexpectedContentType, got, accept)
+}
+
+// isXMLMediaType reports whether mediaType is an XML one, such as
+// application/xml, text/xml or application/soap+xml
+func isXMLMediaType(mediaType string) bool {
+	return mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+}
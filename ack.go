@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+// ResponseAck is the frame some servers send to acknowledge each response
+// they received. Its root element is ACK_FRAME.
+type ResponseAck struct {
+	XMLName   xml.Name
+	RequestID string `xml:"requestId"`
+}
+
+// pendingAcks holds when each response still awaiting its ResponseAck was
+// sent, oldest first, keyed by the requestId of the response
+type pendingAcks struct {
+	mu   sync.Mutex
+	sent map[string][]time.Time
+}
+
+// Responses awaiting acknowledgement, with ACK_FRAME set
+var awaitingAcks = &pendingAcks{sent: make(map[string][]time.Time)}
+
+// add notes that a response with requestID was sent now
+func (p *pendingAcks) add(requestID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent[requestID] = append(p.sent[requestID], time.Now())
+}
+
+// cancel drops the latest response noted with requestID, which could not
+// be sent after all
+func (p *pendingAcks) cancel(requestID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sent := p.sent[requestID]
+	if len(sent) <= 1 {
+		delete(p.sent, requestID)
+		return
+	}
+	p.sent[requestID] = sent[:len(sent)-1]
+}
+
+// ack matches an acknowledgement to the oldest response awaiting it with
+// requestID, returning how long after the send it came
+func (p *pendingAcks) ack(requestID string) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sent := p.sent[requestID]
+	if len(sent) == 0 {
+		return 0, false
+	}
+	if len(sent) == 1 {
+		delete(p.sent, requestID)
+	} else {
+		p.sent[requestID] = sent[1:]
+	}
+	return time.Since(sent[0]), true
+}
+
+// unackedResponse is logged as response_unacked
+type unackedResponse struct {
+	RequestID string    `json:"request_id"`
+	SentAt    time.Time `json:"sent_at"`
+	TimeoutMs int64     `json:"timeout_ms"`
+}
+
+// expire drops the responses sent over timeout ago and returns them
+func (p *pendingAcks) expire(timeout time.Duration) []unackedResponse {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var expired []unackedResponse
+	cutoff := time.Now().Add(-timeout)
+	for id, sent := range p.sent {
+		n := 0
+		for n < len(sent) && sent[n].Before(cutoff) {
+			expired = append(expired, unackedResponse{RequestID: id, SentAt: sent[n], TimeoutMs: timeout.Milliseconds()})
+			n++
+		}
+		if n == len(sent) {
+			delete(p.sent, id)
+		} else {
+			p.sent[id] = sent[n:]
+		}
+	}
+	return expired
+}
+
+// handleResponseAck matches a ResponseAck frame to the response it
+// acknowledges. Nothing is sent back.
+func handleResponseAck(header, body []byte, conn net.Conn) {
+	var ack ResponseAck
+	if err := xml.Unmarshal(body, &ack); err != nil || ack.RequestID == "" {
+		logUnparsedFrame(header, body, conn, fmt.Sprintf("invalid %s: %v", AppConfig().AckFrame, err))
+		return
+	}
+	if after, ok := awaitingAcks.ack(ack.RequestID); ok {
+		AppLogger.Debug("[conn %s] Response to %s acknowledged in %s", connLabel(conn), ack.RequestID, after)
+		return
+	}
+	AppLogger.Warn("[conn %s] Acknowledgement for %s matches no response awaiting one (late or unknown)", connLabel(conn), ack.RequestID)
+}
+
+// checkUnacked counts and logs, as response_unacked, the responses not
+// acknowledged within timeout, returning how many there were
+func checkUnacked(timeout time.Duration) int {
+	expired := awaitingAcks.expire(timeout)
+	for _, unacked := range expired {
+		stats.ResponsesUnacked.Add(1)
+		line, _ := json.Marshal(unacked)
+		AppLogger.Warn("response_unacked %s", line)
+	}
+	return len(expired)
+}
+
+// runAckTracking looks for responses not acknowledged within timeout every
+// half of it, until stop is closed
+func runAckTracking(timeout time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			checkUnacked(timeout)
+		}
+	}
+}
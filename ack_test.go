@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+func TestUnackedResponses(t *testing.T) {
+	// A server acknowledging the responses to requests it has not lost
+	acked := make(chan string, 4)
+	startTestServer(t, func(a *fakeAggregator) {
+		r := bufio.NewReader(a.conn)
+		for {
+			body, err := a.read(r)
+			if err != nil {
+				return
+			}
+			switch frameType(body) {
+			case "AUTHRequest":
+				a.send([]byte("<AUTHResponse><result>0</result></AUTHResponse>"))
+			case "USSDResponse":
+				var resp USSDResponse
+				if xml.Unmarshal(body, &resp) != nil || strings.HasPrefix(resp.RequestID, "LOST") {
+					continue
+				}
+				a.send([]byte(fmt.Sprintf("<USSDAck><requestId>%s</requestId></USSDAck>", resp.RequestID)))
+				acked <- resp.RequestID
+			}
+		}
+	})
+	withConfig(t, func(cfg *Config) { cfg.AckFrame = "USSDAck" })
+	if err := connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	stopChan = make(chan struct{})
+	listening := make(chan struct{})
+	go func() {
+		defer close(listening)
+		listenToTCPMessages()
+	}()
+	t.Cleanup(func() {
+		close(stopChan)
+		closeConn()
+		<-listening
+	})
+
+	for _, id := range []string{"ACKED1", "LOST1", "ACKED2", "LOST2"} {
+		req := testRequest(id, "2348030000071", "123", "")
+		if err := sendUSSDResponse(context.Background(), getConn(), newUSSDResponse(req, "Welcome", true)); err != nil {
+			t.Fatalf("send %s: %v", id, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-acked:
+		case <-time.After(2 * time.Second):
+			t.Fatal("server did not acknowledge the responses")
+		}
+	}
+
+	// The acknowledgements are matched once the listen loop reads them
+	const timeout = 200 * time.Millisecond
+	time.Sleep(timeout)
+	unacked := stats.ResponsesUnacked.Load()
+	if n := checkUnacked(timeout); n != 2 {
+		t.Errorf("%d responses unacked, want 2", n)
+	}
+	if got := stats.ResponsesUnacked.Load() - unacked; got != 2 {
+		t.Errorf("responses_unacked grew by %d, want 2", got)
+	}
+	log := readLog(t, "log")
+	for _, id := range []string{"LOST1", "LOST2"} {
+		if !strings.Contains(log, `response_unacked {"request_id":"`+id+`"`) {
+			t.Errorf("no response_unacked line for %s", id)
+		}
+	}
+	if strings.Contains(log, `response_unacked {"request_id":"ACKED`) {
+		t.Error("acknowledged response logged as unacked")
+	}
+}
+
+func TestFailedSendAwaitsNoAck(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.AckFrame = "USSDAck" })
+
+	req := testRequest("FAILED1", "2348030000071", "123", "")
+	if err := sendUSSDResponse(context.Background(), &failingConn{}, newUSSDResponse(req, "Welcome", true)); err == nil {
+		t.Fatal("send on a failing connection succeeded")
+	}
+	if _, ok := awaitingAcks.ack("FAILED1"); ok {
+		t.Error("response that failed to send awaits an acknowledgement")
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// is8BitDCS reports whether dcs (a GSM 03.38 cell broadcast data coding
+// scheme, as used for USSD) marks the userdata as 8-bit binary data
+func is8BitDCS(dcs int) bool {
+	switch {
+	case dcs&0xC0 == 0x40: // general data coding
+		return dcs&0x0C == 0x04
+	case dcs&0xF0 == 0x90: // message with user data header
+		return dcs&0x0C == 0x04
+	case dcs&0xF0 == 0xF0: // data coding / message class
+		return dcs&0x04 != 0
+	}
+	return false
+}
+
+// decodePayload sets req.Payload to the octets of an 8-bit request. The
+// aggregator hex encodes binary userdata since raw octets are not valid in
+// XML; userdata that is not hex is kept as the bytes of the text.
+func decodePayload(req *USSDRequest) {
+	if !is8BitDCS(req.DCS) {
+		return
+	}
+	payload, err := hex.DecodeString(strings.TrimSpace(req.UserData))
+	if err != nil {
+		RequestLogger.Warn("8-bit userdata for %s is not hex encoded, passing it as is: %v", req.RequestID, err)
+		payload = []byte(req.UserData)
+	}
+	req.Payload = payload
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIs8BitDCS(t *testing.T) {
+	tests := []struct {
+		dcs  int
+		want bool
+	}{
+		{0x0F, false}, // GSM 7-bit, language unspecified
+		{0x44, true},  // general data coding, 8-bit
+		{0x48, false}, // general data coding, UCS2
+		{0x94, true},  // with user data header, 8-bit
+		{0xF4, true},  // data coding / message class, 8-bit
+		{0xF0, false}, // data coding / message class, 7-bit
+	}
+	for _, tt := range tests {
+		if got := is8BitDCS(tt.dcs); got != tt.want {
+			t.Errorf("is8BitDCS(%#x) = %v, want %v", tt.dcs, got, tt.want)
+		}
+	}
+}
+
+func TestBinaryPayloadReachesProvider(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "Received")
+
+	// A binary-capable backend for short code 556
+	binaryInputs := make(chan map[string]any, 1)
+	binaryAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var fields map[string]any
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &fields)
+		binaryInputs <- fields
+		writeMenu(w, "Received", true)
+	}))
+	t.Cleanup(binaryAPI.Close)
+	withConfig(t, func(cfg *Config) {
+		cfg.Providers = []Provider{{Name: "binary", URL: binaryAPI.URL}}
+		cfg.Routes = []Route{{ShortCode: "556", ProductID: 2, BinaryProvider: "binary"}}
+	})
+
+	// Octets that are not valid UTF-8 on their own
+	payload := []byte{0x00, 0xFF, 0x10, 0xFE, 0x80}
+
+	tests := []struct {
+		name      string
+		shortCode string
+		binary    bool // whether the binary provider should get the call
+	}{
+		{"default provider", "555", false},
+		{"binary provider", "556", true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := testRequest(fmt.Sprintf("BIN%d", i), "2348030000027", tt.shortCode, fmt.Sprintf("%x", payload))
+			req.DCS = 0x44
+			t.Cleanup(func() { Sessions.End(req.RequestID) })
+			serve(t, &captureConn{}, req)
+
+			var fields map[string]any
+			if tt.binary {
+				select {
+				case fields = <-binaryInputs:
+				default:
+					t.Fatal("binary provider not called")
+				}
+			} else {
+				fields = calls.lastJSON(t)
+			}
+
+			got, err := base64.StdEncoding.DecodeString(fmt.Sprint(fields["input"]))
+			if err != nil || string(got) != string(payload) || fields["input_encoding"] != "base64" {
+				t.Errorf("provider got input %v (%v), want base64 of %x", fields["input"], fields["input_encoding"], payload)
+			}
+		})
+	}
+}
+
+func TestProviderBinaryInput(t *testing.T) {
+	withLinkUp(t)
+	api := withMenuRecorder(t, "Received")
+	payload := []byte{0xD0, 0x0B, 0x81, 0x03, 0x01, 0x21, 0x80}
+
+	tests := []struct {
+		binaryInput string
+		want        string
+		encoding    string
+	}{
+		{"", base64.StdEncoding.EncodeToString(payload), "base64"},
+		{binaryInputBase64, base64.StdEncoding.EncodeToString(payload), "base64"},
+		{binaryInputHex, "d00b8103012180", "hex"},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("binary_input %q", tt.binaryInput), func(t *testing.T) {
+			withConfig(t, func(cfg *Config) {
+				cfg.Providers = []Provider{{Name: "stk", URL: cfg.MenuAPIURL, BinaryInput: tt.binaryInput}}
+				cfg.Routes = []Route{{ShortCode: "557", ProductID: 2, Provider: "stk"}}
+			})
+			req := testRequest(fmt.Sprintf("STK%d", i), "2348030000067", "557", fmt.Sprintf("%X", payload))
+			req.DCS = 0xF4
+			t.Cleanup(func() { Sessions.End(req.RequestID) })
+			serve(t, &captureConn{}, req)
+
+			fields := api.lastJSON(t)
+			if fields["input"] != tt.want || fields["input_encoding"] != tt.encoding {
+				t.Errorf("provider got input %v (%v), want %s (%s)", fields["input"], fields["input_encoding"], tt.want, tt.encoding)
+			}
+		})
+	}
+}
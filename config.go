@@ -0,0 +1,1308 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/logger"
+	"github.com/joho/godotenv"
+)
+
+// Config holds the application settings loaded from the environment
+// (and .env) plus the optional JSON file named by CONFIG_FILE.
+type Config struct {
+	ServerHost    string
+	ServerPort    string
+	ServerNetwork string
+	Username      string
+	Password      string
+	ClientID      string
+	LogPath       string
+	HTTPPort      string
+	MenuAPIURL    string
+	ConfigFile    string
+
+	// Label of the server connection in request logs and session records
+	ConnectionName string
+
+	// Timeout of each call to the default menu API (0 for none beyond the
+	// response budget)
+	MenuAPITimeout time.Duration
+
+	// Longest menu API response body read, in bytes once decompressed
+	MenuMaxBody int
+
+	MonitoringMode monitoringMode
+
+	// Metrics go to MonitoringURL, falling back to MonitoringSecondaryURL
+	// (if set) when it fails
+	MonitoringURL          string
+	MonitoringSecondaryURL string
+
+	// The health endpoint reports monitoring as failing after this many
+	// failed posts in a row, and as stale when none has succeeded for
+	// MonitoringStaleAfter
+	MonitoringFailureThreshold int
+	MonitoringStaleAfter       time.Duration
+
+	// Metric posts failing on every endpoint are persisted under
+	// MonitoringQueueDir (empty to drop them), at most MonitoringQueueMax of
+	// them for at most MonitoringQueueMaxAge, and replayed every
+	// MonitoringQueueRetry
+	MonitoringQueueDir    string
+	MonitoringQueueMax    int
+	MonitoringQueueMaxAge time.Duration
+	MonitoringQueueRetry  time.Duration
+
+	// Webhook told of each response sent (empty for none), by
+	// PostSendHookWorkers workers taking up to PostSendHookQueue responses
+	// waiting; each post may take PostSendHookTimeout
+	PostSendHookURL     string
+	PostSendHookWorkers int
+	PostSendHookQueue   int
+	PostSendHookTimeout time.Duration
+
+	// Payloads longer than this are truncated in the logs (0 for no limit)
+	LogMaxBody int
+
+	// Log the rendered XML of a response that fails validation or to send
+	LogXMLOnError bool
+
+	// Full request and menu API bodies are logged for 1 in LogSampleRate
+	// requests, and for every request that fails
+	LogSampleRate int
+
+	// How many of the latest ERROR entries GET /api/errors returns
+	RecentErrors int
+
+	// Requests taking longer than this from frame received to response
+	// sent are logged as slow (0 to never log them)
+	SlowRequestThreshold time.Duration
+
+	// Where log entries go: file, syslog or both. SyslogAddr is the
+	// network://host:port of the syslog daemon, empty for the local one.
+	LogSink    string
+	SyslogAddr string
+
+	// Loggers (app, error, request, menu, frame) whose DEBUG lines are written
+	LogDebug []string
+
+	// Timestamp format of log file entries (see logger.SetTimeFormat),
+	// overridden per logger name by LogTimeFormats
+	LogTimeFormat  string
+	LogTimeFormats map[string]string
+
+	// Regular expressions whose matches (or capturing groups) are masked
+	// in every log entry, e.g. PINs in menu inputs
+	LogRedact []string
+
+	// How often the log directories are checked for writability
+	LogProbeInterval time.Duration
+
+	// How long /api/system-health reuses a measurement of host CPU, RAM
+	// and disk usage (0 to take one on every request)
+	HealthCacheTTL time.Duration
+
+	// Where spans go: none or stdout
+	TracingExporter string
+
+	// Time allowed from receiving a request to sending its response, and the
+	// part of it kept in reserve to send RetryMessage when the menu API is slow.
+	ResponseBudget time.Duration
+	RetryMargin    time.Duration
+	RetryMessage   string
+
+	// Accept header of menu API calls, and how responses in another media
+	// type are treated: lenient (only XML ones fail) or strict (all fail)
+	MenuAPIAccept        string
+	MenuContentTypeCheck string
+
+	MissingContinue string
+	InvalidUTF8     string
+	MenuTrim        string
+	MenuConsistency string
+	InputDecoding   string
+
+	// Send menu API requests the step of the session they are on
+	MenuSendStep bool
+
+	// Times the same menu may be sent in a row on a session before it is
+	// ended with MenuLoopMessage (0 to never end it)
+	MenuLoopThreshold int
+	MenuLoopMessage   string
+
+	// Sent, with the pending menu, for a continuation with no input
+	EmptyInputMessage string
+
+	// Short codes served; requests for others are answered with
+	// ShortCodeNotFoundMessage without calling the menu API (empty to serve
+	// every short code)
+	AllowedShortCodes        []string
+	ShortCodeNotFoundMessage string
+
+	// Line appended to menus ending a session, when it fits (empty for
+	// none); routes may override it through closing_message
+	ClosingMessage string
+
+	// What to do with responses too long for the alphabet of their DCS:
+	// send them as is or truncate them, ending with TruncationMarker
+	MessageOverflow  string
+	TruncationMarker string
+
+	// What to do with responses under a GSM 7-bit DCS holding characters
+	// that alphabet lacks: off, warn or switch them to UCS-2
+	DCSCheck string
+
+	// requestId of our responses: echo the request's, generate a new one
+	// or suffix the request's with ResponseIDSeparator and the session step
+	ResponseID          string
+	ResponseIDSeparator string
+
+	// What to do with a menu request received while not logged on: answer
+	// it with UnavailableMessage, ending the session, or drop it
+	OfflineRequests    string
+	UnavailableMessage string
+
+	// errorCode sent back for a request that parsed but cannot be handled
+	// (e.g. no msisdn); such requests are only logged while it is empty
+	ProtocolErrorCode string
+
+	// Enquire-link pacing: base and maximum interval, how many may await an
+	// ack at once, and how long before an unacked one is considered lost.
+	// EnquireLinkIdleTimeout, when shorter than the interval, sends one as
+	// soon as nothing has been received for that long.
+	EnquireLinkInterval       time.Duration
+	EnquireLinkIdleTimeout    time.Duration
+	EnquireLinkMaxInterval    time.Duration
+	EnquireLinkMaxOutstanding int
+	EnquireLinkAckTimeout     time.Duration
+
+	// Whether enquire-links sent by the server are answered with an
+	// ENQResponse
+	AnswerEnquireLinks bool
+
+	// Longest a single frame may take to write before the connection is
+	// treated as stalled
+	WriteTimeout time.Duration
+
+	// Most bytes of body a frame from the server may declare; longer frames
+	// are a protocol error and drop the connection
+	MaxFrameSize int
+
+	// Longest the logon handshake (request sent, response read) may take
+	// before the connection is dropped and the attempt counted failed
+	LogonTimeout time.Duration
+
+	// Outbound pacing: average frames per second written to the server
+	// (0 for no limit) and how many may go out back to back.
+	SendRate  float64
+	SendBurst int
+
+	// For SendRampUp after each (re)connection frames are also paced at
+	// SendRampUpRate per second, without bursts (0 for no ramp-up)
+	SendRampUp     time.Duration
+	SendRampUpRate float64
+
+	// Token required by the authenticated HTTP routes
+	APIToken string
+
+	// Idle time after which a session the aggregator never closed is dropped
+	SessionTTL time.Duration
+
+	// Most sessions kept open at once (0 for no bound); past it the least
+	// recently active one is evicted, and its next continuation answered
+	// with SessionExpiredMessage
+	MaxSessions           int
+	SessionExpiredMessage string
+
+	// What to do with a request reusing the ID of an open session it cannot
+	// belong to: replace or reject
+	DuplicateSession string
+
+	// What to do with a new dial from a subscriber who already has an open
+	// session: off (let them overlap), reset the open one or reject the
+	// dial with SessionLockedMessage
+	SessionLock          string
+	SessionLockedMessage string
+
+	// Root element of the frame the server sends when it releases a
+	// session on its side
+	AbortFrame string
+
+	// Root element of the frame the server acknowledges each response
+	// with (empty when it does not), and how long a response may go
+	// unacknowledged before it is counted as such
+	AckFrame   string
+	AckTimeout time.Duration
+
+	// What identifies a retransmitted request (off, request_id or
+	// msisdn_input) and how long after the original it is dropped
+	DedupKey    string
+	DedupWindow time.Duration
+
+	// Wait before the first reconnect attempt after a drop, then the
+	// initial and maximum delay between failed attempts. The same backoff
+	// applies at startup, giving up after StartupConnectAttempts (0 to keep
+	// trying).
+	ReconnectGrace      time.Duration
+	ReconnectBackoff    time.Duration
+	ReconnectMaxBackoff time.Duration
+
+	StartupConnectAttempts int
+
+	// The listen loop is restarted on a fresh connection when it has not
+	// gone round for ListenStallThreshold while the link is up (0 to never
+	// check)
+	ListenStallThreshold time.Duration
+
+	Routes    []Route
+	Providers []Provider
+
+	// Product ID sent to the menu API when no route matches the short code
+	DefaultProductID int
+
+	// Action per errorCode received from the aggregator; codes not listed
+	// are ignored
+	ErrorCodes map[string]ErrorCodeAction
+
+	// QA subscribers always served by a mock provider
+	TestAccounts TestAccounts
+
+	// What to do with menu API responses per HTTP status, over
+	// defaultMenuStatuses; statuses not listed in either are parsed
+	MenuStatuses map[string]StatusAction
+
+	// DCS of responses per telco, used when the menu API does not set one
+	// (telcos not listed get the request's DCS echoed)
+	TelcoDCS map[string]int
+
+	// Telco of each MSISDN, by the longest of TelcoPrefixes it starts
+	// with, else DefaultTelco. Telcos is built from them on load.
+	TelcoPrefixes map[string]string
+	DefaultTelco  string
+	Telcos        TelcoResolver
+
+	// Name the menu API knows each telco by, when it differs from ours
+	TelcoNames map[string]string
+
+	// Aggregator-specific elements added to every USSDResponse
+	ResponseFields []ResponseField
+}
+
+// Route maps a short code to the product ID sent to the menu API and,
+// optionally, the provider serving it
+type Route struct {
+	ShortCode string `json:"short_code"`
+	ProductID int    `json:"product_id"`
+	Provider  string `json:"provider,omitempty"`
+
+	// Provider for 8-bit (binary) requests on this short code, when they
+	// need a binary-capable backend
+	BinaryProvider string `json:"binary_provider,omitempty"`
+
+	// Menu answered straight away to the first dial of this short code,
+	// without waiting for the menu API; continuations still go to it. With
+	// WarmUp the dial is also passed to the menu API in the background and
+	// its answer discarded, so a cold backend is ready for the next step.
+	InitialMenu string `json:"initial_menu,omitempty"`
+	WarmUp      bool   `json:"warm_up,omitempty"`
+
+	// Replaces CLOSING_MESSAGE for this short code; "" disables it
+	ClosingMessage *string `json:"closing_message,omitempty"`
+
+	// Sends requests outside business hours to another provider
+	Schedule *Schedule `json:"schedule,omitempty"`
+}
+
+// Upper bound on RECENT_ERRORS, keeping the buffer of recent errors small
+const maxRecentErrors = 10000
+
+// Values for MENU_MISSING_CONTINUE, the policy applied when a menu API
+// response omits the "continue" field
+const (
+	missingContinueError = "error" // fail the call, ending the session with UnavailableMessage
+	missingContinueTrue  = "true"
+	missingContinueFalse = "false"
+)
+
+// Values for MENU_INVALID_UTF8, the policy applied to invalid UTF-8 in a
+// menu API response
+const (
+	invalidUTF8Replace = "replace" // substitute U+FFFD for each invalid sequence
+	invalidUTF8Strip   = "strip"   // drop invalid sequences
+)
+
+// Values for LOG_SINK, where log entries are written
+const (
+	logSinkFile   = "file"
+	logSinkSyslog = "syslog"
+	logSinkBoth   = "both"
+)
+
+// Values for MENU_TRIM, the normalization applied to menu text
+const (
+	menuTrimNone = "none" // send the text exactly as the menu API gave it
+	menuTrimEdge = "edge" // drop leading and trailing whitespace and line breaks
+)
+
+// Values for MENU_CONSISTENCY, the check that the menu API's continue flag
+// agrees with its text (numbered options or a prompt mean a reply is expected)
+const (
+	menuConsistencyOff    = "off"    // no check
+	menuConsistencyWarn   = "warn"   // log and count disagreements, send as given
+	menuConsistencyStrict = "strict" // also flip the flag to match the text
+)
+
+// fileConfig is the layout of the JSON file named by CONFIG_FILE
+type fileConfig struct {
+	Routes        []Route                    `json:"routes"`
+	Providers     []Provider                 `json:"providers"`
+	ErrorCodes    map[string]ErrorCodeAction `json:"error_codes"`
+	TestAccounts  TestAccounts               `json:"test_accounts"`
+	TelcoDCS      map[string]int             `json:"telco_dcs"`
+	TelcoPrefixes map[string]string          `json:"telco_prefixes"`
+	TelcoNames    map[string]string          `json:"telco_names"`
+	LogRedact     []string                   `json:"log_redact"`
+	MenuStatuses  map[string]StatusAction    `json:"menu_statuses"`
+
+	ResponseFields []ResponseField `json:"response_fields"`
+}
+
+// ServerAddress returns the host:port of the USSD server
+func (c *Config) ServerAddress() string {
+	return net.JoinHostPort(c.ServerHost, c.ServerPort)
+}
+
+// shortCodeAllowed reports whether requests for shortCode are served
+func (c *Config) shortCodeAllowed(shortCode string) bool {
+	if len(c.AllowedShortCodes) == 0 {
+		return true
+	}
+	for _, code := range c.AllowedShortCodes {
+		if code == shortCode {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeShortCode strips the dialling decoration from a short code, so
+// "*123*4#" and "123*4" are the same code
+func normalizeShortCode(code string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(code), "*"), "#")
+}
+
+// routeFor returns the route for a short code: the route for exactly that
+// code, or else the most specific route for a code it extends (route 123
+// serves 123*4 unless there is a route for 123*4)
+func (c *Config) routeFor(shortCode string) (Route, bool) {
+	code := normalizeShortCode(shortCode)
+	var best Route
+	found := false
+	for _, route := range c.Routes {
+		rc := normalizeShortCode(route.ShortCode)
+		if rc == code {
+			return route, true
+		}
+		if strings.HasPrefix(code, rc+"*") && (!found || len(rc) > len(normalizeShortCode(best.ShortCode))) {
+			best, found = route, true
+		}
+	}
+	return best, found
+}
+
+// productIDFor returns the product ID routed for a short code and the
+// short code of the route that chose it, "" when DefaultProductID applies
+func (c *Config) productIDFor(shortCode string) (int, string) {
+	if route, ok := c.routeFor(shortCode); ok {
+		return route.ProductID, route.ShortCode
+	}
+	return c.DefaultProductID, ""
+}
+
+// loadConfig reads the environment and config file and validates the result.
+// The returned config is always usable for reporting; callers must treat a
+// non-empty problem list as fatal.
+func loadConfig() (*Config, []error) {
+	cfg, problems := readConfig()
+	return cfg, append(problems, cfg.validate()...)
+}
+
+// readConfig reads the environment and config file, returning the settings
+// that could not be parsed as problems but leaving validation to validate
+func readConfig() (*Config, []error) {
+	var problems []error
+	collect := func(err error) {
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	// A missing .env is fine (the environment may be set by the deployment),
+	// but one that exists and cannot be parsed is not.
+	if err := godotenv.Load(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		collect(fmt.Errorf("failed to load .env file: %v", err))
+	}
+
+	cfg := &Config{
+		ServerHost:    os.Getenv("SERVER_HOST"),
+		ServerPort:    os.Getenv("SERVER_PORT"),
+		ServerNetwork: os.Getenv("SERVER_NETWORK"),
+		Username:      os.Getenv("USERNAME"),
+		Password:      os.Getenv("PASSWORD"),
+		ClientID:      os.Getenv("CLIENT_ID"),
+		LogPath:       os.Getenv("LOG_PATH"),
+		HTTPPort:      os.Getenv("PORT"),
+		MenuAPIURL:    os.Getenv("USSD_API_URL"),
+		ConfigFile:    os.Getenv("CONFIG_FILE"),
+		RetryMessage:  os.Getenv("RETRY_MESSAGE"),
+
+		MenuAPIAccept:   os.Getenv("MENU_API_ACCEPT"),
+		MissingContinue: strings.ToLower(os.Getenv("MENU_MISSING_CONTINUE")),
+		InvalidUTF8:     strings.ToLower(os.Getenv("MENU_INVALID_UTF8")),
+		MenuTrim:        strings.ToLower(os.Getenv("MENU_TRIM")),
+		MenuConsistency: strings.ToLower(os.Getenv("MENU_CONSISTENCY")),
+		InputDecoding:   strings.ToLower(os.Getenv("INPUT_DECODING")),
+		APIToken:        os.Getenv("API_TOKEN"),
+
+		MenuContentTypeCheck: strings.ToLower(os.Getenv("MENU_CONTENT_TYPE_CHECK")),
+
+		ProtocolErrorCode:        os.Getenv("PROTOCOL_ERROR_CODE"),
+		MenuLoopMessage:          os.Getenv("MENU_LOOP_MESSAGE"),
+		EmptyInputMessage:        os.Getenv("EMPTY_INPUT_MESSAGE"),
+		ShortCodeNotFoundMessage: os.Getenv("SHORT_CODE_NOT_FOUND_MESSAGE"),
+		ClosingMessage:           os.Getenv("CLOSING_MESSAGE"),
+		MessageOverflow:          strings.ToLower(os.Getenv("MESSAGE_OVERFLOW")),
+		TruncationMarker:         os.Getenv("TRUNCATION_MARKER"),
+		DCSCheck:                 strings.ToLower(os.Getenv("DCS_CHECK")),
+		ResponseID:               strings.ToLower(os.Getenv("RESPONSE_ID")),
+		ResponseIDSeparator:      os.Getenv("RESPONSE_ID_SEPARATOR"),
+		OfflineRequests:          strings.ToLower(os.Getenv("OFFLINE_REQUESTS")),
+		UnavailableMessage:       os.Getenv("UNAVAILABLE_MESSAGE"),
+		LogSink:                  strings.ToLower(os.Getenv("LOG_SINK")),
+		SyslogAddr:               os.Getenv("LOG_SYSLOG_ADDR"),
+		TracingExporter:          strings.ToLower(os.Getenv("TRACING_EXPORTER")),
+		DuplicateSession:         strings.ToLower(os.Getenv("DUPLICATE_SESSION")),
+		SessionLock:              strings.ToLower(os.Getenv("MSISDN_SESSION_LOCK")),
+		SessionLockedMessage:     os.Getenv("SESSION_LOCKED_MESSAGE"),
+		SessionExpiredMessage:    os.Getenv("SESSION_EXPIRED_MESSAGE"),
+		AbortFrame:               os.Getenv("ABORT_FRAME"),
+		AckFrame:                 os.Getenv("ACK_FRAME"),
+		DedupKey:                 strings.ToLower(os.Getenv("DEDUP_KEY")),
+	}
+
+	if cfg.ServerNetwork == "" {
+		cfg.ServerNetwork = "tcp"
+	}
+	cfg.ConnectionName = os.Getenv("CONNECTION_NAME")
+	if cfg.ConnectionName == "" {
+		cfg.ConnectionName = "0" // index of the only connection
+	}
+	if cfg.LogPath == "" {
+		cfg.LogPath = "./logs" // default path
+	}
+	if cfg.HTTPPort == "" {
+		cfg.HTTPPort = "8080"
+	}
+	if cfg.MissingContinue == "" {
+		cfg.MissingContinue = missingContinueError
+	}
+	if cfg.DuplicateSession == "" {
+		cfg.DuplicateSession = duplicateSessionReplace
+	}
+	if cfg.SessionLock == "" {
+		cfg.SessionLock = sessionLockOff
+	}
+	if cfg.AbortFrame == "" {
+		cfg.AbortFrame = "USSDAbort"
+	}
+	if cfg.SessionLockedMessage == "" {
+		cfg.SessionLockedMessage = "You already have an active session. Please complete it and try again."
+	}
+	if cfg.SessionExpiredMessage == "" {
+		cfg.SessionExpiredMessage = "Your session has expired. Please dial again."
+	}
+	if cfg.MessageOverflow == "" {
+		cfg.MessageOverflow = overflowSend
+	}
+	if cfg.TruncationMarker == "" {
+		cfg.TruncationMarker = "..."
+	}
+	if cfg.DCSCheck == "" {
+		cfg.DCSCheck = dcsCheckOff
+	}
+	if cfg.ResponseID == "" {
+		cfg.ResponseID = responseIDEcho
+	}
+	if cfg.ResponseIDSeparator == "" {
+		cfg.ResponseIDSeparator = "_"
+	}
+	if cfg.OfflineRequests == "" {
+		cfg.OfflineRequests = offlineAnswer
+	}
+	if cfg.UnavailableMessage == "" {
+		cfg.UnavailableMessage = "Service momentarily unavailable. Please try again later."
+	}
+	if cfg.DedupKey == "" {
+		cfg.DedupKey = dedupOff
+	}
+	if cfg.TracingExporter == "" {
+		cfg.TracingExporter = tracingNone
+	}
+	if cfg.MenuLoopMessage == "" {
+		cfg.MenuLoopMessage = "Too many invalid attempts. Please try again later."
+	}
+	if cfg.EmptyInputMessage == "" {
+		cfg.EmptyInputMessage = "Invalid input, please try again."
+	}
+	if cfg.LogSink == "" {
+		cfg.LogSink = logSinkFile
+	}
+	if cfg.ShortCodeNotFoundMessage == "" {
+		cfg.ShortCodeNotFoundMessage = "Service not found."
+	}
+	for _, code := range strings.Split(os.Getenv("ALLOWED_SHORT_CODES"), ",") {
+		if code = strings.TrimSpace(code); code != "" {
+			cfg.AllowedShortCodes = append(cfg.AllowedShortCodes, code)
+		}
+	}
+	if cfg.MenuAPIAccept == "" {
+		cfg.MenuAPIAccept = "application/json"
+	}
+	if cfg.MenuContentTypeCheck == "" {
+		cfg.MenuContentTypeCheck = contentTypeCheckLenient
+	}
+	if cfg.InvalidUTF8 == "" {
+		cfg.InvalidUTF8 = invalidUTF8Replace
+	}
+	if cfg.MenuTrim == "" {
+		cfg.MenuTrim = menuTrimNone
+	}
+	if cfg.MenuConsistency == "" {
+		cfg.MenuConsistency = menuConsistencyOff
+	}
+	if cfg.InputDecoding == "" {
+		cfg.InputDecoding = inputDecodingNone
+	}
+	if cfg.RetryMessage == "" {
+		cfg.RetryMessage = "This is taking longer than usual. Please redial."
+	}
+
+	var err error
+	cfg.MonitoringMode, err = parseMonitoringMode(os.Getenv("MONITORING_STATUS"))
+	collect(err)
+	cfg.MonitoringURL = os.Getenv("MONITORING_URL")
+	if cfg.MonitoringURL == "" {
+		cfg.MonitoringURL = defaultMonitoringURL
+	}
+	cfg.MonitoringSecondaryURL = os.Getenv("MONITORING_SECONDARY_URL")
+	cfg.MonitoringFailureThreshold, err = getEnvInt("MONITORING_FAILURE_THRESHOLD", 3)
+	collect(err)
+	cfg.MonitoringStaleAfter, err = getEnvDuration("MONITORING_STALE_AFTER", 15*time.Minute)
+	collect(err)
+	cfg.MonitoringQueueDir = os.Getenv("MONITORING_QUEUE_DIR")
+	cfg.MonitoringQueueMax, err = getEnvInt("MONITORING_QUEUE_MAX", 1000)
+	collect(err)
+	cfg.MonitoringQueueMaxAge, err = getEnvDuration("MONITORING_QUEUE_MAX_AGE", 24*time.Hour)
+	collect(err)
+	cfg.MonitoringQueueRetry, err = getEnvDuration("MONITORING_QUEUE_RETRY", time.Minute)
+	collect(err)
+
+	cfg.PostSendHookURL = os.Getenv("POST_SEND_HOOK_URL")
+	cfg.PostSendHookWorkers, err = getEnvInt("POST_SEND_HOOK_WORKERS", 4)
+	collect(err)
+	cfg.PostSendHookQueue, err = getEnvInt("POST_SEND_HOOK_QUEUE", 1000)
+	collect(err)
+	cfg.PostSendHookTimeout, err = getEnvDuration("POST_SEND_HOOK_TIMEOUT", 5*time.Second)
+	collect(err)
+
+	cfg.ResponseBudget, err = getEnvDuration("RESPONSE_BUDGET", 10*time.Second)
+	collect(err)
+	cfg.RetryMargin, err = getEnvDuration("RETRY_MARGIN", 2*time.Second)
+	collect(err)
+
+	cfg.MenuAPITimeout, err = getEnvDuration("MENU_API_TIMEOUT", 0)
+	collect(err)
+	cfg.MenuMaxBody, err = getEnvInt("MENU_MAX_BODY", 1<<20)
+	collect(err)
+
+	cfg.LogProbeInterval, err = getEnvDuration("LOG_PROBE_INTERVAL", time.Minute)
+	collect(err)
+	cfg.HealthCacheTTL, err = getEnvDuration("HEALTH_CACHE_TTL", 2*time.Second)
+	collect(err)
+
+	cfg.SessionTTL, err = getEnvDuration("SESSION_TTL", 3*time.Minute)
+	collect(err)
+	cfg.AckTimeout, err = getEnvDuration("ACK_TIMEOUT", 10*time.Second)
+	collect(err)
+	cfg.MaxSessions, err = getEnvInt("MAX_SESSIONS", 100000)
+	collect(err)
+
+	cfg.DedupWindow, err = getEnvDuration("DEDUP_WINDOW", 5*time.Second)
+	collect(err)
+
+	cfg.EnquireLinkInterval, err = getEnvDuration("ENQ_INTERVAL", 20*time.Second)
+	collect(err)
+	cfg.EnquireLinkMaxInterval, err = getEnvDuration("ENQ_MAX_INTERVAL", 2*time.Minute)
+	collect(err)
+	cfg.EnquireLinkAckTimeout, err = getEnvDuration("ENQ_ACK_TIMEOUT", time.Minute)
+	collect(err)
+	cfg.EnquireLinkIdleTimeout, err = getEnvDuration("ENQ_IDLE_TIMEOUT", 0)
+	collect(err)
+	cfg.EnquireLinkMaxOutstanding, err = getEnvInt("ENQ_MAX_OUTSTANDING", 1)
+	collect(err)
+	cfg.AnswerEnquireLinks, err = getEnvBool("ENQ_ANSWER", true)
+	collect(err)
+
+	cfg.StartupConnectAttempts, err = getEnvInt("STARTUP_CONNECT_ATTEMPTS", 0)
+	collect(err)
+
+	cfg.MenuLoopThreshold, err = getEnvInt("MENU_LOOP_THRESHOLD", 0)
+	collect(err)
+
+	cfg.WriteTimeout, err = getEnvDuration("WRITE_TIMEOUT", 10*time.Second)
+	collect(err)
+
+	cfg.MaxFrameSize, err = getEnvInt("MAX_FRAME_SIZE", maxFrameBody)
+	collect(err)
+
+	cfg.LogonTimeout, err = getEnvDuration("LOGON_TIMEOUT", 15*time.Second)
+	collect(err)
+	cfg.SlowRequestThreshold, err = getEnvDuration("SLOW_REQUEST_THRESHOLD", 0)
+	collect(err)
+
+	cfg.DefaultProductID, err = getEnvInt("DEFAULT_PRODUCT_ID", 2)
+	collect(err)
+
+	cfg.LogSampleRate, err = getEnvInt("LOG_SAMPLE_RATE", 1)
+	collect(err)
+
+	cfg.RecentErrors, err = getEnvInt("RECENT_ERRORS", 100)
+	collect(err)
+
+	cfg.LogMaxBody, err = getEnvInt("LOG_MAX_BODY", 4096)
+	collect(err)
+	cfg.LogXMLOnError, err = getEnvBool("LOG_XML_ON_ERROR", true)
+	collect(err)
+	cfg.MenuSendStep, err = getEnvBool("MENU_SEND_STEP", false)
+	collect(err)
+
+	debugAll, err := getEnvBool("DEBUG", false)
+	collect(err)
+	if debugAll {
+		cfg.LogDebug = []string{"app", "error", "request", "menu", "frame"}
+	}
+	for _, name := range strings.Split(os.Getenv("LOG_DEBUG"), ",") {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" && !cfg.debugEnabled(name) {
+			cfg.LogDebug = append(cfg.LogDebug, name)
+		}
+	}
+
+	cfg.LogTimeFormat = os.Getenv("LOG_TIME_FORMAT")
+	if cfg.LogTimeFormat == "" {
+		cfg.LogTimeFormat = logger.TimeRFC3339
+	}
+	for _, name := range []string{"app", "error", "request", "menu", "frame"} {
+		if format := os.Getenv("LOG_TIME_FORMAT_" + strings.ToUpper(name)); format != "" {
+			if cfg.LogTimeFormats == nil {
+				cfg.LogTimeFormats = make(map[string]string)
+			}
+			cfg.LogTimeFormats[name] = format
+		}
+	}
+
+	cfg.SendRate, err = getEnvFloat("SEND_RATE", 0)
+	collect(err)
+	cfg.SendBurst, err = getEnvInt("SEND_BURST", 1)
+	collect(err)
+	cfg.SendRampUp, err = getEnvDuration("SEND_RAMP_UP", 0)
+	collect(err)
+	cfg.SendRampUpRate, err = getEnvFloat("SEND_RAMP_UP_RATE", 5)
+	collect(err)
+
+	cfg.ReconnectGrace, err = getEnvDuration("RECONNECT_GRACE", 5*time.Second)
+	collect(err)
+	cfg.ListenStallThreshold, err = getEnvDuration("LISTEN_STALL_THRESHOLD", time.Minute)
+	collect(err)
+	cfg.ReconnectBackoff, err = getEnvDuration("RECONNECT_BACKOFF", time.Second)
+	collect(err)
+	cfg.ReconnectMaxBackoff, err = getEnvDuration("RECONNECT_MAX_BACKOFF", time.Minute)
+	collect(err)
+
+	if cfg.ConfigFile != "" {
+		collect(cfg.loadFile(cfg.ConfigFile))
+	}
+
+	cfg.DefaultTelco = os.Getenv("DEFAULT_TELCO")
+	if cfg.DefaultTelco == "" {
+		cfg.DefaultTelco = defaultTelco
+	}
+	cfg.Telcos = newPrefixResolver(cfg.TelcoPrefixes, cfg.DefaultTelco)
+
+	return cfg, problems
+}
+
+// loadFile merges the structured settings from a JSON config file
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var fc fileConfig
+	if err := json.Unmarshal(data, &fc); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	c.Routes = fc.Routes
+	c.Providers = fc.Providers
+	c.ErrorCodes = fc.ErrorCodes
+	c.TestAccounts = fc.TestAccounts
+	c.TelcoDCS = fc.TelcoDCS
+	c.TelcoPrefixes = fc.TelcoPrefixes
+	c.TelcoNames = fc.TelcoNames
+	c.LogRedact = fc.LogRedact
+	c.MenuStatuses = fc.MenuStatuses
+	c.ResponseFields = fc.ResponseFields
+	return nil
+}
+
+// validate checks every setting and returns all problems found
+func (c *Config) validate() []error {
+	var problems []error
+
+	required := []struct{ name, value string }{
+		{"SERVER_HOST", c.ServerHost},
+		{"SERVER_PORT", c.ServerPort},
+		{"USERNAME", c.Username},
+		{"PASSWORD", c.Password},
+		{"CLIENT_ID", c.ClientID},
+		{"USSD_API_URL", c.MenuAPIURL},
+	}
+	for _, v := range required {
+		if v.value == "" {
+			problems = append(problems, fmt.Errorf("missing required environment variable: %s", v.name))
+		}
+	}
+
+	if c.ServerPort != "" {
+		if err := validatePort(c.ServerPort); err != nil {
+			problems = append(problems, fmt.Errorf("invalid SERVER_PORT: %v", err))
+		}
+	}
+	if err := validatePort(c.HTTPPort); err != nil {
+		problems = append(problems, fmt.Errorf("invalid PORT: %v", err))
+	}
+
+	if !validServerNetwork(c.ServerNetwork) {
+		problems = append(problems, fmt.Errorf("invalid SERVER_NETWORK %q: expected tcp, tcp4 or tcp6", c.ServerNetwork))
+	}
+
+	if c.MenuAPIURL != "" {
+		if err := validateMenuURL(c.MenuAPIURL); err != nil {
+			problems = append(problems, fmt.Errorf("invalid USSD_API_URL: %v", err))
+		}
+	}
+	monitoring := []struct{ name, value string }{
+		{"MONITORING_URL", c.MonitoringURL},
+		{"MONITORING_SECONDARY_URL", c.MonitoringSecondaryURL},
+	}
+	for _, v := range monitoring {
+		if v.value == "" {
+			continue
+		}
+		if err := validateMonitoringURL(v.value); err != nil {
+			problems = append(problems, fmt.Errorf("invalid %s: %v", v.name, err))
+		}
+	}
+	if c.MenuAPITimeout < 0 {
+		problems = append(problems, fmt.Errorf("MENU_API_TIMEOUT must not be negative"))
+	}
+	if c.MenuMaxBody <= 0 {
+		problems = append(problems, fmt.Errorf("MENU_MAX_BODY must be positive"))
+	}
+
+	if c.ResponseBudget <= 0 {
+		problems = append(problems, fmt.Errorf("RESPONSE_BUDGET must be positive"))
+	} else if c.RetryMargin <= 0 || c.RetryMargin >= c.ResponseBudget {
+		problems = append(problems, fmt.Errorf("RETRY_MARGIN must be positive and less than RESPONSE_BUDGET (%s)", c.ResponseBudget))
+	}
+
+	switch c.MissingContinue {
+	case missingContinueError, missingContinueTrue, missingContinueFalse:
+	default:
+		problems = append(problems, fmt.Errorf("invalid MENU_MISSING_CONTINUE %q: expected error, true or false", c.MissingContinue))
+	}
+
+	if _, err := parseAccept(c.MenuAPIAccept); err != nil {
+		problems = append(problems, fmt.Errorf("invalid MENU_API_ACCEPT: %v", err))
+	}
+	switch c.MenuContentTypeCheck {
+	case contentTypeCheckLenient, contentTypeCheckStrict:
+	default:
+		problems = append(problems, fmt.Errorf("invalid MENU_CONTENT_TYPE_CHECK %q: expected lenient or strict", c.MenuContentTypeCheck))
+	}
+	switch c.InvalidUTF8 {
+	case invalidUTF8Replace, invalidUTF8Strip:
+	default:
+		problems = append(problems, fmt.Errorf("invalid MENU_INVALID_UTF8 %q: expected replace or strip", c.InvalidUTF8))
+	}
+
+	switch c.MenuTrim {
+	case menuTrimNone, menuTrimEdge:
+	default:
+		problems = append(problems, fmt.Errorf("invalid MENU_TRIM %q: expected none or edge", c.MenuTrim))
+	}
+
+	switch c.InputDecoding {
+	case inputDecodingNone, inputDecodingURL:
+	default:
+		problems = append(problems, fmt.Errorf("invalid INPUT_DECODING %q: expected none or url", c.InputDecoding))
+	}
+
+	switch c.MenuConsistency {
+	case menuConsistencyOff, menuConsistencyWarn, menuConsistencyStrict:
+	default:
+		problems = append(problems, fmt.Errorf("invalid MENU_CONSISTENCY %q: expected off, warn or strict", c.MenuConsistency))
+	}
+
+	if c.MenuLoopThreshold < 0 {
+		problems = append(problems, fmt.Errorf("MENU_LOOP_THRESHOLD must not be negative"))
+	}
+
+	switch c.TracingExporter {
+	case tracingNone, tracingStdout:
+	default:
+		problems = append(problems, fmt.Errorf("invalid TRACING_EXPORTER %q: expected none or stdout", c.TracingExporter))
+	}
+
+	if c.SessionTTL <= 0 {
+		problems = append(problems, fmt.Errorf("SESSION_TTL must be positive"))
+	}
+	if c.MaxSessions < 0 {
+		problems = append(problems, fmt.Errorf("MAX_SESSIONS must not be negative"))
+	}
+	switch c.MessageOverflow {
+	case overflowSend, overflowTruncate:
+	default:
+		problems = append(problems, fmt.Errorf("invalid MESSAGE_OVERFLOW %q: expected send or truncate", c.MessageOverflow))
+	}
+	// The marker must leave room for text in the smallest message, UCS-2's
+	if encodedLength(c.TruncationMarker, alphabetUCS2) >= maxMessageUnits(alphabetUCS2) {
+		problems = append(problems, fmt.Errorf("TRUNCATION_MARKER must be shorter than %d characters", maxMessageUnits(alphabetUCS2)))
+	}
+	switch c.DCSCheck {
+	case dcsCheckOff, dcsCheckWarn, dcsCheckSwitch:
+	default:
+		problems = append(problems, fmt.Errorf("invalid DCS_CHECK %q: expected off, warn or switch", c.DCSCheck))
+	}
+	switch c.ResponseID {
+	case responseIDEcho, responseIDGenerate, responseIDStep:
+	default:
+		problems = append(problems, fmt.Errorf("invalid RESPONSE_ID %q: expected echo, generate or step", c.ResponseID))
+	}
+	switch c.OfflineRequests {
+	case offlineAnswer, offlineDrop:
+	default:
+		problems = append(problems, fmt.Errorf("invalid OFFLINE_REQUESTS %q: expected answer or drop", c.OfflineRequests))
+	}
+	switch c.DuplicateSession {
+	case duplicateSessionReplace, duplicateSessionReject:
+	default:
+		problems = append(problems, fmt.Errorf("invalid DUPLICATE_SESSION %q: expected replace or reject", c.DuplicateSession))
+	}
+	switch c.SessionLock {
+	case sessionLockOff, sessionLockReset, sessionLockReject:
+	default:
+		problems = append(problems, fmt.Errorf("invalid MSISDN_SESSION_LOCK %q: expected off, reset or reject", c.SessionLock))
+	}
+	switch c.AbortFrame {
+	case "USSDRequest", "USSDResponse", "ENQRequest", "ENQResponse", "AUTHRequest", "AUTHResponse":
+		problems = append(problems, fmt.Errorf("invalid ABORT_FRAME %q: the name of another frame", c.AbortFrame))
+	}
+	switch c.AckFrame {
+	case "USSDRequest", "USSDResponse", "ENQRequest", "ENQResponse", "AUTHRequest", "AUTHResponse", c.AbortFrame:
+		problems = append(problems, fmt.Errorf("invalid ACK_FRAME %q: the name of another frame", c.AckFrame))
+	}
+	if c.AckTimeout <= 0 {
+		problems = append(problems, fmt.Errorf("ACK_TIMEOUT must be positive"))
+	}
+	switch c.DedupKey {
+	case dedupOff, dedupRequestID, dedupMSISDNInput:
+	default:
+		problems = append(problems, fmt.Errorf("invalid DEDUP_KEY %q: expected off, request_id or msisdn_input", c.DedupKey))
+	}
+	if c.DedupWindow <= 0 {
+		problems = append(problems, fmt.Errorf("DEDUP_WINDOW must be positive"))
+	}
+
+	if c.EnquireLinkInterval <= 0 || c.EnquireLinkMaxInterval < c.EnquireLinkInterval {
+		problems = append(problems, fmt.Errorf("ENQ_INTERVAL must be positive and no greater than ENQ_MAX_INTERVAL"))
+	}
+	if c.EnquireLinkIdleTimeout < 0 {
+		problems = append(problems, fmt.Errorf("ENQ_IDLE_TIMEOUT must not be negative"))
+	}
+	if c.EnquireLinkAckTimeout <= 0 {
+		problems = append(problems, fmt.Errorf("ENQ_ACK_TIMEOUT must be positive"))
+	}
+	if c.EnquireLinkMaxOutstanding < 1 {
+		problems = append(problems, fmt.Errorf("ENQ_MAX_OUTSTANDING must be at least 1"))
+	}
+
+	if c.LogMaxBody < 0 {
+		problems = append(problems, fmt.Errorf("LOG_MAX_BODY must not be negative"))
+	}
+	if c.SlowRequestThreshold < 0 {
+		problems = append(problems, fmt.Errorf("SLOW_REQUEST_THRESHOLD must not be negative"))
+	}
+	switch c.LogSink {
+	case logSinkFile, logSinkSyslog, logSinkBoth:
+	default:
+		problems = append(problems, fmt.Errorf("invalid LOG_SINK %q: expected file, syslog or both", c.LogSink))
+	}
+	if c.SyslogAddr != "" {
+		if _, _, err := c.syslogAddress(); err != nil {
+			problems = append(problems, fmt.Errorf("invalid LOG_SYSLOG_ADDR: %v", err))
+		}
+	}
+	if c.LogSampleRate < 1 {
+		problems = append(problems, fmt.Errorf("LOG_SAMPLE_RATE must be at least 1"))
+	}
+	if c.RecentErrors < 1 || c.RecentErrors > maxRecentErrors {
+		problems = append(problems, fmt.Errorf("RECENT_ERRORS must be between 1 and %d", maxRecentErrors))
+	}
+	if c.LogProbeInterval <= 0 {
+		problems = append(problems, fmt.Errorf("LOG_PROBE_INTERVAL must be positive"))
+	}
+	if c.HealthCacheTTL < 0 {
+		problems = append(problems, fmt.Errorf("HEALTH_CACHE_TTL must not be negative"))
+	}
+	if c.MonitoringFailureThreshold < 1 {
+		problems = append(problems, fmt.Errorf("MONITORING_FAILURE_THRESHOLD must be at least 1"))
+	}
+	if c.MonitoringStaleAfter <= 0 {
+		problems = append(problems, fmt.Errorf("MONITORING_STALE_AFTER must be positive"))
+	}
+	if c.MonitoringQueueMax < 1 {
+		problems = append(problems, fmt.Errorf("MONITORING_QUEUE_MAX must be at least 1"))
+	}
+	if c.MonitoringQueueMaxAge <= 0 || c.MonitoringQueueRetry <= 0 {
+		problems = append(problems, fmt.Errorf("MONITORING_QUEUE_MAX_AGE and MONITORING_QUEUE_RETRY must be positive"))
+	}
+	if c.PostSendHookURL != "" {
+		if u, err := url.Parse(c.PostSendHookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("invalid POST_SEND_HOOK_URL %q: expected an http(s) URL", c.PostSendHookURL))
+		}
+	}
+	if c.PostSendHookWorkers < 1 || c.PostSendHookQueue < 1 {
+		problems = append(problems, fmt.Errorf("POST_SEND_HOOK_WORKERS and POST_SEND_HOOK_QUEUE must be at least 1"))
+	}
+	if c.PostSendHookTimeout <= 0 {
+		problems = append(problems, fmt.Errorf("POST_SEND_HOOK_TIMEOUT must be positive"))
+	}
+	for _, name := range c.LogDebug {
+		if !validLoggerName(name) {
+			problems = append(problems, fmt.Errorf("invalid LOG_DEBUG logger %q: expected app, error, request, menu or frame", name))
+		}
+	}
+	if err := logger.ValidateTimeFormat(c.LogTimeFormat); err != nil {
+		problems = append(problems, fmt.Errorf("invalid LOG_TIME_FORMAT: %v", err))
+	}
+	for name, format := range c.LogTimeFormats {
+		if err := logger.ValidateTimeFormat(format); err != nil {
+			problems = append(problems, fmt.Errorf("invalid LOG_TIME_FORMAT_%s: %v", strings.ToUpper(name), err))
+		}
+	}
+	if c.WriteTimeout <= 0 {
+		problems = append(problems, fmt.Errorf("WRITE_TIMEOUT must be positive"))
+	}
+	if c.MaxFrameSize < 1 || c.MaxFrameSize > maxFrameBody {
+		problems = append(problems, fmt.Errorf("MAX_FRAME_SIZE must be between 1 and %d", maxFrameBody))
+	}
+	if c.LogonTimeout <= 0 {
+		problems = append(problems, fmt.Errorf("LOGON_TIMEOUT must be positive"))
+	}
+	if c.SendRate < 0 {
+		problems = append(problems, fmt.Errorf("SEND_RATE must not be negative"))
+	}
+	if c.SendBurst < 1 {
+		problems = append(problems, fmt.Errorf("SEND_BURST must be at least 1"))
+	}
+	if c.SendRampUp < 0 {
+		problems = append(problems, fmt.Errorf("SEND_RAMP_UP must not be negative"))
+	}
+	if c.SendRampUp > 0 && c.SendRampUpRate <= 0 {
+		problems = append(problems, fmt.Errorf("SEND_RAMP_UP_RATE must be positive"))
+	}
+
+	if c.ReconnectGrace < 0 {
+		problems = append(problems, fmt.Errorf("RECONNECT_GRACE must not be negative"))
+	}
+	// A healthy loop goes round at least every readDeadline
+	if c.ListenStallThreshold != 0 && c.ListenStallThreshold <= 2*readDeadline {
+		problems = append(problems, fmt.Errorf("LISTEN_STALL_THRESHOLD must be 0 or longer than %s", 2*readDeadline))
+	}
+	if c.StartupConnectAttempts < 0 {
+		problems = append(problems, fmt.Errorf("STARTUP_CONNECT_ATTEMPTS must not be negative"))
+	}
+	if c.ReconnectBackoff <= 0 || c.ReconnectMaxBackoff < c.ReconnectBackoff {
+		problems = append(problems, fmt.Errorf("RECONNECT_BACKOFF must be positive and no greater than RECONNECT_MAX_BACKOFF"))
+	}
+
+	if err := checkDirWritable(c.LogPath); err != nil {
+		problems = append(problems, fmt.Errorf("log directory %s is not writable: %v", c.LogPath, err))
+	}
+
+	seen := make(map[string]bool)
+	for i, route := range c.Routes {
+		if route.ShortCode == "" {
+			problems = append(problems, fmt.Errorf("route %d: missing short_code", i))
+			continue
+		}
+		if route.ProductID <= 0 {
+			problems = append(problems, fmt.Errorf("route %s: product_id must be positive", route.ShortCode))
+		}
+		code := normalizeShortCode(route.ShortCode)
+		if seen[code] {
+			problems = append(problems, fmt.Errorf("route %s: overlaps another route for short code %s", route.ShortCode, code))
+		}
+		seen[code] = true
+	}
+	if c.DefaultProductID <= 0 {
+		problems = append(problems, fmt.Errorf("DEFAULT_PRODUCT_ID must be positive"))
+	}
+
+	problems = append(problems, c.validateProviders()...)
+
+	for code, action := range c.ErrorCodes {
+		if !validErrorAction(action.Action) {
+			problems = append(problems, fmt.Errorf("error code %s: invalid action %q: expected ignore, ack or alert", code, action.Action))
+		}
+	}
+
+	for code, action := range c.MenuStatuses {
+		if !validMenuStatus(code) {
+			problems = append(problems, fmt.Errorf("menu status %s: not an HTTP status", code))
+		}
+		if !validStatusAction(action) {
+			problems = append(problems, fmt.Errorf("menu status %s: invalid action %q: expected parse, error or end with a message", code, action.Action))
+		}
+	}
+
+	for _, pattern := range c.LogRedact {
+		if _, err := regexp.Compile(pattern); err != nil {
+			problems = append(problems, fmt.Errorf("log_redact %q: %v", pattern, err))
+		}
+	}
+
+	for telco, dcs := range c.TelcoDCS {
+		if !validTextDCS(dcs) {
+			problems = append(problems, fmt.Errorf("telco_dcs %s: invalid DCS %d: expected a text coding scheme between 0 and 255", telco, dcs))
+		}
+	}
+
+	problems = append(problems, validateTelcoPrefixes(c.TelcoPrefixes)...)
+	for telco, name := range c.TelcoNames {
+		if name == "" {
+			problems = append(problems, fmt.Errorf("telco_names %s: no name", telco))
+		}
+	}
+
+	for _, field := range c.ResponseFields {
+		if err := validResponseField(field); err != nil {
+			problems = append(problems, fmt.Errorf("response_fields %s: %v", field.Name, err))
+		}
+	}
+
+	return problems
+}
+
+// getEnvDuration parses the duration in the named variable (e.g. "10s"),
+// returning def when it is unset
+func getEnvDuration(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s %q: expected a duration such as 10s or 500ms", name, value)
+	}
+	return d, nil
+}
+
+// getEnvInt reads a whole number from the environment, returning def when
+// the variable is unset
+func getEnvInt(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return def, fmt.Errorf("invalid %s %q: expected a whole number", name, value)
+	}
+	return n, nil
+}
+
+// getEnvFloat reads a number from the environment, returning def when the
+// variable is unset
+func getEnvFloat(name string, def float64) (float64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return def, fmt.Errorf("invalid %s %q: expected a number", name, value)
+	}
+	return f, nil
+}
+
+// getEnvBool reads true or false (or 1 or 0) from the environment,
+// returning def when the variable is unset
+func getEnvBool(name string, def bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return def, fmt.Errorf("invalid %s %q: expected true or false", name, value)
+	}
+	return b, nil
+}
+
+// validatePort checks that port is a number in the TCP port range
+func validatePort(port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("%q is not a number", port)
+	}
+	if n < 1 || n > 65535 {
+		return fmt.Errorf("%d is out of range 1-65535", n)
+	}
+	return nil
+}
+
+// syslogAddress splits SyslogAddr into the network and address to dial,
+// both empty for the local syslog daemon
+func (c *Config) syslogAddress() (network, addr string, err error) {
+	if c.SyslogAddr == "" {
+		return "", "", nil
+	}
+	network, addr, ok := strings.Cut(c.SyslogAddr, "://")
+	if !ok || addr == "" {
+		return "", "", fmt.Errorf("%q: expected network://host:port, e.g. udp://127.0.0.1:514", c.SyslogAddr)
+	}
+	switch network {
+	case "udp", "tcp", "unix", "unixgram":
+	default:
+		return "", "", fmt.Errorf("%q: unsupported network %s", c.SyslogAddr, network)
+	}
+	return network, addr, nil
+}
+
+// validLoggerName reports whether name is a logger LOG_DEBUG may name
+func validLoggerName(name string) bool {
+	switch name {
+	case "app", "error", "request", "menu", "frame":
+		return true
+	}
+	return false
+}
+
+// debugEnabled reports whether LOG_DEBUG names the logger
+func (c *Config) debugEnabled(name string) bool {
+	for _, n := range c.LogDebug {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// logTimeFormat returns the timestamp format of the named logger
+func (c *Config) logTimeFormat(name string) string {
+	if format, ok := c.LogTimeFormats[name]; ok {
+		return format
+	}
+	return c.LogTimeFormat
+}
+
+// validateMonitoringURL checks that raw is an absolute http(s) URL
+func validateMonitoringURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q: expected an absolute http(s) URL", raw)
+	}
+	return nil
+}
+
+// checkDirWritable creates dir if needed and confirms a file can be written in it
+func checkDirWritable(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".writable-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(filepath.Clean(name))
+}
+
+// runValidateConfig loads and validates the configuration, writes a report
+// to w and returns the process exit code. It never dials the server.
+func runValidateConfig(w io.Writer) int {
+	cfg, problems := loadConfig()
+
+	fmt.Fprintf(w, "Server:       %s (%s)\n", cfg.ServerAddress(), cfg.ServerNetwork)
+	fmt.Fprintf(w, "HTTP port:    %s\n", cfg.HTTPPort)
+	fmt.Fprintf(w, "Log path:     %s\n", cfg.LogPath)
+	fmt.Fprintf(w, "Menu API URL: %s\n", cfg.MenuAPIURL)
+	fmt.Fprintf(w, "Monitoring:   %s (%s)\n", cfg.MonitoringMode, cfg.MonitoringURL)
+	if cfg.MonitoringSecondaryURL != "" {
+		fmt.Fprintf(w, "Failover:     %s\n", cfg.MonitoringSecondaryURL)
+	}
+	fmt.Fprintf(w, "Tracing:      %s\n", cfg.TracingExporter)
+	fmt.Fprintf(w, "Budget:       %s (retry margin %s)\n", cfg.ResponseBudget, cfg.RetryMargin)
+	fmt.Fprintf(w, "Enquire link: every %s (max %s, idle %s), %d outstanding, ack timeout %s\n", cfg.EnquireLinkInterval, cfg.EnquireLinkMaxInterval, cfg.EnquireLinkIdleTimeout, cfg.EnquireLinkMaxOutstanding, cfg.EnquireLinkAckTimeout)
+	fmt.Fprintf(w, "Reconnect:    grace %s, backoff %s up to %s, %d startup attempts\n", cfg.ReconnectGrace, cfg.ReconnectBackoff, cfg.ReconnectMaxBackoff, cfg.StartupConnectAttempts)
+	if cfg.SendRate > 0 {
+		fmt.Fprintf(w, "Send rate:    %g/s (burst %d)\n", cfg.SendRate, cfg.SendBurst)
+	} else {
+		fmt.Fprintf(w, "Send rate:    unlimited\n")
+	}
+	if cfg.SendRampUp > 0 {
+		fmt.Fprintf(w, "Ramp-up:      %g/s for %s after connecting\n", cfg.SendRampUpRate, cfg.SendRampUp)
+	}
+	if cfg.ConfigFile != "" {
+		fmt.Fprintf(w, "Config file:  %s (%d routes, %d providers, %d error codes)\n", cfg.ConfigFile, len(cfg.Routes), len(cfg.Providers), len(cfg.ErrorCodes))
+	}
+
+	if len(problems) > 0 {
+		fmt.Fprintf(w, "\nConfiguration is INVALID (%d problems):\n", len(problems))
+		for _, p := range problems {
+			fmt.Fprintf(w, "  - %v\n", p)
+		}
+		return 1
+	}
+
+	fmt.Fprintln(w, "\nConfiguration OK")
+	return 0
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+// setRequiredEnv sets the environment variables loadConfig requires
+func setRequiredEnv(t *testing.T) {
+	t.Helper()
+	for name, value := range map[string]string{
+		"SERVER_HOST":  "127.0.0.1",
+		"SERVER_PORT":  "9000",
+		"USERNAME":     "user",
+		"PASSWORD":     "secret",
+		"CLIENT_ID":    "client",
+		"USSD_API_URL": "http://localhost:8000/ussd",
+		"CONFIG_FILE":  "",
+	} {
+		t.Setenv(name, value)
+	}
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		problem string // "" when the config is valid
+	}{
+		{"defaults", nil, ""},
+		{"missing host", map[string]string{"SERVER_HOST": ""}, "SERVER_HOST"},
+		{"invalid port", map[string]string{"SERVER_PORT": "http"}, "SERVER_PORT"},
+		{"invalid number", map[string]string{"ENQ_MAX_OUTSTANDING": "many"}, "ENQ_MAX_OUTSTANDING"},
+		{"invalid bool", map[string]string{"DEBUG": "maybe"}, "DEBUG"},
+		{"custom time format", map[string]string{"LOG_TIME_FORMAT": "2006-01-02 15:04:05", "LOG_TIME_FORMAT_MENU": "epoch_ms"}, ""},
+		{"invalid time format", map[string]string{"LOG_TIME_FORMAT_REQUEST": "epoch"}, "LOG_TIME_FORMAT_REQUEST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRequiredEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			_, problems := loadConfig()
+			if tt.problem == "" {
+				if len(problems) > 0 {
+					t.Fatalf("unexpected problems: %v", problems)
+				}
+				return
+			}
+			for _, p := range problems {
+				if strings.Contains(p.Error(), tt.problem) {
+					return
+				}
+			}
+			t.Errorf("no problem mentioning %s in %v", tt.problem, problems)
+		})
+	}
+}
+
+func TestGetEnvInt(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string // "" leaves the variable unset
+		want    int
+		wantErr bool
+	}{
+		{"valid", "25", 25, false},
+		{"padded", " 7 ", 7, false},
+		{"missing", "", 4, false},
+		{"invalid", "ten", 4, true},
+		{"fraction", "2.5", 4, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_INT", tt.value)
+			got, err := getEnvInt("TEST_INT", 4)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getEnvInt error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "TEST_INT") {
+				t.Errorf("error %q does not name the variable", err)
+			}
+			if got != tt.want {
+				t.Errorf("getEnvInt = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetEnvBool(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    bool
+		wantErr bool
+	}{
+		{"true", true, false},
+		{"0", false, false},
+		{"", true, false},
+		{"yes please", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("TEST_BOOL", tt.value)
+			got, err := getEnvBool("TEST_BOOL", true)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("getEnvBool = %v, %v; want %v (error %v)", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunValidateConfig(t *testing.T) {
+	badFile := t.TempDir() + "/config.json"
+	if err := os.WriteFile(badFile, []byte(`{"routes": [`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		env    map[string]string
+		status int
+		output string
+	}{
+		{"valid", nil, 0, "Configuration OK"},
+		{"missing variable", map[string]string{"PASSWORD": ""}, 1, "missing required environment variable: PASSWORD"},
+		{"invalid config file", map[string]string{"CONFIG_FILE": badFile}, 1, "Configuration is INVALID"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRequiredEnv(t)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			var out strings.Builder
+			if status := runValidateConfig(&out); status != tt.status {
+				t.Errorf("exit status %d, want %d", status, tt.status)
+			}
+			if !strings.Contains(out.String(), tt.output) {
+				t.Errorf("output does not mention %q:\n%s", tt.output, out.String())
+			}
+		})
+	}
+}
+
+func TestProductIDFor(t *testing.T) {
+	cfg := &Config{
+		DefaultProductID: 2,
+		Routes: []Route{
+			{ShortCode: "*123#", ProductID: 10},
+			{ShortCode: "123*4", ProductID: 11},
+			{ShortCode: "456", ProductID: 12},
+		},
+	}
+
+	tests := []struct {
+		shortCode string
+		want      int
+		rule      string
+	}{
+		{"123", 10, "*123#"},
+		{"*123*4#", 11, "123*4"},
+		{"123*4*9", 11, "123*4"},
+		{"123*5", 10, "*123#"},
+		{"1234", 2, ""},
+		{"789", 2, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.shortCode, func(t *testing.T) {
+			got, rule := cfg.productIDFor(tt.shortCode)
+			if got != tt.want || rule != tt.rule {
+				t.Errorf("productIDFor = %d (route %q), want %d (route %q)", got, rule, tt.want, tt.rule)
+			}
+		})
+	}
+}
+
+func TestOverlappingRoutesAreInvalid(t *testing.T) {
+	cfg := &Config{
+		DefaultProductID: 2,
+		Routes: []Route{
+			{ShortCode: "123", ProductID: 1},
+			{ShortCode: "*123#", ProductID: 2},
+		},
+	}
+	for _, p := range cfg.validate() {
+		if strings.Contains(p.Error(), "overlaps") {
+			return
+		}
+	}
+	t.Errorf("no overlap reported for routes 123 and *123#")
+}
+
+func TestMenuStatusValidation(t *testing.T) {
+	cfg := &Config{
+		DefaultProductID: 2,
+		MenuStatuses: map[string]StatusAction{
+			"202": {Action: statusActionEnd, Message: "Processing"},
+			"204": {Action: statusActionEnd},
+			"2xx": {Action: statusActionParse},
+			"500": {Action: "retry"},
+		},
+	}
+	var found []string
+	for _, p := range cfg.validate() {
+		if strings.Contains(p.Error(), "menu status") {
+			found = append(found, p.Error())
+		}
+	}
+	if len(found) != 3 {
+		t.Errorf("got %d menu status problems, want 3 (end without message, bad status, bad action): %v", len(found), found)
+	}
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/logger"
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+// Session ID assigned by the server in the logon response; used to frame
+// enquire-links. Replaced on every successful (re)connect; guarded by
+// connMutex together with conn.
+var serverSessionID string
+
+// getConn returns the current server connection, nil before the first
+// connect
+func getConn() net.Conn {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	return conn
+}
+
+// getServerSessionID returns the session ID of the current connection
+func getServerSessionID() string {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	return serverSessionID
+}
+
+// setConn replaces the current server connection and its session ID
+func setConn(c net.Conn, sessionID string) {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	if conn != nil && conn != c {
+		connLabels.Delete(conn)
+		connReaders.Delete(conn)
+		connHealths.Delete(conn)
+	}
+	if c != nil && c != conn {
+		connHealths.Store(c, &connHealth{})
+	}
+	conn, serverSessionID = c, sessionID
+}
+
+// Labels of the server connections, keyed by net.Conn, so each frame can be
+// attributed to the connection it arrived on
+var connLabels sync.Map
+
+// labelConn names c in logs and session records
+func labelConn(c net.Conn, label string) {
+	connLabels.Store(c, label)
+}
+
+// connLabel returns the label of c, "-" for a connection without one
+func connLabel(c net.Conn) string {
+	if label, ok := connLabels.Load(c); ok {
+		return label.(string)
+	}
+	return "-"
+}
+
+// closeConn closes the current server connection, if any, and stops
+// tracking its health
+func closeConn() {
+	if c := getConn(); c != nil {
+		connHealths.Delete(c)
+		c.Close()
+	}
+}
+
+// linkUp is true while we hold a logged-on connection to the server
+var linkUp atomic.Bool
+
+// linkConfirmed is set once the server has acknowledged an enquire-link
+// after the startup logon, proving the link carries traffic both ways
+var linkConfirmed atomic.Bool
+
+// ready reports whether the gateway can serve requests: logged on, with the
+// link confirmed since startup
+func ready() bool {
+	return linkUp.Load() && linkConfirmed.Load()
+}
+
+// Errors returned by dialServer so a DNS problem can be told apart from a
+// server that resolved fine but is refusing our connection.
+var (
+	ErrResolveFailed     = errors.New("failed to resolve server host")
+	ErrConnectionRefused = errors.New("server refused connection")
+)
+
+// Timeout for a single TCP connection attempt to one resolved address
+const dialTimeout = 10 * time.Second
+
+// validServerNetwork reports whether network is a supported SERVER_NETWORK value
+func validServerNetwork(network string) bool {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return true
+	}
+	return false
+}
+
+// dialServer resolves host for the given network ("tcp", "tcp4" or "tcp6"),
+// logs the resolved addresses and tries each of them in turn.
+func dialServer(network, host, port string) (net.Conn, error) {
+	ipNetwork := "ip"
+	switch network {
+	case "tcp4":
+		ipNetwork = "ip4"
+	case "tcp6":
+		ipNetwork = "ip6"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	ips, err := net.DefaultResolver.LookupIP(ctx, ipNetwork, host)
+	cancel()
+	if err != nil {
+		return nil, fmt.Errorf("%w %q (%s): %v", ErrResolveFailed, host, network, err)
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%w %q (%s): no addresses found", ErrResolveFailed, host, network)
+	}
+
+	AppLogger.Info("Resolved %s (%s) to %v", host, network, ips)
+
+	var lastErr error
+	for _, ip := range ips {
+		address := net.JoinHostPort(ip.String(), port)
+		AppLogger.Info("Dialing %s via %s", address, network)
+
+		c, err := net.DialTimeout(network, address, dialTimeout)
+		if err == nil {
+			return c, nil
+		}
+
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			lastErr = fmt.Errorf("%w at %s: %v", ErrConnectionRefused, address, err)
+		} else {
+			lastErr = fmt.Errorf("failed to connect to %s: %w", address, err)
+		}
+		AppLogger.Warn("%v", lastErr)
+	}
+
+	return nil, lastErr
+}
+
+// connect dials the server and logs on, replacing conn and serverSessionID
+// on success
+func connect() error {
+	c, err := dialServer(AppConfig().ServerNetwork, AppConfig().ServerHost, AppConfig().ServerPort)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), AppConfig().LogonTimeout)
+	defer cancel()
+	sessionID, err := logon(ctx, c)
+	if err != nil {
+		connReaders.Delete(c)
+		c.Close()
+		return err
+	}
+
+	labelConn(c, AppConfig().ConnectionName)
+	setConn(c, sessionID)
+	enquireLinks.reset()
+	sendRamp.Start(AppConfig().SendRampUpRate, AppConfig().SendRampUp)
+	linkUp.Store(true)
+	return nil
+}
+
+// logon sends the AUTHRequest on c and returns the session ID from the reply.
+// The handshake fails when ctx is done first; c is then closed, so a stalled
+// write or a reply that never completes cannot hold it up.
+func logon(ctx context.Context, c net.Conn) (string, error) {
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	defer stop()
+	timedOut := func(err error) error {
+		if ctx.Err() != nil {
+			return fmt.Errorf("%w: %v", errLogonTimeout, err)
+		}
+		return err
+	}
+
+	// Generate a unique Request ID (timestamp-based)
+	requestID := generateRequestID()
+
+	logonRequest := LogonRequest{
+		RequestID:     requestID,
+		Username:      AppConfig().Username,
+		Password:      AppConfig().Password,
+		ApplicationID: AppConfig().ClientID,
+	}
+
+	logonXML, _ := xml.Marshal(logonRequest)
+	AppLogger.Info("Sending Logon Request...")
+	if err := sendMessage(c, logonXML, requestID); err != nil {
+		return "", timedOut(fmt.Errorf("failed to send logon: %v", err))
+	}
+
+	// Keep waiting for the reply, however slow, until ctx is done
+	header, body, err := readResponse(c)
+	for errors.Is(err, errReadTimeout) && ctx.Err() == nil {
+		header, body, err = readResponse(c)
+	}
+	if err != nil {
+		return "", timedOut(fmt.Errorf("failed to read logon response: %v", err))
+	}
+
+	AppLogger.Info("[FINAL RESPONSE] Header: %s", string(header))
+	AppLogger.Info("[FINAL RESPONSE] Body: %s", logger.Body(body))
+
+	// Extract session ID from header (First 16 bytes)
+	sessionID := headerSessionID(header)
+	AppLogger.Info("Extracted Session ID: %s", sessionID)
+
+	return sessionID, nil
+}
+
+// connectWithRetry calls connect until it succeeds, backing off from
+// ReconnectBackoff up to ReconnectMaxBackoff between failed attempts. It
+// gives up after maxAttempts failures, or never when maxAttempts is 0.
+// onAttempt, if set, is told the outcome of each attempt and the delay
+// before the next one (0 when there is none).
+func connectWithRetry(maxAttempts int, onAttempt func(attempt int, err error, backoff time.Duration)) error {
+	if onAttempt == nil {
+		onAttempt = func(int, error, time.Duration) {}
+	}
+	delay := AppConfig().ReconnectBackoff
+	for attempt := 1; ; attempt++ {
+		AppLogger.Info("Connection attempt %d to %s", attempt, AppConfig().ServerAddress())
+
+		err := connect()
+		if err == nil {
+			onAttempt(attempt, nil, 0)
+			AppLogger.Info("Connected after %d attempts", attempt)
+			return nil
+		}
+		if maxAttempts > 0 && attempt >= maxAttempts {
+			onAttempt(attempt, err, 0)
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		onAttempt(attempt, err, delay)
+		AppLogger.Error("Connection attempt %d failed: %v, retrying in %s", attempt, err, delay)
+		time.Sleep(delay)
+
+		delay *= 2
+		if delay > AppConfig().ReconnectMaxBackoff {
+			delay = AppConfig().ReconnectMaxBackoff
+		}
+	}
+}
+
+// The reconnect in progress, if any: done is closed when it finishes
+var reconnecting struct {
+	mu   sync.Mutex
+	done chan struct{}
+}
+
+// reconnect drops the current connection and logs on again. It waits
+// ReconnectGrace before the first attempt so the server can clean up our
+// old session, then retries with exponential backoff until it succeeds.
+// Triggers while a reconnect is in progress join it: they wait for it to
+// finish instead of starting another.
+func reconnect(reason error) {
+	reconnecting.mu.Lock()
+	if done := reconnecting.done; done != nil {
+		reconnecting.mu.Unlock()
+		AppLogger.Info("Reconnect already in progress, waiting for it (%v)", reason)
+		<-done
+		return
+	}
+	done := make(chan struct{})
+	reconnecting.done = done
+	reconnecting.mu.Unlock()
+	defer func() {
+		reconnecting.mu.Lock()
+		reconnecting.done = nil
+		reconnecting.mu.Unlock()
+		close(done)
+	}()
+
+	AppLogger.Warn("Connection lost: %v", reason)
+	ErrorLogger.Error("Connection lost: %v", reason)
+	linkUp.Store(false)
+	closeConn()
+
+	start := time.Now()
+	logReconnect("reconnect_start", reconnectEvent{Reason: reason.Error(), GraceMs: AppConfig().ReconnectGrace.Milliseconds()})
+
+	AppLogger.Info("Waiting %s before the first reconnect attempt", AppConfig().ReconnectGrace)
+	time.Sleep(AppConfig().ReconnectGrace)
+
+	// With no attempt limit it only returns once connected
+	attempts := 0
+	connectWithRetry(0, func(attempt int, err error, backoff time.Duration) {
+		attempts = attempt
+		event := reconnectEvent{Attempt: attempt, Result: "ok"}
+		if err != nil {
+			event.Result = "failed"
+			event.Error = err.Error()
+			event.BackoffMs = backoff.Milliseconds()
+		}
+		logReconnect("reconnect_attempt", event)
+	})
+
+	duration := time.Since(start)
+	stats.LastReconnectMs.Store(duration.Milliseconds())
+	logReconnect("reconnect_complete", reconnectEvent{Outcome: "connected", SessionID: getServerSessionID(), Attempts: attempts, DurationMs: duration.Milliseconds()})
+	stats.Reconnects.Add(1)
+}
+
+// reconnectEvent is one step of a reconnect sequence, logged as JSON:
+// its start, each connection attempt and its outcome
+type reconnectEvent struct {
+	Reason     string `json:"reason,omitempty"`
+	GraceMs    int64  `json:"grace_ms,omitempty"`
+	Attempt    int    `json:"attempt,omitempty"`
+	Result     string `json:"result,omitempty"` // ok or failed
+	BackoffMs  int64  `json:"backoff_ms,omitempty"`
+	Outcome    string `json:"outcome,omitempty"` // connected
+	SessionID  string `json:"session_id,omitempty"`
+	Attempts   int    `json:"attempts,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// logReconnect writes event to the app log as a single "name {json}" line
+func logReconnect(name string, event reconnectEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		AppLogger.Error("Failed to encode %s: %v", name, err)
+		return
+	}
+	AppLogger.Info("%s %s", name, line)
+}
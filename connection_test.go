@@ -0,0 +1,690 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+// Session ID the fake aggregator puts in the header of its frames
+const fakeSessionID = "FAKESERVER"
+
+// fakeAggregator plays the USSD server for tests: it answers the gateway's
+// logon and enquire links
+type fakeAggregator struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+// send writes body to the gateway in the aggregator's framing
+func (a *fakeAggregator) send(body []byte) error {
+	header := make([]byte, 19)
+	copy(header[:16], fakeSessionID)
+	copy(header[16:], fmt.Sprintf("%03d", len(body)+16))
+
+	a.writeMu.Lock()
+	defer a.writeMu.Unlock()
+	_, err := a.conn.Write(append(header, body...))
+	return err
+}
+
+// read returns the XML body of the next frame from the gateway. Unlike the
+// aggregator's frames, the length in createHeader counts the whole frame.
+func (a *fakeAggregator) read(r *bufio.Reader) ([]byte, error) {
+	_, body, err := readFrame(r, frameHeaderSize, 0)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimLeft(body, "\x00"), nil
+}
+
+// serve answers the gateway until its connection closes
+func (a *fakeAggregator) serve() {
+	r := bufio.NewReader(a.conn)
+	for {
+		body, err := a.read(r)
+		if err != nil {
+			return
+		}
+
+		switch frameType(body) {
+		case "AUTHRequest":
+			a.send([]byte("<AUTHResponse><result>0</result></AUTHResponse>"))
+		case "ENQRequest":
+			a.send([]byte("<ENQResponse/>"))
+		}
+	}
+}
+
+// testServer is a fake aggregator on localhost that the gateway is
+// configured to connect to. It logs the gateway on and answers its enquire
+// links, noting when each connection was accepted.
+type testServer struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	accepted    []time.Time
+	aggregators []*fakeAggregator
+}
+
+// startTestServer starts a testServer, serving each connection with serve
+// (fakeAggregator.serve when nil), and drops the gateway's connection to
+// it when the test ends
+func startTestServer(t *testing.T, serve func(a *fakeAggregator)) *testServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serve == nil {
+		serve = (*fakeAggregator).serve
+	}
+	s := &testServer{listener: listener}
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			a := &fakeAggregator{conn: c}
+			s.mu.Lock()
+			s.accepted = append(s.accepted, time.Now())
+			s.aggregators = append(s.aggregators, a)
+			s.mu.Unlock()
+			go serve(a)
+		}
+	}()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	withConfig(t, func(cfg *Config) {
+		cfg.ServerNetwork = "tcp"
+		cfg.ServerHost = "127.0.0.1"
+		cfg.ServerPort = port
+	})
+	t.Cleanup(func() {
+		listener.Close()
+		s.mu.Lock()
+		for _, a := range s.aggregators {
+			a.conn.Close()
+		}
+		s.mu.Unlock()
+		closeConn()
+		setConn(nil, "")
+		linkUp.Store(false)
+	})
+	return s
+}
+
+// forwardResponses returns a serve function for startTestServer that logs
+// the gateway on and answers its enquire links like fakeAggregator.serve,
+// but passes every USSDResponse to responses
+func forwardResponses(responses chan<- USSDResponse) func(a *fakeAggregator) {
+	return func(a *fakeAggregator) {
+		r := bufio.NewReader(a.conn)
+		for {
+			body, err := a.read(r)
+			if err != nil {
+				return
+			}
+			switch frameType(body) {
+			case "AUTHRequest":
+				a.send([]byte("<AUTHResponse><result>0</result></AUTHResponse>"))
+			case "ENQRequest":
+				a.send([]byte("<ENQResponse/>"))
+			case "USSDResponse":
+				var resp USSDResponse
+				if xml.Unmarshal(body, &resp) == nil {
+					responses <- resp
+				}
+			}
+		}
+	}
+}
+
+// connections returns when each connection was accepted
+func (s *testServer) connections() []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]time.Time(nil), s.accepted...)
+}
+
+// aggregator returns the fake aggregator serving the n-th connection
+func (s *testServer) aggregator(n int) *fakeAggregator {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.aggregators[n]
+}
+
+func TestDialServerErrors(t *testing.T) {
+	// A port nothing listens on: bind one and close it again
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, closedPort, _ := net.SplitHostPort(closed.Addr().String())
+	closed.Close()
+
+	tests := []struct {
+		name    string
+		network string
+		host    string
+		want    error
+	}{
+		{"unresolvable host", "tcp", "no-such-host.invalid", ErrResolveFailed},
+		{"no IPv6 address for an IPv4 literal", "tcp6", "127.0.0.1", ErrResolveFailed},
+		{"refused", "tcp", "127.0.0.1", ErrConnectionRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := dialServer(tt.network, tt.host, closedPort)
+			if c != nil {
+				c.Close()
+			}
+			if !errors.Is(err, tt.want) {
+				t.Errorf("dialServer(%s, %s) = %v, want %v", tt.network, tt.host, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReconnectWaitsForGrace(t *testing.T) {
+	srv := startTestServer(t, nil)
+
+	tests := []struct {
+		name  string
+		grace time.Duration
+	}{
+		{"no grace", 0},
+		{"grace", 300 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(cfg *Config) { cfg.ReconnectGrace = tt.grace })
+			if err := connect(); err != nil {
+				t.Fatalf("connect: %v", err)
+			}
+
+			dropped := time.Now()
+			reconnect(errors.New("connection reset"))
+			accepted := srv.connections()
+			if after := accepted[len(accepted)-1].Sub(dropped); after < tt.grace {
+				t.Errorf("reconnected %s after the drop, before the %s grace", after, tt.grace)
+			}
+			if !linkUp.Load() {
+				t.Error("link not up after reconnecting")
+			}
+		})
+	}
+}
+
+// Run with -race: swapping the connection while other goroutines send on
+// it must not race
+func TestReconnectWhileSending(t *testing.T) {
+	startTestServer(t, nil)
+	withConfig(t, func(cfg *Config) { cfg.ReconnectGrace = 0 })
+	if err := connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if i%2 == 0 {
+					sendEnquireLink()
+				} else if id, err := pushUSSD("2348030000022", "123", "Hello"); err == nil {
+					Sessions.End(id)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(i)
+	}
+
+	for i := 0; i < 3; i++ {
+		reconnect(errors.New("connection reset"))
+	}
+	close(stop)
+	wg.Wait()
+
+	if !linkUp.Load() || getConn() == nil {
+		t.Error("link not up after reconnecting")
+	}
+}
+
+// Run with -race: simultaneous triggers must run a single reconnect
+func TestConcurrentReconnectsCoalesce(t *testing.T) {
+	srv := startTestServer(t, nil)
+	withConfig(t, func(cfg *Config) { cfg.ReconnectGrace = 200 * time.Millisecond })
+	if err := connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	connections := len(srv.connections())
+	reconnects := stats.Reconnects.Load()
+
+	// A failed write, a failed read and a dead enquire link at once
+	var wg sync.WaitGroup
+	for _, reason := range []string{"write: broken pipe", "read: connection reset", "enquire link unanswered"} {
+		wg.Add(1)
+		go func(reason string) {
+			defer wg.Done()
+			reconnect(errors.New(reason))
+		}(reason)
+	}
+	wg.Wait()
+
+	if n := stats.Reconnects.Load() - reconnects; n != 1 {
+		t.Errorf("%d reconnects ran, want 1", n)
+	}
+	if n := len(srv.connections()) - connections; n != 1 {
+		t.Errorf("%d new connections, want 1", n)
+	}
+	if !linkUp.Load() || getConn() == nil {
+		t.Error("link not up after reconnecting")
+	}
+}
+
+func TestReconnectLogSequence(t *testing.T) {
+	// The server hangs up on the first two logons
+	var mu sync.Mutex
+	served := 0
+	startTestServer(t, func(a *fakeAggregator) {
+		mu.Lock()
+		served++
+		n := served
+		mu.Unlock()
+		if n <= 2 {
+			a.conn.Close()
+			return
+		}
+		a.serve()
+	})
+	withConfig(t, func(cfg *Config) {
+		cfg.ReconnectGrace = 0
+		cfg.ReconnectBackoff = 10 * time.Millisecond
+		cfg.ReconnectMaxBackoff = 15 * time.Millisecond
+	})
+
+	before := len(readLog(t, "log"))
+	reconnect(errors.New("connection reset"))
+	logged := readLog(t, "log")[before:]
+
+	var events []string
+	for _, m := range regexp.MustCompile(`INFO: (reconnect_\w+) (\{.*\})`).FindAllStringSubmatch(logged, -1) {
+		var event reconnectEvent
+		if err := json.Unmarshal([]byte(m[2]), &event); err != nil {
+			t.Fatalf("%s entry %s: %v", m[1], m[2], err)
+		}
+		switch m[1] {
+		case "reconnect_start":
+			events = append(events, "start: "+event.Reason)
+		case "reconnect_attempt":
+			events = append(events, fmt.Sprintf("attempt %d: %s, backoff %dms", event.Attempt, event.Result, event.BackoffMs))
+		case "reconnect_complete":
+			events = append(events, fmt.Sprintf("complete: %s as %s after %d attempts", event.Outcome, event.SessionID, event.Attempts))
+			if event.DurationMs < 25 {
+				t.Errorf("reconnect took %dms, less than its backoffs", event.DurationMs)
+			}
+		}
+	}
+	want := []string{
+		"start: connection reset",
+		"attempt 1: failed, backoff 10ms",
+		"attempt 2: failed, backoff 15ms",
+		"attempt 3: ok, backoff 0ms",
+		"complete: connected as " + fakeSessionID + " after 3 attempts",
+	}
+	if strings.Join(events, "\n") != strings.Join(want, "\n") {
+		t.Errorf("reconnect logged\n%s\nwant\n%s", strings.Join(events, "\n"), strings.Join(want, "\n"))
+	}
+	if ms := stats.Take().LastReconnectMs; ms < 25 {
+		t.Errorf("last_reconnect_ms = %d, want the reconnect's duration", ms)
+	}
+}
+
+func TestConnectWithRetryWaitsForServer(t *testing.T) {
+	// Reserve a port, then leave it closed until the server comes up
+	reserved, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(reserved.Addr().String())
+	reserved.Close()
+
+	withConfig(t, func(cfg *Config) {
+		cfg.ServerNetwork = "tcp"
+		cfg.ServerHost = "127.0.0.1"
+		cfg.ServerPort = port
+		cfg.ReconnectBackoff = 50 * time.Millisecond
+		cfg.ReconnectMaxBackoff = 100 * time.Millisecond
+	})
+	t.Cleanup(func() {
+		closeConn()
+		setConn(nil, "")
+		linkUp.Store(false)
+	})
+
+	if err := connectWithRetry(2, nil); err == nil {
+		t.Fatal("connected with no server listening")
+	}
+
+	const delay = 300 * time.Millisecond
+	up := make(chan net.Listener, 1)
+	go func() {
+		time.Sleep(delay)
+		listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", port))
+		if err != nil {
+			t.Errorf("server could not come up: %v", err)
+			close(up)
+			return
+		}
+		up <- listener
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go (&fakeAggregator{conn: c}).serve()
+		}
+	}()
+	t.Cleanup(func() {
+		if listener, ok := <-up; ok {
+			listener.Close()
+		}
+	})
+
+	start := time.Now()
+	if err := connectWithRetry(0, nil); err != nil {
+		t.Fatalf("connectWithRetry: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("connected after %s, before the server came up", elapsed)
+	}
+	if !linkUp.Load() {
+		t.Error("link not up once the server is available")
+	}
+}
+
+func TestConnectionLabels(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, "Welcome")
+
+	tests := []struct {
+		label, id, msisdn string
+	}{
+		{"gw-a", "CONNLBL1", "2348030000036"},
+		{"gw-b", "CONNLBL2", "2348030000037"},
+	}
+	for _, tt := range tests {
+		c := &captureConn{}
+		labelConn(c, tt.label)
+		t.Cleanup(func() { connLabels.Delete(c) })
+		serve(t, c, testRequest(tt.id, tt.msisdn, "123", ""))
+	}
+
+	requestLog := readLog(t, "requests")
+	for _, tt := range tests {
+		t.Cleanup(func() { Sessions.End(tt.id) })
+		if !regexp.MustCompile(`\[conn ` + tt.label + `\] Received USSD Request[^\n]*` + tt.id).MatchString(requestLog) {
+			t.Errorf("request log has no %s line for %s", tt.label, tt.id)
+		}
+		if !strings.Contains(requestLog, fmt.Sprintf(`"request_id":"%s","connection":"%s"`, tt.id, tt.label)) {
+			t.Errorf("request_complete for %s does not name connection %s", tt.id, tt.label)
+		}
+		if s, ok := Sessions.Get(tt.id); !ok || s.Connection != tt.label {
+			t.Errorf("session %s recorded connection %q, want %q", tt.id, s.Connection, tt.label)
+		}
+	}
+}
+
+func TestReadyzWaitsForLogonAndEnquireLink(t *testing.T) {
+	startTestServer(t, nil)
+	t.Cleanup(func() { linkConfirmed.Store(false) })
+	router := newRouter()
+
+	readyz := func() int {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return w.Code
+	}
+
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("before logon: status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	if err := connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if code := readyz(); code != http.StatusServiceUnavailable {
+		t.Fatalf("after logon, before the enquire-link ack: status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	sendEnquireLink()
+	c := getConn()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	header, body, err := readResponse(c)
+	if err != nil {
+		t.Fatalf("reading the enquire-link ack: %v", err)
+	}
+	processServerMessage(header, body, c)
+
+	if code := readyz(); code != http.StatusOK {
+		t.Errorf("after the enquire-link ack: status %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestHeaderSessionIDUnpadded(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+	}{
+		{"short", "SHORT"},
+		{"full width", "SESS000000000016"},
+		{"empty", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := headerSessionID(createHeader(tt.id, 50)); got != tt.id {
+				t.Errorf("headerSessionID = %q, want %q", got, tt.id)
+			}
+		})
+	}
+
+	// The fake aggregator's session ID is shorter than the header field
+	startTestServer(t, nil)
+	if err := connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	if got := getServerSessionID(); got != fakeSessionID {
+		t.Errorf("session ID after logon = %q, want %q", got, fakeSessionID)
+	}
+}
+
+func TestAnswerServerEnquireLink(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer bool
+	}{
+		{"answered", true},
+		{"disabled", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answers := make(chan []byte, 1)
+			startTestServer(t, func(a *fakeAggregator) {
+				r := bufio.NewReader(a.conn)
+				for {
+					body, err := a.read(r)
+					if err != nil {
+						return
+					}
+					switch frameType(body) {
+					case "AUTHRequest":
+						a.send([]byte("<AUTHResponse><result>0</result></AUTHResponse>"))
+						a.send([]byte("<ENQRequest/>"))
+					case "ENQResponse":
+						answers <- body
+					}
+				}
+			})
+			withConfig(t, func(cfg *Config) { cfg.AnswerEnquireLinks = tt.answer })
+			if err := connect(); err != nil {
+				t.Fatalf("connect: %v", err)
+			}
+
+			c := getConn()
+			header, body, err := readResponse(c)
+			if err != nil {
+				t.Fatalf("reading the server's enquire-link: %v", err)
+			}
+			processServerMessage(header, body, c)
+
+			select {
+			case body := <-answers:
+				if !tt.answer {
+					t.Errorf("answered with %s while ENQ_ANSWER is off", body)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if tt.answer {
+					t.Error("server got no ENQResponse")
+				}
+			}
+		})
+	}
+}
+
+func TestLogonTimesOutOnPartialResponse(t *testing.T) {
+	srv := startTestServer(t, func(a *fakeAggregator) {
+		r := bufio.NewReader(a.conn)
+		for {
+			body, err := a.read(r)
+			if err != nil {
+				return
+			}
+			if frameType(body) == "AUTHRequest" {
+				// A header announcing a body that never comes
+				a.conn.Write([]byte("SESS0001        047<AUTHResp"))
+			}
+		}
+	})
+	withConfig(t, func(cfg *Config) {
+		cfg.LogonTimeout = 200 * time.Millisecond
+		cfg.ReconnectBackoff = 10 * time.Millisecond
+		cfg.ReconnectMaxBackoff = 10 * time.Millisecond
+	})
+
+	start := time.Now()
+	err := connectWithRetry(2, nil)
+	if !errors.Is(err, errLogonTimeout) {
+		t.Fatalf("connectWithRetry: %v, want %v", err, errLogonTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("gave up after %s, want about 2 x %s", elapsed, AppConfig().LogonTimeout)
+	}
+	if n := len(srv.connections()); n != 2 {
+		t.Errorf("%d connections, want one per attempt (2)", n)
+	}
+	if linkUp.Load() {
+		t.Error("link up after the handshake timed out")
+	}
+}
+
+func TestSendRampUpAfterReconnect(t *testing.T) {
+	startTestServer(t, nil)
+	withConfig(t, func(cfg *Config) {
+		cfg.SendRampUp = 400 * time.Millisecond
+		cfg.SendRampUpRate = 20
+	})
+	t.Cleanup(func() { sendRamp.Start(0, 0) })
+	if err := connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	connected := time.Now()
+
+	send := func(n int) time.Duration {
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if err := sendMessage(getConn(), []byte("<ENQResponse/>"), "RAMP"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return time.Since(start)
+	}
+
+	// 5 frames at 20/s, the first at once
+	if elapsed := send(5); elapsed < 190*time.Millisecond {
+		t.Errorf("5 frames right after connecting took %s, want at least 200ms at the ramp-up rate", elapsed)
+	}
+
+	time.Sleep(time.Until(connected.Add(450 * time.Millisecond)))
+	if elapsed := send(20); elapsed > 100*time.Millisecond {
+		t.Errorf("20 frames after the ramp-up took %s, want them unpaced", elapsed)
+	}
+}
+
+func TestWatchdogRestartsStalledListenLoop(t *testing.T) {
+	srv := startTestServer(t, nil)
+	withConfig(t, func(cfg *Config) { cfg.ReconnectGrace = 0 })
+	if err := connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	// Retire whatever loop the watchdog starts once done
+	t.Cleanup(func() {
+		listenGeneration.Add(1)
+		closeConn()
+	})
+
+	const threshold = time.Minute
+	listenBeat.Store(time.Now().UnixNano())
+	if checkListenLoop(threshold) {
+		t.Fatal("restarted a listen loop that just went round")
+	}
+
+	linkUp.Store(false)
+	listenBeat.Store(time.Now().Add(-2 * threshold).UnixNano())
+	if checkListenLoop(threshold) {
+		t.Fatal("restarted the listen loop while the link was down")
+	}
+	linkUp.Store(true)
+
+	connections := len(srv.connections())
+	stalls := stats.ListenStalls.Load()
+	generation := listenGeneration.Load()
+	if !checkListenLoop(threshold) {
+		t.Fatal("did not restart a listen loop stalled with the link up")
+	}
+	if got := stats.ListenStalls.Load() - stalls; got != 1 {
+		t.Errorf("listen stalls counted %d, want 1", got)
+	}
+	if listenGeneration.Load() != generation+1 {
+		t.Error("stalled listen loop not retired")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(srv.connections()) == connections || !linkUp.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("no fresh connection after the stall")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+// Weight of the latest sample in the moving averages of a connection's
+// enquire-link latency and error rate
+const connHealthSmoothing = 0.2
+
+// connHealth tracks the recent behaviour of one server connection
+type connHealth struct {
+	mu             sync.Mutex
+	enquireLatency time.Duration // moving average of enquire-link round trips
+	errorRate      float64       // moving average of failed sends, 0 to 1
+
+	outstanding atomic.Int64 // sends in progress, pacing waits included
+}
+
+// Health of the server connections, keyed by net.Conn: tracked from
+// setConn until closeConn
+var connHealths sync.Map
+
+// connHealthOf returns the health of c. A connection not tracked gets a
+// fresh record that is not kept, so writes to it are never remembered.
+func connHealthOf(c net.Conn) *connHealth {
+	if h, ok := connHealths.Load(c); ok {
+		return h.(*connHealth)
+	}
+	return &connHealth{}
+}
+
+// enquireAcked records the round trip of an acknowledged enquire-link
+func (h *connHealth) enquireAcked(rtt time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.enquireLatency == 0 {
+		h.enquireLatency = rtt
+		return
+	}
+	h.enquireLatency += time.Duration(connHealthSmoothing * float64(rtt-h.enquireLatency))
+}
+
+// sendDone records the outcome of a send started with outstanding.Add(1)
+func (h *connHealth) sendDone(err error) {
+	h.outstanding.Add(-1)
+	failed := 0.0
+	if err != nil {
+		failed = 1
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.errorRate += connHealthSmoothing * (failed - h.errorRate)
+}
+
+// score rates the connection from 100 (perfect) towards 0, with a penalty
+// of 1 per 100ms of enquire-link latency, 1 per 10% of failed sends and 1
+// per outstanding send
+func (h *connHealth) score() float64 {
+	h.mu.Lock()
+	latency, errorRate := h.enquireLatency, h.errorRate
+	h.mu.Unlock()
+
+	penalty := latency.Seconds()*10 + errorRate*10 + float64(h.outstanding.Load())
+	return 100 / (1 + penalty)
+}
+
+// serverConns returns the connections to the server we are logged on to
+func serverConns() []net.Conn {
+	if c := getConn(); c != nil && linkUp.Load() {
+		return []net.Conn{c}
+	}
+	return nil
+}
+
+// connectionHealths reports the health of the server connections for
+// /api/stats
+func connectionHealths() []stats.ConnectionHealth {
+	healths := []stats.ConnectionHealth{}
+	for _, c := range serverConns() {
+		h := connHealthOf(c)
+		h.mu.Lock()
+		latency, errorRate := h.enquireLatency, h.errorRate
+		h.mu.Unlock()
+		healths = append(healths, stats.ConnectionHealth{
+			Label:            connLabel(c),
+			Score:            h.score(),
+			EnquireLatencyMs: float64(latency) / float64(time.Millisecond),
+			ErrorRate:        errorRate,
+			OutstandingSends: h.outstanding.Load(),
+		})
+	}
+	return healths
+}
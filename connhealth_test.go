@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnHealthScoresAilingLower(t *testing.T) {
+	healthy, ailing := &captureConn{}, &captureConn{}
+	connHealths.Store(healthy, &connHealth{})
+	connHealths.Store(ailing, &connHealth{})
+	t.Cleanup(func() {
+		connHealths.Delete(healthy)
+		connHealths.Delete(ailing)
+	})
+
+	h := connHealthOf(healthy)
+	h.enquireAcked(20 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		h.outstanding.Add(1)
+		h.sendDone(nil)
+	}
+
+	a := connHealthOf(ailing)
+	a.enquireAcked(400 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		a.outstanding.Add(1)
+		a.sendDone(errors.New("broken pipe"))
+	}
+	a.outstanding.Add(2) // sends stuck in progress
+
+	if healthyScore, ailingScore := h.score(), a.score(); healthyScore <= ailingScore {
+		t.Errorf("healthy connection scored %.1f, ailing %.1f", healthyScore, ailingScore)
+	}
+}
+
+func TestConnHealthTrackedWhileRegistered(t *testing.T) {
+	tracked := func(c net.Conn) bool {
+		_, ok := connHealths.Load(c)
+		return ok
+	}
+	t.Cleanup(func() { setConn(nil, "") })
+
+	stray := &captureConn{}
+	sendMessage(stray, []byte("<USSDResponse/>"), "SESS0001")
+	if tracked(stray) {
+		t.Error("health tracked for a connection never registered")
+	}
+
+	c := &captureConn{}
+	setConn(c, "SESS0001")
+	if !tracked(c) {
+		t.Fatal("health not tracked for the registered connection")
+	}
+	closeConn()
+	if tracked(c) {
+		t.Error("health still tracked after the connection was closed")
+	}
+}
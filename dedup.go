@@ -0,0 +1,131 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/session"
+)
+
+// Values for DEDUP_KEY, what identifies a retransmitted request. Either
+// way a key only matches requests seen within DEDUP_WINDOW, on the same
+// step of their session: once a menu is sent, the same input is the
+// subscriber's answer to it rather than a retransmission.
+const (
+	dedupOff         = "off"          // every request is processed
+	dedupRequestID   = "request_id"   // same request ID and input, for aggregators that resend the frame as is
+	dedupMSISDNInput = "msisdn_input" // same MSISDN, short code and input, for aggregators that assign a new ID
+)
+
+// dedupKey returns the key identifying retransmissions of req under
+// strategy, "" when requests are not deduplicated
+func dedupKey(strategy string, req USSDRequest) string {
+	switch strategy {
+	case dedupRequestID:
+		return fmt.Sprintf("%s|%s|%d", req.RequestID, req.UserData, dedupStep(strategy, req))
+	case dedupMSISDNInput:
+		return fmt.Sprintf("%s|%s|%s|%d", req.MSISDN, req.StarCode, req.UserData, dedupStep(strategy, req))
+	}
+	return ""
+}
+
+// dedupStep returns how many menus the session req belongs to was sent
+// when req arrived, 0 before its first. Under msisdn_input the session is
+// the subscriber's latest one on the short code, a retransmission not
+// carrying the ID of the session it repeats a request of.
+func dedupStep(strategy string, req USSDRequest) int {
+	if strategy == dedupRequestID {
+		s, _ := Sessions.Get(req.RequestID)
+		return s.Menus
+	}
+
+	var latest session.Session
+	for _, s := range Sessions.ByMSISDN(req.MSISDN) {
+		if s.ShortCode == req.StarCode && s.UpdatedAt.After(latest.UpdatedAt) {
+			latest = s
+		}
+	}
+	return latest.Menus
+}
+
+// dedupEntry is a request seen recently
+type dedupEntry struct {
+	key       string
+	requestID string
+	at        time.Time
+}
+
+// dedupCache remembers the requests seen recently, oldest first, so that
+// expired ones are dropped from the front without a sweep of them all
+type dedupCache struct {
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func newDedupCache() *dedupCache {
+	return &dedupCache{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Requests processed recently
+var recentRequests = newDedupCache()
+
+// expire drops the entries seen more than window before now. Callers hold
+// d.mu.
+func (d *dedupCache) expire(now time.Time, window time.Duration) {
+	for front := d.order.Front(); front != nil; front = d.order.Front() {
+		entry := front.Value.(*dedupEntry)
+		if now.Sub(entry.at) <= window {
+			return
+		}
+		d.order.Remove(front)
+		delete(d.entries, entry.key)
+	}
+}
+
+// duplicate records key, from request requestID, as seen at now and
+// reports whether it was already seen within window
+func (d *dedupCache) duplicate(key, requestID string, now time.Time, window time.Duration) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.expire(now, window)
+	if _, ok := d.entries[key]; ok {
+		return true
+	}
+	d.entries[key] = d.order.PushBack(&dedupEntry{key: key, requestID: requestID, at: now})
+	return false
+}
+
+// forget drops the entries of the session requestID, so that a new dial
+// after it ended is not taken for a retransmission of its first one
+func (d *dedupCache) forget(requestID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for element := d.order.Front(); element != nil; {
+		next := element.Next()
+		if entry := element.Value.(*dedupEntry); entry.requestID == requestID {
+			d.order.Remove(element)
+			delete(d.entries, entry.key)
+		}
+		element = next
+	}
+}
+
+// isRetransmission reports whether req repeats a request seen within
+// DedupWindow on the same step of its session, per the DedupKey strategy.
+// The earlier request is still being answered, so the repeat is dropped.
+func isRetransmission(req USSDRequest) bool {
+	key := dedupKey(AppConfig().DedupKey, req)
+	if key == "" {
+		return false
+	}
+	if !recentRequests.duplicate(key, req.RequestID, time.Now(), AppConfig().DedupWindow) {
+		return false
+	}
+	AppLogger.Warn("Dropping retransmission of request %s from %s (input %q)", req.RequestID, req.MSISDN, req.UserData)
+	return true
+}
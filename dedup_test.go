@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDedupKeyStrategies(t *testing.T) {
+	original := testRequest("DEDUP0000000001", "2348030000039", "123", "1")
+	sameFrame := original
+	newID := original
+	newID.RequestID = "DEDUP0000000002"
+	nextStep := original
+	nextStep.UserData = "2"
+
+	tests := []struct {
+		strategy string
+		resent   USSDRequest
+		after    time.Duration
+		dup      bool
+	}{
+		// Aggregators resending the frame as is
+		{dedupRequestID, sameFrame, time.Second, true},
+		{dedupRequestID, newID, time.Second, false},
+		{dedupRequestID, nextStep, time.Second, false},
+		{dedupRequestID, sameFrame, 10 * time.Second, false},
+		// Aggregators assigning a new ID to the retransmission
+		{dedupMSISDNInput, newID, time.Second, true},
+		{dedupMSISDNInput, sameFrame, time.Second, true},
+		{dedupMSISDNInput, nextStep, time.Second, false},
+		{dedupMSISDNInput, newID, 10 * time.Second, false},
+		{dedupOff, sameFrame, time.Second, false},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.strategy, i), func(t *testing.T) {
+			cache := newDedupCache()
+			now := time.Now()
+			duplicate := func(req USSDRequest, at time.Time) bool {
+				key := dedupKey(tt.strategy, req)
+				if key == "" {
+					return false
+				}
+				return cache.duplicate(key, req.RequestID, at, 5*time.Second)
+			}
+
+			if duplicate(original, now) {
+				t.Fatal("first request reported as a duplicate")
+			}
+			if got := duplicate(tt.resent, now.Add(tt.after)); got != tt.dup {
+				t.Errorf("request %+v %s later: duplicate %v, want %v", tt.resent, tt.after, got, tt.dup)
+			}
+		})
+	}
+}
+
+func TestDedupExpiresOldestFirst(t *testing.T) {
+	cache := newDedupCache()
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		cache.duplicate(fmt.Sprint("key", i), "DEDUP", now.Add(time.Duration(i)*time.Second), 5*time.Second)
+	}
+
+	cache.duplicate("key3", "DEDUP", now.Add(6500*time.Millisecond), 5*time.Second)
+	if n := cache.order.Len(); n != 2 || len(cache.entries) != 2 {
+		t.Errorf("%d entries left (%d keys), want key2 and key3", n, len(cache.entries))
+	}
+	if _, ok := cache.entries["key2"]; !ok {
+		t.Error("key2 expired before its window ended")
+	}
+}
+
+func TestRetransmissionDroppedWhilePending(t *testing.T) {
+	withLinkUp(t)
+	withConfig(t, func(cfg *Config) { cfg.DedupKey = dedupMSISDNInput })
+	arrived := make(chan struct{}, 2)
+	release := make(chan struct{})
+	withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+		writeMenu(w, "Welcome", true)
+	})
+	t.Cleanup(func() {
+		Sessions.End("RESEND1")
+		Sessions.End("RESEND2")
+	})
+
+	c := &captureConn{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(t, c, testRequest("RESEND1", "2348030000040", "123", ""))
+	}()
+	<-arrived
+	serve(t, c, testRequest("RESEND2", "2348030000040", "123", ""))
+	close(release)
+	<-done
+
+	if n := len(arrived); n != 0 {
+		t.Errorf("menu API called %d more times, want the retransmission dropped", n)
+	}
+	if responses := c.responses(t); len(responses) != 1 || responses[0].RequestID != "RESEND1" {
+		t.Errorf("sent %+v, want only the answer to RESEND1", responses)
+	}
+}
+
+func TestRepeatedInputReachesMenuAPI(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "Enter amount")
+	withConfig(t, func(cfg *Config) { cfg.DedupKey = dedupMSISDNInput })
+	t.Cleanup(func() { Sessions.End("REPEAT1") })
+
+	c := &captureConn{}
+	serve(t, c, testRequest("REPEAT1", "2348030000073", "123", ""))
+	serve(t, c, testRequest("REPEAT1", "2348030000073", "123", "1"))
+	serve(t, c, testRequest("REPEAT1", "2348030000073", "123", "1"))
+
+	if n := calls.count(); n != 3 {
+		t.Errorf("menu API called %d times, want the same input on the next menu sent too", n)
+	}
+	if responses := c.responses(t); len(responses) != 3 {
+		t.Errorf("sent %d responses, want 3", len(responses))
+	}
+}
+
+func TestRedialAfterSessionEndNotDropped(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "Goodbye")
+	withConfig(t, func(cfg *Config) { cfg.DedupKey = dedupMSISDNInput })
+	t.Cleanup(func() { Sessions.End("REDIAL2") })
+
+	c := &captureConn{}
+	serve(t, c, testRequest("REDIAL1", "2348030000075", "123", ""))
+	endSession("REDIAL1")
+	serve(t, c, testRequest("REDIAL2", "2348030000075", "123", ""))
+
+	if n := calls.count(); n != 2 {
+		t.Errorf("menu API called %d times, want the new dial served", n)
+	}
+}
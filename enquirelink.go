@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/xml"
+	"net"
+	"sync"
+	"time"
+)
+
+// enquireLinkTracker keeps the send times of enquire-links the server has
+// not acknowledged yet, and when we last heard from the server.
+type enquireLinkTracker struct {
+	mu          sync.Mutex
+	outstanding []time.Time // oldest first
+	lastInbound time.Time
+}
+
+var enquireLinks = &enquireLinkTracker{}
+
+// sent records an enquire-link written to the server
+func (t *enquireLinkTracker) sent() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.outstanding = append(t.outstanding, time.Now())
+}
+
+// acked matches an ENQResponse to the oldest outstanding enquire-link and
+// returns its round-trip time
+func (t *enquireLinkTracker) acked() (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.outstanding) == 0 {
+		return 0, false
+	}
+	sentAt := t.outstanding[0]
+	t.outstanding = t.outstanding[1:]
+	return time.Since(sentAt), true
+}
+
+// pending drops enquire-links unacknowledged for longer than timeout and
+// returns how many are still outstanding and how many were dropped
+func (t *enquireLinkTracker) pending(timeout time.Duration) (int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	cutoff := time.Now().Add(-timeout)
+	lost := 0
+	for lost < len(t.outstanding) && t.outstanding[lost].Before(cutoff) {
+		lost++
+	}
+	t.outstanding = t.outstanding[lost:]
+	return len(t.outstanding), lost
+}
+
+// received records that a frame arrived from the server
+func (t *enquireLinkTracker) received() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastInbound = time.Now()
+}
+
+// idleFor returns how long it has been since the last inbound frame
+func (t *enquireLinkTracker) idleFor() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return time.Since(t.lastInbound)
+}
+
+// reset forgets all state; called for every new connection
+func (t *enquireLinkTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.outstanding = nil
+	t.lastInbound = time.Now()
+}
+
+// idleWindow returns how long the link may be quiet before an enquire-link
+// is sent: EnquireLinkIdleTimeout when set below the interval, otherwise
+// the interval itself
+func idleWindow() time.Duration {
+	if AppConfig().EnquireLinkIdleTimeout > 0 && AppConfig().EnquireLinkIdleTimeout < AppConfig().EnquireLinkInterval {
+		return AppConfig().EnquireLinkIdleTimeout
+	}
+	return AppConfig().EnquireLinkInterval
+}
+
+// runEnquireLinks keeps the link alive until stop is closed. An enquire-link
+// is only sent when the link has been quiet for the idle window (any inbound
+// frame already proves it is alive) and fewer than EnquireLinkMaxOutstanding
+// are unacknowledged. While the link is busy the next check is timed for
+// when the window would run out. While acks are overdue the interval doubles
+// up to EnquireLinkMaxInterval, and returns to EnquireLinkInterval once they
+// catch up.
+func runEnquireLinks(stop <-chan struct{}) {
+	interval := AppConfig().EnquireLinkInterval
+	timer := time.NewTimer(idleWindow())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+
+		outstanding, lost := enquireLinks.pending(AppConfig().EnquireLinkAckTimeout)
+		if lost > 0 {
+			AppLogger.Warn("%d enquire-links not acknowledged within %s", lost, AppConfig().EnquireLinkAckTimeout)
+		}
+
+		idle := enquireLinks.idleFor()
+		next := AppConfig().EnquireLinkInterval
+		switch {
+		case outstanding >= AppConfig().EnquireLinkMaxOutstanding:
+			interval *= 2
+			if interval > AppConfig().EnquireLinkMaxInterval {
+				interval = AppConfig().EnquireLinkMaxInterval
+			}
+			next = interval
+			AppLogger.Warn("%d enquire-links awaiting ack, next check in %s", outstanding, interval)
+		case idle < idleWindow():
+			// Busy link: recent traffic already shows it is alive
+			interval = AppConfig().EnquireLinkInterval
+			next = idleWindow() - idle
+		default:
+			interval = AppConfig().EnquireLinkInterval
+			sendEnquireLink()
+		}
+
+		timer.Reset(next)
+	}
+}
+
+// sendEnquireLink writes an ENQRequest on the current connection
+func sendEnquireLink() {
+	enquireLink := EnquireLink{}
+	enqXML, _ := xml.Marshal(enquireLink)
+	AppLogger.Debug("Sending Enquire Link Request...")
+	c := getConn()
+	// Recorded first, as the ack may be read before sendMessage returns
+	enquireLinks.sent()
+	if err := sendMessage(c, enqXML, getServerSessionID()); err != nil {
+		// Closing the connection makes the listener notice the drop and reconnect
+		AppLogger.Error("Failed to send Enquire Link: %v", err)
+		c.Close()
+		return
+	}
+}
+
+// answerEnquireLink acknowledges an ENQRequest the server sent on c, under
+// the session ID of its frame
+func answerEnquireLink(c net.Conn, sessionID string) {
+	enqXML, _ := xml.Marshal(EnquireLinkResponse{})
+	if err := sendMessage(c, enqXML, sessionID); err != nil {
+		AppLogger.Error("Failed to answer the server's Enquire Link: %v", err)
+		return
+	}
+	AppLogger.Info("Answered the server's Enquire Link")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// withCaptureConn makes c the current server connection for the rest of
+// the test
+func withCaptureConn(t *testing.T, c *captureConn) {
+	t.Helper()
+	setConn(c, "SESS0001")
+	enquireLinks.reset()
+	t.Cleanup(func() {
+		setConn(nil, "")
+		enquireLinks.reset()
+	})
+}
+
+// countFrames returns how many frames of the given type were written to c
+func countFrames(t *testing.T, c *captureConn, kind string) int {
+	t.Helper()
+	n := 0
+	for _, body := range c.frames(t) {
+		if frameType(body) == kind {
+			n++
+		}
+	}
+	return n
+}
+
+// runEnquireLinksFor runs runEnquireLinks for d
+func runEnquireLinksFor(d time.Duration) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runEnquireLinks(stop)
+		close(done)
+	}()
+	time.Sleep(d)
+	close(stop)
+	<-done
+}
+
+func TestEnquireLinksOutstandingCap(t *testing.T) {
+	tests := []struct {
+		name           string
+		maxOutstanding int
+	}{
+		{"one", 1},
+		{"three", 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(cfg *Config) {
+				cfg.EnquireLinkInterval = 20 * time.Millisecond
+				cfg.EnquireLinkMaxInterval = 40 * time.Millisecond
+				cfg.EnquireLinkMaxOutstanding = tt.maxOutstanding
+				cfg.EnquireLinkAckTimeout = time.Minute
+			})
+			c := &captureConn{}
+			withCaptureConn(t, c)
+
+			// The server never acks, so sending stops at the cap
+			runEnquireLinksFor(300 * time.Millisecond)
+			if sent := countFrames(t, c, "ENQRequest"); sent != tt.maxOutstanding {
+				t.Errorf("%d enquire-links sent without acks, want %d", sent, tt.maxOutstanding)
+			}
+		})
+	}
+}
+
+func TestEnquireLinkAcked(t *testing.T) {
+	tracker := &enquireLinkTracker{}
+	tracker.sent()
+	tracker.sent()
+
+	for i, want := range []bool{true, true, false} {
+		if _, ok := tracker.acked(); ok != want {
+			t.Errorf("ack %d matched %v, want %v", i+1, ok, want)
+		}
+	}
+}
+
+func TestEnquireLinkSentWhenIdle(t *testing.T) {
+	tests := []struct {
+		name string
+		idle time.Duration
+		want int
+	}{
+		{"idle timeout", 100 * time.Millisecond, 1},
+		{"interval only", 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(cfg *Config) {
+				cfg.EnquireLinkInterval = time.Second
+				cfg.EnquireLinkMaxInterval = time.Second
+				cfg.EnquireLinkIdleTimeout = tt.idle
+				cfg.EnquireLinkMaxOutstanding = 1
+				cfg.EnquireLinkAckTimeout = time.Minute
+			})
+			c := &captureConn{}
+			withCaptureConn(t, c)
+
+			// Quiet for well under the interval but past the idle timeout
+			runEnquireLinksFor(250 * time.Millisecond)
+			if sent := countFrames(t, c, "ENQRequest"); sent != tt.want {
+				t.Errorf("%d enquire-links sent after 250ms of silence, want %d", sent, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Actions for an errorCode received in a USSDRequest
+const (
+	errorActionIgnore = "ignore" // log only
+	errorActionAck    = "ack"    // answer with a response ending the session
+	errorActionAlert  = "alert"  // log as an error and post a failure metric
+)
+
+// ErrorCodeAction is what to do when a request carries a given errorCode.
+// Message is the text of the acknowledgement sent for the "ack" action.
+type ErrorCodeAction struct {
+	Action  string `json:"action"`
+	Message string `json:"message"`
+}
+
+// errorActionFor returns the action configured for code, ignoring codes
+// without one
+func (c *Config) errorActionFor(code string) ErrorCodeAction {
+	if action, ok := c.ErrorCodes[code]; ok {
+		return action
+	}
+	return ErrorCodeAction{Action: errorActionIgnore}
+}
+
+// validErrorAction reports whether action is a supported error code action
+func validErrorAction(action string) bool {
+	switch action {
+	case errorActionIgnore, errorActionAck, errorActionAlert:
+		return true
+	}
+	return false
+}
+
+// handleErrorCode applies the action configured for the errorCode of req
+func handleErrorCode(ctx context.Context, req USSDRequest, conn net.Conn) {
+	action := AppConfig().errorActionFor(req.ErrorCode)
+
+	switch action.Action {
+	case errorActionAck:
+		AppLogger.Info("Acknowledging error code %s for %s with code %s", req.ErrorCode, req.MSISDN, req.RequestID)
+		ack := newUSSDResponse(req, action.Message, false)
+		err := sendUSSDResponse(ctx, conn, ack)
+		requestRecordFrom(ctx).responded(ack, err)
+		if err != nil {
+			AppLogger.Error("Failed to acknowledge error code %s: %v", req.ErrorCode, err)
+		}
+	case errorActionAlert:
+		AppLogger.Error("Error code %s for %s with code %s", req.ErrorCode, req.MSISDN, req.RequestID)
+		ErrorLogger.Error("Error code %s for %s with code %s", req.ErrorCode, req.MSISDN, req.RequestID)
+		UpdateMonitoringService(&req, "Error code received", fmt.Errorf("error code %s", req.ErrorCode))
+	default:
+		AppLogger.Info("Error code: %s for %s with code %s\n", req.ErrorCode, req.MSISDN, req.RequestID)
+	}
+
+	endSession(req.RequestID)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestErrorCodeActions(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "Welcome")
+	withConfig(t, func(cfg *Config) {
+		cfg.ErrorCodes = map[string]ErrorCodeAction{
+			"101": {Action: errorActionAck, Message: "Not provisioned"},
+			"102": {Action: errorActionAlert},
+		}
+	})
+
+	tests := []struct {
+		name string
+		code string
+		ack  bool
+	}{
+		{"ack", "101", true},
+		{"alert", "102", false},
+		{"unknown", "999", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := testRequest("ERR"+tt.code, "2348030000008", "123", "")
+			req.ErrorCode = tt.code
+			c := &captureConn{}
+			serve(t, c, req)
+
+			responses := c.responses(t)
+			if !tt.ack {
+				if len(responses) > 0 {
+					t.Errorf("sent %+v, want nothing", responses)
+				}
+				return
+			}
+			if len(responses) != 1 {
+				t.Fatalf("sent %d responses, want 1", len(responses))
+			}
+			if resp := responses[0]; resp.UserData != "Not provisioned" || resp.EndOfSession != 1 {
+				t.Errorf("acknowledged with %q (end %d), want %q ending the session", resp.UserData, resp.EndOfSession, "Not provisioned")
+			}
+		})
+	}
+	if n := calls.count(); n > 0 {
+		t.Errorf("menu API called %d times for requests carrying an error code", n)
+	}
+}
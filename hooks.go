@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// responseMeta describes how a response was sent
+type responseMeta struct {
+	Connection string        // label of the connection the request arrived on
+	Step       int           // step of the session, 0 when untracked
+	Latency    time.Duration // from receiving the request to sending the response
+}
+
+// postSendHook is told of each response sent for a request, e.g. to update
+// an external CRM or session system. It runs on the workers of a hookPool,
+// after the send, so it can neither hold up nor change the response; an
+// error is only logged.
+type postSendHook func(req USSDRequest, resp USSDResponse, meta responseMeta) error
+
+// hookPool runs its hook on its own workers, so that a slow or failing
+// hook never holds up or breaks a response
+type hookPool struct {
+	hook postSendHook
+	jobs chan hookJob
+}
+
+type hookJob struct {
+	req  USSDRequest
+	resp USSDResponse
+	meta responseMeta
+}
+
+// Runs the post-send hook, with PostSendHookWorkers and PostSendHookQueue.
+// setupRuntime sets it to post to POST_SEND_HOOK_URL when configured; nil
+// otherwise.
+var postSendHooks *hookPool
+
+// newHookPool starts workers running hook for up to queue responses
+func newHookPool(hook postSendHook, workers, queue int) *hookPool {
+	p := &hookPool{hook: hook, jobs: make(chan hookJob, queue)}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// dispatch queues the hook for resp, sent for req, without waiting. When
+// the queue is full it is skipped for resp.
+func (p *hookPool) dispatch(req USSDRequest, resp USSDResponse, meta responseMeta) {
+	if p == nil {
+		return
+	}
+	select {
+	case p.jobs <- hookJob{req, resp, meta}:
+	default:
+		AppLogger.Warn("Post-send hook queue full, skipping it for the response to %s", req.RequestID)
+	}
+}
+
+// work runs queued hooks
+func (p *hookPool) work() {
+	for job := range p.jobs {
+		if err := job.run(p.hook); err != nil {
+			AppLogger.Error("Post-send hook failed for %s: %v", job.req.RequestID, err)
+			ErrorLogger.Error("Post-send hook failed for %s: %v", job.req.RequestID, err)
+		}
+	}
+}
+
+// run calls hook for the job, turning a panic into an error
+func (job hookJob) run(hook postSendHook) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return hook(job.req, job.resp, job.meta)
+}
+
+// hookEvent is what webhookHook posts
+type hookEvent struct {
+	SessionID  string `json:"session_id"`
+	MSISDN     string `json:"msisdn"`
+	ShortCode  string `json:"shortcode"`
+	Input      string `json:"input"`
+	Message    string `json:"message"`
+	Continue   bool   `json:"continue"`
+	Connection string `json:"connection"`
+	Step       int    `json:"step,omitempty"`
+	LatencyMs  int64  `json:"latency_ms"`
+}
+
+// webhookHook returns a hook posting each interaction as JSON to url,
+// failing on anything but a 2xx answer within timeout
+func webhookHook(url string, timeout time.Duration) postSendHook {
+	client := &http.Client{Timeout: timeout}
+	return func(req USSDRequest, resp USSDResponse, meta responseMeta) error {
+		body, err := json.Marshal(hookEvent{
+			SessionID:  req.RequestID,
+			MSISDN:     req.MSISDN,
+			ShortCode:  "*" + req.StarCode + "#",
+			Input:      req.UserData,
+			Message:    resp.UserData,
+			Continue:   resp.EndOfSession == 0,
+			Connection: meta.Connection,
+			Step:       meta.Step,
+			LatencyMs:  meta.Latency.Milliseconds(),
+		})
+		if err != nil {
+			return err
+		}
+		httpReq, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		r, err := client.Do(httpReq)
+		if err != nil {
+			return err
+		}
+		defer drainAndClose(r.Body)
+		if r.StatusCode/100 != 2 {
+			return fmt.Errorf("webhook answered %s", r.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withPostSendHook runs the rest of the test with hook run after each
+// response sent
+func withPostSendHook(t *testing.T, hook postSendHook) {
+	t.Helper()
+	saved := postSendHooks
+	postSendHooks = newHookPool(hook, 1, 10)
+	t.Cleanup(func() { postSendHooks = saved })
+}
+
+func TestPostSendHook(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, "Welcome. 1. Balance")
+
+	type call struct {
+		req  USSDRequest
+		resp USSDResponse
+		meta responseMeta
+	}
+	calls := make(chan call, 1)
+	withPostSendHook(t, func(req USSDRequest, resp USSDResponse, meta responseMeta) error {
+		calls <- call{req, resp, meta}
+		return errors.New("CRM unreachable")
+	})
+
+	c := &captureConn{}
+	req := testRequest("HOOK1", "2348030000070", "123", "")
+	t.Cleanup(func() { Sessions.End(req.RequestID) })
+	serve(t, c, req)
+
+	// The failing hook does not keep the response from being sent
+	if got := c.lastResponse(t).UserData; got != "Welcome. 1. Balance" {
+		t.Errorf("sent %q, want the menu", got)
+	}
+
+	select {
+	case got := <-calls:
+		if got.req.RequestID != req.RequestID || got.req.MSISDN != req.MSISDN || got.req.UserData != req.UserData {
+			t.Errorf("hook got request %+v, want %+v", got.req, req)
+		}
+		if got.resp.UserData != "Welcome. 1. Balance" || got.resp.EndOfSession != 0 {
+			t.Errorf("hook got response %+v, want the menu sent", got.resp)
+		}
+		if got.meta.Step != 1 {
+			t.Errorf("hook got step %d, want 1", got.meta.Step)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("hook not called after the response was sent")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(readLog(t, "errors"), "Post-send hook failed for HOOK1: CRM unreachable") {
+		if time.Now().After(deadline) {
+			t.Fatal("hook error not logged")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookHook(t *testing.T) {
+	events := make(chan map[string]any, 1)
+	status := http.StatusOK
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]any
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(webhook.Close)
+
+	hook := webhookHook(webhook.URL, time.Second)
+	req := testRequest("HOOK2", "2348030000070", "123", "1")
+	resp := newUSSDResponse(req, "Your balance is N100", false)
+	if err := hook(req, resp, responseMeta{Connection: "primary", Step: 2}); err != nil {
+		t.Fatalf("hook: %v", err)
+	}
+	event := <-events
+	if event["session_id"] != "HOOK2" || event["input"] != "1" || event["message"] != "Your balance is N100" || event["continue"] != false || event["step"] != float64(2) {
+		t.Errorf("webhook got %v", event)
+	}
+
+	status = http.StatusBadGateway
+	if err := hook(req, resp, responseMeta{}); err == nil {
+		t.Error("hook succeeded on a 502")
+	}
+	<-events
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+)
+
+// Values for INPUT_DECODING, how the aggregator encodes userdata
+const (
+	inputDecodingNone = "none" // plain text, forwarded as is
+	inputDecodingURL  = "url"  // percent-encoded (e.g. %20 for a space)
+)
+
+// decodeUserData undoes the aggregator's encoding of req.UserData per
+// INPUT_DECODING. Binary requests are left alone, as is userdata that does
+// not decode.
+func decodeUserData(req *USSDRequest) {
+	if AppConfig().InputDecoding != inputDecodingURL || req.Payload != nil {
+		return
+	}
+	decoded, err := url.PathUnescape(req.UserData)
+	if err != nil {
+		RequestLogger.Warn("Keeping userdata of %s as received, it is not URL-encoded: %v", req.RequestID, err)
+		return
+	}
+	req.UserData = decoded
+}
+
+// repromptEmptyInput answers req, a continuation with no input, with
+// EmptyInputMessage followed by the menu the session is waiting on, when
+// known and both fit in one message. The session stays open for another
+// try and the menu API is not called. Without an open session there is
+// nothing to try again, so the answer ends it.
+func repromptEmptyInput(ctx context.Context, req USSDRequest, conn net.Conn) {
+	s, open := Sessions.Get(req.RequestID)
+	if open {
+		AppLogger.Warn("Empty input from %s with code %s, prompting again", req.MSISDN, req.RequestID)
+	} else {
+		AppLogger.Warn("Empty input from %s with code %s and no open session, ending it", req.MSISDN, req.RequestID)
+	}
+
+	message := AppConfig().EmptyInputMessage
+	if open && s.LastMenu != "" {
+		message = s.LastMenu
+		if prompt := AppConfig().EmptyInputMessage + "\n" + s.LastMenu; fitsMessage(prompt, responseDCS(req, AppConfig().telcoFor(req.MSISDN), nil)) {
+			message = prompt
+		}
+		Sessions.Touch(req.RequestID)
+	}
+
+	response := newUSSDResponse(req, message, open)
+	err := sendUSSDResponse(ctx, conn, response)
+	requestRecordFrom(ctx).responded(response, err)
+	if err != nil {
+		AppLogger.Error("Failed to send empty input prompt: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+// requestRecord gathers what happened to one inbound request so it can be
+// logged as a single request_complete line once processing ends
+type requestRecord struct {
+	mu     sync.Mutex
+	start  time.Time
+	sentAt time.Time // when the response was sent, zero until then
+	stages []stageTiming
+
+	request USSDRequest // as received, for the post-send hooks
+
+	RequestID  string           `json:"request_id"`
+	Connection string           `json:"connection"`     // label of the connection the frame arrived on
+	Step       int              `json:"step,omitempty"` // step of the session, 1 for the dial; 0 when untracked
+	Inbound    inboundSummary   `json:"inbound"`
+	Menu       *menuSummary     `json:"menu,omitempty"`     // nil when the menu API was not called
+	Response   *responseSummary `json:"response,omitempty"` // nil when nothing was sent
+	TotalMs    int64            `json:"total_ms"`
+}
+
+type inboundSummary struct {
+	MSISDN    string `json:"msisdn"`
+	ShortCode string `json:"short_code"`
+	MsgType   int    `json:"msg_type"`
+	Input     string `json:"input"`
+	End       bool   `json:"end_of_session"`
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+type menuSummary struct {
+	LatencyMs int64  `json:"latency_ms"`
+	Result    string `json:"result"` // "ok" or the error
+}
+
+type responseSummary struct {
+	Continue bool   `json:"continue"`
+	Length   int    `json:"length"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Pipeline stages timed for the request_timing line
+const (
+	stageParse   = "parse"   // decoding the frame into a USSDRequest
+	stageTelco   = "telco"   // resolving the telco of the MSISDN
+	stageBackend = "backend" // the menu API call
+	stageRender  = "render"  // rendering the response XML
+	stageSend    = "send"    // writing the response frame
+)
+
+type stageTiming struct {
+	stage    string
+	duration time.Duration
+}
+
+type requestRecordKey struct{}
+
+// withRequestRecord starts the record of req and returns a context carrying it
+func withRequestRecord(ctx context.Context, req USSDRequest) (context.Context, *requestRecord) {
+	record := &requestRecord{
+		start:     time.Now(),
+		request:   req,
+		RequestID: req.RequestID,
+		Inbound: inboundSummary{
+			MSISDN:    maskMSISDN(req.MSISDN),
+			ShortCode: req.StarCode,
+			MsgType:   req.MsgType,
+			Input:     maskInput(req),
+			End:       req.EndOfSession != 0,
+			ErrorCode: req.ErrorCode,
+		},
+	}
+	return context.WithValue(ctx, requestRecordKey{}, record), record
+}
+
+// maskInput returns the input of req for the request_complete line: the
+// dial string as is, anything the subscriber typed after it (which may be
+// a PIN) masked
+func maskInput(req USSDRequest) string {
+	if req.MsgType == msgTypeBegin {
+		return req.UserData
+	}
+	return strings.Repeat("*", utf8.RuneCountInString(req.UserData))
+}
+
+// requestRecordFrom returns the record carried by ctx. Its methods do
+// nothing on the nil record returned when there is none.
+func requestRecordFrom(ctx context.Context) *requestRecord {
+	record, _ := ctx.Value(requestRecordKey{}).(*requestRecord)
+	return record
+}
+
+// menuCalled records the outcome of the menu API call
+func (r *requestRecord) menuCalled(latency time.Duration, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	r.Menu = &menuSummary{LatencyMs: latency.Milliseconds(), Result: result}
+	r.addStage(stageBackend, latency)
+}
+
+// stepped records the step of the session the request was
+func (r *requestRecord) stepped(step int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Step = step
+}
+
+// timed adds d to the time spent in stage
+func (r *requestRecord) timed(stage string, d time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addStage(stage, d)
+}
+
+// addStage adds d to stage, keeping stages in the order first timed.
+// r.mu must be held.
+func (r *requestRecord) addStage(stage string, d time.Duration) {
+	for i := range r.stages {
+		if r.stages[i].stage == stage {
+			r.stages[i].duration += d
+			return
+		}
+	}
+	r.stages = append(r.stages, stageTiming{stage, d})
+}
+
+// timingLine returns the request_timing breakdown: each stage timed, then
+// the total, in microseconds. r.mu must be held.
+func (r *requestRecord) timingLine(total time.Duration) string {
+	var b strings.Builder
+	id, _ := json.Marshal(r.RequestID)
+	fmt.Fprintf(&b, `{"request_id":%s`, id)
+	for _, s := range r.stages {
+		fmt.Fprintf(&b, `,"%s_us":%d`, s.stage, s.duration.Microseconds())
+	}
+	fmt.Fprintf(&b, `,"total_us":%d}`, total.Microseconds())
+	return b.String()
+}
+
+// responded records the response sent for the request
+func (r *requestRecord) responded(response USSDResponse, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sentAt = time.Now()
+	r.Response = &responseSummary{
+		Continue: response.EndOfSession == 0,
+		Length:   len(response.UserData),
+	}
+	if err != nil {
+		r.Response.Error = err.Error()
+	}
+}
+
+// meta returns how the response to the request was sent, now
+func (r *requestRecord) meta() responseMeta {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return responseMeta{Connection: r.Connection, Step: r.Step, Latency: time.Since(r.start)}
+}
+
+// complete writes the request_complete line to the request log
+func (r *requestRecord) complete() {
+	r.mu.Lock()
+	total := time.Since(r.start)
+	r.TotalMs = total.Milliseconds()
+	line, err := json.Marshal(r)
+	sentAt := r.sentAt
+	var timing string
+	if RequestLogger.DebugEnabled() {
+		timing = r.timingLine(total)
+	}
+	r.mu.Unlock()
+
+	if timing != "" {
+		RequestLogger.Debug("request_timing %s", timing)
+	}
+
+	if !sentAt.IsZero() {
+		processing := sentAt.Sub(r.start)
+		stats.ProcessingTimes.Observe(processing)
+		if threshold := AppConfig().SlowRequestThreshold; threshold > 0 && processing > threshold {
+			RequestLogger.Warn("Slow request %s: response sent %s after the frame was received (threshold %s)", r.RequestID, processing, threshold)
+		}
+	}
+
+	if err != nil {
+		RequestLogger.Error("Failed to encode request_complete for %s: %v", r.RequestID, err)
+		return
+	}
+	RequestLogger.Info("request_complete %s", line)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+// requestCompleteLine returns the fields of the request_complete line
+// logged for id
+func requestCompleteLine(t *testing.T, id string) map[string]any {
+	t.Helper()
+	return requestLogLine(t, "request_complete", id)
+}
+
+// requestLogLine returns the fields of the JSON line of event logged for id
+// to the request log
+func requestLogLine(t *testing.T, event, id string) map[string]any {
+	t.Helper()
+	path := filepath.Join(AppConfig().LogPath, "requests", time.Now().Format("2006-01-02")+".log")
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	marker := event + " "
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		i := strings.Index(line, marker)
+		if i < 0 {
+			continue
+		}
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(line[i+len(marker):]), &fields); err != nil {
+			t.Fatalf("%s line is not JSON: %s", event, line)
+		}
+		if fields["request_id"] == id {
+			return fields
+		}
+	}
+	t.Fatalf("no %s line for %s in %s", event, id, path)
+	return nil
+}
+
+func TestRequestCompleteLine(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, "1. Balance")
+
+	serve(t, &captureConn{}, testRequest("LIFE1", "2348030000019", "123", ""))
+	t.Cleanup(func() { Sessions.End("LIFE1") })
+
+	fields := requestCompleteLine(t, "LIFE1")
+	for path, want := range map[string]any{
+		"inbound.msisdn":     "*********0019",
+		"inbound.short_code": "123",
+		"inbound.msg_type":   float64(1),
+		"inbound.input":      "*123#",
+		"menu.result":        "ok",
+		"response.continue":  true,
+		"response.length":    float64(len("1. Balance")),
+	} {
+		section, key, _ := strings.Cut(path, ".")
+		sub, ok := fields[section].(map[string]any)
+		if !ok {
+			t.Errorf("no %s section in %v", section, fields)
+			continue
+		}
+		if got := sub[key]; got != want {
+			t.Errorf("%s = %v, want %v", path, got, want)
+		}
+	}
+	for _, path := range []string{"menu.latency_ms", "total_ms"} {
+		section, key, nested := strings.Cut(path, ".")
+		value := fields[section]
+		if nested {
+			value = fields[section].(map[string]any)[key]
+		}
+		if _, ok := value.(float64); !ok {
+			t.Errorf("%s = %v, want a number of milliseconds", path, value)
+		}
+	}
+}
+
+func TestProcessingTimeRecorded(t *testing.T) {
+	withLinkUp(t)
+	withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		writeMenu(w, "Welcome", true)
+	})
+	withConfig(t, func(cfg *Config) { cfg.SlowRequestThreshold = 100 * time.Millisecond })
+
+	before := stats.ProcessingTimes.Snapshot()
+	serve(t, &captureConn{}, testRequest("SLOW1", "2348030000032", "123", ""))
+	t.Cleanup(func() { Sessions.End("SLOW1") })
+
+	got := stats.ProcessingTimes.Snapshot().Since(before)
+	if got.Count != 1 || got.Buckets["250"] != 1 {
+		t.Errorf("processing times %+v, want one request in the 250ms bucket", got)
+	}
+	if !regexp.MustCompile(`WARN: Slow request SLOW1: `).MatchString(readLog(t, "requests")) {
+		t.Error("no slow request warning in the request log")
+	}
+}
+
+func TestRequestTimingLine(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, "1. Balance")
+	RequestLogger.SetDebug(true)
+	t.Cleanup(applyLogDebug)
+
+	serve(t, &captureConn{}, testRequest("TIMING1", "2348030000061", "123", ""))
+	t.Cleanup(func() { Sessions.End("TIMING1") })
+
+	fields := requestLogLine(t, "request_timing", "TIMING1")
+	for _, stage := range []string{"parse", "telco", "backend", "render", "send", "total"} {
+		if _, ok := fields[stage+"_us"].(float64); !ok {
+			t.Errorf("request_timing has no %s duration: %v", stage, fields)
+		}
+	}
+}
+
+func TestInputMasked(t *testing.T) {
+	dial := testRequest("LIFE3", "2348030000019", "123", "")
+	if got := maskInput(dial); got != dial.UserData {
+		t.Errorf("dial string logged as %q, want %q", got, dial.UserData)
+	}
+	pin := testRequest("LIFE3", "2348030000019", "123", "1234")
+	if got := maskInput(pin); got != "****" {
+		t.Errorf("input logged as %q, want it masked", got)
+	}
+}
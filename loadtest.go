@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// loadTestOptions shape the synthetic traffic of --loadtest
+type loadTestOptions struct {
+	Rate     float64       // sessions started per second
+	Duration time.Duration // how long sessions keep being started
+	Steps    int           // requests per session, the dial included
+}
+
+// Options from the --loadtest-* flags
+var loadTestFlags loadTestOptions
+
+// Short code dialled by the synthetic sessions
+const loadTestShortCode = "999"
+
+// loadTestReport is what a load test measured
+type loadTestReport struct {
+	Sessions  int
+	Requests  int
+	Errors    int // requests unanswered or answered unexpectedly
+	Elapsed   time.Duration
+	Latencies []time.Duration // per answered request, sorted
+}
+
+// Throughput returns the answered requests per second
+func (r loadTestReport) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(len(r.Latencies)) / r.Elapsed.Seconds()
+}
+
+// ErrorRate returns the share of requests that failed
+func (r loadTestReport) ErrorRate() float64 {
+	if r.Requests == 0 {
+		return 0
+	}
+	return float64(r.Errors) / float64(r.Requests)
+}
+
+// Percentile returns the latency below which p (0-1) of the answered
+// requests fell
+func (r loadTestReport) Percentile(p float64) time.Duration {
+	if len(r.Latencies) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(r.Latencies)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return r.Latencies[i]
+}
+
+// write prints the report to w
+func (r loadTestReport) write(w io.Writer) {
+	fmt.Fprintf(w, "Sessions:   %d\n", r.Sessions)
+	fmt.Fprintf(w, "Requests:   %d in %s\n", r.Requests, r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "Throughput: %.1f responses/s\n", r.Throughput())
+	fmt.Fprintf(w, "Latency:    p50 %s, p95 %s, p99 %s, max %s\n", r.Percentile(0.50), r.Percentile(0.95), r.Percentile(0.99), r.Percentile(1))
+	fmt.Fprintf(w, "Errors:     %d (%.2f%%)\n", r.Errors, 100*r.ErrorRate())
+}
+
+// runLoadTest runs the gateway against a local mock aggregator and menu
+// API, writes a report to w and returns the process exit code: 0 when
+// every request was answered as expected.
+func runLoadTest(w io.Writer, opts loadTestOptions) int {
+	// The server and menu API settings are replaced by the mocks, so they
+	// are validated as such: typically they are unset here
+	cfg, problems := readConfig()
+	mocked := withLoadTestMocks(*cfg, "127.0.0.1:1", "127.0.0.1:1")
+	if problems = append(problems, mocked.validate()...); len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(w, "Config error: %v\n", p)
+		}
+		fmt.Fprintf(w, "Invalid configuration (%d problems), run with --validate-config for a full report\n", len(problems))
+		return 1
+	}
+	cfg.MonitoringMode = monitoringDisabled
+	currentConfig.Store(cfg)
+	setupRuntime()
+	defer cleanup()
+
+	report, err := loadTest(opts)
+	if err != nil {
+		fmt.Fprintf(w, "Load test failed: %v\n", err)
+		return 1
+	}
+	report.write(w)
+	if report.Errors > 0 {
+		return 1
+	}
+	return 0
+}
+
+// loadTest points AppConfig at a mock aggregator and menu API, connects
+// to the former and plays opts.Rate sessions per second through the
+// gateway for opts.Duration
+func loadTest(opts loadTestOptions) (loadTestReport, error) {
+	if opts.Rate <= 0 || opts.Duration <= 0 {
+		return loadTestReport{}, fmt.Errorf("rate and duration must be positive")
+	}
+	if opts.Steps < 2 {
+		return loadTestReport{}, fmt.Errorf("a session takes at least 2 steps, the dial and the exit")
+	}
+
+	menuAPI, err := startLoadTestMenuAPI()
+	if err != nil {
+		return loadTestReport{}, err
+	}
+	defer menuAPI.Close()
+
+	aggregator, err := startLoadTestAggregator()
+	if err != nil {
+		return loadTestReport{}, err
+	}
+	defer aggregator.close()
+
+	cfg := withLoadTestMocks(*AppConfig(), aggregator.listener.Addr().String(), menuAPI.Addr)
+	currentConfig.Store(&cfg)
+
+	if err := connect(); err != nil {
+		return loadTestReport{}, err
+	}
+	stopChan = make(chan struct{})
+	listening := make(chan struct{})
+	go func() {
+		defer close(listening)
+		listenToTCPMessages()
+	}()
+	defer func() {
+		close(stopChan)
+		closeConn()
+		<-listening
+		setConn(nil, "")
+		linkUp.Store(false)
+	}()
+
+	var (
+		mu     sync.Mutex
+		report loadTestReport
+		wg     sync.WaitGroup
+	)
+	record := func(latencies []time.Duration, requests int, failed bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		report.Sessions++
+		report.Requests += requests
+		report.Latencies = append(report.Latencies, latencies...)
+		if failed {
+			report.Errors++
+		}
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+	defer ticker.Stop()
+	for n := 1; time.Since(start) < opts.Duration; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			record(aggregator.runSession(n, opts.Steps))
+		}(n)
+		<-ticker.C
+	}
+	wg.Wait()
+	report.Elapsed = time.Since(start)
+
+	sort.Slice(report.Latencies, func(i, j int) bool { return report.Latencies[i] < report.Latencies[j] })
+	return report, nil
+}
+
+// withLoadTestMocks returns cfg pointed at the mock aggregator and menu API
+// listening on the given addresses, without the routing that would send the
+// load test's short code elsewhere
+func withLoadTestMocks(cfg Config, aggregatorAddr, menuAPIAddr string) Config {
+	cfg.ServerNetwork = "tcp"
+	cfg.ServerHost, cfg.ServerPort, _ = net.SplitHostPort(aggregatorAddr)
+	cfg.Username, cfg.Password, cfg.ClientID = "loadtest", "loadtest", "loadtest"
+	cfg.MenuAPIURL = "http://" + menuAPIAddr + "/"
+	cfg.Routes = nil
+	cfg.Providers = nil
+	cfg.TestAccounts = TestAccounts{}
+	cfg.AllowedShortCodes = nil
+	return cfg
+}
+
+// startLoadTestMenuAPI serves a menu that continues for any input but "0",
+// which ends the session
+func startLoadTestMenuAPI() (*http.Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the mock menu API: %w", err)
+	}
+	server := &http.Server{
+		Addr: listener.Addr().String(),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req USSDMenuRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			cont := req.Input != "0"
+			message := "Load test menu\n1. Next\n0. Exit"
+			if !cont {
+				message = "Goodbye"
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(USSDMenuResponse{Message: message, Continue: &cont})
+		}),
+	}
+	go server.Serve(listener)
+	return server, nil
+}
+
+// loadTestAggregator plays the aggregator for the gateway's connection,
+// passing each response to the session awaiting it
+type loadTestAggregator struct {
+	listener net.Listener
+
+	mu      sync.Mutex
+	conn    net.Conn
+	waiting map[string]chan USSDResponse
+}
+
+// startLoadTestAggregator listens for the gateway on a loopback port
+func startLoadTestAggregator() (*loadTestAggregator, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to start the mock aggregator: %w", err)
+	}
+	a := &loadTestAggregator{listener: listener, waiting: make(map[string]chan USSDResponse)}
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			a.mu.Lock()
+			a.conn = c
+			a.mu.Unlock()
+			go a.serve(c)
+		}
+	}()
+	return a, nil
+}
+
+// close stops listening and drops the gateway's connection
+func (a *loadTestAggregator) close() {
+	a.listener.Close()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn != nil {
+		a.conn.Close()
+	}
+}
+
+// send writes body to the gateway in the aggregator's framing
+func (a *loadTestAggregator) send(body []byte) error {
+	header := make([]byte, 19)
+	copy(header[:16], "LOADTEST")
+	copy(header[16:], fmt.Sprintf("%03d", len(body)+16))
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.conn == nil {
+		return fmt.Errorf("gateway not connected")
+	}
+	_, err := a.conn.Write(append(header, body...))
+	return err
+}
+
+// serve answers logons and enquire links from the gateway on c and hands
+// out its USSD responses until c closes
+func (a *loadTestAggregator) serve(c net.Conn) {
+	r := bufio.NewReader(c)
+	for {
+		// Unlike the aggregator's frames, the length in createHeader
+		// counts the whole header
+		_, body, err := readFrame(r, frameHeaderSize, 0)
+		if err != nil {
+			return
+		}
+		body = bytes.TrimLeft(body, "\x00")
+
+		switch frameType(body) {
+		case "AUTHRequest":
+			a.send([]byte("<AUTHResponse><result>0</result></AUTHResponse>"))
+		case "ENQRequest":
+			a.send([]byte("<ENQResponse/>"))
+		case "USSDResponse":
+			var response USSDResponse
+			if err := xml.Unmarshal(body, &response); err != nil {
+				continue
+			}
+			a.mu.Lock()
+			ch := a.waiting[response.RequestID]
+			a.mu.Unlock()
+			if ch != nil {
+				ch <- response
+			}
+		}
+	}
+}
+
+// runSession dials the load test short code as the nth subscriber, picks
+// "1", "2"... until the last of steps, where it picks "0", and returns the
+// latency of each answered request, how many were sent and whether any
+// went unanswered or was answered unexpectedly
+func (a *loadTestAggregator) runSession(n, steps int) ([]time.Duration, int, bool) {
+	requestID := fmt.Sprintf("LT%08d", n)
+	responses := make(chan USSDResponse, 1)
+	a.mu.Lock()
+	a.waiting[requestID] = responses
+	a.mu.Unlock()
+	defer func() {
+		a.mu.Lock()
+		delete(a.waiting, requestID)
+		a.mu.Unlock()
+	}()
+
+	timeout := AppConfig().ResponseBudget + time.Second
+	var latencies []time.Duration
+	for step := 1; step <= steps; step++ {
+		req := USSDRequest{
+			RequestID: requestID,
+			MSISDN:    fmt.Sprintf("23490%08d", n),
+			StarCode:  loadTestShortCode,
+			ClientID:  "loadtest",
+			Phase:     2,
+			DCS:       15,
+			MsgType:   4,
+			UserData:  strconv.Itoa(step - 1),
+		}
+		switch {
+		case step == 1:
+			req.MsgType = msgTypeBegin
+			req.UserData = "*" + loadTestShortCode + "#"
+		case step == steps:
+			req.UserData = "0"
+		}
+		body, _ := xml.Marshal(req)
+
+		sent := time.Now()
+		if err := a.send(body); err != nil {
+			return latencies, step, true
+		}
+		select {
+		case response := <-responses:
+			latencies = append(latencies, time.Since(sent))
+			if (response.EndOfSession == 1) != (step == steps) {
+				return latencies, step, true
+			}
+		case <-time.After(timeout):
+			return latencies, step, true
+		}
+	}
+	return latencies, steps, false
+}
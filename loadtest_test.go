@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadTestBurst(t *testing.T) {
+	withConfig(t, func(cfg *Config) {})
+
+	report, err := loadTest(loadTestOptions{Rate: 50, Duration: 300 * time.Millisecond, Steps: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Sessions == 0 || report.Throughput() <= 0 {
+		t.Fatalf("no throughput: %d sessions, %.1f responses/s", report.Sessions, report.Throughput())
+	}
+	if report.Errors != 0 {
+		t.Fatalf("%d errors in %d requests", report.Errors, report.Requests)
+	}
+	if report.Requests != 3*report.Sessions {
+		t.Errorf("requests = %d, want %d for %d sessions", report.Requests, 3*report.Sessions, report.Sessions)
+	}
+
+	var out strings.Builder
+	report.write(&out)
+	for _, want := range []string{"Throughput:", "p95", "Errors:     0 (0.00%)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("report missing %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestLoadTestNeedsAnExitStep(t *testing.T) {
+	if _, err := loadTest(loadTestOptions{Rate: 1, Duration: time.Second, Steps: 1}); err == nil {
+		t.Fatal("a single-step load test was accepted")
+	}
+}
+
+func TestLoadTestRejectsInvalidConfig(t *testing.T) {
+	t.Setenv("SEND_RATE", "fast")
+
+	var out strings.Builder
+	if code := runLoadTest(&out, loadTestOptions{Rate: 1, Duration: time.Second, Steps: 2}); code == 0 {
+		t.Fatal("load test ran with an invalid configuration")
+	}
+	if !strings.Contains(out.String(), "SEND_RATE") {
+		t.Errorf("report does not name the invalid setting:\n%s", out.String())
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Requests seen by withLogSample, used to pick 1 in LogSampleRate
+var logSampleCount atomic.Int64
+
+type logSampleKey struct{}
+
+// withLogSample decides whether the request handled under ctx has its
+// bodies logged in full and returns a context carrying the decision. The
+// first of every LogSampleRate requests is sampled.
+func withLogSample(ctx context.Context) context.Context {
+	n := int64(AppConfig().LogSampleRate)
+	sampled := n <= 1 || (logSampleCount.Add(1)-1)%n == 0
+	return context.WithValue(ctx, logSampleKey{}, sampled)
+}
+
+// logSampled reports whether bodies should be logged in full for the
+// request handled under ctx; requests that were never sampled always are
+func logSampled(ctx context.Context) bool {
+	sampled, ok := ctx.Value(logSampleKey{}).(bool)
+	return sampled || !ok
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Result of the last log storage probe, reported by the health endpoint
+var logStorage struct {
+	mu  sync.Mutex
+	err error
+}
+
+// logDirs returns the directories the application loggers write to
+func logDirs() []string {
+	dirs := []string{"log", "errors", "requests", "menu", "frames"}
+	for i, dir := range dirs {
+		dirs[i] = filepath.Join(AppConfig().LogPath, dir)
+	}
+	return dirs
+}
+
+// probeLogStorage checks that every log directory is still writable and
+// records the result for logStorageErr. Failures go to stderr since the
+// log files themselves may be what is broken.
+func probeLogStorage() error {
+	var err error
+	for _, dir := range logDirs() {
+		if err = checkDirWritable(dir); err != nil {
+			err = fmt.Errorf("log directory %s is not writable: %w", dir, err)
+			break
+		}
+	}
+
+	logStorage.mu.Lock()
+	was := logStorage.err
+	logStorage.err = err
+	logStorage.mu.Unlock()
+
+	switch {
+	case err != nil && was == nil:
+		log.Printf("Log storage failing: %v", err)
+	case err == nil && was != nil:
+		log.Printf("Log storage recovered")
+	}
+	return err
+}
+
+// logStorageErr returns the error found by the last probe, nil while the
+// log directories are writable
+func logStorageErr() error {
+	logStorage.mu.Lock()
+	defer logStorage.mu.Unlock()
+	return logStorage.err
+}
+
+// runLogStorageProbe probes the log directories every interval until stop
+// is closed
+func runLogStorageProbe(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			probeLogStorage()
+		}
+	}
+}
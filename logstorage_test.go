@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	systemHealthController "github.com/abeloha/USSDTCP/pkg/controllers/system_health"
+	"github.com/gin-gonic/gin"
+)
+
+// health calls the system health endpoint and returns its JSON body
+func health(t *testing.T) map[string]interface{} {
+	t.Helper()
+	controller := &systemHealthController.SystemHealthController{LogStorage: logStorageErr, Sessions: Sessions.Snapshot, Monitoring: monitoringStatus}
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest("GET", "/api/system-health", nil)
+	controller.Index(ctx)
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("health body %s: %v", w.Body, err)
+	}
+	return body
+}
+
+func TestLogStorageProbe(t *testing.T) {
+	// A regular file where the log directory should be can't be written to,
+	// whoever the tests run as
+	blocked := filepath.Join(t.TempDir(), "logs")
+	if err := os.WriteFile(blocked, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		logPath string
+		storage string
+		status  string
+	}{
+		{"unwritable", blocked, "failing", "degraded"},
+		{"writable", t.TempDir(), "ok", "healthy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Probe again once the real log path is back
+			t.Cleanup(func() { probeLogStorage() })
+			withConfig(t, func(cfg *Config) { cfg.LogPath = tt.logPath })
+
+			if err := probeLogStorage(); (err != nil) != (tt.storage == "failing") {
+				t.Errorf("probeLogStorage() = %v", err)
+			}
+			body := health(t)
+			if body["log_storage"] != tt.storage || body["status"] != tt.status {
+				t.Errorf("health reported log_storage %v and status %v, want %s and %s", body["log_storage"], body["status"], tt.storage, tt.status)
+			}
+		})
+	}
+}
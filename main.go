@@ -1,71 +1,109 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"encoding/json"
 	"encoding/xml"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	errorsController "github.com/abeloha/USSDTCP/pkg/controllers/errors"
+	pushController "github.com/abeloha/USSDTCP/pkg/controllers/push"
+	simulateController "github.com/abeloha/USSDTCP/pkg/controllers/simulate"
+	statsController "github.com/abeloha/USSDTCP/pkg/controllers/stats"
 	systemHealthController "github.com/abeloha/USSDTCP/pkg/controllers/system_health"
-	"github.com/abeloha/USSDTCP/pkg/jobs"
 	"github.com/abeloha/USSDTCP/pkg/logger"
+	"github.com/abeloha/USSDTCP/pkg/middleware"
+	"github.com/abeloha/USSDTCP/pkg/ratelimit"
+	"github.com/abeloha/USSDTCP/pkg/session"
+	"github.com/abeloha/USSDTCP/pkg/stats"
 	"github.com/gin-gonic/gin"
-	"github.com/joho/godotenv"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// The configuration in force, swapped whole on reload; read it through
+// AppConfig
+var currentConfig atomic.Pointer[Config]
+
+// AppConfig returns the configuration in force
+func AppConfig() *Config {
+	return currentConfig.Load()
+}
+
 var (
-	ServerAddress string
-	Username      string
-	Password      string
-	ClientID      string
 	AppLogger     *logger.Logger
 	ErrorLogger   *logger.Logger
 	RequestLogger *logger.Logger
 	MenuLogger    *logger.Logger
+	FrameLogger   *logger.Logger // frames from the server that could not be parsed
+	Sessions      *session.Store
 
+	// Latest ERROR entries of all loggers, served by GET /api/errors
+	RecentErrors *logger.Ring
+
+	// Paces every frame written to the server
+	sendLimiter *ratelimit.Limiter
+	sendRamp    ratelimit.Ramp // restarted on each (re)connection
 
 	conn       net.Conn
-	connMutex  sync.Mutex // Ensures safe access to `conn`
+	connMutex  sync.Mutex // Ensures safe access to `conn` and `serverSessionID`; use getConn/setConn
 	stopChan   chan struct{}
 )
 
-func init() {
-	// Load .env file
-	if err := godotenv.Load(); err != nil {
-		log.Fatal("Error loading .env file")
+// setup loads the configuration and initializes the loggers
+func setup() {
+	cfg, problems := loadConfig()
+	if len(problems) > 0 {
+		for _, p := range problems {
+			log.Printf("Config error: %v", p)
+		}
+		log.Fatalf("Invalid configuration (%d problems), run with --validate-config for a full report", len(problems))
 	}
+	currentConfig.Store(cfg)
+	setupRuntime()
+}
 
-	// Read environment variables
-	host := os.Getenv("SERVER_HOST")
-	port := os.Getenv("SERVER_PORT")
-	ServerAddress = net.JoinHostPort(host, port)
-
-	Username = os.Getenv("USERNAME")
-	Password = os.Getenv("PASSWORD")
-	ClientID = os.Getenv("CLIENT_ID")
-
-	// Validate required environment variables
-	requiredVars := []string{"SERVER_HOST", "SERVER_PORT", "USERNAME", "PASSWORD", "CLIENT_ID"}
-	for _, v := range requiredVars {
-		if os.Getenv(v) == "" {
-			log.Fatalf("Missing required environment variable: %s", v)
-		}
+// setupRuntime applies AppConfig to the shared state and initializes the
+// loggers
+func setupRuntime() {
+	applyMonitoring()
+	logger.SetMaxBodySize(func() int { return AppConfig().LogMaxBody })
+	logger.CountDroppedLines(&stats.LogLinesDropped)
+	if err := logger.SetRedactions(AppConfig().LogRedact); err != nil {
+		log.Fatalf("Invalid log_redact pattern: %v", err)
 	}
+	Sessions = session.NewStore(AppConfig().SessionTTL)
+	Sessions.SetCapacity(AppConfig().MaxSessions, onSessionEvicted)
+	evictedSessions = newRecentIDs(AppConfig().MaxSessions)
+	if AppConfig().PostSendHookURL != "" {
+		hook := webhookHook(AppConfig().PostSendHookURL, AppConfig().PostSendHookTimeout)
+		postSendHooks = newHookPool(hook, AppConfig().PostSendHookWorkers, AppConfig().PostSendHookQueue)
+	}
+	sendLimiter = ratelimit.New(AppConfig().SendRate, AppConfig().SendBurst)
 
 	// Initialize logger
-	logPath := os.Getenv("LOG_PATH")
-	if logPath == "" {
-		logPath = "./logs" // default path
-	}
+	logPath := AppConfig().LogPath
 	var err error
 	AppLogger, err = logger.New(logPath + "/log")
 	if err != nil {
@@ -86,14 +124,113 @@ func init() {
 	if err != nil {
 		log.Fatalf("Failed to initialize menu logger: %v", err)
 	}
+
+	FrameLogger, err = logger.New(logPath + "/frames")
+	if err != nil {
+		log.Fatalf("Failed to initialize frame logger: %v", err)
+	}
+	applyLogDebug()
+	applyLogTimeFormat()
+	keepRecentErrors()
+	if err := applyLogSink(); err != nil {
+		log.Fatalf("Failed to connect to syslog: %v", err)
+	}
+}
+
+// namedLoggers returns the application loggers by the names LOG_DEBUG uses
+func namedLoggers() map[string]*logger.Logger {
+	return map[string]*logger.Logger{
+		"app":     AppLogger,
+		"error":   ErrorLogger,
+		"request": RequestLogger,
+		"menu":    MenuLogger,
+		"frame":   FrameLogger,
+	}
+}
+
+// applyLogDebug enables DEBUG output on the loggers named by LOG_DEBUG and
+// disables it on the others
+func applyLogDebug() {
+	for name, l := range namedLoggers() {
+		l.SetDebug(AppConfig().debugEnabled(name))
+	}
+}
+
+// applyLogTimeFormat sets the timestamp format of each logger
+func applyLogTimeFormat() {
+	for name, l := range namedLoggers() {
+		l.SetTimeFormat(AppConfig().logTimeFormat(name))
+	}
+}
+
+// keepRecentErrors has every logger copy its ERROR entries into RecentErrors
+func keepRecentErrors() {
+	RecentErrors = logger.NewRing(AppConfig().RecentErrors)
+	for name, l := range namedLoggers() {
+		l.KeepErrors(RecentErrors, name)
+	}
+}
+
+// applyLogSink points the loggers at syslog when LOG_SINK asks for it
+func applyLogSink() error {
+	if AppConfig().LogSink == logSinkFile {
+		return nil
+	}
+	network, addr, err := AppConfig().syslogAddress()
+	if err != nil {
+		return err
+	}
+	for name, l := range namedLoggers() {
+		if err := l.UseSyslog(network, addr, "ussdtcp-"+name, AppConfig().LogSink == logSinkBoth); err != nil {
+			return fmt.Errorf("%s logger: %v", name, err)
+		}
+	}
+	return nil
 }
 
-// Generates a unique Request ID (timestamp-based)
+// Returned by readResponse when no message arrived before the read deadline
+var errReadTimeout = errors.New("read timeout")
+
+// Returned by getMenuWithinBudget when the menu API did not answer in time
+var errResponseBudgetExceeded = errors.New("menu API response budget exceeded")
+
+// Returned by readResponse for a frame declaring a body over MaxFrameSize
+var errFrameTooLarge = errors.New("frame too large")
+
+// Largest body the 3-digit length of a frame header can declare, the
+// length counting the 16-byte session ID too
+const maxFrameBody = 999 - 16
+
+// Returned by sendMessage when a frame could not be written within WriteTimeout
+var errWriteTimeout = errors.New("write timeout")
+
+// Returned by logon when the handshake did not complete within LogonTimeout
+var errLogonTimeout = errors.New("logon timed out")
+
+// Returned by checkUSSDRequest for a request that parsed but cannot be handled
+var errUnprocessableRequest = errors.New("unprocessable request")
+
+// Reported to monitoring for a request whose short code is not in
+// ALLOWED_SHORT_CODES
+var errShortCodeNotAllowed = errors.New("short code not allowed")
+
+// Returned by getUssdMenu when the response omits "continue" and
+// MENU_MISSING_CONTINUE is "error"
+var errMissingContinue = errors.New("menu API response has no continue field")
+
+// Sequence keeping request IDs generated within the same millisecond apart
+var requestSeq atomic.Uint32
+
+// Generates a unique Request ID: 13 digits of milliseconds and 3 of
+// sequence, filling the 16-byte header field
 func generateRequestID() string {
-	return fmt.Sprintf("%010d", time.Now().UnixNano()/int64(time.Millisecond))
+	return fmt.Sprintf("%013d%03d", time.Now().UnixMilli(), requestSeq.Add(1)%1000)
 }
 
-// Creates a properly formatted 19-byte header
+// Creates a properly formatted 19-byte header.
+// Session IDs shorter than the 16-byte field are padded with NUL bytes on
+// the wire. The unpadded form returned by headerSessionID is the canonical
+// one, used for comparisons and as a key.
 func createHeader(sessionID string, length int) []byte {
 	header := make([]byte, 32)
 	copy(header[:16], sessionID)             // Use the provided session ID
@@ -104,346 +241,942 @@ func createHeader(sessionID string, length int) []byte {
 
 // Utility function to send a message
 func sendMessage(conn net.Conn, message []byte, sessionID string) error {
+	health := connHealthOf(conn)
+	health.outstanding.Add(1)
+	err := writeFrame(conn, message, sessionID)
+	health.sendDone(err)
+	return err
+}
+
+// writeFrame frames message and writes it to conn
+func writeFrame(conn net.Conn, message []byte, sessionID string) error {
 	fullXML := message
 	header := createHeader(sessionID, len(fullXML)+32) // 16-byte session ID
 	fullMessage := append(header, fullXML...)
 
+	// Stay within the aggregator's messages-per-second limit, and under the
+	// ramp-up rate just after connecting
+	sendRamp.Wait()
+	sendLimiter.Wait()
+
 	// Log the message
-	AppLogger.Info("[SEND] Request:\n%s\n", string(fullXML))
-	_, err := conn.Write(fullMessage)
+	AppLogger.Info("[SEND] Request:\n%s\n", logger.Body(fullXML))
+
+	// Bound the write so a peer that stops reading cannot hang the caller
+	if err := conn.SetWriteDeadline(time.Now().Add(AppConfig().WriteTimeout)); err != nil {
+		return fmt.Errorf("failed to set write deadline: %v", err)
+	}
+	defer conn.SetWriteDeadline(time.Time{}) // Clear deadline after writing
+
+	n, err := conn.Write(fullMessage)
+	stats.BytesSent.Add(n)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		// Closing the connection makes the listener notice the stall and reconnect
+		conn.Close()
+		return fmt.Errorf("%w after %s: %v", errWriteTimeout, AppConfig().WriteTimeout, err)
+	}
+	if err == nil {
+		stats.Sends.Mark()
+	}
 	return err
 }
 
-// Reads a response and logs the raw data
+// headerSessionID returns the session ID in a frame header without its NUL
+// padding
+func headerSessionID(header []byte) string {
+	return string(bytes.TrimRight(header[:16], "\x00"))
+}
+
+// Length of the header of the server's frames: the 16-byte session ID and
+// a 3-digit length counting the session ID and the body
+const frameHeaderSize = 19
+
+// Buffered readers of the server connections, keyed by net.Conn. Frames are
+// parsed out of the buffered stream, so several frames arriving in one TCP
+// segment, or a frame split across segments, are read in order.
+var connReaders sync.Map
+
+// frameReader returns the buffered reader of c, created on first use
+func frameReader(c net.Conn) *bufio.Reader {
+	if r, ok := connReaders.Load(c); ok {
+		return r.(*bufio.Reader)
+	}
+	r, _ := connReaders.LoadOrStore(c, bufio.NewReader(c))
+	return r.(*bufio.Reader)
+}
+
+// How long readResponse waits for a frame before returning errReadTimeout
+const readDeadline = 5 * time.Second
+
+// Reads the next frame from the server, returning its header and body. A
+// frame is only consumed once it has fully arrived; when the deadline passes
+// first, errReadTimeout is returned and the bytes received so far stay
+// buffered for the next call.
 func readResponse(conn net.Conn) ([]byte, []byte, error) {
 	// Set a read timeout to prevent indefinite blocking
-	err := conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	err := conn.SetReadDeadline(time.Now().Add(readDeadline))
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to set read deadline: %v", err)
 	}
 	defer conn.SetReadDeadline(time.Time{}) // Clear deadline after reading
 
-	header := make([]byte, 19)
-	_, err = conn.Read(header)
+	header, body, err := readFrame(frameReader(conn), 16, AppConfig().MaxFrameSize)
+	if errors.Is(err, errFrameTooLarge) {
+		length, _ := strconv.Atoi(string(header[16:]))
+		FrameLogger.Error("[conn %s] Rejecting frame declaring %d body bytes, over MAX_FRAME_SIZE %d: header %q", connLabel(conn), length-16, AppConfig().MaxFrameSize, header)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	stats.BytesReceived.Add(len(header) + len(body))
+	return header, body, nil
+}
+
+// readFrame reads the next frame from r: a 16-byte session ID, a 3-digit
+// length and the body. counted is how much of the header the length counts
+// besides the body: the session ID (16) in the server's frames, the whole
+// header in ours (frameHeaderSize; the padding createHeader adds then
+// starts the body). A frame is only consumed once it has fully arrived, and
+// one declaring a body over maxBody (0 for no limit) is rejected, with its
+// header, before it is waited for.
+func readFrame(r *bufio.Reader, counted, maxBody int) ([]byte, []byte, error) {
+	header, err := r.Peek(frameHeaderSize)
 	if err != nil {
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return nil, nil, fmt.Errorf("read timeout: no message received")
+			return nil, nil, fmt.Errorf("%w: no message received", errReadTimeout)
 		}
 		return nil, nil, fmt.Errorf("failed to read header: %v", err)
 	}
 
 	length, err := strconv.Atoi(string(header[16:]))
-	if err != nil {
-		return nil, nil, fmt.Errorf("invalid message length: %v", err)
+	if err != nil || length < counted {
+		return nil, nil, fmt.Errorf("invalid message length %q", header[16:])
+	}
+	// Checked before waiting for (and buffering) the body
+	if size := length - counted; maxBody > 0 && size > maxBody {
+		return append([]byte(nil), header...), nil, fmt.Errorf("%w: %d body bytes declared, limit %d", errFrameTooLarge, size, maxBody)
 	}
 
-	body := make([]byte, length-16) // Subtract session ID length
-	_, err = conn.Read(body)
+	// The body follows the header
+	frame, err := r.Peek(frameHeaderSize + length - counted)
 	if err != nil {
 		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-			return nil, nil, fmt.Errorf("read timeout: incomplete message")
+			return nil, nil, fmt.Errorf("%w: incomplete message", errReadTimeout)
 		}
 		return nil, nil, fmt.Errorf("failed to read body: %v", err)
 	}
+	frame = append([]byte(nil), frame...) // Peek's slice is only valid until the next read
+	r.Discard(len(frame))
 
-	return header, body, nil
+	return frame[:frameHeaderSize], frame[frameHeaderSize:], nil
 }
 
 func main() {
+	validateConfig := flag.Bool("validate-config", false, "validate the configuration, print a report and exit")
+	loadTest := flag.Bool("loadtest", false, "run synthetic sessions through the gateway against a local mock aggregator and menu API, print a report and exit")
+	flag.Float64Var(&loadTestFlags.Rate, "loadtest-rate", 20, "sessions started per second by --loadtest")
+	flag.DurationVar(&loadTestFlags.Duration, "loadtest-duration", 10*time.Second, "how long --loadtest keeps starting sessions")
+	flag.IntVar(&loadTestFlags.Steps, "loadtest-steps", 3, "requests per --loadtest session, the dial included")
+	flag.Parse()
+
+	if *validateConfig {
+		os.Exit(runValidateConfig(os.Stdout))
+	}
+	if *loadTest {
+		os.Exit(runLoadTest(os.Stdout, loadTestFlags))
+	}
 
+	setup()
 	defer cleanup()
 
+	shutdownTracing, err := setupTracing(AppConfig().TracingExporter)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	AppLogger.Info("Starting USSD TCP Application")
 
 
-	// Start Gin HTTP server in a separate Goroutine
+	// Create a channel to signal when to stop listening, before anything
+	// that may use it starts
+	stopChan = make(chan struct{})
+
+	// Start Gin HTTP server in a separate Goroutine. /readyz answers 503
+	// until the link is confirmed below.
 	go startHTTPServer()
 
-	// Connect to server
-	var err error
-	conn, err = net.Dial("tcp", ServerAddress)
-	if err != nil {
+	// Connect to server and log on, waiting for it to come up if needed
+	if err := connectWithRetry(AppConfig().StartupConnectAttempts, nil); err != nil {
+		AppLogger.Error("Failed to connect to server %s: %v", AppConfig().ServerAddress(), err)
+		ErrorLogger.Error("Failed to connect to server %s: %v", AppConfig().ServerAddress(), err)
 		log.Fatalf("Error connecting to server: %v", err)
-		AppLogger.Error("Failed to connect to server: %v", err)
 	}
-	defer conn.Close()
+	defer closeConn()
+	defer close(stopChan)
 
-	// Generate a unique Request ID (timestamp-based)
-	requestID := generateRequestID()
+	// Goroutine for continuous TCP message listening
+	go listenToTCPMessages()
 
-	// Send Logon Request
-	logon := LogonRequest{
-		RequestID:     requestID,
-		Username:      Username,
-		Password:      Password,
-		ApplicationID: ClientID,
-	}
+	// Confirm the link with an enquire-link right away; its ack makes the
+	// gateway ready
+	sendEnquireLink()
 
-	logonXML, _ := xml.Marshal(logon)
-	fmt.Println("Sending Logon Request...")
-	if err := sendMessage(conn, logonXML, requestID); err != nil {
-		log.Fatalf("Failed to send logon: %v", err)
-		AppLogger.Error("Failed to send logon: %v", err)
-	}
+	// Drop sessions the aggregator never closed
+	go Sessions.RunExpiry(AppConfig().SessionTTL/2, stopChan, onSessionExpired)
 
-	// Read Logon Response
-	header, body, err := readResponse(conn)
-	if err != nil {
-		AppLogger.Error("Error reading response: %v", err)
-		ErrorLogger.Error("Error reading response: %v", err)
-		log.Fatalf("Error reading response: %v", err)
-	}
+	// Notice a full disk or lost log volume while running
+	go runLogStorageProbe(AppConfig().LogProbeInterval, stopChan)
 
-	// Log response
-	AppLogger.Info("[FINAL RESPONSE] Header: %s", string(header))
-	AppLogger.Info("[FINAL RESPONSE] Body: %s", string(body))
-
-	// Extract session ID from header (First 16 bytes)
-	sessionID := string(header[:16])
-	AppLogger.Info("Extracted Session ID: %s", sessionID)
+	// Count responses the server never acknowledged
+	if AppConfig().AckFrame != "" {
+		go runAckTracking(AppConfig().AckTimeout, stopChan)
+	}
 
+	// Restart the listen loop should it stall with the link up
+	if AppConfig().ListenStallThreshold > 0 {
+		go runListenWatchdog(AppConfig().ListenStallThreshold, stopChan)
+	}
 
-	// Create a channel to signal when to stop listening
-	stopChan = make(chan struct{})
-	defer close(stopChan)
+	// Replay metrics persisted while the monitoring service was down
+	go runMetricReplay(stopChan)
 
-	// Goroutine for continuous TCP message listening
-	go listenToTCPMessages()
+	// Swap in routing, log levels and messages on SIGHUP
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go runConfigReload(sighup, stopChan)
 
 	// Periodic Enquire Link Request
-	ticker := time.NewTicker(20 * time.Second)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		enquireLink := EnquireLink{}
-		enqXML, _ := xml.Marshal(enquireLink)
-		fmt.Println("Sending Enquire Link Request...")
-		if err := sendMessage(conn, enqXML, sessionID); err != nil {
-			log.Fatalf("Failed to send Enquire Link: %v", err)
-		}
-	}
+	runEnquireLinks(stopChan)
 }
 
 
 // Starts the Gin HTTP server
 func startHTTPServer() {
+	r := newRouter()
+
+	port := AppConfig().HTTPPort
+	log.Printf("Starting server on port %v", port)
+	r.Run(":" + port)
+}
+
+// newRouter returns the HTTP API routes
+func newRouter() *gin.Engine {
 	r := gin.Default()
 
 	// Initialize controller
 	controller := &systemHealthController.SystemHealthController{
+		LogStorage:      logStorageErr,
+		LogLinesDropped: stats.LogLinesDropped.Load,
+		Ready:           ready,
+		Sessions:        Sessions.Snapshot,
+		Monitoring:      monitoringStatus,
+		HostUsageTTL:    AppConfig().HealthCacheTTL,
 	}
 	r.GET("/api/system-health", controller.Index)
+	r.GET("/readyz", controller.Readyz)
 
+	statsCtrl := &statsController.StatsController{
+		ActiveSessions: Sessions.Len,
+		Sessions:       Sessions.Snapshot,
+		Connections:    connectionHealths,
+	}
+	r.GET("/api/stats", statsCtrl.Index)
+	r.GET("/metrics", statsCtrl.Metrics)
 
-	port := os.Getenv("PORT")
-	log.Printf("Starting server on port %v", port)
-	r.Run(":" + port)
+	// Authenticated routes
+	api := r.Group("/api", middleware.APIToken(AppConfig().APIToken))
+
+	push := &pushController.PushController{
+		Push: pushUSSD,
+	}
+	api.POST("/push", push.Store)
+
+	recentErrors := &errorsController.ErrorsController{
+		Recent: RecentErrors.Recent,
+	}
+	api.GET("/errors", recentErrors.Index)
+
+	simulate := &simulateController.SimulateController{
+		Step: simulateStep,
+	}
+	api.POST("/simulate", simulate.Store)
+
+	return r
 }
 
 // Continuously listens for TCP messages
 func listenToTCPMessages() {
-for {
+	generation := listenGeneration.Load()
+	for {
+			// Replaced by a fresh loop after the watchdog found this one stalled
+			if listenGeneration.Load() != generation {
+				return
+			}
+			listenBeat.Store(time.Now().UnixNano())
+
 			select {
 			case <-stopChan:
 				return
 			default:
-				header, body, err := readResponse(conn)
+				c := getConn()
+				header, body, err := readResponse(c)
+				if errors.Is(err, errReadTimeout) {
+					// Nothing received within the read deadline; keep listening
+					continue
+				}
 				if err != nil {
-					// AppLogger.Error("Error reading server message: %v", err)
-					// Add a small delay to prevent tight loop on continuous errors
-					time.Sleep(1 * time.Second)
+					select {
+					case <-stopChan:
+						return
+					default:
+					}
+					if listenGeneration.Load() != generation {
+						return
+					}
+					reconnect(err)
 					continue
 				}
 
-				AppLogger.Info("[SERVER MESSAGE] Body: %s", string(body))
+				enquireLinks.received()
+				AppLogger.Info("[SERVER MESSAGE] Body: %s", logger.Body(body))
 
 				// Process the response
-				go processServerMessage(header, body, conn)
+				go processServerMessage(header, body, c)
 			}
 		}
 }
 // processServerMessage checks if the message matches a USSDRequest, parses it, and logs it
 func processServerMessage(header []byte, body []byte, conn net.Conn) {
+	parseStart := time.Now()
+
+	switch frameType(body) {
+	case "ENQResponse":
+		if rtt, ok := enquireLinks.acked(); ok {
+			AppLogger.Info("Enquire Link acknowledged in %s", rtt)
+			connHealthOf(conn).enquireAcked(rtt)
+			if linkConfirmed.CompareAndSwap(false, true) {
+				AppLogger.Info("Link to the server confirmed, ready to serve")
+			}
+		}
+		return
+	case "ENQRequest":
+		if AppConfig().AnswerEnquireLinks {
+			answerEnquireLink(conn, headerSessionID(header))
+		}
+		return
+	case AppConfig().AbortFrame:
+		handleSessionAbort(header, body, conn)
+		return
+	case "USSDRequest":
+	case "":
+		logUnparsedFrame(header, body, conn, "not an XML document")
+		return
+	case AppConfig().AckFrame: // after "", which it is when unset
+		handleResponseAck(header, body, conn)
+		return
+	default:
+		logUnparsedFrame(header, body, conn, fmt.Sprintf("unexpected %s", frameType(body)))
+		return
+	}
 
 	// Try to parse the XML body into USSDRequest
 	var ussdRequest USSDRequest
 	err := xml.Unmarshal(body, &ussdRequest)
 	if err != nil || ussdRequest.XMLName.Local != "USSDRequest" {
 		// not a valid USSDRequest
+		logUnparsedFrame(header, body, conn, fmt.Sprintf("invalid USSDRequest: %v", err))
 		return
 	}
 
-	// Log the parsed USSDRequest
-	RequestLogger.Info("[INFO] Received USSD Request: %+v\n", ussdRequest)
+	stats.RequestsReceived.Add(1)
+	decodePayload(&ussdRequest)
+	decodeUserData(&ussdRequest)
+	parseTime := time.Since(parseStart)
+
+	// One trace per inbound request, spanning the menu API call and response
+	ctx, span := tracer().Start(context.Background(), "ussd.request", trace.WithAttributes(requestAttributes(ussdRequest)...))
+	defer span.End()
+
+	// One consolidated line summarising the request once it is handled
+	ctx, record := withRequestRecord(ctx, ussdRequest)
+	defer record.complete()
+	record.timed(stageParse, parseTime)
+	label := connLabel(conn)
+	record.Connection = label
+
+	// Log the parsed USSDRequest, in full for sampled requests only
+	ctx = withLogSample(ctx)
+	if logSampled(ctx) {
+		RequestLogger.Info("[INFO] [conn %s] Received USSD Request: %+v\n", label, ussdRequest)
+	} else {
+		RequestLogger.Info("[conn %s] Received USSD Request %s from %s for %s (msgtype %d)", label, ussdRequest.RequestID, ussdRequest.MSISDN, ussdRequest.StarCode, ussdRequest.MsgType)
+	}
+	RequestLogger.Debug("[conn %s] Raw USSD Request frame for %s: header %q body %s", label, ussdRequest.RequestID, header, logger.Body(body))
 
 	// Handle the USSD request
-	handleUSSDRequest(ussdRequest, conn)
+	handleUSSDRequest(ctx, ussdRequest, conn)
+}
+
+// frameType returns the name of the root XML element of body
+func frameType(body []byte) string {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return ""
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local
+		}
+	}
+}
+
+// Most bytes of an unparsed frame written to the frame log
+const maxRawFrameLog = 1024
+
+// logUnparsedFrame records a frame from the server that could not be
+// handled, with its raw bytes escaped (and capped at maxRawFrameLog), to
+// diagnose malformed frames from the aggregator
+func logUnparsedFrame(header, body []byte, conn net.Conn, reason string) {
+	raw := append(append([]byte(nil), header...), body...)
+	truncated := ""
+	if len(raw) > maxRawFrameLog {
+		truncated = fmt.Sprintf(" (first %d of %d bytes)", maxRawFrameLog, len(raw))
+		raw = raw[:maxRawFrameLog]
+	}
+	FrameLogger.Warn("[conn %s] Unparsed frame, %s: %q%s", connLabel(conn), reason, raw, truncated)
 }
 
 // handleUSSDRequest processes the parsed USSD request
-func handleUSSDRequest(req USSDRequest, conn net.Conn) {
+func handleUSSDRequest(ctx context.Context, req USSDRequest, conn net.Conn) {
+
+	if err := checkUSSDRequest(req); err != nil {
+		AppLogger.Error("Rejecting request %s from %s: %v", req.RequestID, req.MSISDN, err)
+		if AppConfig().ProtocolErrorCode != "" {
+			if err := sendErrorResponse(conn, req, AppConfig().ProtocolErrorCode, err); err != nil {
+				AppLogger.Error("Failed to send error response: %v", err)
+			}
+		}
+		return
+	}
 
 	if req.ErrorCode != "" {
-		AppLogger.Info("Error code: %s for %s with code %s\n", req.ErrorCode, req.MSISDN, req.RequestID)
+		handleErrorCode(ctx, req, conn)
+		return
+	}
+
+	if req.EndOfSession == 0 && isRetransmission(req) {
 		return
 	}
 
 	if req.EndOfSession == 0 {
-		handleMenuRequest(req, conn)
+		handleMenuRequest(ctx, req, conn)
 	} else {
 		AppLogger.Info("USSD session ended for %s with code %s\n", req.MSISDN, req.RequestID)
+		endSession(req.RequestID)
+	}
+}
+
+// checkUSSDRequest returns why a well-formed request cannot be processed,
+// or nil when it can
+func checkUSSDRequest(req USSDRequest) error {
+	if req.RequestID == "" {
+		return fmt.Errorf("%w: missing requestId", errUnprocessableRequest)
 	}
+	if req.MSISDN == "" {
+		return fmt.Errorf("%w: missing msisdn", errUnprocessableRequest)
+	}
+	// Only menu requests carry a meaningful message type
+	if req.ErrorCode == "" && req.EndOfSession == 0 && req.MsgType != 1 && req.MsgType != 4 {
+		return fmt.Errorf("%w: invalid msgtype %d", errUnprocessableRequest, req.MsgType)
+	}
+	return nil
 }
 
 // getUSSDMenu calls the API and logs the request/response
-func handleMenuRequest(req USSDRequest, conn net.Conn) {
+func handleMenuRequest(ctx context.Context, req USSDRequest, conn net.Conn) {
 
-	go UpdateMonitoringService(&req, "new", nil)
+	UpdateMonitoringService(&req, "new", nil)
 
-	if req.MsgType != 1 && req.MsgType != 4 {
-		AppLogger.Error("Invalid message type of %d for %s with code %s\n", req.MsgType, req.MSISDN, req.RequestID)
+	if req.UserData == "" {
+		if req.MsgType != msgTypeBegin {
+			repromptEmptyInput(ctx, req, conn)
+			return
+		}
+		AppLogger.Error("Invalid input of %s for %s with code %s\n", req.UserData, req.MSISDN, req.RequestID)
 		return
 	}
 
-	if req.UserData == "" {
-		AppLogger.Error("Invalid input of %s for %s with code %s\n", req.UserData, req.MSISDN, req.RequestID)
+	if !linkUp.Load() && !simulated(ctx) {
+		handleOfflineRequest(ctx, req, conn)
 		return
 	}
 
 	AppLogger.Info("[INFO] Continuing USSD session for %s with code %s\n", req.MSISDN, req.RequestID)
 
-	//apiResponse, err := getUSSDMenu(req)
-	apiResponse, err := getUssdMenu(req)
+	if !AppConfig().shortCodeAllowed(req.StarCode) {
+		AppLogger.Warn("Rejecting request %s from %s for short code %s, which is not allowed", req.RequestID, req.MSISDN, req.StarCode)
+		UpdateMonitoringService(&req, "Short code "+req.StarCode+" not allowed", errShortCodeNotAllowed)
+
+		response := newUSSDResponse(req, AppConfig().ShortCodeNotFoundMessage, false)
+		err := sendUSSDResponse(ctx, conn, response)
+		requestRecordFrom(ctx).responded(response, err)
+		if err != nil {
+			AppLogger.Error("Failed to send service not found response: %v", err)
+		}
+		return
+	}
+
+	if req.MsgType == msgTypeBegin && !applySessionLock(ctx, req, conn) {
+		return
+	}
+	if req.MsgType != msgTypeBegin && !checkEvicted(ctx, req, conn) {
+		return
+	}
+	if !trackSession(req) {
+		return
+	}
+	Sessions.SetConnection(req.RequestID, connLabel(conn))
+	if s, ok := Sessions.Get(req.RequestID); ok {
+		requestRecordFrom(ctx).stepped(s.Steps)
+	}
+	if req.MsgType != msgTypeBegin {
+		Sessions.AddInput(req.RequestID, req.UserData)
+	}
+
+	if req.MsgType == msgTypeBegin {
+		if route, ok := AppConfig().routeFor(req.StarCode); ok && route.InitialMenu != "" {
+			sendInitialMenu(ctx, req, conn, route)
+			return
+		}
+	}
+
+	// Bound the whole exchange by the response budget; cancelling the context
+	// also aborts a menu API call that is still in flight.
+	ctx, cancel := context.WithTimeout(ctx, AppConfig().ResponseBudget)
+	defer cancel()
+	ctx, untrack := trackMenuCall(ctx, req.RequestID, req.UserData)
+	defer untrack()
+
+	menuStart := time.Now()
+	apiResponse, err := getMenuWithinBudget(ctx, req)
+	requestRecordFrom(ctx).menuCalled(time.Since(menuStart), err)
+	if err != nil {
+		stats.MenuAPIFailures.Add(1)
+	} else {
+		stats.MenuAPISuccesses.Add(1)
+	}
+	if errors.Is(context.Cause(ctx), errSessionAborted) {
+		MenuLogger.Info("Menu API call for %s with code %s cancelled, the server aborted the session", req.MSISDN, req.RequestID)
+		return
+	}
+	if errors.Is(err, errResponseBudgetExceeded) {
+		MenuLogger.Warn("Menu API too slow for %s with code %s, asking subscriber to retry", req.MSISDN, req.RequestID)
+		UpdateMonitoringService(&req, "Response budget exceeded", err)
+
+		retry := newUSSDResponse(req, AppConfig().RetryMessage, false)
+		err := sendUSSDResponse(ctx, conn, retry)
+		requestRecordFrom(ctx).responded(retry, err)
+		if err != nil {
+			MenuLogger.Error("Failed to send retry message: %v", err)
+		}
+		endSession(req.RequestID)
+		return
+	}
 	if err != nil {
 		MenuLogger.Error("[ERROR] Failed to get USSD menu: %v\n", err)
-		go UpdateMonitoringService(&req, "Failed to get USSD menu", err)
+		UpdateMonitoringService(&req, "Failed to get USSD menu", err)
 
+		unavailable := newUSSDResponse(req, AppConfig().UnavailableMessage, false)
+		err := sendUSSDResponse(ctx, conn, unavailable)
+		requestRecordFrom(ctx).responded(unavailable, err)
+		if err != nil {
+			MenuLogger.Error("Failed to send unavailable message: %v", err)
+		}
+		endSession(req.RequestID)
 		return
 	}
 
 	// Store response as variables
 	ussdMessage := apiResponse.Message
-	ussdContinue := apiResponse.Continue
+	ussdContinue := *apiResponse.Continue
+	if AppConfig().MenuTrim == menuTrimEdge {
+		ussdMessage = trimMenuText(ussdMessage)
+	}
 
 	// Output stored response (for debugging)
-	MenuLogger.Info("USSD Response Message:", ussdMessage)
-	MenuLogger.Info("USSD Continue:", ussdContinue)
+	MenuLogger.Info("USSD Response Message: %s", logger.Body([]byte(ussdMessage)))
+	MenuLogger.Info("USSD Continue: %v", ussdContinue)
+
+	if AppConfig().MenuConsistency != menuConsistencyOff {
+		if mismatch := continueMismatch(ussdMessage, ussdContinue); mismatch != "" {
+			stats.InconsistentMenus.Add(1)
+			MenuLogger.Warn("Menu API response for %s with code %s %s (continue %v)", req.MSISDN, req.RequestID, mismatch, ussdContinue)
+			if AppConfig().MenuConsistency == menuConsistencyStrict {
+				ussdContinue = !ussdContinue
+			}
+		}
+	}
 
-	// You can now use `ussdMessage` and `ussdContinue` for further processing.
+	if apiResponse.Locale != "" {
+		MenuLogger.Info("USSD Locale: %s for %s with code %s", apiResponse.Locale, req.MSISDN, req.RequestID)
+		Sessions.SetLocale(req.RequestID, apiResponse.Locale)
+		stats.Locales.Add(apiResponse.Locale)
+	}
 
-	// send response back to client
-	response := USSDResponse{
-		RequestID:    req.RequestID,
-		MSISDN:       req.MSISDN,
-		StarCode:     req.StarCode,
-		ClientID:     req.ClientID,
-		Phase:        req.Phase,
-		DCS:          req.DCS,
-		MsgType:      2, // 2 for response expected, 3 for no response expected
-		UserData:     ussdMessage,
-		EndOfSession: 0, // 0 for not end of session, 1 for end of session
+	// A subscriber stuck on the same menu (e.g. repeating an invalid option)
+	// is let go once it has been sent MenuLoopThreshold times in a row
+	if ussdContinue && AppConfig().MenuLoopThreshold > 0 &&
+		Sessions.RecordMenu(req.RequestID, ussdMessage) >= AppConfig().MenuLoopThreshold {
+		MenuLogger.Warn("Same menu sent %d times in a row to %s with code %s, ending session", AppConfig().MenuLoopThreshold, req.MSISDN, req.RequestID)
+		ussdMessage, ussdContinue = AppConfig().MenuLoopMessage, false
 	}
 
+	dcs := responseDCS(req, AppConfig().telcoFor(req.MSISDN), apiResponse.DCS)
 	if !ussdContinue {
-		response.EndOfSession = 1
-		response.MsgType = 6
-	}
-
-	// Issue with xml.MarshalIndent; using fmt.Sprintf instead.
-	// The marshalling replaces new line with special characters, making the XML not display well on mobile app.
-	// messageXML, _ := xml.MarshalIndent(response, "", "  ")
-
-	messageXML := []byte(fmt.Sprintf(`<USSDResponse>
-	<requestId>%s</requestId>
-	<msisdn>%s</msisdn>
-	<starCode>%s</starCode>
-	<clientId>%s</clientId>
-	<phase>%d</phase>
-	<dcs>%d</dcs>
-	<msgtype>%d</msgtype>
-	<userdata>%s</userdata>
-	<EndofSession>%d</EndofSession>
-	</USSDResponse>`, response.RequestID, response.MSISDN, response.StarCode, response.ClientID, response.Phase, response.DCS, response.MsgType, response.UserData, response.EndOfSession))
+		ussdMessage = withClosingMessage(req.StarCode, ussdMessage, dcs)
+	}
+
+	// send response back to client
+	response := newUSSDResponse(req, ussdMessage, ussdContinue)
+	response.DCS = dcs
+	if preSendHook != nil {
+		if err := preSendHook(&response); err != nil {
+			MenuLogger.Error("Pre-send hook stopped the response to %s with code %s: %v", req.MSISDN, req.RequestID, err)
+			UpdateMonitoringService(&req, "Pre-send hook stopped the response", err)
+			endSession(req.RequestID)
+			return
+		}
+	}
 
 	MenuLogger.Info("Sending ussd Request... for %s with code %s\n", req.MSISDN, req.RequestID)
-	if err := sendMessage(conn, messageXML, response.RequestID); err != nil {
+	_, span := tracer().Start(ctx, "ussd.response", trace.WithAttributes(attribute.Bool("ussd.continue", ussdContinue)))
+	err = sendUSSDResponse(ctx, conn, response)
+	requestRecordFrom(ctx).responded(response, err)
+	if err == nil && ussdContinue {
+		Sessions.SetLastMenu(req.RequestID, response.UserData)
+	}
+	if err != nil {
 		MenuLogger.Error("Failed to send ussd request message: %v", err)
-		go UpdateMonitoringService(&req, "Failed to send ussd request message", err)
+		UpdateMonitoringService(&req, "Failed to send ussd request message", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "send failed")
+	}
+	span.End()
+
+	if !ussdContinue {
+		endSession(req.RequestID)
 	}
 
 }
 
+// sendInitialMenu answers the first dial of req with the static menu of
+// route, warming up the menu API in the background when the route asks for it
+func sendInitialMenu(ctx context.Context, req USSDRequest, conn net.Conn, route Route) {
+	MenuLogger.Info("Sending initial menu of %s to %s with code %s", route.ShortCode, req.MSISDN, req.RequestID)
+	if route.WarmUp {
+		go func() {
+			if _, err := getUssdMenu(context.WithoutCancel(ctx), req); err != nil {
+				MenuLogger.Warn("Menu API warm-up for %s with code %s failed: %v", req.MSISDN, req.RequestID, err)
+			}
+		}()
+	}
+
+	response := newUSSDResponse(req, route.InitialMenu, true)
+	err := sendUSSDResponse(ctx, conn, response)
+	requestRecordFrom(ctx).responded(response, err)
+	if err == nil {
+		Sessions.SetLastMenu(req.RequestID, response.UserData)
+	}
+	if err != nil {
+		MenuLogger.Error("Failed to send initial menu: %v", err)
+		UpdateMonitoringService(&req, "Failed to send initial menu", err)
+	}
+}
+
+// getMenuWithinBudget calls the menu API but gives up once only RetryMargin
+// of the response budget in ctx is left, so there is still time to tell the
+// subscriber to redial before the handset times out.
+func getMenuWithinBudget(ctx context.Context, req USSDRequest) (*USSDMenuResponse, error) {
+	type result struct {
+		response *USSDMenuResponse
+		err      error
+	}
+	done := make(chan result, 1)
+
+	go func() {
+		response, err := getUssdMenu(ctx, req)
+		done <- result{response, err}
+	}()
+
+	deadline, _ := ctx.Deadline()
+	timer := time.NewTimer(time.Until(deadline) - AppConfig().RetryMargin)
+	defer timer.Stop()
+
+	select {
+	case r := <-done:
+		return r.response, r.err
+	case <-timer.C:
+		return nil, errResponseBudgetExceeded
+	}
+}
+
 func getUSSDMenuMock(req USSDRequest) (*USSDMenuResponse, error) {
 	var apiResponse USSDMenuResponse
-	apiResponse.Continue = true
+	ussdContinue := true
+	apiResponse.Continue = &ussdContinue
 	apiResponse.Message = "Hi & Welcome to the NCC Menu &#xA;1. Data Advisory&#xA;2. Unified USSD Short Codes"
 	//"This menu is coming soon"
 
 	return &apiResponse, nil
 }
 
-func getUssdMenu(req USSDRequest) (*USSDMenuResponse, error) {
+// Headers of a menu API request written to the menu log. Any other, such
+// as credentials a provider adds, is left out.
+var loggedMenuHeaders = []string{"Content-Type", "Accept", "Accept-Encoding", "Traceparent", "Tracestate"}
+
+// loggableHeaders returns the headers of h in loggedMenuHeaders
+func loggableHeaders(h http.Header) http.Header {
+	logged := http.Header{}
+	for _, name := range loggedMenuHeaders {
+		if values := h.Values(name); len(values) > 0 {
+			logged[name] = values
+		}
+	}
+	return logged
+}
+
+// errMenuBodyTooLarge is returned for a menu API response body over
+// MENU_MAX_BODY
+var errMenuBodyTooLarge = errors.New("menu API response body too large")
+
+// readMenuBody reads a menu API response body, decompressing it according
+// to its Content-Encoding (gzip or deflate). Bodies over MenuMaxBody,
+// compressed or not, fail with errMenuBodyTooLarge, so that a small
+// compressed body cannot expand without bound.
+func readMenuBody(resp *http.Response) ([]byte, error) {
+	limit := AppConfig().MenuMaxBody
+	var body io.Reader = resp.Body
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+	case "gzip":
+		if resp.Uncompressed {
+			break // already decompressed by the transport
+		}
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %v", err)
+		}
+		defer zr.Close()
+		body = zr
+	case "deflate":
+		// Meant to be zlib-wrapped, though some servers send raw deflate
+		compressed, err := readLimited(resp.Body, limit)
+		if err != nil {
+			return nil, err
+		}
+		if zr, err := zlib.NewReader(bytes.NewReader(compressed)); err == nil {
+			defer zr.Close()
+			body = zr
+		} else {
+			body = flate.NewReader(bytes.NewReader(compressed))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+	return readLimited(body, limit)
+}
+
+// readLimited reads r to the end, failing with errMenuBodyTooLarge once it
+// has given more than limit bytes
+func readLimited(r io.Reader, limit int) ([]byte, error) {
+	b, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > limit {
+		return nil, fmt.Errorf("%w: over MENU_MAX_BODY %d bytes", errMenuBodyTooLarge, limit)
+	}
+	return b, nil
+}
+
+// Most bytes drainAndClose reads from a response body. A longer remainder
+// is not worth waiting for: the connection is closed instead of reused.
+const maxDrain = 64 << 10
+
+// drainAndClose reads what is left of a response body, up to maxDrain,
+// before closing it, which lets the transport reuse the connection
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, maxDrain))
+	body.Close()
+}
+
+func getUssdMenu(ctx context.Context, req USSDRequest) (apiResponse *USSDMenuResponse, err error) {
+	ctx, span := tracer().Start(ctx, "menu_api.call", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "menu API call failed")
+		}
+		span.End()
+	}()
 
 	MenuLogger.Info("[INFO] Getting USSD menu for %s with code %s\n and request ID %s", req.MSISDN, req.StarCode, req.RequestID)
 
+	productID, rule := AppConfig().productIDFor(req.StarCode)
+	if rule == "" {
+		MenuLogger.Info("Product ID %d for short code %s of %s (no route, default)", productID, req.StarCode, req.RequestID)
+	} else {
+		MenuLogger.Info("Product ID %d for short code %s of %s (route %s)", productID, req.StarCode, req.RequestID, rule)
+	}
+
+	provider := AppConfig().providerFor(req.StarCode, req.Payload != nil)
+	if mock, ok := AppConfig().testProviderFor(req.MSISDN); ok {
+		MenuLogger.Info("[TEST ACCOUNT] Routing %s with code %s to provider %s", req.MSISDN, req.RequestID, mock.Name)
+		provider = mock
+	}
+
 	// Prepare API request payload
+	telcoStart := time.Now()
+	telco := AppConfig().menuTelco(AppConfig().telcoFor(req.MSISDN))
+	requestRecordFrom(ctx).timed(stageTelco, time.Since(telcoStart))
 	apiRequest := USSDMenuRequest{
-		Telco:     "MTN", // Hardcoded for now; adjust as needed
+		Telco:     telco,
 		Shortcode: "*" + req.StarCode + "#",
-		ProductID: 2,
+		ProductID: productID,
 		Phone:     req.MSISDN,
 		Input:     req.UserData,
 		SessionID: req.RequestID,
+		IMSI:      req.IMSI,
+	}
+	s, _ := Sessions.Get(req.RequestID)
+	if provider.AccumulateInput {
+		apiRequest.Input = provider.menuInput(req, s.Inputs)
+	}
+	if AppConfig().MenuSendStep {
+		apiRequest.Step = s.Steps
+	}
+	if req.Payload != nil {
+		apiRequest.Input, apiRequest.InputEncoding = provider.binaryInput(req.Payload)
 	}
 
-	// Convert to JSON
-	requestBody, err := json.Marshal(apiRequest)
+	// Encode as the provider expects, JSON unless it takes forms
+	requestBody, contentType, err := provider.encodeMenuRequest(apiRequest)
 	if err != nil {
 		MenuLogger.Error("[ERROR] Failed to marshal request: %v\n", err)
 		return nil, err
 	}
 
-	// API URL
-	apiURL := os.Getenv("USSD_API_URL")
-	if apiURL == "" {
-		MenuLogger.Error("[ERROR] USSD menu url not set")
-		return nil, errors.New("ussd menu url not set")
+	// Log request and response once the call is over: always when it
+	// failed, otherwise only for sampled requests
+	var responseBody []byte
+	defer func() {
+		if err == nil && !logSampled(ctx) {
+			return
+		}
+		MenuLogger.Info("[INFO] USSD Menu API Request: %s\n", logger.Body(requestBody))
+		if responseBody != nil {
+			MenuLogger.Info("[INFO] USSD Menu API Response: %s\n", logger.Body(responseBody))
+		}
+	}()
+
+	// Each provider may bound its calls more tightly than the response budget
+	if provider.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(provider.Timeout))
+		defer cancel()
+	}
+
+	apiURL, err := expandMenuURL(provider.URL, menuURLValues(telco, req.StarCode, productID))
+	if err != nil {
+		MenuLogger.Error("[ERROR] Failed to build USSD menu API URL: %v\n", err)
+		return nil, err
 	}
 
 	// Make HTTP request
-	resp, err := http.Post(apiURL, "application/json", bytes.NewBuffer(requestBody))
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, apiURL, bytes.NewBuffer(requestBody))
+	if err != nil {
+		MenuLogger.Error("[ERROR] Failed to create USSD menu API request: %v\n", err)
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+	httpReq.Header.Set("Accept", AppConfig().MenuAPIAccept)
+	// Asking explicitly turns off the transport's own gzip handling, so
+	// readMenuBody is the only place bodies are decompressed
+	httpReq.Header.Set("Accept-Encoding", "gzip, deflate")
+	injectTraceHeaders(ctx, httpReq.Header)
+	MenuLogger.Debug("Calling USSD Menu API %s for %s with headers %v", apiURL, req.RequestID, loggableHeaders(httpReq.Header))
+
+	start := time.Now()
+	resp, err := http.DefaultClient.Do(httpReq)
 	if err != nil {
 		MenuLogger.Error("[ERROR] Failed to call USSD menu API: %v\n", err)
 		return nil, err
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
 
 	// Read response body
-	responseBody, err := io.ReadAll(resp.Body)
+	responseBody, err = readMenuBody(resp)
 	if err != nil {
 		MenuLogger.Error("[ERROR] Failed to read response: %v\n", err)
 		return nil, err
 	}
 
-	// Log request and response
-	MenuLogger.Info("[INFO] USSD Menu API Request: %s\n", string(requestBody))
-	MenuLogger.Info("[INFO] USSD Menu API Response: %s\n", string(responseBody))
+	MenuLogger.Debug("USSD Menu API answered %s for %s in %s", resp.Status, req.RequestID, time.Since(start))
+
+	switch action := AppConfig().menuStatusAction(resp.StatusCode); action.Action {
+	case statusActionEnd:
+		MenuLogger.Info("USSD Menu API answered %s for %s, ending the session", resp.Status, req.RequestID)
+		end := false
+		return &USSDMenuResponse{Message: action.Message, Continue: &end}, nil
+	case statusActionError:
+		MenuLogger.Error("[ERROR] USSD Menu API answered %s for %s", resp.Status, req.RequestID)
+		return nil, fmt.Errorf("%w: %s", errMenuAPIStatus, resp.Status)
+	}
+
+	// A backend defaulting to another format (typically XML) would only
+	// fail to parse below, with a less telling error
+	if err = checkContentType(AppConfig().MenuAPIAccept, resp.Header.Get("Content-Type"), AppConfig().MenuContentTypeCheck == contentTypeCheckStrict); err != nil {
+		MenuLogger.Error("[ERROR] USSD Menu API response for %s: %v", req.RequestID, err)
+		return nil, err
+	}
+
+	// encoding/json would silently substitute invalid UTF-8, so apply the
+	// configured policy to the raw body first
+	if !utf8.Valid(responseBody) {
+		MenuLogger.Warn("USSD Menu API response for %s is not valid UTF-8, applying %q", req.RequestID, AppConfig().InvalidUTF8)
+		responseBody = toValidUTF8(responseBody, AppConfig().InvalidUTF8)
+	}
 
 	// Parse JSON response
-	var apiResponse USSDMenuResponse
-	err = json.Unmarshal(responseBody, &apiResponse)
+	apiResponse = &USSDMenuResponse{}
+	err = json.Unmarshal(responseBody, apiResponse)
 	if err != nil {
 		log.Printf("[ERROR] Failed to parse response JSON: %v\n", err)
 		return nil, err
 	}
 
-	return &apiResponse, nil
+	// A missing "continue" would otherwise decode as false and silently end
+	// the session, so apply the configured policy explicitly.
+	if apiResponse.Continue == nil {
+		if AppConfig().MissingContinue == missingContinueError {
+			MenuLogger.Warn("USSD Menu API response for %s has no continue field", req.RequestID)
+			return nil, errMissingContinue
+		}
+		ussdContinue := AppConfig().MissingContinue == missingContinueTrue
+		MenuLogger.Warn("USSD Menu API response for %s has no continue field, defaulting to %v", req.RequestID, ussdContinue)
+		apiResponse.Continue = &ussdContinue
+	}
+
+	return apiResponse, nil
 }
 
 // function to perform general cleanup
 func cleanup() {
 	// Close the logger when the application exits
 	if AppLogger != nil {
+		logShutdownReport()
 		AppLogger.Close()
 	}
 	if MenuLogger != nil {
@@ -455,10 +1188,18 @@ func cleanup() {
 	if RequestLogger != nil {
 		RequestLogger.Close()
 	}
+	if FrameLogger != nil {
+		FrameLogger.Close()
+	}
 }
 
+// UpdateMonitoringService posts the count or failure metric of a request. It
+// returns at once, posting in the background, and does nothing while
+// monitoring is disabled.
 func UpdateMonitoringService(req *USSDRequest, status string, err error) {
-	// update monitoring if transaction is not successful
+	if !AppConfig().MonitoringMode.Enabled() || req.ClientID == simulatorClientID {
+		return
+	}
 
 	channel := ""
 	errMsg := "None"
@@ -475,14 +1216,11 @@ func UpdateMonitoringService(req *USSDRequest, status string, err error) {
 		fmt.Println("Failed to get monitoring channel")
 		return
 	}
-	// test job
-	job := jobs.NewPostMetricData(
+	postMetric(
 		channel,
 		1,
 		req.MSISDN,
 		req.RequestID,
 		fmt.Sprint("Status: ", status, ". Error: ", errMsg),
 	)
-	go job.Handle()
-
 }
@@ -0,0 +1,1430 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/abeloha/USSDTCP/pkg/logger"
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+// TestMain sets the gateway up as main does, logging to a temporary
+// directory, so tests can run requests through handleMenuRequest
+func TestMain(m *testing.M) {
+	logPath, err := os.MkdirTemp("", "ussdtcp-test")
+	if err != nil {
+		log.Fatalf("Failed to create log directory: %v", err)
+	}
+	for key, value := range map[string]string{
+		"SERVER_HOST":  "127.0.0.1",
+		"SERVER_PORT":  "9000",
+		"USERNAME":     "test",
+		"PASSWORD":     "test",
+		"CLIENT_ID":    "test",
+		"USSD_API_URL": "http://127.0.0.1/test",
+		"LOG_PATH":     logPath,
+		"CONFIG_FILE":  "",
+	} {
+		os.Setenv(key, value)
+	}
+
+	setup()
+	code := m.Run()
+	cleanup()
+	os.RemoveAll(logPath)
+	os.Exit(code)
+}
+
+// withConfig runs the rest of the test with the config changed by change,
+// restoring the previous one afterwards
+func withConfig(t *testing.T, change func(cfg *Config)) {
+	t.Helper()
+	saved := AppConfig()
+	cfg := *saved
+	change(&cfg)
+	currentConfig.Store(&cfg)
+	t.Cleanup(func() { currentConfig.Store(saved) })
+}
+
+// withMenuAPI points the default provider at a menu API answering every
+// request with message, continuing the session
+func withMenuAPI(t *testing.T, message string) {
+	t.Helper()
+	withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		writeMenu(w, message, true)
+	})
+}
+
+// withMenuHandler points the default provider at a menu API served by handler
+func withMenuHandler(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	api := httptest.NewServer(handler)
+	t.Cleanup(api.Close)
+	withConfig(t, func(cfg *Config) { cfg.MenuAPIURL = api.URL })
+}
+
+// menuCalls records the requests a test menu API received
+type menuCalls struct {
+	mu      sync.Mutex
+	bodies  [][]byte
+	headers []http.Header
+}
+
+// last returns the body and headers of the last call
+func (m *menuCalls) last(t *testing.T) ([]byte, http.Header) {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.bodies) == 0 {
+		t.Fatal("menu API not called")
+	}
+	return m.bodies[len(m.bodies)-1], m.headers[len(m.headers)-1]
+}
+
+// lastJSON decodes the body of the last call
+func (m *menuCalls) lastJSON(t *testing.T) map[string]any {
+	t.Helper()
+	body, _ := m.last(t)
+	var fields map[string]any
+	if err := json.Unmarshal(body, &fields); err != nil {
+		t.Fatalf("menu API body %s is not JSON: %v", body, err)
+	}
+	return fields
+}
+
+// count returns the number of calls
+func (m *menuCalls) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.bodies)
+}
+
+// withMenuRecorder points the default provider at a menu API answering
+// every request with message, continuing the session, and recording it
+func withMenuRecorder(t *testing.T, message string) *menuCalls {
+	t.Helper()
+	calls := &menuCalls{}
+	withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		calls.mu.Lock()
+		calls.bodies = append(calls.bodies, body)
+		calls.headers = append(calls.headers, r.Header.Clone())
+		calls.mu.Unlock()
+		writeMenu(w, message, true)
+	})
+	return calls
+}
+
+// writeMenu writes a menu API response
+func writeMenu(w http.ResponseWriter, message string, cont bool) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"message": message, "continue": cont})
+}
+
+// withLinkUp runs the rest of the test as if logged on to the server
+func withLinkUp(t *testing.T) {
+	t.Helper()
+	linkUp.Store(true)
+	t.Cleanup(func() { linkUp.Store(false) })
+}
+
+// captureConn stands in for the server connection, keeping the frames
+// written to it
+type captureConn struct {
+	net.Conn // nil; only the methods below are used
+
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (c *captureConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written.Write(p)
+}
+
+func (c *captureConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *captureConn) Close() error                     { return nil }
+
+// frames returns the XML body of each frame written to c so far
+func (c *captureConn) frames(t *testing.T) [][]byte {
+	t.Helper()
+	c.mu.Lock()
+	r := bufio.NewReader(bytes.NewReader(c.written.Bytes()))
+	c.mu.Unlock()
+
+	var bodies [][]byte
+	for {
+		body, err := (&fakeAggregator{}).read(r)
+		if err != nil {
+			return bodies
+		}
+		bodies = append(bodies, body)
+	}
+}
+
+// responses returns the USSDResponse frames written to c so far
+func (c *captureConn) responses(t *testing.T) []USSDResponse {
+	t.Helper()
+	var responses []USSDResponse
+	for _, body := range c.frames(t) {
+		if frameType(body) != "USSDResponse" {
+			continue
+		}
+		var resp USSDResponse
+		if err := xml.Unmarshal(body, &resp); err != nil {
+			t.Fatalf("invalid USSDResponse %s: %v", body, err)
+		}
+		responses = append(responses, resp)
+	}
+	return responses
+}
+
+// lastResponse returns the last USSDResponse written to c
+func (c *captureConn) lastResponse(t *testing.T) USSDResponse {
+	t.Helper()
+	responses := c.responses(t)
+	if len(responses) == 0 {
+		t.Fatalf("no USSDResponse sent; frames: %q", c.frames(t))
+	}
+	return responses[len(responses)-1]
+}
+
+// testRequest returns a USSDRequest from msisdn on the session id, a first
+// dial of shortCode when input is "" and a continuation otherwise
+func testRequest(id, msisdn, shortCode, input string) USSDRequest {
+	req := USSDRequest{
+		RequestID: id,
+		MSISDN:    msisdn,
+		StarCode:  shortCode,
+		ClientID:  "test",
+		Phase:     2,
+		DCS:       15,
+		MsgType:   4,
+		UserData:  input,
+	}
+	if input == "" {
+		req.MsgType = 1
+		req.UserData = "*" + shortCode + "#"
+	}
+	return req
+}
+
+// serve passes req to the gateway on c as a frame from the server
+func serve(t *testing.T, c *captureConn, req USSDRequest) {
+	t.Helper()
+	body, err := xml.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	processServerMessage(createHeader(req.RequestID, len(body)+32), body, c)
+}
+
+func TestSlowMenuAPIGetsRetryMessage(t *testing.T) {
+	withLinkUp(t)
+	withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		writeMenu(w, "Too late", true)
+	})
+
+	tests := []struct {
+		name   string
+		budget time.Duration
+		want   string
+		cont   bool
+	}{
+		{"within budget", 3 * time.Second, "Too late", true},
+		{"over budget", 200 * time.Millisecond, "Please redial", false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(cfg *Config) {
+				cfg.ResponseBudget = tt.budget
+				cfg.RetryMargin = 100 * time.Millisecond
+				cfg.RetryMessage = "Please redial"
+			})
+
+			c := &captureConn{}
+			serve(t, c, testRequest(fmt.Sprintf("SLOW%d", i), "2348030000002", "123", ""))
+			resp := c.lastResponse(t)
+			if resp.UserData != tt.want || (resp.EndOfSession == 0) != tt.cont {
+				t.Errorf("got %q (end %d), want %q (continue %v)", resp.UserData, resp.EndOfSession, tt.want, tt.cont)
+			}
+		})
+	}
+}
+
+func TestMenuRequestIMSI(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "Welcome")
+
+	tests := []struct {
+		name string
+		imsi string
+	}{
+		{"present", "621300000000001"},
+		{"absent", ""},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := testRequest(fmt.Sprintf("IMSI%d", i), "2348030000003", "123", "")
+			req.IMSI = tt.imsi
+			serve(t, &captureConn{}, req)
+
+			imsi, sent := calls.lastJSON(t)["imsi"]
+			if sent != (tt.imsi != "") || (sent && imsi != tt.imsi) {
+				t.Errorf("imsi sent %v as %v, want %q", sent, imsi, tt.imsi)
+			}
+		})
+	}
+}
+
+func TestMenuContinueField(t *testing.T) {
+	withLinkUp(t)
+	var body atomic.Value
+	withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body.Load().(string))
+	})
+
+	tests := []struct {
+		name    string
+		body    string
+		missing string
+		menu    bool // false when the response is treated as an error
+		cont    bool
+	}{
+		{"present true", `{"message":"1. Balance","continue":true}`, missingContinueError, true, true},
+		{"present false", `{"message":"1. Balance","continue":false}`, missingContinueTrue, true, false},
+		{"absent, error", `{"message":"1. Balance"}`, missingContinueError, false, false},
+		{"absent, true", `{"message":"1. Balance"}`, missingContinueTrue, true, true},
+		{"absent, false", `{"message":"1. Balance"}`, missingContinueFalse, true, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body.Store(tt.body)
+			withConfig(t, func(cfg *Config) { cfg.MissingContinue = tt.missing })
+
+			c := &captureConn{}
+			serve(t, c, testRequest(fmt.Sprintf("CONT%d", i), "2348030000004", "123", ""))
+			responses := c.responses(t)
+			if len(responses) != 1 {
+				t.Fatalf("sent %d responses, want 1", len(responses))
+			}
+			if !tt.menu {
+				if resp := responses[0]; resp.UserData != AppConfig().UnavailableMessage || resp.EndOfSession != 1 {
+					t.Errorf("answered %q (EndofSession %d), want %q ending the session", resp.UserData, resp.EndOfSession, AppConfig().UnavailableMessage)
+				}
+				if _, open := Sessions.Get(fmt.Sprintf("CONT%d", i)); open {
+					t.Error("session left open after the menu API error")
+				}
+				return
+			}
+			if cont := responses[0].EndOfSession == 0; cont != tt.cont {
+				t.Errorf("continue %v, want %v", cont, tt.cont)
+			}
+		})
+	}
+}
+
+func TestStatsCountRequestFlow(t *testing.T) {
+	withLinkUp(t)
+	var cont atomic.Bool
+	withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		writeMenu(w, "1. Balance", cont.Load())
+	})
+	before := stats.Take()
+	active := Sessions.Len()
+
+	c := &captureConn{}
+	cont.Store(true)
+	serve(t, c, testRequest("STATS1", "2348030000007", "123", ""))
+	if got := Sessions.Len(); got != active+1 {
+		t.Errorf("%d active sessions mid-flow, want %d", got, active+1)
+	}
+	cont.Store(false)
+	serve(t, c, testRequest("STATS1", "2348030000007", "123", "1"))
+
+	after := stats.Take()
+	for _, tt := range []struct {
+		name          string
+		before, after int64
+		want          int64
+	}{
+		{"requests received", before.RequestsReceived, after.RequestsReceived, 2},
+		{"responses sent", before.ResponsesSent, after.ResponsesSent, 2},
+		{"sessions started", before.SessionsStarted, after.SessionsStarted, 1},
+		{"sessions ended", before.SessionsEnded, after.SessionsEnded, 1},
+		{"menu API successes", before.MenuAPISuccesses, after.MenuAPISuccesses, 2},
+		{"menu API failures", before.MenuAPIFailures, after.MenuAPIFailures, 0},
+	} {
+		if got := tt.after - tt.before; got != tt.want {
+			t.Errorf("%s grew by %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	if got := Sessions.Len(); got != active {
+		t.Errorf("%d active sessions after the flow, want %d", got, active)
+	}
+
+	stats.SinceLast()
+	serve(t, c, testRequest("STATS2", "2348030000007", "123", ""))
+	if delta := stats.SinceLast(); delta.RequestsReceived != 1 || delta.SessionsStarted != 1 {
+		t.Errorf("since last: %d requests and %d sessions started, want 1 and 1", delta.RequestsReceived, delta.SessionsStarted)
+	}
+}
+
+func TestMenuInvalidUTF8(t *testing.T) {
+	withLinkUp(t)
+	withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{\"message\":\"1. Caf\xe9 \xff\xfe2. Menu\",\"continue\":true}"))
+	})
+
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{invalidUTF8Replace, "1. Caf� �2. Menu"},
+		{invalidUTF8Strip, "1. Caf 2. Menu"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			withConfig(t, func(cfg *Config) { cfg.InvalidUTF8 = tt.policy })
+
+			c := &captureConn{}
+			serve(t, c, testRequest(fmt.Sprintf("UTF%d", i), "2348030000009", "123", ""))
+			for _, body := range c.frames(t) {
+				if !utf8.Valid(body) {
+					t.Errorf("frame is not valid UTF-8: %q", body)
+				}
+			}
+			if got := c.lastResponse(t).UserData; got != tt.want {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnprocessableRequestGetsErrorResponse(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "Welcome")
+
+	tests := []struct {
+		name   string
+		code   string
+		change func(req *USSDRequest)
+		want   string // expected errorDescription, "" for no error frame
+	}{
+		{"missing msisdn", "900", func(req *USSDRequest) { req.MSISDN = "" }, "unprocessable request: missing msisdn"},
+		{"bad msgtype", "900", func(req *USSDRequest) { req.MsgType = 9 }, "unprocessable request: invalid msgtype 9"},
+		{"disabled", "", func(req *USSDRequest) { req.MSISDN = "" }, ""},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(cfg *Config) { cfg.ProtocolErrorCode = tt.code })
+			req := testRequest(fmt.Sprintf("BAD%d", i), "2348030000011", "123", "")
+			tt.change(&req)
+
+			c := &captureConn{}
+			serve(t, c, req)
+			frames := c.frames(t)
+			if tt.want == "" {
+				if len(frames) > 0 {
+					t.Errorf("sent %q, want nothing", frames)
+				}
+				return
+			}
+			if len(frames) != 1 {
+				t.Fatalf("sent %d frames, want 1", len(frames))
+			}
+
+			var resp struct {
+				RequestID        string `xml:"requestId"`
+				EndOfSession     int    `xml:"EndofSession"`
+				ErrorCode        string `xml:"errorCode"`
+				ErrorDescription string `xml:"errorDescription"`
+			}
+			if err := xml.Unmarshal(frames[0], &resp); err != nil {
+				t.Fatalf("invalid error response %s: %v", frames[0], err)
+			}
+			if resp.RequestID != req.RequestID || resp.EndOfSession != 1 || resp.ErrorCode != tt.code || resp.ErrorDescription != tt.want {
+				t.Errorf("got %+v, want errorCode %s and description %q ending %s", resp, tt.code, tt.want, req.RequestID)
+			}
+		})
+	}
+	if n := calls.count(); n > 0 {
+		t.Errorf("menu API called %d times for unprocessable requests", n)
+	}
+}
+
+func TestMenuLoopEndsSession(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, "1. Balance 2. Airtime")
+	withConfig(t, func(cfg *Config) {
+		cfg.MenuLoopThreshold = 3
+		cfg.MenuLoopMessage = "Too many attempts"
+	})
+
+	c := &captureConn{}
+	serve(t, c, testRequest("LOOP1", "2348030000012", "123", ""))
+	for _, input := range []string{"9", "9"} {
+		serve(t, c, testRequest("LOOP1", "2348030000012", "123", input))
+	}
+
+	responses := c.responses(t)
+	if len(responses) != 3 {
+		t.Fatalf("sent %d responses, want 3", len(responses))
+	}
+	for i, resp := range responses[:2] {
+		if resp.UserData != "1. Balance 2. Airtime" || resp.EndOfSession != 0 {
+			t.Errorf("response %d: %q (end %d), want the menu", i+1, resp.UserData, resp.EndOfSession)
+		}
+	}
+	if last := responses[2]; last.UserData != "Too many attempts" || last.EndOfSession != 1 {
+		t.Errorf("response 3: %q (end %d), want the loop message ending the session", last.UserData, last.EndOfSession)
+	}
+	if _, ok := Sessions.Get("LOOP1"); ok {
+		t.Error("session still open after the loop was detected")
+	}
+}
+
+func TestMenuLocale(t *testing.T) {
+	withLinkUp(t)
+	withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"message":"Barka da zuwa","continue":true,"locale":"ha"}`)
+	})
+	before := stats.Take().Locales["ha"]
+
+	c := &captureConn{}
+	serve(t, c, testRequest("LOCALE1", "2348030000018", "123", ""))
+	t.Cleanup(func() { Sessions.End("LOCALE1") })
+
+	if got := c.lastResponse(t).UserData; got != "Barka da zuwa" {
+		t.Errorf("sent %q, want the menu unchanged", got)
+	}
+	if s, _ := Sessions.Get("LOCALE1"); s.Locale != "ha" {
+		t.Errorf("session locale %q, want ha", s.Locale)
+	}
+	if after := stats.Take().Locales["ha"]; after != before+1 {
+		t.Errorf("locale ha counted %d times, want %d", after, before+1)
+	}
+}
+
+func TestSendMessageWriteTimeout(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.WriteTimeout = 100 * time.Millisecond })
+
+	// A peer that never reads: writes on a pipe block until read
+	client, peer := net.Pipe()
+	t.Cleanup(func() { peer.Close() })
+
+	start := time.Now()
+	err := sendMessage(client, []byte("<ENQRequest/>"), "SESS0001")
+	elapsed := time.Since(start)
+
+	if !errors.Is(err, errWriteTimeout) {
+		t.Fatalf("sendMessage = %v, want %v", err, errWriteTimeout)
+	}
+	if elapsed > time.Second {
+		t.Errorf("write gave up after %s, want about %s", elapsed, AppConfig().WriteTimeout)
+	}
+	if _, err := client.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("connection still open after the timeout (write: %v)", err)
+	}
+}
+
+func TestByteCounters(t *testing.T) {
+	const frames = 50
+	body := []byte("<ENQRequest/>")
+	frameSize := int64(len(createHeader("SESS0002", len(body)+32)) + len(body))
+	inbound := aggregatorFrame("SESS0002", []byte("<ENQResponse/>"))
+
+	client, peer := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		peer.Close()
+	})
+	sentBefore, receivedBefore := stats.BytesSent.Total(), stats.BytesReceived.Total()
+
+	var wg sync.WaitGroup
+	for i := 0; i < frames; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sendMessage(client, body, "SESS0002"); err != nil {
+				t.Errorf("sendMessage: %v", err)
+			}
+		}()
+	}
+	if _, err := io.ReadFull(peer, make([]byte, frames*frameSize)); err != nil {
+		t.Fatalf("reading the frames sent: %v", err)
+	}
+	wg.Wait()
+
+	go func() {
+		for i := 0; i < frames; i++ {
+			peer.Write(inbound)
+		}
+	}()
+	for i := 0; i < frames; i++ {
+		if _, _, err := readResponse(client); err != nil {
+			t.Fatalf("readResponse: %v", err)
+		}
+	}
+
+	if got := stats.BytesSent.Total() - sentBefore; got != frames*frameSize {
+		t.Errorf("%d bytes sent, want %d", got, frames*frameSize)
+	}
+	if got, want := stats.BytesReceived.Total()-receivedBefore, int64(frames*len(inbound)); got != want {
+		t.Errorf("%d bytes received, want %d", got, want)
+	}
+	if rate := stats.Take().BytesSentRate; rate <= 0 {
+		t.Errorf("bytes sent rate %g, want it positive", rate)
+	}
+}
+
+// aggregatorFrame returns body framed the way the server sends it
+func aggregatorFrame(sessionID string, body []byte) []byte {
+	header := make([]byte, frameHeaderSize)
+	copy(header[:16], sessionID)
+	copy(header[16:], fmt.Sprintf("%03d", len(body)+16))
+	return append(header, body...)
+}
+
+func TestOversizedFrameRejected(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.MaxFrameSize = 64 })
+
+	client, peer := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		peer.Close()
+	})
+	// Only the header is ever sent: reading on into the declared body would
+	// block until the read deadline instead of failing at once
+	header := []byte("SESSBIGFRAME0000999")
+	go peer.Write(header)
+
+	start := time.Now()
+	_, _, err := readResponse(client)
+	if !errors.Is(err, errFrameTooLarge) {
+		t.Fatalf("readResponse = %v, want %v", err, errFrameTooLarge)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("rejected after %s, having waited for the body", elapsed)
+	}
+	if !strings.Contains(readLog(t, "frames"), `Rejecting frame declaring 983 body bytes, over MAX_FRAME_SIZE 64: header "SESSBIGFRAME0000999"`) {
+		t.Error("oversized frame not logged")
+	}
+}
+
+func TestPipelinedFrames(t *testing.T) {
+	first := []byte("<ENQResponse/>")
+	second := []byte("<USSDRequest><requestId>PIPE0001</requestId></USSDRequest>")
+	segment := append(aggregatorFrame("SESS0003", first), aggregatorFrame("SESS0003", second)...)
+
+	client, peer := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		peer.Close()
+	})
+	go func() {
+		// Both frames in one write, then a frame split across two
+		peer.Write(segment)
+		split := aggregatorFrame("SESS0003", first)
+		peer.Write(split[:10])
+		time.Sleep(10 * time.Millisecond)
+		peer.Write(split[10:])
+	}()
+
+	for i, want := range [][]byte{first, second, first} {
+		header, body, err := readResponse(client)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i+1, err)
+		}
+		if got := headerSessionID(header); got != "SESS0003" {
+			t.Errorf("frame %d: session ID %q, want SESS0003", i+1, got)
+		}
+		if !bytes.Equal(body, want) {
+			t.Errorf("frame %d: body %q, want %q", i+1, body, want)
+		}
+	}
+}
+
+// readLog returns today's contents of the named log (e.g. "menu")
+func readLog(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(AppConfig().LogPath, name, time.Now().Format("2006-01-02")+".log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestUnparsedFrameLogged(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"truncated XML", "<USSDRequest><requestId>BADFRAME1</requestId><msisdn>234", `<USSDRequest><requestId>BADFRAME1</requestId><msisdn>234"`},
+		{"not XML", "BADFRAME2\x01\xff", `BADFRAME2\x01\xff"`},
+		{"unknown type", "<BindRequest>BADFRAME3</BindRequest>", "unexpected BindRequest"},
+		{"capped", "<Junk>BADFRAME4" + strings.Repeat("x", 2*maxRawFrameLog), "(first 1024 of"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &captureConn{}
+			processServerMessage(createHeader("SESS0004", len(tt.body)+32), []byte(tt.body), c)
+
+			if frames := c.frames(t); len(frames) != 0 {
+				t.Errorf("answered an unparsed frame: %q", frames)
+			}
+			log := readLog(t, "frames")
+			if !strings.Contains(log, "Unparsed frame") || !strings.Contains(log, tt.want) {
+				t.Errorf("frame log missing %q:\n%s", tt.want, log)
+			}
+		})
+	}
+}
+
+func TestLogBodyTruncated(t *testing.T) {
+	withLinkUp(t)
+	menu := "LONGMENU " + strings.Repeat("1. Option ", 30)
+	withMenuAPI(t, menu)
+	withConfig(t, func(cfg *Config) { cfg.LogMaxBody = 64 })
+
+	c := &captureConn{}
+	serve(t, c, testRequest("TRUNC1", "2348030000021", "123", ""))
+	t.Cleanup(func() { Sessions.End("TRUNC1") })
+
+	if got := c.lastResponse(t).UserData; got != menu {
+		t.Errorf("sent %q, want the full menu", got)
+	}
+
+	menuLog := readLog(t, "menu")
+	if strings.Contains(menuLog, menu) {
+		t.Error("menu logged in full")
+	}
+	if !regexp.MustCompile(`LONGMENU [^\n]*\.\.\.\[truncated \d+ bytes\]`).MatchString(menuLog) {
+		t.Error("no truncated menu in the menu log")
+	}
+}
+
+func TestLogDebugPerLogger(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, "Welcome")
+	withConfig(t, func(cfg *Config) { cfg.LogDebug = []string{"menu"} })
+	applyLogDebug()
+	t.Cleanup(applyLogDebug)
+
+	c := &captureConn{}
+	serve(t, c, testRequest("DEBUG1", "2348030000024", "123", ""))
+	t.Cleanup(func() { Sessions.End("DEBUG1") })
+
+	debugLine := regexp.MustCompile(`DEBUG: [^\n]*DEBUG1`)
+	if !debugLine.MatchString(readLog(t, "menu")) {
+		t.Error("no DEBUG line in the menu log")
+	}
+	if debugLine.MatchString(readLog(t, "requests")) {
+		t.Error("DEBUG line in the request log, which is not configured for debug")
+	}
+}
+
+func TestLoggableHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Content-Type", "application/json")
+	h.Set("Authorization", "Bearer secret-token")
+	h.Set("X-Api-Key", "secret-key")
+
+	got := loggableHeaders(h)
+	if got.Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type left out of %v", got)
+	}
+	if got.Get("Authorization") != "" || got.Get("X-Api-Key") != "" {
+		t.Errorf("credentials logged: %v", got)
+	}
+}
+
+func TestMenuTrim(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, " Welcome&#xA;1. Data&#xA; ")
+
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{menuTrimNone, " Welcome\n1. Data\n "},
+		{menuTrimEdge, "Welcome\n1. Data"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			withConfig(t, func(cfg *Config) { cfg.MenuTrim = tt.policy })
+			id := fmt.Sprintf("TRIM%d", i)
+			t.Cleanup(func() { Sessions.End(id) })
+
+			c := &captureConn{}
+			serve(t, c, testRequest(id, "2348030000025", "123", ""))
+			if got := c.lastResponse(t).UserData; got != tt.want {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPreSendHook(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, "Your secret code is ready. 1. Show")
+
+	tests := []struct {
+		name    string
+		hook    func(resp *USSDResponse) error
+		want    string // sent message, "" for nothing sent
+		session bool   // whether the session stays open
+	}{
+		{"redact", func(resp *USSDResponse) error {
+			resp.UserData = strings.ReplaceAll(resp.UserData, "secret", "******")
+			return nil
+		}, "Your ****** code is ready. 1. Show", true},
+		{"abort", func(resp *USSDResponse) error {
+			return errors.New("banned content")
+		}, "", false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			preSendHook = tt.hook
+			t.Cleanup(func() { preSendHook = nil })
+			id := fmt.Sprintf("HOOK%d", i)
+			t.Cleanup(func() { Sessions.End(id) })
+
+			c := &captureConn{}
+			serve(t, c, testRequest(id, "2348030000026", "123", ""))
+
+			if tt.want == "" {
+				if n := len(c.frames(t)); n != 0 {
+					t.Errorf("%d frames sent after the hook failed, want none", n)
+				}
+			} else if got := c.lastResponse(t).UserData; got != tt.want {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+			if _, open := Sessions.Get(id); open != tt.session {
+				t.Errorf("session open = %v, want %v", open, tt.session)
+			}
+		})
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	withLinkUp(t)
+	withConfig(t, func(cfg *Config) { cfg.LogSampleRate = 4 })
+	logSampleCount.Store(0)
+
+	tests := []struct {
+		name   string
+		menu   string // menu API answer
+		logged int    // of 8 requests, those with their menu API body logged
+	}{
+		{"successes sampled", `{"message":"Welcome","continue":true}`, 2},
+		{"errors always logged", `not json`, 8},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.menu))
+			})
+
+			var ids []string
+			for j := 0; j < 8; j++ {
+				id := fmt.Sprintf("SAMPLE%d%d", i, j)
+				ids = append(ids, id)
+				t.Cleanup(func() { Sessions.End(id) })
+				serve(t, &captureConn{}, testRequest(id, "2348030000028", "123", ""))
+			}
+
+			menuLog := readLog(t, "menu")
+			logged := 0
+			for _, id := range ids {
+				if regexp.MustCompile(`USSD Menu API Request: [^\n]*"session_id":"` + id + `"`).MatchString(menuLog) {
+					logged++
+				}
+			}
+			if logged != tt.logged {
+				t.Errorf("%d of 8 requests logged in full, want %d", logged, tt.logged)
+			}
+		})
+	}
+}
+
+func TestMenuAPIReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+	api := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json"))
+	}))
+	api.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	api.Start()
+	t.Cleanup(api.Close)
+	withConfig(t, func(cfg *Config) { cfg.MenuAPIURL = api.URL })
+
+	for i := 0; i < 3; i++ {
+		if _, err := getUssdMenu(context.Background(), testRequest(fmt.Sprintf("REUSE%d", i), "2348030000031", "123", "")); err == nil {
+			t.Fatal("getUssdMenu accepted a body that is not JSON")
+		}
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("%d connections for 3 sequential menu calls, want 1", got)
+	}
+}
+
+func TestMenuAPIAccept(t *testing.T) {
+	tests := []struct {
+		name        string
+		accept      string
+		check       string
+		contentType string
+		err         error
+	}{
+		{"json", "application/json", contentTypeCheckLenient, "application/json; charset=utf-8", nil},
+		{"xml by default", "application/json", contentTypeCheckLenient, "application/xml", errUnexpectedContentType},
+		{"unlabelled json", "application/json", contentTypeCheckLenient, "text/plain; charset=utf-8", nil},
+		{"unlabelled json, strict", "application/json", contentTypeCheckStrict, "text/plain", errUnexpectedContentType},
+		{"no content type", "application/json", contentTypeCheckStrict, "", nil},
+		{"wildcard", "application/json, application/*;q=0.5", contentTypeCheckStrict, "application/vnd.menu+json", nil},
+		{"xml accepted", "application/json, application/xml", contentTypeCheckLenient, "application/xml", nil},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var accept string
+			withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+				accept = r.Header.Get("Accept")
+				w.Header()["Content-Type"] = []string{tt.contentType}
+				w.Write([]byte(`{"message":"Welcome","continue":true}`))
+			})
+			withConfig(t, func(cfg *Config) {
+				cfg.MenuAPIAccept = tt.accept
+				cfg.MenuContentTypeCheck = tt.check
+			})
+
+			_, err := getUssdMenu(context.Background(), testRequest(fmt.Sprintf("ACCEPT%d", i), "2348030000069", "123", ""))
+			if accept != tt.accept {
+				t.Errorf("sent Accept %q, want %q", accept, tt.accept)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("getUssdMenu = %v, want %v", err, tt.err)
+			}
+			if tt.err != nil && (err == nil || !strings.Contains(err.Error(), tt.contentType)) {
+				t.Errorf("error %v does not name the content type %s", err, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestCompressedMenuResponse(t *testing.T) {
+	withLinkUp(t)
+	menu := `{"message":"Compressed welcome","continue":true}`
+
+	tests := []struct {
+		encoding string
+		compress func(w io.Writer) io.WriteCloser
+	}{
+		{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+		{"deflate", func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }},
+		{"raw deflate", func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.encoding, func(t *testing.T) {
+			withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+				if accept := r.Header.Get("Accept-Encoding"); !strings.Contains(accept, "gzip") {
+					t.Errorf("Accept-Encoding %q does not offer gzip", accept)
+				}
+				w.Header().Set("Content-Encoding", strings.TrimPrefix(tt.encoding, "raw "))
+				zw := tt.compress(w)
+				zw.Write([]byte(menu))
+				zw.Close()
+			})
+			id := fmt.Sprintf("GZIP%d", i)
+			t.Cleanup(func() { Sessions.End(id) })
+
+			c := &captureConn{}
+			serve(t, c, testRequest(id, "2348030000033", "123", ""))
+			if got := c.lastResponse(t).UserData; got != "Compressed welcome" {
+				t.Errorf("sent %q, want the decompressed menu", got)
+			}
+		})
+	}
+}
+
+func TestCompressedMenuResponseLimited(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.MenuMaxBody = 1024 })
+
+	// A small gzip body expanding far beyond the limit
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(bytes.Repeat([]byte(" "), 1<<20))
+	zw.Close()
+
+	resp := &http.Response{
+		Header: http.Header{"Content-Encoding": {"gzip"}},
+		Body:   io.NopCloser(&compressed),
+	}
+	if _, err := readMenuBody(resp); !errors.Is(err, errMenuBodyTooLarge) {
+		t.Errorf("readMenuBody() = %v, want %v", err, errMenuBodyTooLarge)
+	}
+
+	resp = &http.Response{Body: io.NopCloser(strings.NewReader(strings.Repeat("x", 1024)))}
+	if body, err := readMenuBody(resp); err != nil || len(body) != 1024 {
+		t.Errorf("readMenuBody() = %d bytes, %v for a body at the limit", len(body), err)
+	}
+}
+
+func TestShortCodeAllowlist(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "Welcome")
+	withConfig(t, func(cfg *Config) { cfg.AllowedShortCodes = []string{"123", "456"} })
+
+	tests := []struct {
+		name      string
+		shortCode string
+		want      string
+		end       bool
+		called    bool // whether the menu API should be called
+	}{
+		{"allowed", "456", "Welcome", false, true},
+		{"not allowed", "999", "Service not found.", true, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := fmt.Sprintf("ALLOW%d", i)
+			t.Cleanup(func() { Sessions.End(id) })
+			before := calls.count()
+
+			c := &captureConn{}
+			serve(t, c, testRequest(id, "2348030000034", tt.shortCode, ""))
+
+			resp := c.lastResponse(t)
+			if resp.UserData != tt.want || (resp.EndOfSession == 1) != tt.end {
+				t.Errorf("sent %q (EndofSession %d), want %q (end %v)", resp.UserData, resp.EndOfSession, tt.want, tt.end)
+			}
+			if called := calls.count() > before; called != tt.called {
+				t.Errorf("menu API called = %v, want %v", called, tt.called)
+			}
+			if _, open := Sessions.Get(id); open == tt.end {
+				t.Errorf("session open = %v after the request", open)
+			}
+		})
+	}
+}
+
+func TestRecentErrorsEndpoint(t *testing.T) {
+	t.Cleanup(keepRecentErrors)
+	withConfig(t, func(cfg *Config) {
+		cfg.APIToken = "errors-token"
+		cfg.RecentErrors = 3
+	})
+	keepRecentErrors()
+
+	AppLogger.Error("recent error 1")
+	MenuLogger.Info("not an error")
+	ErrorLogger.Error("recent error 2")
+	MenuLogger.Error("recent error 3")
+	RequestLogger.Warn("not an error either")
+	AppLogger.Error("recent error 4")
+
+	router := newRouter()
+	get := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/errors", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get(""); w.Code != http.StatusUnauthorized {
+		t.Errorf("without a token: status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w := get("errors-token")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", w.Code, http.StatusOK)
+	}
+	var body struct {
+		Errors []logger.Entry `json:"errors"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct{ source, message string }{
+		{"app", "recent error 4"},
+		{"menu", "recent error 3"},
+		{"error", "recent error 2"},
+	}
+	if len(body.Errors) != len(want) {
+		t.Fatalf("got %d errors, want %d: %+v", len(body.Errors), len(want), body.Errors)
+	}
+	for i, e := range body.Errors {
+		if e.Source != want[i].source || e.Message != want[i].message || e.Time.IsZero() {
+			t.Errorf("error %d = %+v, want %s from %s with a timestamp", i, e, want[i].message, want[i].source)
+		}
+	}
+}
+
+func TestMenuConsistency(t *testing.T) {
+	withLinkUp(t)
+
+	tests := []struct {
+		policy   string
+		menu     string
+		cont     bool
+		wantCont bool
+		warned   bool
+	}{
+		{menuConsistencyOff, "Welcome&#xA;1. Data", false, false, false},
+		{menuConsistencyWarn, "Welcome&#xA;1. Data", true, true, false},
+		{menuConsistencyWarn, "Welcome&#xA;1. Data", false, false, true},
+		{menuConsistencyWarn, "Your bundle is active.", true, true, true},
+		{menuConsistencyStrict, "Welcome&#xA;1. Data", false, true, true},
+		{menuConsistencyStrict, "Your bundle is active.", true, false, true},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.policy, i), func(t *testing.T) {
+			withConfig(t, func(cfg *Config) { cfg.MenuConsistency = tt.policy })
+			withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+				writeMenu(w, tt.menu, tt.cont)
+			})
+			id := fmt.Sprintf("CONSIST%d", i)
+			t.Cleanup(func() { Sessions.End(id) })
+			before := stats.InconsistentMenus.Load()
+
+			c := &captureConn{}
+			serve(t, c, testRequest(id, "2348030000038", "123", ""))
+			if got := c.lastResponse(t).EndOfSession == 0; got != tt.wantCont {
+				t.Errorf("sent continue %v, want %v", got, tt.wantCont)
+			}
+			if warned := stats.InconsistentMenus.Load() > before; warned != tt.warned {
+				t.Errorf("counted as inconsistent %v, want %v", warned, tt.warned)
+			}
+			warning := regexp.MustCompile(`WARN: Menu API response for 2348030000038 with code ` + id + ` `)
+			if warning.MatchString(readLog(t, "menu")) != tt.warned {
+				t.Errorf("warning logged %v, want %v", !tt.warned, tt.warned)
+			}
+		})
+	}
+}
+
+func TestInitialMenu(t *testing.T) {
+	withLinkUp(t)
+
+	tests := []struct {
+		name   string
+		warmUp bool
+	}{
+		{"static", false},
+		{"warm up", true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := withMenuRecorder(t, "Your balance is N100")
+			withConfig(t, func(cfg *Config) {
+				cfg.Routes = []Route{{ShortCode: "789", ProductID: 2, InitialMenu: "Welcome\n1. Balance", WarmUp: tt.warmUp}}
+			})
+			id := fmt.Sprintf("INITIAL%d", i)
+			t.Cleanup(func() { Sessions.End(id) })
+
+			c := &captureConn{}
+			serve(t, c, testRequest(id, "2348030000041", "789", ""))
+			if got := c.lastResponse(t); got.UserData != "Welcome\n1. Balance" || got.EndOfSession != 0 {
+				t.Errorf("first dial got %q (EndofSession %d), want the initial menu", got.UserData, got.EndOfSession)
+			}
+			if _, ok := Sessions.Get(id); !ok {
+				t.Error("no session open after the initial menu")
+			}
+
+			warmed := 0
+			if tt.warmUp {
+				warmed = 1
+				deadline := time.Now().Add(time.Second)
+				for calls.count() < 1 && time.Now().Before(deadline) {
+					time.Sleep(5 * time.Millisecond)
+				}
+			}
+			if n := calls.count(); n != warmed {
+				t.Fatalf("menu API called %d times for the first dial, want %d", n, warmed)
+			}
+
+			serve(t, c, testRequest(id, "2348030000041", "789", "1"))
+			if got := c.lastResponse(t).UserData; got != "Your balance is N100" {
+				t.Errorf("continuation got %q, want the menu API's answer", got)
+			}
+			if n := calls.count(); n != warmed+1 {
+				t.Errorf("menu API called %d times, want %d", n, warmed+1)
+			}
+		})
+	}
+}
+
+func TestMenuResponseDCS(t *testing.T) {
+	withLinkUp(t)
+	withConfig(t, func(cfg *Config) { cfg.TelcoDCS = map[string]int{defaultTelco: 72} })
+
+	tests := []struct {
+		name string
+		body map[string]any
+		want int
+	}{
+		{"telco default", map[string]any{"message": "Welcome", "continue": true}, 72},
+		{"menu API DCS", map[string]any{"message": "Welcome", "continue": true, "dcs": 0}, 0},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(tt.body)
+			})
+			id := fmt.Sprintf("MENUDCS%d", i)
+			t.Cleanup(func() { Sessions.End(id) })
+
+			c := &captureConn{}
+			serve(t, c, testRequest(id, "2348030000045", "123", ""))
+			if got := c.lastResponse(t).DCS; got != tt.want {
+				t.Errorf("sent DCS %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogRedaction(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "PIN accepted")
+	if err := logger.SetRedactions([]string{`"input":"(\d{4})"`, `UserData:(\d{4})\b`}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { logger.SetRedactions(AppConfig().LogRedact) })
+	t.Cleanup(func() { Sessions.End("REDACT1") })
+
+	c := &captureConn{}
+	serve(t, c, testRequest("REDACT1", "2348030000046", "123", ""))
+	serve(t, c, testRequest("REDACT1", "2348030000046", "123", "7391"))
+
+	if input := calls.lastJSON(t)["input"]; input != "7391" {
+		t.Errorf("menu API got input %v, want the real PIN", input)
+	}
+	for _, name := range []string{"requests", "menu", "log"} {
+		if strings.Contains(readLog(t, name), "7391") {
+			t.Errorf("PIN written to the %s log", name)
+		}
+	}
+	if !strings.Contains(readLog(t, "requests"), "UserData:****") {
+		t.Error("no masked PIN in the request log")
+	}
+}
+
+func TestMenuAPIStatuses(t *testing.T) {
+	withLinkUp(t)
+	withConfig(t, func(cfg *Config) {
+		cfg.MenuStatuses = map[string]StatusAction{
+			"503": {Action: statusActionError},
+			"201": {Action: statusActionEnd, Message: "Order placed."},
+		}
+	})
+
+	tests := []struct {
+		name   string
+		status int
+		want   string // "" when the call fails
+	}{
+		{"accepted", http.StatusAccepted, "Your request is being processed. You will be notified shortly."},
+		{"no content", http.StatusNoContent, "Thank you."},
+		{"configured end", http.StatusCreated, "Order placed."},
+		{"configured error", http.StatusServiceUnavailable, ""},
+		{"unlisted is parsed", http.StatusOK, "Welcome"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+				if tt.status == http.StatusOK {
+					writeMenu(w, "Welcome", true)
+					return
+				}
+				w.WriteHeader(tt.status)
+				if tt.status != http.StatusNoContent {
+					io.WriteString(w, `{"status": "queued"}`)
+				}
+			})
+			id := fmt.Sprintf("STATUS%d", i)
+			t.Cleanup(func() { Sessions.End(id) })
+			failures := stats.MenuAPIFailures.Load()
+
+			c := &captureConn{}
+			serve(t, c, testRequest(id, "2348030000047", "123", ""))
+
+			if tt.want == "" {
+				if got := c.lastResponse(t); got.UserData != AppConfig().UnavailableMessage || got.EndOfSession != 1 {
+					t.Errorf("sent %q (EndofSession %d), want %q ending the session", got.UserData, got.EndOfSession, AppConfig().UnavailableMessage)
+				}
+				if stats.MenuAPIFailures.Load() == failures {
+					t.Error("error status not counted as a menu API failure")
+				}
+				return
+			}
+			got := c.lastResponse(t)
+			if got.UserData != tt.want {
+				t.Errorf("sent %q, want %q", got.UserData, tt.want)
+			}
+			if stats.MenuAPIFailures.Load() != failures {
+				t.Error("counted as a menu API failure")
+			}
+			_, open := Sessions.Get(id)
+			if ended := got.EndOfSession == 1; ended == open || ended != (tt.status != http.StatusOK) {
+				t.Errorf("EndofSession %d with session open %v", got.EndOfSession, open)
+			}
+		})
+	}
+}
+
+func TestClosingMessage(t *testing.T) {
+	withLinkUp(t)
+	disabled, custom := "", "Dial *555# again soon"
+	withConfig(t, func(cfg *Config) {
+		cfg.ClosingMessage = "Thank you for using our service"
+		cfg.Routes = []Route{
+			{ShortCode: "555", ProductID: 2, ClosingMessage: &custom},
+			{ShortCode: "556", ProductID: 2, ClosingMessage: &disabled},
+		}
+	})
+	long := strings.Repeat("x", 170)
+
+	tests := []struct {
+		name      string
+		shortCode string
+		menu      string
+		cont      bool
+		want      string
+	}{
+		{"end", "123", "Bundle activated.", false, "Bundle activated.\nThank you for using our service"},
+		{"continue", "123", "1. Data", true, "1. Data"},
+		{"route override", "555", "Bundle activated.", false, "Bundle activated.\nDial *555# again soon"},
+		{"route disabled", "556", "Bundle activated.", false, "Bundle activated."},
+		{"too long", "123", long, false, long},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+				writeMenu(w, tt.menu, tt.cont)
+			})
+			id := fmt.Sprintf("CLOSING%d", i)
+			t.Cleanup(func() { Sessions.End(id) })
+
+			c := &captureConn{}
+			serve(t, c, testRequest(id, "2348030000048", tt.shortCode, ""))
+			if got := c.lastResponse(t).UserData; got != tt.want {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInputDecoding(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "Thanks")
+
+	tests := []struct {
+		decoding string
+		input    string
+		want     string
+	}{
+		{inputDecodingURL, "Lagos%20Island", "Lagos Island"},
+		{inputDecodingURL, "1%2B1", "1+1"},
+		{inputDecodingURL, "100%", "100%"},
+		{inputDecodingNone, "Lagos%20Island", "Lagos%20Island"},
+		{inputDecodingNone, "Lagos Island", "Lagos Island"},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tt.decoding, i), func(t *testing.T) {
+			withConfig(t, func(cfg *Config) { cfg.InputDecoding = tt.decoding })
+			id := fmt.Sprintf("DECODE%d", i)
+			t.Cleanup(func() { Sessions.End(id) })
+
+			c := &captureConn{}
+			serve(t, c, testRequest(id, "2348030000050", "123", tt.input))
+			if input := calls.lastJSON(t)["input"]; input != tt.want {
+				t.Errorf("menu API got input %q, want %q", input, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmptyInputReprompts(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "Welcome. 1. Balance")
+	withConfig(t, func(cfg *Config) { cfg.EmptyInputMessage = "Invalid input, please try again." })
+	t.Cleanup(func() { Sessions.End("EMPTY001") })
+
+	serve(t, &captureConn{}, testRequest("EMPTY001", "2348030000058", "123", ""))
+
+	c := &captureConn{}
+	req := testRequest("EMPTY001", "2348030000058", "123", "1")
+	req.UserData = ""
+	serve(t, c, req)
+
+	resp := c.lastResponse(t)
+	if want := "Invalid input, please try again.\nWelcome. 1. Balance"; resp.UserData != want || resp.EndOfSession != 0 {
+		t.Errorf("empty input answered %q (EndofSession %d), want %q keeping the session", resp.UserData, resp.EndOfSession, want)
+	}
+	if n := calls.count(); n != 1 {
+		t.Errorf("menu API called %d times, want only for the dial", n)
+	}
+	if _, ok := Sessions.Get("EMPTY001"); !ok {
+		t.Error("session ended by the empty input")
+	}
+}
+
+func TestEmptyInputWithoutSessionEnds(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "Welcome. 1. Balance")
+	withConfig(t, func(cfg *Config) { cfg.EmptyInputMessage = "Invalid input, please try again." })
+
+	c := &captureConn{}
+	req := testRequest("EMPTY002", "2348030000074", "123", "1")
+	req.UserData = ""
+	serve(t, c, req)
+
+	resp := c.lastResponse(t)
+	if resp.UserData != "Invalid input, please try again." || resp.EndOfSession != 1 {
+		t.Errorf("empty input answered %q (EndofSession %d), want the message ending the session", resp.UserData, resp.EndOfSession)
+	}
+	if n := calls.count(); n != 0 {
+		t.Errorf("menu API called %d times, want none", n)
+	}
+}
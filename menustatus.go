@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+)
+
+// Actions for an HTTP status answered by the menu API
+const (
+	statusActionParse = "parse" // read the body as a menu, the default
+	statusActionEnd   = "end"   // ignore the body and end the session with Message
+	statusActionError = "error" // treat the call as failed
+)
+
+// StatusAction is what to do with a menu API response of a given status.
+// Message is the text ending the session for the "end" action.
+type StatusAction struct {
+	Action  string `json:"action"`
+	Message string `json:"message"`
+}
+
+// Returned by getUssdMenu for a status mapped to the "error" action
+var errMenuAPIStatus = errors.New("menu API answered with an error status")
+
+// Statuses handled without menu_statuses: backends answer 202 when they
+// process the request asynchronously and 204 when there is nothing to show
+var defaultMenuStatuses = map[int]StatusAction{
+	http.StatusAccepted:  {Action: statusActionEnd, Message: "Your request is being processed. You will be notified shortly."},
+	http.StatusNoContent: {Action: statusActionEnd, Message: "Thank you."},
+}
+
+// menuStatusAction returns the action for a menu API response with the
+// given status: the configured one, else the default, else parse
+func (c *Config) menuStatusAction(status int) StatusAction {
+	if action, ok := c.MenuStatuses[strconv.Itoa(status)]; ok {
+		return action
+	}
+	if action, ok := defaultMenuStatuses[status]; ok {
+		return action
+	}
+	return StatusAction{Action: statusActionParse}
+}
+
+// validMenuStatus reports whether code names an HTTP status
+func validMenuStatus(code string) bool {
+	status, err := strconv.Atoi(code)
+	return err == nil && len(code) == 3 && status >= 100 && status <= 599
+}
+
+// validStatusAction reports whether action is a supported status action
+func validStatusAction(action StatusAction) bool {
+	switch action.Action {
+	case statusActionParse, statusActionError:
+		return true
+	case statusActionEnd:
+		return action.Message != ""
+	}
+	return false
+}
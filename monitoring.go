@@ -0,0 +1,74 @@
+//go:build !nomonitoring
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/jobs"
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+// monitoringMode is whether metrics are posted to the monitoring service
+type monitoringMode = jobs.MonitoringMode
+
+const monitoringDisabled = jobs.MonitoringDisabled
+
+// defaultMonitoringURL is the primary endpoint when MONITORING_URL is unset
+const defaultMonitoringURL = jobs.DefaultMonitoringURL
+
+// parseMonitoringMode converts a MONITORING_STATUS value
+func parseMonitoringMode(status string) (monitoringMode, error) {
+	return jobs.ParseMonitoringMode(status)
+}
+
+// applyMonitoring hands the monitoring settings of AppConfig to the jobs
+// package
+func applyMonitoring() {
+	jobs.SetMonitoringMode(AppConfig().MonitoringMode)
+	jobs.SetMonitoringURLs(AppConfig().MonitoringURL, AppConfig().MonitoringSecondaryURL)
+	if err := jobs.SetMetricQueue(AppConfig().MonitoringQueueDir, AppConfig().MonitoringQueueMax, AppConfig().MonitoringQueueMaxAge); err != nil {
+		log.Fatalf("Failed to set up the metric queue: %v", err)
+	}
+}
+
+// runMetricReplay replays the metrics queued under MONITORING_QUEUE_DIR
+// every MONITORING_QUEUE_RETRY until stop is closed
+func runMetricReplay(stop <-chan struct{}) {
+	if !AppConfig().MonitoringMode.Enabled() || AppConfig().MonitoringQueueDir == "" {
+		return
+	}
+	jobs.RunQueueReplay(AppConfig().MonitoringQueueRetry, stop)
+}
+
+// postMetric posts a metric in the background. Nothing is started while
+// monitoring is disabled.
+func postMetric(metric string, value int, context1, context2, details interface{}) {
+	if !AppConfig().MonitoringMode.Enabled() {
+		return
+	}
+	go jobs.NewPostMetricData(metric, value, context1, context2, details).Handle()
+}
+
+// monitoringStatus reports how metric posting is going for the health
+// endpoint: disabled, failing after MonitoringFailureThreshold failed posts
+// in a row, stale when none has succeeded (since start) for
+// MonitoringStaleAfter, or ok
+func monitoringStatus() string {
+	if !AppConfig().MonitoringMode.Enabled() {
+		return "disabled"
+	}
+	health := jobs.Health()
+	if health.ConsecutiveFailures >= AppConfig().MonitoringFailureThreshold {
+		return "failing"
+	}
+	lastSuccess := health.LastSuccess
+	if lastSuccess.IsZero() {
+		lastSuccess = stats.Take().Since
+	}
+	if time.Since(lastSuccess) > AppConfig().MonitoringStaleAfter {
+		return "stale"
+	}
+	return "ok"
+}
@@ -0,0 +1,37 @@
+//go:build nomonitoring
+
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// monitoringMode stands in for jobs.MonitoringMode in builds without the
+// monitoring package, where metrics are never posted
+type monitoringMode int
+
+const monitoringDisabled monitoringMode = 0
+
+func (monitoringMode) Enabled() bool  { return false }
+func (monitoringMode) String() string { return "excluded from this build" }
+
+// No endpoint in builds without monitoring
+const defaultMonitoringURL = ""
+
+// parseMonitoringMode rejects MONITORING_STATUS=ACTIVE, which this build
+// cannot honour
+func parseMonitoringMode(status string) (monitoringMode, error) {
+	if strings.EqualFold(strings.TrimSpace(status), "ACTIVE") {
+		return monitoringDisabled, errors.New("MONITORING_STATUS=ACTIVE but monitoring is excluded from this build (nomonitoring tag)")
+	}
+	return monitoringDisabled, nil
+}
+
+func applyMonitoring() {}
+
+func runMetricReplay(stop <-chan struct{}) {}
+
+func postMetric(metric string, value int, context1, context2, details interface{}) {}
+
+func monitoringStatus() string { return "disabled" }
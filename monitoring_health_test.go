@@ -0,0 +1,62 @@
+//go:build !nomonitoring
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/jobs"
+)
+
+func TestMonitoringHealth(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	}))
+	t.Cleanup(srv.Close)
+
+	// Registered first so it runs once the configuration is restored
+	t.Cleanup(applyMonitoring)
+	withConfig(t, func(cfg *Config) {
+		cfg.MonitoringMode = jobs.MonitoringEnabled
+		cfg.MonitoringURL = srv.URL
+		cfg.MonitoringSecondaryURL = ""
+		cfg.MonitoringFailureThreshold = 3
+		cfg.MonitoringStaleAfter = time.Hour
+	})
+	applyMonitoring()
+
+	post := func() { jobs.NewPostMetricData("ussd_count", 1, nil, nil, nil).Handle() }
+	expect := func(monitoring, overall string) {
+		t.Helper()
+		body := health(t)
+		if body["monitoring"] != monitoring || body["status"] != overall {
+			t.Errorf("health reported monitoring %v and status %v, want %s and %s", body["monitoring"], body["status"], monitoring, overall)
+		}
+	}
+
+	post()
+	expect("ok", "healthy")
+
+	status.Store(http.StatusInternalServerError)
+	post()
+	post()
+	expect("ok", "healthy") // 2 failures, below the threshold
+	post()
+	expect("failing", "degraded")
+
+	status.Store(http.StatusOK)
+	post()
+	expect("ok", "healthy")
+
+	withConfig(t, func(cfg *Config) { cfg.MonitoringStaleAfter = time.Nanosecond })
+	expect("stale", "healthy")
+
+	withConfig(t, func(cfg *Config) { cfg.MonitoringMode = jobs.MonitoringDisabled })
+	expect("disabled", "healthy")
+}
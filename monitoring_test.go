@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestNoMonitoringGoroutineWhenDisabled(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.MonitoringMode = monitoringDisabled })
+	t.Setenv("MONITORING_USSD_COUNT", "ussd_count")
+	t.Setenv("MONITORING_USSD_FAILURE", "ussd_failure")
+	t.Setenv("MONITORING_USSD_STEPS", "ussd_steps")
+
+	// Let goroutines of earlier tests settle before counting
+	time.Sleep(50 * time.Millisecond)
+	before := runtime.NumGoroutine()
+
+	req := testRequest("MON00001", "2348030000051", "123", "1")
+	for i := 0; i < 100; i++ {
+		UpdateMonitoringService(&req, "new", nil)
+		UpdateMonitoringService(&req, "Failed to get USSD menu", errors.New("boom"))
+		postMetric("ussd_steps", 3, req.MSISDN, req.RequestID, "Short code: 123")
+	}
+
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines after posting metrics with monitoring disabled, %d before", after, before)
+	}
+}
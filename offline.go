@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+// Values for OFFLINE_REQUESTS, what to do with a menu request that arrives
+// while we are not logged on to the server (e.g. between a drop and the
+// next logon), when its response could not be relied on to get through
+const (
+	offlineAnswer = "answer" // end the session with UNAVAILABLE_MESSAGE on the connection it came on
+	offlineDrop   = "drop"   // neither call the menu API nor answer
+)
+
+// Reported to monitoring for requests received while not logged on
+var errNotLoggedOn = errors.New("not logged on to the server")
+
+// handleOfflineRequest deals with req, received on conn while not logged
+// on, without calling the menu API. Either way it is counted and reported
+// to monitoring as a failure.
+func handleOfflineRequest(ctx context.Context, req USSDRequest, conn net.Conn) {
+	stats.OfflineRequests.Add(1)
+	AppLogger.Warn("Request %s from %s received while not logged on to the server", req.RequestID, req.MSISDN)
+
+	if AppConfig().OfflineRequests == offlineAnswer && conn != nil {
+		response := newUSSDResponse(req, AppConfig().UnavailableMessage, false)
+		err := sendUSSDResponse(ctx, conn, response)
+		requestRecordFrom(ctx).responded(response, err)
+		if err == nil {
+			UpdateMonitoringService(&req, "Not logged on, answered as unavailable", errNotLoggedOn)
+			return
+		}
+		AppLogger.Error("Failed to send unavailable response to %s with code %s: %v", req.MSISDN, req.RequestID, err)
+	}
+
+	AppLogger.Warn("Dropping request %s from %s: %v", req.RequestID, req.MSISDN, errNotLoggedOn)
+	UpdateMonitoringService(&req, "Not logged on, request dropped", errNotLoggedOn)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+func TestRequestWhileNotLoggedOn(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		answered bool
+	}{
+		{"answer", offlineAnswer, true},
+		{"drop", offlineDrop, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := withMenuRecorder(t, "Welcome. 1. Balance")
+			withConfig(t, func(cfg *Config) { cfg.OfflineRequests = tt.policy })
+			// Dropped and not yet logged on again, as during a reconnect
+			linkUp.Store(false)
+
+			before := stats.OfflineRequests.Load()
+			c := &captureConn{}
+			id := "OFFLINE0" + string(rune('1'+i))
+			serve(t, c, testRequest(id, "2348030000052", "123", ""))
+
+			if n := calls.count(); n != 0 {
+				t.Errorf("menu API called %d times while not logged on", n)
+			}
+			if got := stats.OfflineRequests.Load() - before; got != 1 {
+				t.Errorf("offline_requests grew by %d, want 1", got)
+			}
+			if _, ok := Sessions.Get(id); ok {
+				t.Errorf("session %s opened while not logged on", id)
+			}
+
+			responses := c.responses(t)
+			if !tt.answered {
+				if len(responses) != 0 {
+					t.Errorf("dropped request answered with %+v", responses)
+				}
+				return
+			}
+			if len(responses) != 1 {
+				t.Fatalf("%d responses, want 1", len(responses))
+			}
+			if resp := responses[0]; resp.UserData != AppConfig().UnavailableMessage || resp.EndOfSession != 1 {
+				t.Errorf("answered %q (EndofSession %d), want %q ending the session", resp.UserData, resp.EndOfSession, AppConfig().UnavailableMessage)
+			}
+		})
+	}
+}
@@ -0,0 +1,20 @@
+package errorsController
+
+import (
+	"net/http"
+
+	"github.com/abeloha/USSDTCP/pkg/logger"
+	"github.com/gin-gonic/gin"
+)
+
+type ErrorsController struct {
+	// Recent returns the latest ERROR entries, newest first
+	Recent func() []logger.Entry
+}
+
+// Index returns the latest ERROR entries of all logs, newest first
+func (c *ErrorsController) Index(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"errors": c.Recent(),
+	})
+}
@@ -0,0 +1,49 @@
+package pushController
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrConnectionDown is returned by PushFunc when there is no logged-on
+// connection to the USSD server
+var ErrConnectionDown = errors.New("connection to USSD server is down")
+
+// PushFunc sends message to msisdn as a network-initiated USSD session and
+// returns the ID of the new session
+type PushFunc func(msisdn, shortCode, message string) (string, error)
+
+type PushController struct {
+	Push PushFunc
+}
+
+type pushRequest struct {
+	MSISDN    string `json:"msisdn" binding:"required"`
+	ShortCode string `json:"short_code" binding:"required"`
+	Message   string `json:"message" binding:"required"`
+}
+
+func (c *PushController) Store(ctx *gin.Context) {
+	var req pushRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sessionID, err := c.Push(req.MSISDN, req.ShortCode, req.Message)
+	if errors.Is(err, ErrConnectionDown) {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"session_id": sessionID,
+		"msisdn":     req.MSISDN,
+	})
+}
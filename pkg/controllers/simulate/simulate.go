@@ -0,0 +1,51 @@
+package simulateController
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StepFunc plays input as the next step of the simulated session named by
+// token, starting one when there is none, and returns the message the
+// subscriber would see and whether the session continues
+type StepFunc func(token, msisdn, shortCode, input string) (message string, cont bool, err error)
+
+// Returned by a StepFunc that cannot begin another simulated session
+var ErrTooManySimulations = errors.New("too many simulated sessions open")
+
+type SimulateController struct {
+	Step StepFunc
+}
+
+type simulateRequest struct {
+	SessionToken string `json:"session_token" binding:"required"`
+	MSISDN       string `json:"msisdn" binding:"required"`
+	ShortCode    string `json:"short_code" binding:"required"`
+	Input        string `json:"input"`
+}
+
+func (c *SimulateController) Store(ctx *gin.Context) {
+	var req simulateRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	message, cont, err := c.Step(req.SessionToken, req.MSISDN, req.ShortCode, req.Input)
+	if errors.Is(err, ErrTooManySimulations) {
+		ctx.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"session_token": req.SessionToken,
+		"message":       message,
+		"continue":      cont,
+	})
+}
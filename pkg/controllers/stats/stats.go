@@ -0,0 +1,53 @@
+package statsController
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/abeloha/USSDTCP/pkg/session"
+	"github.com/abeloha/USSDTCP/pkg/stats"
+	"github.com/gin-gonic/gin"
+)
+
+type StatsController struct {
+	// ActiveSessions reports the current number of open sessions
+	ActiveSessions func() int
+
+	// Sessions summarises the open sessions
+	Sessions func() session.Snapshot
+
+	// Connections reports the health of the server connections
+	Connections func() []stats.ConnectionHealth
+}
+
+// Index returns the counters since start (?since=start, the default) or
+// since the previous ?since=last call
+func (c *StatsController) Index(ctx *gin.Context) {
+	var snapshot stats.Snapshot
+	switch ctx.DefaultQuery("since", "start") {
+	case "start":
+		snapshot = stats.Take()
+	case "last":
+		snapshot = stats.SinceLast()
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "since must be start or last"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{
+		"counters":        snapshot,
+		"active_sessions": c.ActiveSessions(),
+		"sessions":        c.Sessions(),
+		"connections":     c.Connections(),
+	})
+}
+
+// Metrics returns the counters since start in the Prometheus text format
+func (c *StatsController) Metrics(ctx *gin.Context) {
+	var buf bytes.Buffer
+	stats.WritePrometheus(&buf, stats.Take())
+	fmt.Fprintf(&buf, "# HELP ussdtcp_active_sessions Open sessions\n# TYPE ussdtcp_active_sessions gauge\nussdtcp_active_sessions %d\n", c.ActiveSessions())
+
+	ctx.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
@@ -2,39 +2,150 @@ package systemHealthController
 
 import (
 	"fmt"
+	"net/http"
 	"os/exec"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/abeloha/USSDTCP/pkg/session"
 	"github.com/gin-gonic/gin"
 )
 
 type SystemHealthController struct {
-	
+	// LogStorage returns why logs cannot be written, nil while they can
+	LogStorage func() error
+
+	// LogLinesDropped returns how many log lines could not be written to
+	// their log file
+	LogLinesDropped func() int64
+
+	// Ready reports whether the gateway is logged on and its link confirmed
+	Ready func() bool
+
+	// Sessions summarises the open sessions
+	Sessions func() session.Snapshot
+
+	// Monitoring reports how metric posting is going: ok, failing, stale
+	// or disabled
+	Monitoring func() string
+
+	// HostUsage measures the CPU, RAM and disk usage of the host; nil for
+	// the built-in collectors
+	HostUsage func() HostUsage
+
+	// How long a measurement of host usage is served before it is taken
+	// again (0 to take one on every request). Up to twice that it is still
+	// served while a fresh one is taken in the background.
+	HostUsageTTL time.Duration
+
+	hostUsage struct {
+		sync.Mutex
+		value   HostUsage
+		takenAt time.Time
+		// Closed once the measurement in progress is taken; nil when none is
+		pending chan struct{}
+	}
+}
+
+// HostUsage is the load of the host running the gateway
+type HostUsage struct {
+	CPU  float64
+	RAM  float64
+	Disk map[string]interface{}
+}
+
+// Readyz answers 200 once the gateway can serve requests, 503 until then
+// (e.g. while still connecting at startup)
+func (c *SystemHealthController) Readyz(ctx *gin.Context) {
+	if !c.Ready() {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"status": "ready"})
 }
 
 func (c *SystemHealthController) Index(ctx *gin.Context) {
-	cpuUsage := c.getCpuUsage()
-	ramUsage := c.getRamUsage()
-	diskUsage := c.getDiskUsage()
+	host := c.getHostUsage()
 	dbActive := c.isDatabaseActive()
 	dbConnections := c.getDatabaseConnections()
 	redisHealth := c.getRedisHealth()
+	logStorage := c.getLogStorage()
+	monitoring := c.getMonitoring()
+
+	status := "healthy"
+	if logStorage != "ok" || monitoring == "failing" {
+		status = "degraded"
+	}
 
 	ctx.JSON(200, gin.H{
-		"cpu_usage":            cpuUsage,
-		"ram_usage":            ramUsage,
-		"disk_usage":           diskUsage,
+		"status":               status,
+		"cpu_usage":            host.CPU,
+		"ram_usage":            host.RAM,
+		"disk_usage":           host.Disk,
 		"db_active":            dbActive,
 		"active_db_connections": dbConnections,
 		"redis_active":         redisHealth,
+		"log_storage":          logStorage,
+		"log_lines_dropped":    c.getLogLinesDropped(),
+		"monitoring":           monitoring,
+		"sessions":             c.Sessions(),
 	})
 
 
 	
 
+}
+
+// getHostUsage returns the latest measurement of host usage, taking a new
+// one when it is older than HostUsageTTL
+func (c *SystemHealthController) getHostUsage() HostUsage {
+	measure := c.HostUsage
+	if measure == nil {
+		measure = c.measureHostUsage
+	}
+	if c.HostUsageTTL <= 0 {
+		return measure()
+	}
+
+	// Measurements are taken outside the lock, one at a time; callers
+	// without a value recent enough to serve wait for the one in progress
+	c.hostUsage.Lock()
+	age := time.Since(c.hostUsage.takenAt)
+	stale := c.hostUsage.takenAt.IsZero() || age >= 2*c.HostUsageTTL
+	if age >= c.HostUsageTTL && c.hostUsage.pending == nil {
+		c.hostUsage.pending = make(chan struct{})
+		go c.refreshHostUsage(measure, c.hostUsage.pending)
+	}
+	pending, value := c.hostUsage.pending, c.hostUsage.value
+	c.hostUsage.Unlock()
+
+	if stale {
+		<-pending
+		c.hostUsage.Lock()
+		value = c.hostUsage.value
+		c.hostUsage.Unlock()
+	}
+	return value
+}
+
+// refreshHostUsage takes a measurement of host usage and stores it,
+// closing done once it is
+func (c *SystemHealthController) refreshHostUsage(measure func() HostUsage, done chan struct{}) {
+	value := measure()
+	c.hostUsage.Lock()
+	c.hostUsage.value, c.hostUsage.takenAt = value, time.Now()
+	c.hostUsage.pending = nil
+	c.hostUsage.Unlock()
+	close(done)
+}
+
+// measureHostUsage runs the built-in collectors
+func (c *SystemHealthController) measureHostUsage() HostUsage {
+	return HostUsage{CPU: c.getCpuUsage(), RAM: c.getRamUsage(), Disk: c.getDiskUsage()}
 }
 
 func (c *SystemHealthController) getCpuUsage() float64 {
@@ -101,6 +212,33 @@ func (c *SystemHealthController) getDatabaseConnections() int {
 	return 0
 }
 
+// getLogStorage reports "ok" while the log directories are writable and
+// "failing" once a probe found one that is not
+func (c *SystemHealthController) getLogStorage() string {
+	if c.LogStorage != nil && c.LogStorage() != nil {
+		return "failing"
+	}
+	return "ok"
+}
+
+// getLogLinesDropped returns the log lines dropped so far, 0 when no
+// LogLinesDropped func is set
+func (c *SystemHealthController) getLogLinesDropped() int64 {
+	if c.LogLinesDropped == nil {
+		return 0
+	}
+	return c.LogLinesDropped()
+}
+
+// getMonitoring reports how metric posting is going, "disabled" when no
+// Monitoring func is set
+func (c *SystemHealthController) getMonitoring() string {
+	if c.Monitoring == nil {
+		return "disabled"
+	}
+	return c.Monitoring()
+}
+
 func (c *SystemHealthController) getRedisHealth() bool {
 	return true
 }
\ No newline at end of file
@@ -0,0 +1,84 @@
+package systemHealthController
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHostUsageCached(t *testing.T) {
+	var measured atomic.Int32
+	controller := &SystemHealthController{
+		HostUsage: func() HostUsage {
+			measured.Add(1)
+			return HostUsage{CPU: 0.5}
+		},
+		HostUsageTTL: 100 * time.Millisecond,
+	}
+
+	for i := 0; i < 10; i++ {
+		if got := controller.getHostUsage(); got.CPU != 0.5 {
+			t.Fatalf("getHostUsage() = %+v, want the measurement", got)
+		}
+	}
+	if got := measured.Load(); got != 1 {
+		t.Errorf("host usage measured %d times for 10 polls within the TTL, want 1", got)
+	}
+
+	// Stale: served as is while a fresh measurement is taken
+	time.Sleep(120 * time.Millisecond)
+	controller.getHostUsage()
+	deadline := time.Now().Add(time.Second)
+	for measured.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := measured.Load(); got != 2 {
+		t.Errorf("host usage measured %d times after the TTL, want 2", got)
+	}
+}
+
+func TestHostUsageMeasuredOnce(t *testing.T) {
+	var measured atomic.Int32
+	release := make(chan struct{})
+	controller := &SystemHealthController{
+		HostUsage: func() HostUsage {
+			measured.Add(1)
+			<-release
+			return HostUsage{CPU: 0.5}
+		},
+		HostUsageTTL: time.Minute,
+	}
+
+	// Polls arriving while the first measurement is taken wait for it
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := controller.getHostUsage(); got.CPU != 0.5 {
+				t.Errorf("getHostUsage() = %+v, want the measurement", got)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// The lock is not held while measuring
+	locked := make(chan struct{})
+	go func() {
+		controller.hostUsage.Lock()
+		controller.hostUsage.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("host usage locked while measuring")
+	}
+
+	close(release)
+	wg.Wait()
+	if got := measured.Load(); got != 1 {
+		t.Errorf("host usage measured %d times for concurrent polls, want 1", got)
+	}
+}
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/abeloha/USSDTCP/pkg/logger"
 	"github.com/joho/godotenv"
@@ -34,13 +38,78 @@ func getLogger(channel string) (*logger.Logger, error) {
 	
 }
 
+// MonitoringMode controls whether metrics are posted to the monitoring service
+type MonitoringMode int
+
+const (
+	MonitoringDefault  MonitoringMode = iota // MONITORING_STATUS unset, treated as disabled
+	MonitoringEnabled                        // MONITORING_STATUS=ACTIVE
+	MonitoringDisabled                       // MONITORING_STATUS=INACTIVE
+)
+
+// Mode applied by Handle; set once at startup through SetMonitoringMode
+var monitoringMode = MonitoringDefault
+
+// ParseMonitoringMode converts a MONITORING_STATUS value into a MonitoringMode
+func ParseMonitoringMode(status string) (MonitoringMode, error) {
+	switch strings.ToUpper(strings.TrimSpace(status)) {
+	case "":
+		return MonitoringDefault, nil
+	case "ACTIVE":
+		return MonitoringEnabled, nil
+	case "INACTIVE":
+		return MonitoringDisabled, nil
+	}
+	return MonitoringDefault, fmt.Errorf("invalid MONITORING_STATUS %q: expected ACTIVE or INACTIVE", status)
+}
+
+// Enabled reports whether metrics should be posted. Only an explicit
+// ACTIVE enables monitoring.
+func (m MonitoringMode) Enabled() bool {
+	return m == MonitoringEnabled
+}
+
+func (m MonitoringMode) String() string {
+	switch m {
+	case MonitoringEnabled:
+		return "enabled"
+	case MonitoringDisabled:
+		return "disabled"
+	}
+	return "default (disabled)"
+}
+
+// SetMonitoringMode sets the mode used by all subsequent metric posts
+func SetMonitoringMode(m MonitoringMode) {
+	monitoringMode = m
+}
+
+// DefaultMonitoringURL is the primary monitoring endpoint when
+// MONITORING_URL is not set
+const DefaultMonitoringURL = "http://164.92.240.63:8000/api/update_metrics"
+
+// Endpoints used by NewPostMetricData; set once at startup through
+// SetMonitoringURLs
+var (
+	monitoringURL          = DefaultMonitoringURL
+	monitoringSecondaryURL string
+)
+
+// SetMonitoringURLs sets the primary endpoint and the secondary one metrics
+// fall back to when the primary fails (empty for no failover)
+func SetMonitoringURLs(primary, secondary string) {
+	monitoringURL = primary
+	monitoringSecondaryURL = secondary
+}
+
 type PostMetricData struct {
-	URL      string
-	Metric   string
-	Value    interface{}
-	Context1 interface{}
-	Context2 interface{}
-	Details  interface{}
+	URL          string
+	SecondaryURL string
+	Metric       string
+	Value        interface{}
+	Context1     interface{}
+	Context2     interface{}
+	Details      interface{}
 }
 
 
@@ -48,30 +117,22 @@ type PostMetricData struct {
 // all interface is nullable string
 func NewPostMetricData(metric string, value int, context1, context2, details interface{}) *PostMetricData {
 	return &PostMetricData{
-		URL:      "http://164.92.240.63:8000/api/update_metrics",
-		Metric:   metric,
-		Value:    value,
-		Context1: context1,
-		Context2: context2,
-		Details:  details,
+		URL:          monitoringURL,
+		SecondaryURL: monitoringSecondaryURL,
+		Metric:       metric,
+		Value:        value,
+		Context1:     context1,
+		Context2:     context2,
+		Details:      details,
 	}
 }
 
 func (p *PostMetricData) Handle() {
-
-
-
-	errorLogger, err := getLogger("error")
-
-	monitoringStatus := os.Getenv("MONITORING_STATUS")
-	if monitoringStatus == "INACTIVE" {
+	if !monitoringMode.Enabled() {
 		return
 	}
 
-	
-	if errorLogger != nil {
-		errorLogger.Error("Test2")
-	}
+	errorLogger, err := getLogger("error")
 
 	data := map[string]interface{}{
 		"api_key":   os.Getenv("MONITORING_API_KEY"),
@@ -84,38 +145,117 @@ func (p *PostMetricData) Handle() {
 
 	jsonData, err := json.Marshal(data)
 	if err != nil {
+		recordPost(false)
 		if errorLogger != nil {
 		errorLogger.Error("Failed to marshal data: %v", err)
 		}
 		return
 	}
 
-	req, err := http.NewRequest("POST", p.URL, bytes.NewBuffer(jsonData))
-	if err != nil {
+	if err := postToEndpoints(p.URL, p.SecondaryURL, jsonData, errorLogger); err == nil {
+		recordPost(true)
+		return
+	}
+	recordPost(false)
+
+	if queue == nil {
+		return
+	}
+	if err := queue.push(jsonData); err != nil {
 		if errorLogger != nil {
-		errorLogger.Error("Failed to create request: %v", err)
+			errorLogger.Error("Failed to queue metric data for replay: %v", err)
+		}
+	}
+}
+
+// postToEndpoints posts body to primary, falling back to secondary (if
+// set), and returns the last error when neither accepts it. Each attempt is
+// logged to errorLogger when it is not nil.
+func postToEndpoints(primary, secondary string, body []byte, errorLogger *logger.Logger) error {
+	err := fmt.Errorf("no monitoring endpoint")
+	endpoints := []struct{ name, url string }{{"primary", primary}, {"secondary", secondary}}
+	for _, endpoint := range endpoints {
+		if endpoint.url == "" {
+			continue
+		}
+		err = postMetric(endpoint.url, body)
+		if err == nil {
+			if errorLogger != nil {
+				errorLogger.Error("Metric data posted successfully to %s endpoint %s", endpoint.name, endpoint.url)
+			}
+			return nil
 		}
+		if errorLogger != nil {
+			errorLogger.Error("Failed to post metric data to %s endpoint %s: %v", endpoint.name, endpoint.url, err)
+		}
+	}
+	return err
+}
+
+// PostHealth summarises the outcome of recent metric posts. A post
+// succeeds when any endpoint accepts it.
+type PostHealth struct {
+	LastSuccess         time.Time
+	LastFailure         time.Time
+	ConsecutiveFailures int
+}
+
+var postHealth struct {
+	mu sync.Mutex
+	PostHealth
+}
+
+// recordPost notes the outcome of a metric post
+func recordPost(ok bool) {
+	postHealth.mu.Lock()
+	defer postHealth.mu.Unlock()
+	if ok {
+		postHealth.LastSuccess = time.Now()
+		postHealth.ConsecutiveFailures = 0
 		return
 	}
+	postHealth.LastFailure = time.Now()
+	postHealth.ConsecutiveFailures++
+}
+
+// Health returns the outcome of recent metric posts
+func Health() PostHealth {
+	postHealth.mu.Lock()
+	defer postHealth.mu.Unlock()
+	return postHealth.PostHealth
+}
+
+// Shared so keep-alive connections to the monitoring service are reused
+var metricClient = &http.Client{}
 
+// Most bytes drainAndClose reads from a response body. A longer remainder
+// is not worth waiting for: the connection is closed instead of reused.
+const maxDrain = 64 << 10
+
+// drainAndClose reads what is left of a response body, up to maxDrain,
+// before closing it, which lets the transport reuse the connection
+func drainAndClose(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, maxDrain))
+	body.Close()
+}
+
+// postMetric posts body to url, failing on a transport error or a non-2xx
+// status
+func postMetric(url string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return fmt.Errorf("create request: %w", err)
+	}
 	req.Header.Set("Content-Type", "application/json")
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := metricClient.Do(req)
 	if err != nil {
-		if errorLogger != nil {
-		errorLogger.Error("Failed to post metric data: %v", err)
-		}
-		return
+		return err
 	}
-	defer resp.Body.Close()
+	defer drainAndClose(resp.Body)
 
-	logMsg := ""
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		logMsg = fmt.Sprint("Metric data posted successfully. Status: %v", resp.Status)
-		errorLogger.Error(logMsg)
-	} else {
-		logMsg = fmt.Sprint("Failed to post metric data. Status: %v", resp.Status)
-		errorLogger.Error(logMsg)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("status %v", resp.Status)
 	}
-}
\ No newline at end of file
+	return nil
+}
@@ -0,0 +1,172 @@
+package jobs
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+)
+
+// TestMain keeps the monitoring logs out of the source tree
+func TestMain(m *testing.M) {
+	logPath, err := os.MkdirTemp("", "ussdtcp-jobs-test")
+	if err != nil {
+		log.Fatalf("Failed to create log directory: %v", err)
+	}
+	os.Setenv("LOG_PATH", logPath)
+
+	code := m.Run()
+	os.RemoveAll(logPath)
+	os.Exit(code)
+}
+
+// withMode runs the rest of the test with monitoring in mode
+func withMode(t *testing.T, mode MonitoringMode) {
+	t.Helper()
+	saved := monitoringMode
+	SetMonitoringMode(mode)
+	t.Cleanup(func() { SetMonitoringMode(saved) })
+}
+
+// metricServer returns a monitoring endpoint answering with status and
+// counting the posts it receives
+func metricServer(t *testing.T, status int) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var posts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		posts.Add(1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &posts
+}
+
+func TestParseMonitoringMode(t *testing.T) {
+	tests := []struct {
+		status  string
+		want    MonitoringMode
+		enabled bool
+		wantErr bool
+	}{
+		{"ACTIVE", MonitoringEnabled, true, false},
+		{" active ", MonitoringEnabled, true, false},
+		{"INACTIVE", MonitoringDisabled, false, false},
+		{"", MonitoringDefault, false, false},
+		{"sometimes", MonitoringDefault, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			got, err := ParseMonitoringMode(tt.status)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseMonitoringMode(%q) error = %v, want error %v", tt.status, err, tt.wantErr)
+			}
+			if got != tt.want || got.Enabled() != tt.enabled {
+				t.Errorf("ParseMonitoringMode(%q) = %v (enabled %v), want %v (enabled %v)", tt.status, got, got.Enabled(), tt.want, tt.enabled)
+			}
+		})
+	}
+}
+
+func TestHandlePostsOnlyWhenEnabled(t *testing.T) {
+	tests := []struct {
+		mode  MonitoringMode
+		posts int32
+	}{
+		{MonitoringEnabled, 1},
+		{MonitoringDisabled, 0},
+		{MonitoringDefault, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode.String(), func(t *testing.T) {
+			withMode(t, tt.mode)
+			srv, posts := metricServer(t, http.StatusOK)
+
+			metric := NewPostMetricData("requests", 1, nil, nil, nil)
+			metric.URL = srv.URL
+			metric.Handle()
+
+			if got := posts.Load(); got != tt.posts {
+				t.Errorf("%d posts, want %d", got, tt.posts)
+			}
+		})
+	}
+}
+
+func TestHandleFailsOverToSecondary(t *testing.T) {
+	tests := []struct {
+		name          string
+		primaryStatus int
+		primary       int32
+		secondary     int32
+	}{
+		{"primary up", http.StatusOK, 1, 0},
+		{"primary 5xx", http.StatusServiceUnavailable, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMode(t, MonitoringEnabled)
+			primary, primaryPosts := metricServer(t, tt.primaryStatus)
+			secondary, secondaryPosts := metricServer(t, http.StatusOK)
+
+			saved, savedSecondary := monitoringURL, monitoringSecondaryURL
+			SetMonitoringURLs(primary.URL, secondary.URL)
+			t.Cleanup(func() { SetMonitoringURLs(saved, savedSecondary) })
+
+			NewPostMetricData("requests", 1, nil, nil, nil).Handle()
+
+			if got := primaryPosts.Load(); got != tt.primary {
+				t.Errorf("%d posts to the primary, want %d", got, tt.primary)
+			}
+			if got := secondaryPosts.Load(); got != tt.secondary {
+				t.Errorf("%d posts to the secondary, want %d", got, tt.secondary)
+			}
+		})
+	}
+}
+
+func TestPostMetricReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An error page the caller never reads, short enough to drain
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(bytes.Repeat([]byte("unavailable "), maxDrain/20))
+	}))
+	srv.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	for i := 0; i < 3; i++ {
+		if err := postMetric(srv.URL, []byte(`{}`)); err == nil {
+			t.Fatal("postMetric succeeded on a 500")
+		}
+	}
+	if got := conns.Load(); got != 1 {
+		t.Errorf("%d connections for 3 sequential posts, want 1", got)
+	}
+}
+
+// endlessBody is a response body that never ends, counting what is read
+type endlessBody struct{ read int }
+
+func (b *endlessBody) Read(p []byte) (int, error) {
+	b.read += len(p)
+	return len(p), nil
+}
+
+func (b *endlessBody) Close() error { return nil }
+
+func TestDrainBounded(t *testing.T) {
+	body := &endlessBody{}
+	drainAndClose(body)
+	if body.read != maxDrain {
+		t.Errorf("drained %d bytes, want %d", body.read, maxDrain)
+	}
+}
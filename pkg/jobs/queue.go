@@ -0,0 +1,198 @@
+package jobs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricQueue keeps, one file each, the payloads of metric posts that
+// failed on every endpoint so they can be replayed once the monitoring
+// service recovers. It holds at most maxSize payloads, dropping the oldest,
+// and none older than maxAge.
+type metricQueue struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int
+	maxAge  time.Duration
+	seq     uint64
+
+	// Names of the queued payloads, oldest first, as in dir
+	names []string
+
+	// Held for the whole of a replay, so that two never post the same
+	// payload
+	replaying sync.Mutex
+}
+
+// Queue failed posts are persisted to; nil when disabled. Set once at
+// startup through SetMetricQueue.
+var queue *metricQueue
+
+// SetMetricQueue persists failed metric posts under dir, keeping at most
+// maxSize of them for at most maxAge. An empty dir disables the queue.
+func SetMetricQueue(dir string, maxSize int, maxAge time.Duration) error {
+	if dir == "" {
+		queue = nil
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("create metric queue directory: %w", err)
+	}
+	q := &metricQueue{dir: dir, maxSize: maxSize, maxAge: maxAge}
+	names, err := q.entries()
+	if err != nil {
+		return fmt.Errorf("read metric queue directory: %w", err)
+	}
+	q.names = names
+	queue = q
+	return nil
+}
+
+// QueuedMetrics returns how many failed posts are waiting to be replayed
+func QueuedMetrics() int {
+	if queue == nil {
+		return 0
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return len(queue.names)
+}
+
+// push persists payload, then evicts what no longer fits the bounds
+func (q *metricQueue) push(payload []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	name := fmt.Sprintf("%019d-%06d.json", time.Now().UnixNano(), q.seq%1000000)
+	tmp := filepath.Join(q.dir, name+".tmp")
+	if err := os.WriteFile(tmp, payload, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(q.dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	q.names = append(q.names, name)
+	q.evict()
+	return nil
+}
+
+// entries returns the names of the payloads queued in dir, oldest first
+func (q *metricQueue) entries() ([]string, error) {
+	files, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// evict removes payloads older than maxAge and, beyond maxSize, the oldest
+// ones. It returns the names left, oldest first. q.mu must be held.
+func (q *metricQueue) evict() []string {
+	cutoff := time.Now().Add(-q.maxAge).UnixNano()
+	kept := q.names[:0]
+	for i, name := range q.names {
+		if queuedAt(name) < cutoff || len(q.names)-i > q.maxSize {
+			os.Remove(filepath.Join(q.dir, name))
+			continue
+		}
+		kept = append(kept, name)
+	}
+	q.names = kept
+	return kept
+}
+
+// remove deletes the payload in the file name from the queue, unless it
+// was evicted already
+func (q *metricQueue) remove(name string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, queued := range q.names {
+		if queued == name {
+			q.names = append(q.names[:i], q.names[i+1:]...)
+			os.Remove(filepath.Join(q.dir, name))
+			return
+		}
+	}
+}
+
+// queuedAt returns when the payload in the file name was queued, in Unix
+// nanoseconds
+func queuedAt(name string) int64 {
+	stamp, _, _ := strings.Cut(name, "-")
+	n, _ := strconv.ParseInt(stamp, 10, 64)
+	return n
+}
+
+// ReplayQueued posts the queued payloads, oldest first, removing each one
+// accepted. It stops at the first that fails, as the service is still down,
+// and returns how many were replayed. The queue is not locked while
+// posting, so failed posts keep being queued meanwhile.
+func ReplayQueued() (int, error) {
+	q := queue
+	if q == nil {
+		return 0, nil
+	}
+	q.replaying.Lock()
+	defer q.replaying.Unlock()
+
+	q.mu.Lock()
+	names := append([]string(nil), q.evict()...)
+	q.mu.Unlock()
+
+	replayed := 0
+	for _, name := range names {
+		payload, err := os.ReadFile(filepath.Join(q.dir, name))
+		if err != nil {
+			q.remove(name)
+			continue
+		}
+		if err := postToEndpoints(monitoringURL, monitoringSecondaryURL, payload, nil); err != nil {
+			return replayed, err
+		}
+		recordPost(true)
+		q.remove(name)
+		replayed++
+	}
+	return replayed, nil
+}
+
+// RunQueueReplay replays the queued payloads every interval until stop is
+// closed
+func RunQueueReplay(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !monitoringMode.Enabled() || QueuedMetrics() == 0 {
+				continue
+			}
+			replayed, err := ReplayQueued()
+			if errorLogger, _ := getLogger("error"); errorLogger != nil {
+				if err != nil {
+					errorLogger.Error("Replayed %d queued metrics, then failed: %v", replayed, err)
+				} else {
+					errorLogger.Info("Replayed %d queued metrics", replayed)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package jobs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// withQueue runs the rest of the test with failed posts queued in a
+// temporary directory
+func withQueue(t *testing.T, maxSize int, maxAge time.Duration) {
+	t.Helper()
+	saved := queue
+	if err := SetMetricQueue(t.TempDir(), maxSize, maxAge); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { queue = saved })
+}
+
+// withURLs runs the rest of the test posting to primary only
+func withURLs(t *testing.T, primary string) {
+	t.Helper()
+	saved, savedSecondary := monitoringURL, monitoringSecondaryURL
+	SetMonitoringURLs(primary, "")
+	t.Cleanup(func() { SetMonitoringURLs(saved, savedSecondary) })
+}
+
+func TestFailedMetricsQueuedAndReplayed(t *testing.T) {
+	withMode(t, MonitoringEnabled)
+	withQueue(t, 100, time.Hour)
+
+	var (
+		up      atomic.Bool
+		mu      sync.Mutex
+		metrics []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !up.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var data map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&data)
+		mu.Lock()
+		metrics = append(metrics, data["metric"].(string))
+		mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	withURLs(t, srv.URL)
+
+	NewPostMetricData("first", 1, nil, nil, nil).Handle()
+	NewPostMetricData("second", 1, nil, nil, nil).Handle()
+	if got := QueuedMetrics(); got != 2 {
+		t.Fatalf("%d metrics queued after failed posts, want 2", got)
+	}
+
+	// Still down: nothing is lost
+	if replayed, err := ReplayQueued(); err == nil || replayed != 0 {
+		t.Errorf("ReplayQueued() = %d, %v while down, want 0 and an error", replayed, err)
+	}
+	if got := QueuedMetrics(); got != 2 {
+		t.Fatalf("%d metrics queued after a failed replay, want 2", got)
+	}
+
+	up.Store(true)
+	if replayed, err := ReplayQueued(); err != nil || replayed != 2 {
+		t.Errorf("ReplayQueued() = %d, %v, want 2 and no error", replayed, err)
+	}
+	if got := QueuedMetrics(); got != 0 {
+		t.Errorf("%d metrics still queued after the replay, want 0", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(metrics) != 2 || metrics[0] != "first" || metrics[1] != "second" {
+		t.Errorf("replayed %v, want [first second]", metrics)
+	}
+}
+
+func TestMetricQueueBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		maxSize int
+		maxAge  time.Duration
+		want    int
+	}{
+		{"within bounds", 10, time.Hour, 3},
+		{"over size", 2, time.Hour, 2},
+		{"expired", 10, time.Nanosecond, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withQueue(t, tt.maxSize, tt.maxAge)
+			for i := 0; i < 3; i++ {
+				if err := queue.push([]byte(`{}`)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			time.Sleep(time.Millisecond)
+			queue.mu.Lock()
+			kept := queue.evict()
+			queue.mu.Unlock()
+			if len(kept) != tt.want {
+				t.Errorf("%d metrics kept, want %d", len(kept), tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueNotLockedWhileReplaying(t *testing.T) {
+	withMode(t, MonitoringEnabled)
+	withQueue(t, 100, time.Hour)
+
+	arrived, release := make(chan struct{}, 1), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case arrived <- struct{}{}:
+		default:
+		}
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	withURLs(t, srv.URL)
+
+	if err := queue.push([]byte(`{"metric":"first"}`)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ReplayQueued()
+	}()
+	<-arrived
+
+	pushed := make(chan error)
+	go func() { pushed <- queue.push([]byte(`{"metric":"second"}`)) }()
+	select {
+	case err := <-pushed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("push blocked while a replay was posting")
+	}
+	if got := QueuedMetrics(); got != 2 {
+		t.Errorf("%d metrics queued during the replay, want 2", got)
+	}
+
+	close(release)
+	<-done
+	if got := QueuedMetrics(); got != 1 {
+		t.Errorf("%d metrics still queued after the replay, want the one pushed during it", got)
+	}
+}
+
+func TestQueueKeepsEarlierPayloads(t *testing.T) {
+	saved := queue
+	t.Cleanup(func() { queue = saved })
+	dir := t.TempDir()
+	if err := SetMetricQueue(dir, 100, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	queue.push([]byte(`{}`))
+	queue.push([]byte(`{}`))
+
+	// A restart picks up what the previous run left queued
+	if err := SetMetricQueue(dir, 100, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got := QueuedMetrics(); got != 2 {
+		t.Errorf("%d metrics queued after a restart, want 2", got)
+	}
+}
@@ -0,0 +1,89 @@
+package logger
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A logger whose file writes fail degradeAfter times in a row stops
+// reporting each failure and only prints, every dropSummaryInterval, how
+// many lines it dropped
+var (
+	degradeAfter        = 3
+	dropSummaryInterval = time.Minute
+)
+
+// Counter of lines dropped by all loggers, set once at startup through
+// CountDroppedLines
+var droppedLines *atomic.Int64
+
+// CountDroppedLines adds the lines loggers fail to write to their file to
+// counter
+func CountDroppedLines(counter *atomic.Int64) {
+	droppedLines = counter
+}
+
+// writeHealth tracks the failing file writes of a logger
+type writeHealth struct {
+	failing atomic.Bool // spares successful writes the lock
+
+	mu          sync.Mutex
+	failures    int // in a row
+	degraded    bool
+	dropped     int // since the last summary
+	lastSummary time.Time
+}
+
+// failed notes that a line could not be written to path. The first
+// failures are reported one by one; after degradeAfter in a row the logger
+// is degraded and only reports periodic summaries.
+func (h *writeHealth) failed(path string, err error) {
+	if droppedLines != nil {
+		droppedLines.Add(1)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failing.Store(true)
+	h.failures++
+	if !h.degraded && h.failures < degradeAfter {
+		log.Printf("Failed to write to log file: %v", err)
+		return
+	}
+
+	now := time.Now()
+	if !h.degraded {
+		h.degraded, h.dropped, h.lastSummary = true, 1, now
+		log.Printf("Log %s degraded after %d failed writes in a row (%v), dropping lines until writes succeed", path, h.failures, err)
+		return
+	}
+	h.dropped++
+	if now.Sub(h.lastSummary) >= dropSummaryInterval {
+		log.Printf("Log %s still degraded: dropped %d lines in the last %s (%v)", path, h.dropped, now.Sub(h.lastSummary).Round(time.Second), err)
+		h.dropped, h.lastSummary = 0, now
+	}
+}
+
+// succeeded notes a successful write, ending a degraded spell
+func (h *writeHealth) succeeded(path string) {
+	if !h.failing.Load() {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.degraded {
+		log.Printf("Log %s recovered, %d lines dropped since the last summary", path, h.dropped)
+	}
+	h.failures, h.degraded, h.dropped = 0, false, 0
+	h.failing.Store(false)
+}
+
+// Degraded reports whether the logger is dropping lines it cannot write to
+// its file
+func (l *Logger) Degraded() bool {
+	l.writes.mu.Lock()
+	defer l.writes.mu.Unlock()
+	return l.writes.degraded
+}
@@ -0,0 +1,51 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDegradedAfterWriteFailures(t *testing.T) {
+	var stderr bytes.Buffer
+	savedOutput := log.Writer()
+	log.SetOutput(&stderr)
+	t.Cleanup(func() { log.SetOutput(savedOutput) })
+
+	var dropped atomic.Int64
+	CountDroppedLines(&dropped)
+	t.Cleanup(func() { CountDroppedLines(nil) })
+	savedInterval := dropSummaryInterval
+	dropSummaryInterval = 100 * time.Millisecond
+	t.Cleanup(func() { dropSummaryInterval = savedInterval })
+
+	l, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every write fails from now on, as on a full disk
+	l.logFile.Close()
+
+	for i := 0; i < 10; i++ {
+		l.Info("line %d", i)
+	}
+	if got := strings.Count(stderr.String(), "Failed to write to log file"); got != degradeAfter-1 {
+		t.Errorf("%d write failures reported one by one, want %d", got, degradeAfter-1)
+	}
+	if !strings.Contains(stderr.String(), "degraded after 3 failed writes") || !l.Degraded() {
+		t.Errorf("logger not degraded after 10 failed writes:\n%s", stderr.String())
+	}
+	if got := dropped.Load(); got != 10 {
+		t.Errorf("%d lines counted dropped, want 10", got)
+	}
+
+	// The drops since degrading are summarised once the interval is over
+	time.Sleep(dropSummaryInterval)
+	l.Info("line 10")
+	if !strings.Contains(stderr.String(), "dropped 9 lines") {
+		t.Errorf("no summary of the 9 lines dropped while degraded:\n%s", stderr.String())
+	}
+}
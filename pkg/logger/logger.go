@@ -5,7 +5,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 type LogLevel int
@@ -17,10 +19,80 @@ const (
 	DEBUG
 )
 
+// Returns the longest payload Body returns in full, 0 meaning no limit, as
+// does leaving it unset. Set once at startup through SetMaxBodySize.
+var maxBodySize func() int
+
+// SetMaxBodySize has Body truncate payloads over the size returned by size,
+// which is asked on every call so the limit can change at run time
+func SetMaxBodySize(size func() int) {
+	maxBodySize = size
+}
+
+// Body returns a payload for logging, truncated to the configured maximum
+// size with a marker saying how much was left out
+func Body(b []byte) string {
+	limit := 0
+	if maxBodySize != nil {
+		limit = maxBodySize()
+	}
+	if limit <= 0 || len(b) <= limit {
+		return string(b)
+	}
+	// Don't cut a multi-byte character in half
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(b[cut]) {
+		cut--
+	}
+	return fmt.Sprintf("%s...[truncated %d bytes]", b[:cut], len(b)-cut)
+}
+
 type Logger struct {
 	logFile   *os.File
 	logPath   string
 	logPrefix string
+
+	// Debug lines are dropped unless enabled through SetDebug
+	debug atomic.Bool
+
+	// Entries also go to syslog once UseSyslog succeeded, and only there
+	// when syslogOnly is set
+	syslog     syslogWriter
+	syslogOnly bool
+
+	// ERROR entries are also kept in errors, if set, under source
+	errors *Ring
+	source string
+
+	// Format of the timestamp of file entries, see SetTimeFormat
+	timeFormat string
+
+	// Failing writes to logFile
+	writes writeHealth
+}
+
+// syslogWriter is the part of *syslog.Writer the logger uses, one method
+// per priority
+type syslogWriter interface {
+	Debug(m string) error
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+	Close() error
+}
+
+// UseSyslog sends entries to the syslog daemon at addr over network (the
+// local daemon when network is empty) under tag, with a priority matching
+// their level. With keepFile false entries are no longer written to the
+// log file. It must be called before the logger is shared.
+func (l *Logger) UseSyslog(network, addr, tag string, keepFile bool) error {
+	w, err := dialSyslog(network, addr, tag)
+	if err != nil {
+		return err
+	}
+	l.syslog = w
+	l.syslogOnly = !keepFile
+	return nil
 }
 
 func New(logPath string) (*Logger, error) {
@@ -53,20 +125,48 @@ func (l *Logger) log(level LogLevel, format string, v ...interface{}) {
 		DEBUG: "DEBUG",
 	}[level]
 
+	message := Redact(fmt.Sprintf(format, v...))
 	logEntry := fmt.Sprintf("%s %s %s: %s\n", 
-		time.Now().Format(time.RFC3339), 
+		formatTime(time.Now(), l.timeFormat), 
 		l.logPrefix, 
 		levelPrefix, 
-		fmt.Sprintf(format, v...),
+		message,
 	)
 
 	// Write to file
-	if _, err := l.logFile.WriteString(logEntry); err != nil {
-		log.Printf("Failed to write to log file: %v", err)
+	if !l.syslogOnly {
+		if _, err := l.logFile.WriteString(logEntry); err != nil {
+			l.writes.failed(l.logPath, err)
+		} else {
+			l.writes.succeeded(l.logPath)
+		}
+	}
+
+	if l.syslog != nil {
+		if err := l.writeSyslog(level, message); err != nil {
+			log.Printf("Failed to write to syslog: %v", err)
+		}
+	}
+
+	if level == ERROR && l.errors != nil {
+		l.errors.Add(Entry{Time: time.Now(), Source: l.source, Message: message})
 	}
 
 	// Also log to console
-	log.Printf("%s %s: %s", l.logPrefix, levelPrefix, fmt.Sprintf(format, v...))
+	log.Printf("%s %s: %s", l.logPrefix, levelPrefix, message)
+}
+
+// writeSyslog sends msg to syslog with the priority for level
+func (l *Logger) writeSyslog(level LogLevel, msg string) error {
+	switch level {
+	case WARN:
+		return l.syslog.Warning(msg)
+	case ERROR:
+		return l.syslog.Err(msg)
+	case DEBUG:
+		return l.syslog.Debug(msg)
+	}
+	return l.syslog.Info(msg)
 }
 
 func (l *Logger) Info(format string, v ...interface{}) {
@@ -81,10 +181,35 @@ func (l *Logger) Error(format string, v ...interface{}) {
 	l.log(ERROR, format, v...)
 }
 
+// Debug logs only when debug output is enabled for this logger
 func (l *Logger) Debug(format string, v ...interface{}) {
+	if !l.debug.Load() {
+		return
+	}
 	l.log(DEBUG, format, v...)
 }
 
+// SetTimeFormat sets how file entries are timestamped: rfc3339 (the
+// default), rfc3339nano, epoch_ms or a time layout accepted by
+// ValidateTimeFormat. It must be called before the logger is shared.
+func (l *Logger) SetTimeFormat(format string) {
+	l.timeFormat = format
+}
+
+// DebugEnabled reports whether Debug lines are written, so callers can skip
+// building them
+func (l *Logger) DebugEnabled() bool {
+	return l.debug.Load()
+}
+
+// SetDebug turns this logger's debug output on or off
+func (l *Logger) SetDebug(enabled bool) {
+	l.debug.Store(enabled)
+}
+
 func (l *Logger) Close() error {
+	if l.syslog != nil {
+		l.syslog.Close()
+	}
 	return l.logFile.Close()
 }
\ No newline at end of file
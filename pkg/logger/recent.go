@@ -0,0 +1,64 @@
+package logger
+
+import (
+	"sync"
+	"time"
+)
+
+// Entry is one log entry kept by a Ring
+type Entry struct {
+	Time    time.Time `json:"timestamp"`
+	Source  string    `json:"source"` // name of the logger that wrote it
+	Message string    `json:"message"`
+}
+
+// Ring keeps the most recent entries, up to a fixed number, in memory
+type Ring struct {
+	mu      sync.Mutex
+	entries []Entry
+	next    int // index the next entry is written to
+	full    bool
+}
+
+// NewRing returns a ring holding at most size entries
+func NewRing(size int) *Ring {
+	return &Ring{entries: make([]Entry, size)}
+}
+
+// Add stores e, dropping the oldest entry when the ring is full
+func (r *Ring) Add(e Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.entries) == 0 {
+		return
+	}
+	r.entries[r.next] = e
+	r.next = (r.next + 1) % len(r.entries)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Recent returns a copy of the stored entries, newest first
+func (r *Ring) Recent() []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.entries)
+	}
+	recent := make([]Entry, 0, n)
+	for i := 1; i <= n; i++ {
+		recent = append(recent, r.entries[(r.next-i+len(r.entries))%len(r.entries)])
+	}
+	return recent
+}
+
+// KeepErrors copies this logger's ERROR entries into ring, tagged with
+// source. It must be called before the logger is shared.
+func (l *Logger) KeepErrors(ring *Ring, source string) {
+	l.errors = ring
+	l.source = source
+}
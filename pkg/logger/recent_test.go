@@ -0,0 +1,35 @@
+package logger
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingKeepsNewestFirst(t *testing.T) {
+	tests := []struct {
+		added int
+		want  []string
+	}{
+		{0, []string{}},
+		{2, []string{"e2", "e1"}},
+		{3, []string{"e3", "e2", "e1"}},
+		{5, []string{"e5", "e4", "e3"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.added), func(t *testing.T) {
+			r := NewRing(3)
+			for i := 1; i <= tt.added; i++ {
+				r.Add(Entry{Message: fmt.Sprintf("e%d", i)})
+			}
+			got := r.Recent()
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d entries, want %d", len(got), len(tt.want))
+			}
+			for i, e := range got {
+				if e.Message != tt.want[i] {
+					t.Errorf("entry %d = %s, want %s", i, e.Message, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package logger
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Patterns whose matches are masked in every entry before it is written.
+// Set once at startup through SetRedactions.
+var redactions []*regexp.Regexp
+
+// Replacement for each redacted run of text
+const redactedMask = "****"
+
+// SetRedactions compiles patterns and masks their matches in all log
+// entries from now on. A pattern with capturing groups masks only the text
+// of its groups, e.g. `"input":"(\d{4})"` keeps the field name readable.
+func SetRedactions(patterns []string) error {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return err
+		}
+		compiled = append(compiled, re)
+	}
+	redactions = compiled
+	return nil
+}
+
+// Redact returns s with the text matched by the redaction patterns masked
+func Redact(s string) string {
+	for _, re := range redactions {
+		s = redact(re, s)
+	}
+	return s
+}
+
+// redact masks the matches of re in s, or only their groups when re has any
+func redact(re *regexp.Regexp, s string) string {
+	matches := re.FindAllStringSubmatchIndex(s, -1)
+	if matches == nil {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		spans := [][2]int{{m[0], m[1]}}
+		if len(m) > 2 {
+			spans = spans[:0]
+			for i := 2; i < len(m); i += 2 {
+				if m[i] >= 0 && m[i+1] > m[i] { // the group took part and matched text
+					spans = append(spans, [2]int{m[i], m[i+1]})
+				}
+			}
+		}
+		for _, span := range spans {
+			if span[0] < last { // nested in a group already masked
+				continue
+			}
+			b.WriteString(s[last:span[0]])
+			b.WriteString(redactedMask)
+			last = span[1]
+		}
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
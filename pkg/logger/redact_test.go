@@ -0,0 +1,29 @@
+package logger
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	if err := SetRedactions([]string{`"input":"(\d{4})"`, `\b\d{16}\b`, `pin=(\d+)|otp=(\d+)`}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetRedactions(nil) })
+
+	tests := []struct {
+		in, want string
+	}{
+		{`{"input":"1234","phone":"2348030000046"}`, `{"input":"****","phone":"2348030000046"}`},
+		{`{"input":"12345"}`, `{"input":"12345"}`},
+		{"card 4111111111111111 saved", "card **** saved"},
+		{"pin=9876 otp=5555", "pin=**** otp=****"},
+		{"nothing sensitive", "nothing sensitive"},
+	}
+	for _, tt := range tests {
+		if got := Redact(tt.in); got != tt.want {
+			t.Errorf("Redact(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	if err := SetRedactions([]string{"("}); err == nil {
+		t.Error("invalid pattern accepted")
+	}
+}
@@ -0,0 +1,65 @@
+//go:build !windows && !plan9
+
+package logger
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyslogPriorities(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	dir := t.TempDir()
+	l, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	if err := l.UseSyslog("udp", listener.LocalAddr().String(), "ussdtcp-test", false); err != nil {
+		t.Fatal(err)
+	}
+	l.SetDebug(true)
+
+	// Priority is facility (user, 1) * 8 + severity
+	tests := []struct {
+		log  func(format string, v ...interface{})
+		msg  string
+		want string
+	}{
+		{l.Info, "info entry", "<14>"},
+		{l.Warn, "warn entry", "<12>"},
+		{l.Error, "error entry", "<11>"},
+		{l.Debug, "debug entry", "<15>"},
+	}
+	buf := make([]byte, 1024)
+	for _, tt := range tests {
+		tt.log(tt.msg)
+
+		listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := listener.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("no syslog entry for %q: %v", tt.msg, err)
+		}
+		got := string(buf[:n])
+		if !strings.HasPrefix(got, tt.want) || !strings.Contains(got, "ussdtcp-test") || !strings.Contains(got, tt.msg) {
+			t.Errorf("syslog got %q, want priority %s with tag ussdtcp-test and %q", got, tt.want, tt.msg)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, time.Now().Format("2006-01-02")+".log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > 0 {
+		t.Errorf("entries written to the log file while logging only to syslog: %s", data)
+	}
+}
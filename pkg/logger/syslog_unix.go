@@ -0,0 +1,11 @@
+//go:build !windows && !plan9
+
+package logger
+
+import "log/syslog"
+
+// dialSyslog connects to the syslog daemon at addr over network, or to the
+// local one when network is empty
+func dialSyslog(network, addr, tag string) (syslogWriter, error) {
+	return syslog.Dial(network, addr, syslog.LOG_USER|syslog.LOG_INFO, tag)
+}
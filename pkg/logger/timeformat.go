@@ -0,0 +1,41 @@
+package logger
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Named timestamp formats; any other format is a Go time layout
+const (
+	TimeRFC3339     = "rfc3339"
+	TimeRFC3339Nano = "rfc3339nano"
+	TimeEpochMillis = "epoch_ms"
+)
+
+// ValidateTimeFormat checks that format is a named format or a time
+// layout with at least one element, such as "2006-01-02 15:04:05"
+func ValidateTimeFormat(format string) error {
+	switch format {
+	case TimeRFC3339, TimeRFC3339Nano, TimeEpochMillis:
+		return nil
+	}
+	// A layout without elements formats every time as itself
+	if format == "" || time.Unix(0, 0).UTC().Format(format) == format {
+		return fmt.Errorf("%q is neither rfc3339, rfc3339nano, epoch_ms nor a time layout", format)
+	}
+	return nil
+}
+
+// formatTime stamps t in format, RFC3339 when format is empty
+func formatTime(t time.Time, format string) string {
+	switch format {
+	case "", TimeRFC3339:
+		return t.Format(time.RFC3339)
+	case TimeRFC3339Nano:
+		return t.Format(time.RFC3339Nano)
+	case TimeEpochMillis:
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	}
+	return t.Format(format)
+}
@@ -0,0 +1,52 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestTimeFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string // pattern of the line's timestamp
+	}{
+		{"", `\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(Z|[+-]\d\d:\d\d)`},
+		{TimeRFC3339Nano, `\d{4}-\d\d-\d\dT\d\d:\d\d:\d\d(\.\d+)?(Z|[+-]\d\d:\d\d)`},
+		{TimeEpochMillis, `\d{13}`},
+		{"2006/01/02 15:04:05.000", `\d{4}/\d\d/\d\d \d\d:\d\d:\d\d\.\d{3}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			if err := ValidateTimeFormat(tt.format); err != nil && tt.format != "" {
+				t.Fatalf("ValidateTimeFormat(%q) = %v", tt.format, err)
+			}
+			dir := t.TempDir()
+			l, err := New(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { l.Close() })
+			l.SetTimeFormat(tt.format)
+			l.Info("stamped")
+
+			data, err := os.ReadFile(filepath.Join(dir, time.Now().Format("2006-01-02")+".log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !regexp.MustCompile(`^` + tt.want + ` \[USSDTCP\] INFO: stamped\n$`).Match(data) {
+				t.Errorf("line %q not stamped in format %q", data, tt.format)
+			}
+		})
+	}
+}
+
+func TestValidateTimeFormatRejects(t *testing.T) {
+	for _, format := range []string{"", "epoch", "no elements here"} {
+		if err := ValidateTimeFormat(format); err == nil {
+			t.Errorf("ValidateTimeFormat(%q) accepted", format)
+		}
+	}
+}
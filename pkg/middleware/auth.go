@@ -0,0 +1,28 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIToken only lets through requests carrying token as a Bearer token in
+// the Authorization header. An empty token disables the protected routes.
+func APIToken(token string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if token == "" {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API_TOKEN is not configured"})
+			return
+		}
+
+		provided := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+
+		ctx.Next()
+	}
+}
@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket: it allows rate events per second on average
+// with bursts of up to burst events. A nil Limiter, or one with a rate of
+// zero, never waits.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// New returns a Limiter with a full bucket
+func New(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until the next event is allowed. Callers are served in the
+// order they arrive: each one reserves a token, going into debt when the
+// bucket is empty, and sleeps until that debt is repaid.
+func (l *Limiter) Wait() {
+	if l == nil || l.rate <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens--
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	time.Sleep(wait)
+}
+
+// Ramp paces events at a reduced rate for a period after Start, then lets
+// them through. The zero Ramp, or one started with a zero period or rate,
+// never waits.
+type Ramp struct {
+	mu      sync.Mutex
+	limiter *Limiter
+	until   time.Time
+}
+
+// Start paces the events of the next period at rate per second, without
+// bursts
+func (r *Ramp) Start(rate float64, period time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rate <= 0 || period <= 0 {
+		r.limiter, r.until = nil, time.Time{}
+		return
+	}
+	r.limiter, r.until = New(rate, 1), time.Now().Add(period)
+}
+
+// Wait blocks until the next event is allowed while ramping up
+func (r *Ramp) Wait() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	limiter := r.limiter
+	if limiter != nil && time.Now().After(r.until) {
+		r.limiter, limiter = nil, nil
+	}
+	r.mu.Unlock()
+	limiter.Wait()
+}
@@ -0,0 +1,77 @@
+package ratelimit
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiterPacesToRate(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		sends int
+	}{
+		{"no burst", 50, 1, 21},
+		{"burst", 50, 5, 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.rate, tt.burst)
+
+			start := time.Now()
+			var wg sync.WaitGroup
+			for i := 0; i < tt.sends; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					l.Wait()
+				}()
+			}
+			wg.Wait()
+			elapsed := time.Since(start)
+
+			// The burst goes out at once, the rest at the configured rate
+			want := time.Duration(float64(tt.sends-tt.burst) / tt.rate * float64(time.Second))
+			if elapsed < want-10*time.Millisecond {
+				t.Errorf("%d sends took %s, want at least %s at %g/s", tt.sends, elapsed, want, tt.rate)
+			}
+		})
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	for _, l := range []*Limiter{nil, New(0, 1)} {
+		start := time.Now()
+		for i := 0; i < 1000; i++ {
+			l.Wait()
+		}
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Errorf("unlimited sends took %s", elapsed)
+		}
+	}
+}
+
+func TestRampPacesThenNormalizes(t *testing.T) {
+	var r Ramp
+	r.Start(20, 300*time.Millisecond)
+
+	// 5 events at 20/s, the first at once
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		r.Wait()
+	}
+	if elapsed := time.Since(start); elapsed < 190*time.Millisecond {
+		t.Errorf("5 events while ramping up took %s, want at least 200ms at 20/s", elapsed)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		r.Wait()
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("100 events after the ramp-up took %s", elapsed)
+	}
+}
@@ -0,0 +1,346 @@
+package session
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Who started a session
+const (
+	OriginSubscriber = "subscriber" // dialled by the subscriber (mobile originated)
+	OriginPush       = "push"       // pushed by us (mobile terminated)
+)
+
+// Session tracks one USSD dialogue, keyed by the aggregator's request ID
+type Session struct {
+	ID        string
+	MSISDN    string
+	ShortCode string
+	Origin    string
+	StartedAt time.Time
+	UpdatedAt time.Time
+	Steps     int // requests handled on the session, the dial included
+
+	// Hash of the last menu sent and how many times in a row it was sent
+	MenuHash    uint64
+	MenuRepeats int
+
+	// Language of the last menu, as reported by the menu API
+	Locale string
+
+	// Text of the last menu sent that expected a reply and how many such
+	// menus were sent on the session
+	LastMenu string
+	Menus    int
+
+	// Subscriber inputs after the initial dial, oldest first
+	Inputs []string
+
+	// Label of the server connection the session's last request arrived on
+	Connection string
+}
+
+// Store is an in-memory, concurrency-safe session store. Sessions that see
+// no activity for the TTL are dropped by Expire; with a capacity set, the
+// least recently active session also makes way for a new one once the
+// store is full.
+type Store struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	ttl      time.Duration
+
+	// Session IDs, most recently active first, and their place in the list
+	recency *list.List
+	places  map[string]*list.Element
+
+	capacity int // 0 for no bound
+	onEvict  func(Session)
+}
+
+func NewStore(ttl time.Duration) *Store {
+	return &Store{
+		sessions: make(map[string]*Session),
+		ttl:      ttl,
+		recency:  list.New(),
+		places:   make(map[string]*list.Element),
+	}
+}
+
+// SetCapacity bounds the store to max sessions, 0 for no bound. Starting a
+// session in a full store evicts the least recently active one, which is
+// then passed to onEvict (which may be nil).
+func (s *Store) SetCapacity(max int, onEvict func(Session)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.capacity = max
+	s.onEvict = onEvict
+}
+
+// Start records a new session, replacing any existing one with the same ID
+func (s *Store) Start(id, msisdn, shortCode, origin string) Session {
+	s.mu.Lock()
+	evicted := s.makeRoom(id)
+	onEvict := s.onEvict
+	sess := s.start(id, msisdn, shortCode, origin)
+	s.mu.Unlock()
+
+	if onEvict != nil {
+		for _, e := range evicted {
+			onEvict(e)
+		}
+	}
+	return sess
+}
+
+// makeRoom evicts the least recently active sessions until one more than
+// id fits within the capacity, returning them. s.mu must be held.
+func (s *Store) makeRoom(id string) []Session {
+	if s.capacity <= 0 {
+		return nil
+	}
+	if _, ok := s.sessions[id]; ok {
+		return nil
+	}
+	var evicted []Session
+	for len(s.sessions) >= s.capacity {
+		oldest := s.recency.Back()
+		if oldest == nil {
+			break
+		}
+		evicted = append(evicted, *s.sessions[oldest.Value.(string)])
+		s.remove(oldest.Value.(string))
+	}
+	return evicted
+}
+
+// start records a new session. s.mu must be held.
+func (s *Store) start(id, msisdn, shortCode, origin string) Session {
+	now := time.Now()
+	sess := &Session{
+		ID:        id,
+		MSISDN:    msisdn,
+		ShortCode: shortCode,
+		Origin:    origin,
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	s.sessions[id] = sess
+	s.active(id)
+	return *sess
+}
+
+// active moves id to the front of the recency list. s.mu must be held.
+func (s *Store) active(id string) {
+	if place, ok := s.places[id]; ok {
+		s.recency.MoveToFront(place)
+		return
+	}
+	s.places[id] = s.recency.PushFront(id)
+}
+
+// remove drops the session with the given ID. s.mu must be held.
+func (s *Store) remove(id string) {
+	delete(s.sessions, id)
+	if place, ok := s.places[id]; ok {
+		s.recency.Remove(place)
+		delete(s.places, id)
+	}
+}
+
+// Get returns a copy of the session with the given ID
+func (s *Store) Get(id string) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return Session{}, false
+	}
+	return *sess, true
+}
+
+// ByMSISDN returns copies of the open sessions of msisdn
+func (s *Store) ByMSISDN(msisdn string) []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var found []Session
+	for _, sess := range s.sessions {
+		if sess.MSISDN == msisdn {
+			found = append(found, *sess)
+		}
+	}
+	return found
+}
+
+// Touch marks the session as active now and counts a step on it
+func (s *Store) Touch(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if ok {
+		sess.UpdatedAt = time.Now()
+		sess.Steps++
+		s.active(id)
+	}
+	return ok
+}
+
+// SetLastMenu records the text of the menu the session is waiting on and
+// counts it among the menus sent
+func (s *Store) SetLastMenu(id, menu string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[id]; ok {
+		sess.LastMenu = menu
+		sess.Menus++
+	}
+}
+
+// RecordMenu notes that menu was sent on the session and returns how many
+// times in a row it has now been sent, or 0 if the session is not open
+func (s *Store) RecordMenu(id, menu string) int {
+	h := fnv.New64a()
+	h.Write([]byte(menu))
+	hash := h.Sum64()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return 0
+	}
+	if sess.MenuRepeats > 0 && sess.MenuHash == hash {
+		sess.MenuRepeats++
+	} else {
+		sess.MenuHash = hash
+		sess.MenuRepeats = 1
+	}
+	return sess.MenuRepeats
+}
+
+// AddInput appends a subscriber input to the session's history and returns
+// the whole history, or nil if the session is not open
+func (s *Store) AddInput(id, input string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return nil
+	}
+	sess.Inputs = append(sess.Inputs, input)
+	return append([]string(nil), sess.Inputs...)
+}
+
+// SetLocale records the language the session's menus are served in
+func (s *Store) SetLocale(id, locale string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[id]; ok {
+		sess.Locale = locale
+	}
+}
+
+// SetConnection records the connection the session's last request arrived on
+func (s *Store) SetConnection(id, label string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[id]; ok {
+		sess.Connection = label
+	}
+}
+
+// End removes the session and returns its final state
+func (s *Store) End(id string) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	if !ok {
+		return Session{}, false
+	}
+	s.remove(id)
+	return *sess, true
+}
+
+// Len returns the number of active sessions
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.sessions)
+}
+
+// Snapshot summarises the open sessions at one point in time
+type Snapshot struct {
+	Active      int            `json:"active"`
+	ByShortCode map[string]int `json:"by_short_code"`
+	OldestAge   float64        `json:"oldest_age_seconds"` // 0 when there are none
+}
+
+// Snapshot returns a summary of the open sessions. The copy is built under
+// the lock and owned by the caller, so it can be serialized without holding
+// up the store.
+func (s *Store) Snapshot() Snapshot {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := Snapshot{
+		Active:      len(s.sessions),
+		ByShortCode: make(map[string]int),
+	}
+	for _, sess := range s.sessions {
+		snap.ByShortCode[sess.ShortCode]++
+		if age := now.Sub(sess.StartedAt).Seconds(); age > snap.OldestAge {
+			snap.OldestAge = age
+		}
+	}
+	return snap
+}
+
+// Expire removes sessions idle for longer than the TTL and returns them
+func (s *Store) Expire() []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var expired []Session
+	cutoff := time.Now().Add(-s.ttl)
+	for id, sess := range s.sessions {
+		if sess.UpdatedAt.Before(cutoff) {
+			expired = append(expired, *sess)
+			s.remove(id)
+		}
+	}
+	return expired
+}
+
+// RunExpiry calls Expire every interval until stop is closed, passing the
+// expired sessions to onExpire (which may be nil)
+func (s *Store) RunExpiry(interval time.Duration, stop <-chan struct{}, onExpire func(Session)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, sess := range s.Expire() {
+				if onExpire != nil {
+					onExpire(sess)
+				}
+			}
+		}
+	}
+}
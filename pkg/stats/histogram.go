@@ -0,0 +1,145 @@
+package stats
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Histogram counts how often each integer value is observed
+type Histogram struct {
+	mu     sync.Mutex
+	counts map[int]int64
+	sum    int64
+	n      int64
+}
+
+// HistogramSnapshot is a point-in-time copy of a Histogram
+type HistogramSnapshot struct {
+	Count   int64         `json:"count"`
+	Sum     int64         `json:"sum"`
+	Average float64       `json:"average"`
+	Counts  map[int]int64 `json:"counts"` // observations per value
+}
+
+// Observe records one observation of v
+func (h *Histogram) Observe(v int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.counts == nil {
+		h.counts = make(map[int]int64)
+	}
+	h.counts[v]++
+	h.sum += int64(v)
+	h.n++
+}
+
+// Snapshot returns a copy of the histogram
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	counts := make(map[int]int64, len(h.counts))
+	for v, n := range h.counts {
+		counts[v] = n
+	}
+	return newHistogramSnapshot(h.n, h.sum, counts)
+}
+
+// newHistogramSnapshot fills in the average of a snapshot
+func newHistogramSnapshot(n, sum int64, counts map[int]int64) HistogramSnapshot {
+	s := HistogramSnapshot{Count: n, Sum: sum, Counts: counts}
+	if n > 0 {
+		s.Average = float64(sum) / float64(n)
+	}
+	return s
+}
+
+// Since returns the observations made after before was taken
+func (s HistogramSnapshot) Since(before HistogramSnapshot) HistogramSnapshot {
+	counts := make(map[int]int64)
+	for v, n := range s.Counts {
+		if d := n - before.Counts[v]; d > 0 {
+			counts[v] = d
+		}
+	}
+	return newHistogramSnapshot(s.Count-before.Count, s.Sum-before.Sum, counts)
+}
+
+// DurationHistogram counts durations in buckets bounded by Bounds
+type DurationHistogram struct {
+	Bounds []time.Duration // upper bound of each bucket, ascending
+
+	mu     sync.Mutex
+	counts []int64 // one per bound, plus one for longer durations
+	sum    time.Duration
+	n      int64
+}
+
+// DurationHistogramSnapshot is a point-in-time copy of a DurationHistogram
+type DurationHistogramSnapshot struct {
+	Count     int64            `json:"count"`
+	SumMs     int64            `json:"sum_ms"`
+	AverageMs float64          `json:"average_ms"`
+	Buckets   map[string]int64 `json:"buckets"` // observations per upper bound in ms, "+Inf" for the rest
+}
+
+// Observe records one duration
+func (h *DurationHistogram) Observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.counts == nil {
+		h.counts = make([]int64, len(h.Bounds)+1)
+	}
+	i := 0
+	for i < len(h.Bounds) && d > h.Bounds[i] {
+		i++
+	}
+	h.counts[i]++
+	h.sum += d
+	h.n++
+}
+
+// Snapshot returns a copy of the histogram
+func (h *DurationHistogram) Snapshot() DurationHistogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[string]int64, len(h.Bounds)+1)
+	for i := 0; i <= len(h.Bounds); i++ {
+		var n int64
+		if h.counts != nil {
+			n = h.counts[i]
+		}
+		buckets[bucketLabel(h.Bounds, i)] = n
+	}
+	return newDurationHistogramSnapshot(h.n, h.sum.Milliseconds(), buckets)
+}
+
+// bucketLabel names bucket i of a histogram with the given bounds
+func bucketLabel(bounds []time.Duration, i int) string {
+	if i >= len(bounds) {
+		return "+Inf"
+	}
+	return strconv.FormatInt(bounds[i].Milliseconds(), 10)
+}
+
+// newDurationHistogramSnapshot fills in the average of a snapshot
+func newDurationHistogramSnapshot(n, sumMs int64, buckets map[string]int64) DurationHistogramSnapshot {
+	s := DurationHistogramSnapshot{Count: n, SumMs: sumMs, Buckets: buckets}
+	if n > 0 {
+		s.AverageMs = float64(sumMs) / float64(n)
+	}
+	return s
+}
+
+// Since returns the observations made after before was taken
+func (s DurationHistogramSnapshot) Since(before DurationHistogramSnapshot) DurationHistogramSnapshot {
+	buckets := make(map[string]int64, len(s.Buckets))
+	for label, n := range s.Buckets {
+		buckets[label] = n - before.Buckets[label]
+	}
+	return newDurationHistogramSnapshot(s.Count-before.Count, s.SumMs-before.SumMs, buckets)
+}
@@ -0,0 +1,76 @@
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Seconds covered by a Meter
+const meterWindow = 10
+
+// Meter measures the rate of an event over the last meterWindow seconds
+type Meter struct {
+	mu      sync.Mutex
+	counts  [meterWindow]int64
+	seconds [meterWindow]int64 // Unix second each slot of counts belongs to
+}
+
+// Mark records one event
+func (m *Meter) Mark() {
+	m.Add(1)
+}
+
+// Add records n events at once
+func (m *Meter) Add(n int64) {
+	now := time.Now().Unix()
+	slot := now % meterWindow
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.seconds[slot] != now {
+		m.seconds[slot] = now
+		m.counts[slot] = 0
+	}
+	m.counts[slot] += n
+}
+
+// Rate returns the average events per second over the window
+func (m *Meter) Rate() float64 {
+	now := time.Now().Unix()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var total int64
+	for i, second := range m.seconds {
+		if now-second < meterWindow {
+			total += m.counts[i]
+		}
+	}
+	return float64(total) / meterWindow
+}
+
+// Throughput counts bytes moved and measures their rate
+type Throughput struct {
+	total atomic.Int64
+	meter Meter
+}
+
+// Add records n bytes
+func (t *Throughput) Add(n int) {
+	if n <= 0 {
+		return
+	}
+	t.total.Add(int64(n))
+	t.meter.Add(int64(n))
+}
+
+// Total returns the bytes recorded since start
+func (t *Throughput) Total() int64 {
+	return t.total.Load()
+}
+
+// Rate returns the bytes per second over the meter window
+func (t *Throughput) Rate() float64 {
+	return t.meter.Rate()
+}
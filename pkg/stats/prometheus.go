@@ -0,0 +1,57 @@
+package stats
+
+import (
+	"fmt"
+	"io"
+)
+
+// WritePrometheus writes s in the Prometheus text exposition format, with
+// counters as ussdtcp_*_total and current rates as gauges
+func WritePrometheus(w io.Writer, s Snapshot) {
+	counters := []struct {
+		name, help string
+		value      int64
+	}{
+		{"requests_received", "USSD requests received from the server", s.RequestsReceived},
+		{"responses_sent", "USSD responses sent to the server", s.ResponsesSent},
+		{"sessions_started", "Sessions started", s.SessionsStarted},
+		{"sessions_ended", "Sessions ended", s.SessionsEnded},
+		{"menu_api_successes", "Successful menu API calls", s.MenuAPISuccesses},
+		{"menu_api_failures", "Failed menu API calls", s.MenuAPIFailures},
+		{"reconnects", "Reconnections to the server", s.Reconnects},
+		{"inconsistent_menus", "Menu API responses whose continue flag disagreed with their text", s.InconsistentMenus},
+		{"offline_requests", "Menu requests received while not logged on to the server", s.OfflineRequests},
+		{"sessions_aborted", "Sessions the server released on its side with an abort frame", s.SessionsAborted},
+		{"sessions_evicted", "Least recently active sessions evicted to keep the session store within its cap", s.SessionsEvicted},
+		{"responses_unacked", "Responses the server did not acknowledge within ACK_TIMEOUT", s.ResponsesUnacked},
+		{"log_lines_dropped", "Log lines that could not be written to their log file", s.LogLinesDropped},
+		{"listen_stalls", "Times the watchdog found the listen loop stalled and restarted it", s.ListenStalls},
+		{"bytes_sent", "Bytes written to the server, headers included", s.BytesSent},
+		{"bytes_received", "Bytes read from the server, headers included", s.BytesReceived},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP ussdtcp_%s_total %s\n# TYPE ussdtcp_%s_total counter\nussdtcp_%s_total %d\n", c.name, c.help, c.name, c.name, c.value)
+	}
+
+	gauges := []struct {
+		name, help string
+		value      float64
+	}{
+		{"send_rate", "Frames written to the server per second", s.SendRate},
+		{"bytes_sent_rate", "Bytes written to the server per second", s.BytesSentRate},
+		{"bytes_received_rate", "Bytes read from the server per second", s.BytesReceivedRate},
+		{"last_reconnect_seconds", "Duration of the latest reconnect to the server", float64(s.LastReconnectMs) / 1000},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP ussdtcp_%s %s\n# TYPE ussdtcp_%s gauge\nussdtcp_%s %g\n", g.name, g.help, g.name, g.name, g.value)
+	}
+
+	fmt.Fprintf(w, "# HELP ussdtcp_processing_seconds Time from receiving a request frame to sending its response\n# TYPE ussdtcp_processing_seconds histogram\n")
+	var cumulative int64
+	for i, bound := range ProcessingTimes.Bounds {
+		cumulative += s.ProcessingTimes.Buckets[bucketLabel(ProcessingTimes.Bounds, i)]
+		fmt.Fprintf(w, "ussdtcp_processing_seconds_bucket{le=\"%g\"} %d\n", bound.Seconds(), cumulative)
+	}
+	fmt.Fprintf(w, "ussdtcp_processing_seconds_bucket{le=\"+Inf\"} %d\n", s.ProcessingTimes.Count)
+	fmt.Fprintf(w, "ussdtcp_processing_seconds_sum %g\nussdtcp_processing_seconds_count %d\n", float64(s.ProcessingTimes.SumMs)/1000, s.ProcessingTimes.Count)
+}
@@ -0,0 +1,181 @@
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counters updated across the application. They only ever increase;
+// SinceLast derives per-call deltas from them.
+var (
+	RequestsReceived atomic.Int64
+	ResponsesSent    atomic.Int64
+	SessionsStarted  atomic.Int64
+	SessionsEnded    atomic.Int64
+	MenuAPISuccesses atomic.Int64
+	MenuAPIFailures  atomic.Int64
+	Reconnects       atomic.Int64
+
+	// Menu API responses whose continue flag disagreed with their text
+	InconsistentMenus atomic.Int64
+
+	// Menu requests received while not logged on to the server
+	OfflineRequests atomic.Int64
+
+	// Sessions the server released on its side with an abort frame
+	SessionsAborted atomic.Int64
+
+	// Responses the server did not acknowledge within ACK_TIMEOUT
+	ResponsesUnacked atomic.Int64
+
+	// Sessions evicted to keep the session store within MAX_SESSIONS
+	SessionsEvicted atomic.Int64
+
+	// Log lines that could not be written to their log file
+	LogLinesDropped atomic.Int64
+
+	// Times the watchdog found the listen loop stalled and restarted it
+	ListenStalls atomic.Int64
+)
+
+// How long the latest reconnect took, from the drop to logged on again
+var LastReconnectMs atomic.Int64
+
+// Sends measures the rate of frames written to the server
+var Sends Meter
+
+// Bytes written to and read from the server, headers included
+var (
+	BytesSent     Throughput
+	BytesReceived Throughput
+)
+
+// Locales counts menu responses per locale reported by the menu API
+var Locales Tally
+
+// SessionSteps counts ended sessions by the number of requests they took
+var SessionSteps Histogram
+
+// ProcessingTimes counts requests by the time from receiving their frame to
+// sending the response
+var ProcessingTimes = DurationHistogram{
+	Bounds: []time.Duration{
+		50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+		time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+	},
+}
+
+// ConnectionHealth is the health score of a server connection and the
+// signals behind it
+type ConnectionHealth struct {
+	Label            string  `json:"label"`
+	Score            float64 `json:"score"` // 100 for perfect health, towards 0
+	EnquireLatencyMs float64 `json:"enquire_latency_ms"`
+	ErrorRate        float64 `json:"error_rate"` // share of recent sends that failed
+	OutstandingSends int64   `json:"outstanding_sends"`
+}
+
+var startedAt = time.Now()
+
+// Snapshot is a point-in-time copy of the counters
+type Snapshot struct {
+	Since             time.Time                 `json:"since"`
+	RequestsReceived  int64                     `json:"requests_received"`
+	ResponsesSent     int64                     `json:"responses_sent"`
+	SessionsStarted   int64                     `json:"sessions_started"`
+	SessionsEnded     int64                     `json:"sessions_ended"`
+	MenuAPISuccesses  int64                     `json:"menu_api_successes"`
+	MenuAPIFailures   int64                     `json:"menu_api_failures"`
+	Reconnects        int64                     `json:"reconnects"`
+	InconsistentMenus int64                     `json:"inconsistent_menus"`
+	OfflineRequests   int64                     `json:"offline_requests"`
+	SessionsAborted   int64                     `json:"sessions_aborted"`
+	SessionsEvicted   int64                     `json:"sessions_evicted"`
+	ResponsesUnacked  int64                     `json:"responses_unacked"`
+	LogLinesDropped   int64                     `json:"log_lines_dropped"`
+	ListenStalls      int64                     `json:"listen_stalls"`
+	LastReconnectMs   int64                     `json:"last_reconnect_ms"` // always current, 0 before the first reconnect
+	SendRate          float64                   `json:"send_rate"`         // frames per second, always current
+	BytesSent         int64                     `json:"bytes_sent"`
+	BytesReceived     int64                     `json:"bytes_received"`
+	BytesSentRate     float64                   `json:"bytes_sent_rate"`     // bytes per second, always current
+	BytesReceivedRate float64                   `json:"bytes_received_rate"` // bytes per second, always current
+	Locales           map[string]int64          `json:"locales"`
+	SessionSteps      HistogramSnapshot         `json:"session_steps"`
+	ProcessingTimes   DurationHistogramSnapshot `json:"processing_times"`
+}
+
+// Take returns the counters accumulated since the process started
+func Take() Snapshot {
+	return Snapshot{
+		Since:             startedAt,
+		RequestsReceived:  RequestsReceived.Load(),
+		ResponsesSent:     ResponsesSent.Load(),
+		SessionsStarted:   SessionsStarted.Load(),
+		SessionsEnded:     SessionsEnded.Load(),
+		MenuAPISuccesses:  MenuAPISuccesses.Load(),
+		MenuAPIFailures:   MenuAPIFailures.Load(),
+		Reconnects:        Reconnects.Load(),
+		InconsistentMenus: InconsistentMenus.Load(),
+		OfflineRequests:   OfflineRequests.Load(),
+		SessionsAborted:   SessionsAborted.Load(),
+		SessionsEvicted:   SessionsEvicted.Load(),
+		ResponsesUnacked:  ResponsesUnacked.Load(),
+		LogLinesDropped:   LogLinesDropped.Load(),
+		ListenStalls:      ListenStalls.Load(),
+		LastReconnectMs:   LastReconnectMs.Load(),
+		SendRate:          Sends.Rate(),
+		BytesSent:         BytesSent.Total(),
+		BytesReceived:     BytesReceived.Total(),
+		BytesSentRate:     BytesSent.Rate(),
+		BytesReceivedRate: BytesReceived.Rate(),
+		Locales:           Locales.Counts(),
+		SessionSteps:      SessionSteps.Snapshot(),
+		ProcessingTimes:   ProcessingTimes.Snapshot(),
+	}
+}
+
+var (
+	lastMu   sync.Mutex
+	lastTake = Snapshot{Since: startedAt}
+)
+
+// SinceLast returns how much each counter grew since the previous call to
+// SinceLast (or since start for the first call)
+func SinceLast() Snapshot {
+	lastMu.Lock()
+	defer lastMu.Unlock()
+
+	now := Take()
+	delta := Snapshot{
+		Since:             lastTake.Since,
+		RequestsReceived:  now.RequestsReceived - lastTake.RequestsReceived,
+		ResponsesSent:     now.ResponsesSent - lastTake.ResponsesSent,
+		SessionsStarted:   now.SessionsStarted - lastTake.SessionsStarted,
+		SessionsEnded:     now.SessionsEnded - lastTake.SessionsEnded,
+		MenuAPISuccesses:  now.MenuAPISuccesses - lastTake.MenuAPISuccesses,
+		MenuAPIFailures:   now.MenuAPIFailures - lastTake.MenuAPIFailures,
+		Reconnects:        now.Reconnects - lastTake.Reconnects,
+		InconsistentMenus: now.InconsistentMenus - lastTake.InconsistentMenus,
+		OfflineRequests:   now.OfflineRequests - lastTake.OfflineRequests,
+		SessionsAborted:   now.SessionsAborted - lastTake.SessionsAborted,
+		SessionsEvicted:   now.SessionsEvicted - lastTake.SessionsEvicted,
+		ResponsesUnacked:  now.ResponsesUnacked - lastTake.ResponsesUnacked,
+		LogLinesDropped:   now.LogLinesDropped - lastTake.LogLinesDropped,
+		ListenStalls:      now.ListenStalls - lastTake.ListenStalls,
+		LastReconnectMs:   now.LastReconnectMs,
+		SendRate:          now.SendRate,
+		BytesSent:         now.BytesSent - lastTake.BytesSent,
+		BytesReceived:     now.BytesReceived - lastTake.BytesReceived,
+		BytesSentRate:     now.BytesSentRate,
+		BytesReceivedRate: now.BytesReceivedRate,
+		Locales:           subtractCounts(now.Locales, lastTake.Locales),
+		SessionSteps:      now.SessionSteps.Since(lastTake.SessionSteps),
+		ProcessingTimes:   now.ProcessingTimes.Since(lastTake.ProcessingTimes),
+	}
+
+	now.Since = time.Now()
+	lastTake = now
+	return delta
+}
@@ -0,0 +1,44 @@
+package stats
+
+import "sync"
+
+// Tally counts occurrences of each of a set of labels
+type Tally struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+// Add counts one occurrence of label
+func (t *Tally) Add(label string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.counts == nil {
+		t.counts = make(map[string]int64)
+	}
+	t.counts[label]++
+}
+
+// Counts returns a copy of the count per label
+func (t *Tally) Counts() map[string]int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := make(map[string]int64, len(t.counts))
+	for label, n := range t.counts {
+		counts[label] = n
+	}
+	return counts
+}
+
+// subtractCounts returns how much each count in now grew over before,
+// leaving out labels that did not grow
+func subtractCounts(now, before map[string]int64) map[string]int64 {
+	delta := make(map[string]int64)
+	for label, n := range now {
+		if d := n - before[label]; d > 0 {
+			delta[label] = d
+		}
+	}
+	return delta
+}
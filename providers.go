@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name of the provider built from USSD_API_URL and MENU_API_TIMEOUT, used
+// by short codes whose route names no provider
+const defaultProviderName = "default"
+
+// Provider is a menu API backend. Timeout bounds each call to it on top of
+// the response budget; zero leaves only the budget. Stateless backends set
+// AccumulateInput to be sent every input of the session so far, joined by
+// InputSeparator ("*" by default), rather than only the latest. Encoding
+// is how requests are posted to it: json (the default) or form.
+// BinaryInput is how the payload of 8-bit requests is put in the input:
+// base64 (the default) or hex.
+type Provider struct {
+	Name            string   `json:"name"`
+	URL             string   `json:"url"`
+	Timeout         Duration `json:"timeout"`
+	AccumulateInput bool     `json:"accumulate_input,omitempty"`
+	InputSeparator  string   `json:"input_separator,omitempty"`
+	Encoding        string   `json:"encoding,omitempty"`
+	BinaryInput     string   `json:"binary_input,omitempty"`
+}
+
+// Values for a provider's binary_input, also sent as the input_encoding
+const (
+	binaryInputBase64 = "base64"
+	binaryInputHex    = "hex"
+)
+
+// binaryInput returns the input and input_encoding carrying payload, the
+// octets of an 8-bit request, to the provider. Raw octets would not
+// survive as a JSON string.
+func (p Provider) binaryInput(payload []byte) (string, string) {
+	if p.BinaryInput == binaryInputHex {
+		return hex.EncodeToString(payload), binaryInputHex
+	}
+	return base64.StdEncoding.EncodeToString(payload), binaryInputBase64
+}
+
+// Values for a provider's encoding
+const (
+	encodingJSON = "json" // application/json
+	encodingForm = "form" // application/x-www-form-urlencoded
+)
+
+// encodeMenuRequest returns req as the body of a post to the provider and
+// its content type. Form fields are named and omitted like the JSON ones.
+func (p Provider) encodeMenuRequest(req USSDMenuRequest) ([]byte, string, error) {
+	body, err := json.Marshal(req)
+	if err != nil || p.Encoding != encodingForm {
+		return body, "application/json", err
+	}
+
+	var fields map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, "", err
+	}
+	form := url.Values{}
+	for name, value := range fields {
+		form.Set(name, fmt.Sprint(value))
+	}
+	return []byte(form.Encode()), "application/x-www-form-urlencoded", nil
+}
+
+// Joins inputs for providers with AccumulateInput and no InputSeparator
+const defaultInputSeparator = "*"
+
+// menuInput returns the input sent to the provider for a request whose
+// session has seen history so far
+func (p Provider) menuInput(req USSDRequest, history []string) string {
+	if !p.AccumulateInput || len(history) == 0 {
+		return req.UserData
+	}
+	sep := p.InputSeparator
+	if sep == "" {
+		sep = defaultInputSeparator
+	}
+	return strings.Join(history, sep)
+}
+
+// Duration is a time.Duration written in config files as a string such as
+// "10s" or "500ms"
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("expected a duration string such as \"10s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// defaultProvider returns the provider configured through the environment
+func (c *Config) defaultProvider() Provider {
+	return Provider{
+		Name:    defaultProviderName,
+		URL:     c.MenuAPIURL,
+		Timeout: Duration(c.MenuAPITimeout),
+	}
+}
+
+// providerFor returns the provider routed for a short code at the current
+// time, preferring the route's binary provider for 8-bit requests
+func (c *Config) providerFor(shortCode string, binary bool) Provider {
+	route, ok := c.routeFor(shortCode)
+	if !ok {
+		return c.defaultProvider()
+	}
+	name := route.Provider
+	if route.Schedule != nil && !route.Schedule.businessHours(clock()) {
+		name = route.Schedule.OffHoursProvider
+	}
+	if binary && route.BinaryProvider != "" {
+		name = route.BinaryProvider
+	}
+	for _, provider := range c.Providers {
+		if provider.Name == name {
+			return provider
+		}
+	}
+	return c.defaultProvider()
+}
+
+// TestAccounts lists the MSISDNs (exactly, or by prefix) of QA subscribers
+// whose requests go to Provider whatever their short code is routed to
+type TestAccounts struct {
+	Provider string   `json:"provider"`
+	MSISDNs  []string `json:"msisdns"`
+	Prefixes []string `json:"prefixes"`
+}
+
+// testProviderFor returns the provider serving msisdn when it is a test
+// account
+func (c *Config) testProviderFor(msisdn string) (Provider, bool) {
+	accounts := c.TestAccounts
+	if accounts.Provider == "" {
+		return Provider{}, false
+	}
+	matched := false
+	for _, m := range accounts.MSISDNs {
+		matched = matched || m == msisdn
+	}
+	for _, prefix := range accounts.Prefixes {
+		matched = matched || strings.HasPrefix(msisdn, prefix)
+	}
+	if !matched {
+		return Provider{}, false
+	}
+	for _, provider := range c.Providers {
+		if provider.Name == accounts.Provider {
+			return provider, true
+		}
+	}
+	return Provider{}, false
+}
+
+// placeholderPattern matches a {name} placeholder in a menu API URL
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// Placeholders a menu API URL may contain, substituted per request
+var urlPlaceholders = map[string]bool{
+	"{telco}":      true,
+	"{shortcode}":  true,
+	"{product_id}": true,
+}
+
+// errUnresolvedPlaceholder is returned by expandMenuURL for a placeholder
+// it has no value for
+var errUnresolvedPlaceholder = errors.New("unresolved placeholder in menu API URL")
+
+// expandMenuURL substitutes the placeholders in template with the
+// path-escaped values for the request
+func expandMenuURL(template string, values map[string]string) (string, error) {
+	var missing []string
+	expanded := placeholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		value := values[placeholder]
+		if !urlPlaceholders[placeholder] || value == "" {
+			missing = append(missing, placeholder)
+			return placeholder
+		}
+		return url.PathEscape(value)
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("%w %q: %s", errUnresolvedPlaceholder, template, strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// menuURLValues returns the placeholder values for a request
+func menuURLValues(telco, shortCode string, productID int) map[string]string {
+	return map[string]string{
+		"{telco}":      telco,
+		"{shortcode}":  shortCode,
+		"{product_id}": strconv.Itoa(productID),
+	}
+}
+
+// validateMenuURL checks that raw is an absolute http(s) URL once its
+// placeholders are substituted, and that it uses no unknown placeholders
+func validateMenuURL(raw string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(raw, -1) {
+		if !urlPlaceholders[placeholder] {
+			return fmt.Errorf("%q: unknown placeholder %s, expected {telco}, {shortcode} or {product_id}", raw, placeholder)
+		}
+	}
+	sample, err := expandMenuURL(raw, menuURLValues("telco", "123", 1))
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(sample)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q: expected an absolute http(s) URL", raw)
+	}
+	return nil
+}
+
+// validateProviders checks the provider profiles and the providers named
+// by routes
+func (c *Config) validateProviders() []error {
+	var problems []error
+
+	names := map[string]bool{defaultProviderName: true}
+	for i, provider := range c.Providers {
+		if provider.Name == "" {
+			problems = append(problems, fmt.Errorf("provider %d: missing name", i))
+			continue
+		}
+		if names[provider.Name] {
+			problems = append(problems, fmt.Errorf("provider %s: duplicate or reserved name", provider.Name))
+		}
+		names[provider.Name] = true
+
+		if err := validateMenuURL(provider.URL); err != nil {
+			problems = append(problems, fmt.Errorf("provider %s: invalid url: %v", provider.Name, err))
+		}
+		if provider.Timeout < 0 {
+			problems = append(problems, fmt.Errorf("provider %s: timeout must not be negative", provider.Name))
+		}
+		switch provider.Encoding {
+		case "", encodingJSON, encodingForm:
+		default:
+			problems = append(problems, fmt.Errorf("provider %s: invalid encoding %q: expected json or form", provider.Name, provider.Encoding))
+		}
+		switch provider.BinaryInput {
+		case "", binaryInputBase64, binaryInputHex:
+		default:
+			problems = append(problems, fmt.Errorf("provider %s: invalid binary_input %q: expected base64 or hex", provider.Name, provider.BinaryInput))
+		}
+	}
+
+	for _, route := range c.Routes {
+		if route.Provider != "" && !names[route.Provider] {
+			problems = append(problems, fmt.Errorf("route %s: unknown provider %q", route.ShortCode, route.Provider))
+		}
+		if route.BinaryProvider != "" && !names[route.BinaryProvider] {
+			problems = append(problems, fmt.Errorf("route %s: unknown binary provider %q", route.ShortCode, route.BinaryProvider))
+		}
+		if schedule := route.Schedule; schedule != nil {
+			if schedule.OffHoursProvider == "" {
+				problems = append(problems, fmt.Errorf("route %s: schedule missing off_hours_provider", route.ShortCode))
+			} else if !names[schedule.OffHoursProvider] {
+				problems = append(problems, fmt.Errorf("route %s: unknown off-hours provider %q", route.ShortCode, schedule.OffHoursProvider))
+			}
+			if schedule.Start == schedule.End {
+				problems = append(problems, fmt.Errorf("route %s: schedule start and end must differ", route.ShortCode))
+			}
+		}
+	}
+
+	accounts := c.TestAccounts
+	if accounts.Provider != "" && !names[accounts.Provider] {
+		problems = append(problems, fmt.Errorf("test_accounts: unknown provider %q", accounts.Provider))
+	}
+	if accounts.Provider == "" && len(accounts.MSISDNs)+len(accounts.Prefixes) > 0 {
+		problems = append(problems, fmt.Errorf("test_accounts: missing provider"))
+	}
+
+	return problems
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProviderTimeouts(t *testing.T) {
+	withLinkUp(t)
+	// Both providers take 300ms to answer
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(300 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+		writeMenu(w, "Welcome", true)
+	}))
+	t.Cleanup(api.Close)
+	withConfig(t, func(cfg *Config) {
+		cfg.Providers = []Provider{
+			{Name: "local", URL: api.URL, Timeout: Duration(100 * time.Millisecond)},
+			{Name: "thirdparty", URL: api.URL, Timeout: Duration(2 * time.Second)},
+		}
+		cfg.Routes = []Route{
+			{ShortCode: "111", ProductID: 1, Provider: "local"},
+			{ShortCode: "222", ProductID: 2, Provider: "thirdparty"},
+		}
+	})
+
+	tests := []struct {
+		name      string
+		shortCode string
+		menu      bool
+	}{
+		{"shorter than the call", "111", false},
+		{"longer than the call", "222", true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &captureConn{}
+			serve(t, c, testRequest(fmt.Sprintf("PROV%d", i), "2348030000010", tt.shortCode, ""))
+			if menu := c.lastResponse(t).UserData == "Welcome"; menu != tt.menu {
+				t.Errorf("answered with the menu %v, want %v", menu, tt.menu)
+			}
+		})
+	}
+}
+
+func TestProviderValidation(t *testing.T) {
+	cfg := &Config{
+		Providers: []Provider{
+			{Name: "fast", URL: "http://localhost/menu", Timeout: Duration(time.Second)},
+			{Name: "fast", URL: "not a url"},
+			{Name: "legacy", URL: "http://localhost/menu", Encoding: "xml"},
+			{Name: "stk", URL: "http://localhost/menu", BinaryInput: "raw"},
+		},
+		Routes: []Route{{ShortCode: "123", ProductID: 1, Provider: "missing"}},
+	}
+	if problems := cfg.validateProviders(); len(problems) != 5 {
+		t.Errorf("got %d problems, want 5 (duplicate name, bad url, bad encoding, bad binary input, unknown provider): %v", len(problems), problems)
+	}
+}
+
+func TestExpandMenuURL(t *testing.T) {
+	values := menuURLValues("MTN", "123*4", 7)
+
+	tests := []struct {
+		name     string
+		template string
+		want     string
+		err      error
+	}{
+		{"flat", "http://menu/ussd", "http://menu/ussd", nil},
+		{"all placeholders", "http://menu/ussd/{telco}/{shortcode}?product={product_id}", "http://menu/ussd/MTN/123%2A4?product=7", nil},
+		{"unknown placeholder", "http://menu/ussd/{network}", "", errUnresolvedPlaceholder},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandMenuURL(tt.template, values)
+			if !errors.Is(err, tt.err) || got != tt.want {
+				t.Errorf("expandMenuURL(%q) = %q, %v; want %q, %v", tt.template, got, err, tt.want, tt.err)
+			}
+			if err != nil && !strings.Contains(err.Error(), "{network}") {
+				t.Errorf("error %q does not name the placeholder", err)
+			}
+		})
+	}
+
+	if _, err := expandMenuURL("http://menu/{shortcode}", menuURLValues("MTN", "", 7)); !errors.Is(err, errUnresolvedPlaceholder) {
+		t.Errorf("empty short code: got %v, want %v", err, errUnresolvedPlaceholder)
+	}
+	if err := validateMenuURL("http://menu/{network}"); err == nil {
+		t.Error("validateMenuURL accepted an unknown placeholder")
+	}
+}
+
+func TestMenuURLTemplate(t *testing.T) {
+	withLinkUp(t)
+	paths := make(chan string, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.RequestURI()
+		writeMenu(w, "Welcome", true)
+	}))
+	t.Cleanup(api.Close)
+	withConfig(t, func(cfg *Config) {
+		cfg.MenuAPIURL = api.URL + "/ussd/{telco}/{shortcode}?product={product_id}"
+		cfg.Routes = []Route{{ShortCode: "321", ProductID: 5}}
+	})
+
+	serve(t, &captureConn{}, testRequest("TMPL1", "2348030000020", "321", ""))
+	t.Cleanup(func() { Sessions.End("TMPL1") })
+
+	select {
+	case got := <-paths:
+		if want := "/ussd/MTN/321?product=5"; got != want {
+			t.Errorf("menu API called at %s, want %s", got, want)
+		}
+	default:
+		t.Fatal("menu API not called")
+	}
+}
+
+func TestTestAccountsGetMockProvider(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, "Real menu")
+	mock := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeMenu(w, "Mock menu", true)
+	}))
+	t.Cleanup(mock.Close)
+	withConfig(t, func(cfg *Config) {
+		cfg.Providers = []Provider{{Name: "mock", URL: mock.URL}}
+		cfg.TestAccounts = TestAccounts{
+			Provider: "mock",
+			MSISDNs:  []string{"2348030000029"},
+			Prefixes: []string{"234809999"},
+		}
+	})
+
+	tests := []struct {
+		name   string
+		msisdn string
+		want   string
+	}{
+		{"listed test MSISDN", "2348030000029", "Mock menu"},
+		{"test prefix", "2348099990001", "Mock menu"},
+		{"real subscriber", "2348030000030", "Real menu"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id := fmt.Sprintf("QA%d", i)
+			t.Cleanup(func() { Sessions.End(id) })
+
+			c := &captureConn{}
+			serve(t, c, testRequest(id, tt.msisdn, "123", ""))
+			if got := c.lastResponse(t).UserData; got != tt.want {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccumulatedInput(t *testing.T) {
+	withLinkUp(t)
+	inputs := make(chan string, 4)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body USSDMenuRequest
+		json.NewDecoder(r.Body).Decode(&body)
+		inputs <- body.Input
+		writeMenu(w, "Next", true)
+	}))
+	t.Cleanup(api.Close)
+	withConfig(t, func(cfg *Config) {
+		cfg.Providers = []Provider{{Name: "stateless", URL: api.URL, AccumulateInput: true}}
+		cfg.Routes = []Route{{ShortCode: "777", ProductID: 2, Provider: "stateless"}}
+	})
+	t.Cleanup(func() { Sessions.End("ACCUM1") })
+
+	for _, input := range []string{"", "1", "2", "3"} {
+		serve(t, &captureConn{}, testRequest("ACCUM1", "2348030000035", "777", input))
+	}
+	close(inputs)
+
+	var got []string
+	for input := range inputs {
+		got = append(got, input)
+	}
+	want := []string{"*777#", "1", "1*2", "1*2*3"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("backend got inputs %q, want %q", got, want)
+	}
+}
+
+func TestProviderEncoding(t *testing.T) {
+	withLinkUp(t)
+	type post struct {
+		contentType string
+		body        string
+	}
+	posts := make(chan post, 1)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		posts <- post{r.Header.Get("Content-Type"), string(body)}
+		writeMenu(w, "Welcome", true)
+	}))
+	t.Cleanup(api.Close)
+	withConfig(t, func(cfg *Config) {
+		cfg.Providers = []Provider{
+			{Name: "modern", URL: api.URL, Encoding: encodingJSON},
+			{Name: "legacy", URL: api.URL, Encoding: encodingForm},
+		}
+		cfg.Routes = []Route{
+			{ShortCode: "881", ProductID: 4, Provider: "modern"},
+			{ShortCode: "882", ProductID: 5, Provider: "legacy"},
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		serve(t, &captureConn{}, testRequest("ENCJSON1", "2348030000062", "881", ""))
+		t.Cleanup(func() { Sessions.End("ENCJSON1") })
+
+		got := <-posts
+		if got.contentType != "application/json" {
+			t.Errorf("Content-Type %q, want application/json", got.contentType)
+		}
+		var body USSDMenuRequest
+		if err := json.Unmarshal([]byte(got.body), &body); err != nil {
+			t.Fatalf("body %q is not JSON: %v", got.body, err)
+		}
+		if body.Phone != "2348030000062" || body.Shortcode != "*881#" || body.ProductID != 4 {
+			t.Errorf("sent %+v", body)
+		}
+	})
+
+	t.Run("form", func(t *testing.T) {
+		serve(t, &captureConn{}, testRequest("ENCFORM1", "2348030000063", "882", ""))
+		t.Cleanup(func() { Sessions.End("ENCFORM1") })
+
+		got := <-posts
+		if got.contentType != "application/x-www-form-urlencoded" {
+			t.Errorf("Content-Type %q, want application/x-www-form-urlencoded", got.contentType)
+		}
+		if !strings.Contains(got.body, "shortcode=%2A882%23") {
+			t.Errorf("body %q does not URL-encode the short code", got.body)
+		}
+		form, err := url.ParseQuery(got.body)
+		if err != nil {
+			t.Fatalf("body %q is not a form: %v", got.body, err)
+		}
+		want := url.Values{
+			"telco":      {"MTN"},
+			"shortcode":  {"*882#"},
+			"product_id": {"5"},
+			"phone":      {"2348030000063"},
+			"input":      {"*882#"},
+			"session_id": {"ENCFORM1"},
+		}
+		if !reflect.DeepEqual(form, want) {
+			t.Errorf("sent form %v, want %v", form, want)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+
+	pushController "github.com/abeloha/USSDTCP/pkg/controllers/push"
+	"github.com/abeloha/USSDTCP/pkg/session"
+)
+
+// Phase and DCS used for network-initiated (mobile terminated) pushes
+const (
+	pushPhase = 2
+	pushDCS   = 15 // GSM 7-bit default alphabet
+)
+
+// pushUSSD starts a network-initiated session by sending message to msisdn
+// and tracks it so the subscriber's reply is matched to it
+func pushUSSD(msisdn, shortCode, message string) (string, error) {
+	conns := serverConns()
+	if len(conns) == 0 {
+		return "", pushController.ErrConnectionDown
+	}
+	c := conns[0]
+
+	requestID := generateRequestID()
+	response := USSDResponse{
+		RequestID: requestID,
+		MSISDN:    msisdn,
+		StarCode:  shortCode,
+		ClientID:  AppConfig().ClientID,
+		Phase:     pushPhase,
+		DCS:       pushDCS,
+		MsgType:   msgTypeResponseExpected,
+		UserData:  message,
+		Extra:     AppConfig().ResponseFields,
+	}
+
+	// Open the session before sending so a quick reply finds it
+	startSession(requestID, msisdn, shortCode, session.OriginPush)
+
+	AppLogger.Info("Pushing USSD menu to %s on %s with code %s", msisdn, shortCode, requestID)
+	if err := sendUSSDResponse(context.Background(), c, response); err != nil {
+		AppLogger.Error("Failed to push USSD menu to %s: %v", msisdn, err)
+		endSession(requestID)
+		return "", err
+	}
+	return requestID, nil
+}
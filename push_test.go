@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pushController "github.com/abeloha/USSDTCP/pkg/controllers/push"
+)
+
+// failingConn is a server connection every write to fails
+type failingConn struct {
+	net.Conn // nil; only the methods below are used
+}
+
+func (failingConn) Write([]byte) (int, error)        { return 0, errors.New("broken pipe") }
+func (failingConn) SetWriteDeadline(time.Time) error { return nil }
+func (failingConn) Close() error                     { return nil }
+
+func TestPushUSSD(t *testing.T) {
+	responses := make(chan USSDResponse, 1)
+	startTestServer(t, forwardResponses(responses))
+	if err := connect(); err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+
+	id, err := pushUSSD("2348030000005", "123", "Your bill is due. 1. Pay")
+	if err != nil {
+		t.Fatalf("pushUSSD: %v", err)
+	}
+	if _, ok := Sessions.Get(id); !ok {
+		t.Errorf("no session open for push %s", id)
+	}
+
+	select {
+	case resp := <-responses:
+		if resp.RequestID != id || resp.MSISDN != "2348030000005" || resp.UserData != "Your bill is due. 1. Pay" {
+			t.Errorf("server got %+v for push %s", resp, id)
+		}
+		if resp.MsgType != msgTypeResponseExpected || resp.EndOfSession != 0 {
+			t.Errorf("push sent with msgtype %d and EndofSession %d, want a menu expecting a reply", resp.MsgType, resp.EndOfSession)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("server got no push frame")
+	}
+}
+
+func TestPushUSSDFailures(t *testing.T) {
+	tests := []struct {
+		name string
+		conn net.Conn
+		up   bool
+		want error
+	}{
+		{"link down", nil, false, pushController.ErrConnectionDown},
+		{"send fails", failingConn{}, true, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConn(tt.conn, "")
+			linkUp.Store(tt.up)
+			t.Cleanup(func() {
+				setConn(nil, "")
+				linkUp.Store(false)
+			})
+			before := Sessions.Len()
+
+			id, err := pushUSSD("2348030000006", "123", "Hello")
+			if err == nil || (tt.want != nil && !errors.Is(err, tt.want)) {
+				t.Errorf("pushUSSD = %q, %v; want error %v", id, err, tt.want)
+			}
+			if after := Sessions.Len(); after != before {
+				t.Errorf("%d sessions after a failed push, want %d", after, before)
+			}
+		})
+	}
+}
+
+func TestGenerateRequestIDUnique(t *testing.T) {
+	const n = 500
+	ids := make(chan string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids <- generateRequestID()
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[string]bool)
+	for id := range ids {
+		if len(id) > 16 {
+			t.Errorf("request ID %q is longer than the 16-byte header field", id)
+		}
+		if seen[id] {
+			t.Errorf("request ID %q generated twice", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/joho/godotenv"
+)
+
+// reloadable copies from fresh the settings that can change while running:
+// routing, log levels, fallback messages and the short code allowlist.
+// Connection, pacing and logging sink settings only apply on restart.
+func (c *Config) reloadable(fresh *Config) {
+	c.Routes = fresh.Routes
+	c.Providers = fresh.Providers
+	c.DefaultProductID = fresh.DefaultProductID
+	c.TestAccounts = fresh.TestAccounts
+	c.TelcoDCS = fresh.TelcoDCS
+	c.TelcoPrefixes = fresh.TelcoPrefixes
+	c.DefaultTelco = fresh.DefaultTelco
+	c.Telcos = fresh.Telcos
+	c.TelcoNames = fresh.TelcoNames
+	c.ErrorCodes = fresh.ErrorCodes
+	c.MenuStatuses = fresh.MenuStatuses
+	c.ResponseFields = fresh.ResponseFields
+
+	c.LogDebug = fresh.LogDebug
+	c.LogMaxBody = fresh.LogMaxBody
+
+	c.RetryMessage = fresh.RetryMessage
+	c.MenuLoopMessage = fresh.MenuLoopMessage
+	c.EmptyInputMessage = fresh.EmptyInputMessage
+	c.ShortCodeNotFoundMessage = fresh.ShortCodeNotFoundMessage
+	c.ClosingMessage = fresh.ClosingMessage
+	c.UnavailableMessage = fresh.UnavailableMessage
+	c.SessionLockedMessage = fresh.SessionLockedMessage
+	c.SessionExpiredMessage = fresh.SessionExpiredMessage
+
+	c.AllowedShortCodes = fresh.AllowedShortCodes
+}
+
+// Variables set in the process environment at startup, before .env was
+// loaded. They take precedence over .env, on reload as well.
+var processEnv = environKeys()
+
+// environKeys returns the names of the variables set in the environment
+func environKeys() map[string]bool {
+	keys := make(map[string]bool)
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		keys[name] = true
+	}
+	return keys
+}
+
+// reloadConfig reads the configuration again and swaps in its reloadable
+// settings. The connection and open sessions are left alone. When the new
+// configuration is invalid the current one stays in force.
+func reloadConfig() error {
+	// loadConfig leaves variables that are already set alone, which after
+	// startup would be every one from .env; take its edits first, except
+	// to those the process environment sets
+	dotEnv, err := godotenv.Read()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to load .env file, keeping the current configuration: %v", err)
+	}
+	for name, value := range dotEnv {
+		if !processEnv[name] {
+			os.Setenv(name, value)
+		}
+	}
+	fresh, problems := loadConfig()
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration (%d problems), keeping the current one: %w", len(problems), errors.Join(problems...))
+	}
+
+	next := *AppConfig()
+	next.reloadable(fresh)
+	currentConfig.Store(&next)
+	applyLogDebug()
+	return nil
+}
+
+// runConfigReload reloads the configuration on every signal from sighup
+// until stop is closed
+func runConfigReload(sighup <-chan os.Signal, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		case <-sighup:
+			AppLogger.Info("Reloading configuration")
+			if err := reloadConfig(); err != nil {
+				AppLogger.Error("Failed to reload configuration: %v", err)
+				ErrorLogger.Error("Failed to reload configuration: %v", err)
+				continue
+			}
+			AppLogger.Info("Configuration reloaded (%d routes, %d providers)", len(AppConfig().Routes), len(AppConfig().Providers))
+		}
+	}
+}
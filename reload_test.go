@@ -0,0 +1,110 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes a config file and points CONFIG_FILE at it
+func writeConfigFile(t *testing.T, body string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+}
+
+func TestReloadConfigOnSIGHUP(t *testing.T) {
+	t.Cleanup(applyLogDebug)
+	withConfig(t, func(cfg *Config) {})
+	withLinkUp(t)
+	connBefore := getConn()
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	stop := make(chan struct{})
+	t.Cleanup(func() {
+		signal.Stop(sighup)
+		close(stop)
+	})
+	go runConfigReload(sighup, stop)
+
+	writeConfigFile(t, `{"routes": [{"short_code": "321", "product_id": 9}]}`)
+	t.Setenv("LOG_DEBUG", "menu")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !strings.Contains(readLog(t, "log"), "Configuration reloaded (1 routes") {
+		if time.Now().After(deadline) {
+			t.Fatal("configuration not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if id, rule := AppConfig().productIDFor("321"); id != 9 || rule != "321" {
+		t.Errorf("productIDFor(321) = %d (route %q) after reload, want 9", id, rule)
+	}
+	if !AppConfig().debugEnabled("menu") {
+		t.Error("LOG_DEBUG not reloaded")
+	}
+	if getConn() != connBefore || !linkUp.Load() {
+		t.Error("connection changed by the reload")
+	}
+}
+
+func TestReloadConfigKeepsCurrentWhenInvalid(t *testing.T) {
+	withConfig(t, func(cfg *Config) {
+		cfg.Routes = []Route{{ShortCode: "321", ProductID: 5}}
+	})
+
+	writeConfigFile(t, `{"routes": [{"short_code": "321", "product_id": 9}, {"short_code": "*321#", "product_id": 10}]}`)
+	if err := reloadConfig(); err == nil {
+		t.Fatal("overlapping routes reloaded without error")
+	}
+	if id, _ := AppConfig().productIDFor("321"); id != 5 {
+		t.Errorf("productIDFor(321) = %d after a failed reload, want the current 5", id)
+	}
+}
+
+func TestReloadConfigTakesDotEnvEdits(t *testing.T) {
+	withConfig(t, func(cfg *Config) {})
+	dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(dir) })
+
+	// RETRY_MESSAGE comes from the process environment, DEFAULT_PRODUCT_ID
+	// was set at startup from .env, then edited there
+	saved := processEnv
+	processEnv = map[string]bool{"RETRY_MESSAGE": true}
+	t.Cleanup(func() { processEnv = saved })
+	t.Setenv("RETRY_MESSAGE", "Set by the deployment")
+	t.Setenv("DEFAULT_PRODUCT_ID", "3")
+	dotEnv := "DEFAULT_PRODUCT_ID=7\nRETRY_MESSAGE=Set in .env\n"
+	if err := os.WriteFile(".env", []byte(dotEnv), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(); err != nil {
+		t.Fatalf("reloadConfig: %v", err)
+	}
+	if got := AppConfig().DefaultProductID; got != 7 {
+		t.Errorf("DEFAULT_PRODUCT_ID = %d after editing .env, want 7", got)
+	}
+	if got := AppConfig().RetryMessage; got != "Set by the deployment" {
+		t.Errorf("RETRY_MESSAGE = %q after reload, want the process environment's", got)
+	}
+}
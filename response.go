@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/logger"
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+// Values for the msgtype field of a USSDResponse
+const (
+	msgTypeResponseExpected = 2 // subscriber is expected to reply
+	msgTypeEndOfSession     = 6 // final message, session is released
+)
+
+// Values for RESPONSE_ID, the requestId our responses carry, in the XML
+// body and the frame header alike
+const (
+	responseIDEcho     = "echo"     // the ID of the request answered
+	responseIDGenerate = "generate" // a fresh ID for every response
+	responseIDStep     = "step"     // the request's, suffixed with the session step
+)
+
+// responseID returns the requestId of a response to req
+func responseID(req USSDRequest) string {
+	switch AppConfig().ResponseID {
+	case responseIDGenerate:
+		return generateRequestID()
+	case responseIDStep:
+		step := 1
+		if s, ok := Sessions.Get(req.RequestID); ok && s.Steps > 0 {
+			step = s.Steps
+		}
+		return req.RequestID + AppConfig().ResponseIDSeparator + strconv.Itoa(step)
+	}
+	return req.RequestID
+}
+
+// responseFrameID returns the session ID in the frame header of a response
+// to req with requestId id: id itself, except with RESPONSE_ID=step where
+// the header keeps the request's
+func responseFrameID(req USSDRequest, id string) string {
+	if AppConfig().ResponseID == responseIDStep {
+		return req.RequestID
+	}
+	return id
+}
+
+// toValidUTF8 replaces each invalid UTF-8 sequence in b with U+FFFD, or
+// drops it when policy is invalidUTF8Strip
+func toValidUTF8(b []byte, policy string) []byte {
+	if policy == invalidUTF8Strip {
+		return bytes.ToValidUTF8(b, nil)
+	}
+	return bytes.ToValidUTF8(b, []byte("\uFFFD"))
+}
+
+// Line break references the menu API may end its text with
+var newlineReferences = []string{"&#xa;", "&#10;", "&#xd;", "&#13;"}
+
+// trimMenuText drops leading and trailing whitespace from s, along with any
+// line break references (&#xA; and friends) at its end
+func trimMenuText(s string) string {
+	s = strings.TrimSpace(s)
+	for trimmed := false; !trimmed; {
+		trimmed = true
+		for _, ref := range newlineReferences {
+			if len(s) >= len(ref) && strings.EqualFold(s[len(s)-len(ref):], ref) {
+				s = strings.TrimSpace(s[:len(s)-len(ref)])
+				trimmed = false
+			}
+		}
+	}
+	return s
+}
+
+// Line breaks in menu text, written out or as character references
+var lineBreakPattern = regexp.MustCompile(`(?i)\r\n?|&#(xa|10|xd|13);`)
+
+// A numbered option at the start of a line ("1. Data", "2) Airtime") and
+// words asking the subscriber for a reply
+var (
+	menuOptionPattern = regexp.MustCompile(`(?m)^\s*\d{1,2}\s*[.):-]\s*\S`)
+	menuPromptPattern = regexp.MustCompile(`(?i)\?|\b(enter|reply|select|choose)\b`)
+)
+
+// expectsReply reports whether menu text reads as a prompt the subscriber
+// is meant to answer
+func expectsReply(s string) bool {
+	s = lineBreakPattern.ReplaceAllString(s, "\n")
+	return menuOptionPattern.MatchString(s) || menuPromptPattern.MatchString(s)
+}
+
+// continueMismatch describes how the continue flag disagrees with the menu
+// text, or returns "" when they agree
+func continueMismatch(message string, cont bool) string {
+	switch reply := expectsReply(message); {
+	case reply && !cont:
+		return "ends the session on a menu expecting a reply"
+	case !reply && cont:
+		return "continues the session on a message expecting no reply"
+	}
+	return ""
+}
+
+// validTextDCS reports whether dcs is a data coding scheme responses can
+// carry menu text in: a single octet that does not mark 8-bit binary data
+func validTextDCS(dcs int) bool {
+	return dcs >= 0 && dcs <= 255 && !is8BitDCS(dcs)
+}
+
+// responseDCS returns the DCS of a response to req: menuDCS when the menu
+// API set a valid one, else the default of telco, else the request's DCS
+func responseDCS(req USSDRequest, telco string, menuDCS *int) int {
+	if menuDCS != nil {
+		if validTextDCS(*menuDCS) {
+			return *menuDCS
+		}
+		MenuLogger.Warn("Ignoring invalid DCS %d from the menu API for %s with code %s", *menuDCS, req.MSISDN, req.RequestID)
+	}
+	if dcs, ok := AppConfig().TelcoDCS[telco]; ok {
+		return dcs
+	}
+	return req.DCS
+}
+
+// Longest USSD message, in characters of the GSM 7-bit alphabet
+const maxUSSDMessageLength = 182
+
+// closingMessageFor returns the closing line for sessions on shortCode:
+// the route's own when it sets one, else ClosingMessage
+func (c *Config) closingMessageFor(shortCode string) string {
+	if route, ok := c.routeFor(shortCode); ok && route.ClosingMessage != nil {
+		return *route.ClosingMessage
+	}
+	return c.ClosingMessage
+}
+
+// withClosingMessage appends the closing line for shortCode to message, on
+// a line of its own, unless there is none or the result would not fit in a
+// USSD message in the alphabet of dcs
+func withClosingMessage(shortCode, message string, dcs int) string {
+	closing := AppConfig().closingMessageFor(shortCode)
+	if closing == "" {
+		return message
+	}
+	closed := message + "\n" + closing
+	if !fitsMessage(closed, dcs) {
+		alphabet := dcsAlphabet(dcs)
+		MenuLogger.Debug("Closing message left out for short code %s: %d characters would exceed %d", shortCode, encodedLength(closed, alphabet), maxMessageUnits(alphabet))
+		return message
+	}
+	return closed
+}
+
+// newUSSDResponse builds the response to req carrying message, with the
+// telco's default DCS. When cont is false the response ends the session.
+func newUSSDResponse(req USSDRequest, message string, cont bool) USSDResponse {
+	id := responseID(req)
+	response := USSDResponse{
+		RequestID:    id,
+		FrameID:      responseFrameID(req, id),
+		MSISDN:       req.MSISDN,
+		StarCode:     req.StarCode,
+		ClientID:     req.ClientID,
+		Phase:        req.Phase,
+		DCS:          responseDCS(req, AppConfig().telcoFor(req.MSISDN), nil),
+		MsgType:      msgTypeResponseExpected,
+		UserData:     message,
+		EndOfSession: 0, // 0 for not end of session, 1 for end of session
+		Extra:        AppConfig().ResponseFields,
+	}
+
+	if !cont {
+		response.EndOfSession = 1
+		response.MsgType = msgTypeEndOfSession
+	}
+
+	return response
+}
+
+// Standard elements of a USSDResponse, in the order they are rendered
+var responseElements = []string{"requestId", "msisdn", "starCode", "clientId", "phase", "dcs", "msgtype", "userdata", "EndofSession"}
+
+// RenderUSSDResponse returns the XML body of response. Text fields are
+// escaped with escapeText; numeric fields are written as they are. Extra
+// fields follow the standard element they are placed after.
+func RenderUSSDResponse(response USSDResponse) []byte {
+	// Issue with xml.MarshalIndent; using fmt.Sprintf instead.
+	// The marshalling replaces new line with special characters, making the XML not display well on mobile app.
+	// messageXML, _ := xml.MarshalIndent(response, "", "  ")
+
+	values := []string{
+		escapeText(response.RequestID),
+		escapeText(response.MSISDN),
+		escapeText(response.StarCode),
+		escapeText(response.ClientID),
+		strconv.Itoa(response.Phase),
+		strconv.Itoa(response.DCS),
+		strconv.Itoa(response.MsgType),
+		escapeText(response.UserData),
+		strconv.Itoa(response.EndOfSession),
+	}
+
+	var b strings.Builder
+	b.WriteString("<USSDResponse>")
+	for i, name := range responseElements {
+		fmt.Fprintf(&b, "\n\t<%s>%s</%s>", name, values[i], name)
+		for _, field := range response.Extra {
+			if field.After == name || (field.After == "" && name == "EndofSession") {
+				fmt.Fprintf(&b, "\n\t<%s>%s</%s>", field.Name, escapeText(field.Value), field.Name)
+			}
+		}
+	}
+	b.WriteString("\n\t</USSDResponse>")
+	return []byte(b.String())
+}
+
+// validResponseField checks that field names an element of its own and
+// follows a standard one
+func validResponseField(field ResponseField) error {
+	if !xmlNamePattern.MatchString(field.Name) {
+		return fmt.Errorf("invalid element name %q", field.Name)
+	}
+	after := false
+	for _, name := range responseElements {
+		if strings.EqualFold(field.Name, name) {
+			return fmt.Errorf("%q is a standard element", field.Name)
+		}
+		after = after || field.After == name
+	}
+	if field.After != "" && !after {
+		return fmt.Errorf("after %q: expected one of %s", field.After, strings.Join(responseElements, ", "))
+	}
+	return nil
+}
+
+// Element names accepted in response_fields
+var xmlNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9._-]*$`)
+
+// escapeText escapes s for use as XML character data while keeping line
+// breaks readable on handsets: CRLF and CR become LF, which is written as
+// is, and character or entity references already in s (the menu API
+// writes line breaks as &#xA;) are passed through rather than re-escaped.
+func escapeText(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '&':
+			if n := referenceLength(s[i:]); n > 0 {
+				b.WriteString(s[i : i+n])
+				i += n - 1
+			} else {
+				b.WriteString("&amp;")
+			}
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		case '\r':
+			b.WriteByte('\n')
+			if i+1 < len(s) && s[i+1] == '\n' {
+				i++
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// referenceLength returns the length of the XML character or predefined
+// entity reference at the start of s, or 0 if there is none
+func referenceLength(s string) int {
+	end := strings.IndexByte(s, ';')
+	if end < 2 || end > 10 {
+		return 0
+	}
+	name := s[1:end]
+	switch name {
+	case "amp", "lt", "gt", "quot", "apos":
+		return end + 1
+	}
+	if name[0] != '#' || len(name) < 2 {
+		return 0
+	}
+	digits, base := name[1:], 10
+	if digits[0] == 'x' || digits[0] == 'X' {
+		digits, base = digits[1:], 16
+	}
+	if digits == "" {
+		return 0
+	}
+	if _, err := strconv.ParseUint(digits, base, 32); err != nil {
+		return 0
+	}
+	return end + 1
+}
+
+// sendUSSDResponse renders response and writes it to conn, timing both on
+// the request record of ctx
+func sendUSSDResponse(ctx context.Context, conn net.Conn, response USSDResponse) error {
+	record := requestRecordFrom(ctx)
+	renderStart := time.Now()
+	if AppConfig().DCSCheck != dcsCheckOff {
+		response.DCS = checkDCS(response)
+	}
+	if AppConfig().MessageOverflow == overflowTruncate {
+		if fitted := fitMessage(response.UserData, response.DCS, AppConfig().TruncationMarker); fitted != response.UserData {
+			MenuLogger.Warn("Response to %s with code %s truncated to fit a message with DCS %d", response.MSISDN, response.RequestID, response.DCS)
+			response.UserData = fitted
+		}
+	}
+	body := RenderUSSDResponse(response)
+	if err := checkRenderedXML(body); err != nil {
+		logRenderedXML(response, body, fmt.Sprintf("is not valid XML: %v", err))
+	}
+	record.timed(stageRender, time.Since(renderStart))
+
+	// A simulated response goes back to the simulator instead
+	if captured := simulationFrom(ctx); captured != nil {
+		captured.take(response)
+		return nil
+	}
+
+	sendStart := time.Now()
+	frameID := response.FrameID
+	if frameID == "" {
+		frameID = response.RequestID
+	}
+	// Await the acknowledgement before writing, which a fast server may
+	// send before sendMessage returns
+	tracked := AppConfig().AckFrame != ""
+	if tracked {
+		awaitingAcks.add(response.RequestID)
+	}
+	err := sendMessage(conn, body, frameID)
+	record.timed(stageSend, time.Since(sendStart))
+	if err != nil {
+		if tracked {
+			awaitingAcks.cancel(response.RequestID)
+		}
+		logRenderedXML(response, body, fmt.Sprintf("failed to send: %v", err))
+		return err
+	}
+	stats.ResponsesSent.Add(1)
+	if record != nil && !simulated(ctx) {
+		postSendHooks.dispatch(record.request, response, record.meta())
+	}
+	return nil
+}
+
+// checkDCS returns the DCS to send response under: its own, or dcsUCS2
+// with DCS_CHECK=switch when it holds characters its GSM 7-bit DCS cannot
+// encode. Either way such responses are logged.
+func checkDCS(response USSDResponse) int {
+	if dcsAlphabet(response.DCS) != alphabetGSM7 {
+		return response.DCS
+	}
+	r, found := nonGSM7(response.UserData)
+	if !found {
+		return response.DCS
+	}
+	if AppConfig().DCSCheck != dcsCheckSwitch {
+		MenuLogger.Warn("Response to %s with code %s holds %q, outside the GSM 7-bit alphabet of DCS %d", response.MSISDN, response.RequestID, r, response.DCS)
+		return response.DCS
+	}
+
+	MenuLogger.Warn("Response to %s with code %s holds %q, outside the GSM 7-bit alphabet of DCS %d, sending it as UCS-2", response.MSISDN, response.RequestID, r, response.DCS)
+	// UCS-2 fits fewer characters; MESSAGE_OVERFLOW=truncate cuts it below
+	if n := encodedLength(response.UserData, alphabetUCS2); n > maxMessageUnits(alphabetUCS2) && AppConfig().MessageOverflow != overflowTruncate {
+		MenuLogger.Warn("Response to %s with code %s is %d characters, over the %d of a UCS-2 message", response.MSISDN, response.RequestID, n, maxMessageUnits(alphabetUCS2))
+	}
+	return dcsUCS2
+}
+
+// checkRenderedXML returns why body, a rendered response, is not a
+// well-formed USSDResponse document, or nil when it is
+func checkRenderedXML(body []byte) error {
+	if frameType(body) != "USSDResponse" {
+		return fmt.Errorf("root element is not USSDResponse")
+	}
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// logRenderedXML writes the rendered XML of response to the menu log with
+// what went wrong with it, when LogXMLOnError is set
+func logRenderedXML(response USSDResponse, body []byte, problem string) {
+	if !AppConfig().LogXMLOnError {
+		return
+	}
+	MenuLogger.Error("Response to %s with code %s %s; rendered XML: %s", response.MSISDN, response.RequestID, problem, logger.Body(body))
+}
+
+// preSendHook, when set, is given each menu response just before it is
+// sent, e.g. to audit or redact it. It may modify the response; an error
+// aborts the send and ends the session.
+var preSendHook func(resp *USSDResponse) error
+
+// sendErrorResponse tells the server that req was rejected, ending the
+// session with errorCode and a description of the problem
+func sendErrorResponse(conn net.Conn, req USSDRequest, errorCode string, reason error) error {
+	id := responseID(req)
+	messageXML := []byte(fmt.Sprintf(`<USSDResponse>
+	<requestId>%s</requestId>
+	<msisdn>%s</msisdn>
+	<starCode>%s</starCode>
+	<clientId>%s</clientId>
+	<msgtype>%d</msgtype>
+	<EndofSession>1</EndofSession>
+	<errorCode>%s</errorCode>
+	<errorDescription>%s</errorDescription>
+	</USSDResponse>`, escapeText(id), escapeText(req.MSISDN), escapeText(req.StarCode), escapeText(req.ClientID), msgTypeEndOfSession, escapeText(errorCode), escapeText(reason.Error())))
+
+	return sendMessage(conn, messageXML, responseFrameID(req, id))
+}
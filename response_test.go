@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testResponse returns a response with every field set
+func testResponse(userData string) USSDResponse {
+	return USSDResponse{
+		RequestID:    "REQ0001",
+		MSISDN:       "2348030000017",
+		StarCode:     "123",
+		ClientID:     "client",
+		Phase:        2,
+		DCS:          15,
+		MsgType:      msgTypeResponseExpected,
+		UserData:     userData,
+		EndOfSession: 0,
+	}
+}
+
+func TestRenderUSSDResponseFields(t *testing.T) {
+	rendered := RenderUSSDResponse(testResponse("Welcome"))
+
+	var got USSDResponse
+	if err := xml.Unmarshal(rendered, &got); err != nil {
+		t.Fatalf("rendered invalid XML %s: %v", rendered, err)
+	}
+	got.XMLName = xml.Name{}
+	if want := testResponse("Welcome"); !reflect.DeepEqual(got, want) {
+		t.Errorf("rendered %+v, want %+v", got, want)
+	}
+}
+
+func TestRenderUSSDResponseExtraFields(t *testing.T) {
+	response := testResponse("Welcome")
+	response.Extra = []ResponseField{
+		{Name: "operator", Value: "MTN", After: "msisdn"},
+		{Name: "cost", Value: "0.05"},
+		{Name: "note", Value: "fees & charges", After: "userdata"},
+		{Name: "channel", Value: "ussd"},
+	}
+	rendered := RenderUSSDResponse(response)
+
+	var elements []string
+	decoder := xml.NewDecoder(bytes.NewReader(rendered))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			break
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			elements = append(elements, start.Name.Local)
+		}
+	}
+	want := []string{"USSDResponse", "requestId", "msisdn", "operator", "starCode", "clientId", "phase", "dcs", "msgtype", "userdata", "note", "EndofSession", "cost", "channel"}
+	if !reflect.DeepEqual(elements, want) {
+		t.Errorf("elements %v, want %v", elements, want)
+	}
+	if !bytes.Contains(rendered, []byte("<note>fees &amp; charges</note>")) {
+		t.Errorf("extra field not escaped in %s", rendered)
+	}
+}
+
+func TestValidResponseField(t *testing.T) {
+	tests := []struct {
+		field ResponseField
+		valid bool
+	}{
+		{ResponseField{Name: "operator", Value: "MTN"}, true},
+		{ResponseField{Name: "cost", After: "dcs"}, true},
+		{ResponseField{Name: "bad name"}, false},
+		{ResponseField{Name: "userdata"}, false},
+		{ResponseField{Name: "cost", After: "price"}, false},
+	}
+	for _, tt := range tests {
+		if err := validResponseField(tt.field); (err == nil) != tt.valid {
+			t.Errorf("validResponseField(%+v) = %v, want valid %v", tt.field, err, tt.valid)
+		}
+	}
+}
+
+func TestRenderUSSDResponseEscaping(t *testing.T) {
+	tests := []struct {
+		name     string
+		userData string
+		want     string // expected <userdata> content
+	}{
+		{"plain", "1. Balance", "1. Balance"},
+		{"markup", "<b>Tom & Jerry</b>", "&lt;b&gt;Tom &amp; Jerry&lt;/b&gt;"},
+		{"newline entities kept", "Menu&#xA;1. Data&#10;2. Airtime", "Menu&#xA;1. Data&#10;2. Airtime"},
+		{"named entities kept", "Q&amp;A &quot;now&quot;", "Q&amp;A &quot;now&quot;"},
+		{"not a reference", "AT&T &#xZZ; &;", "AT&amp;T &amp;#xZZ; &amp;;"},
+		{"CRLF normalised", "Menu\r\n1. Data\r2. Airtime\n3. Exit", "Menu\n1. Data\n2. Airtime\n3. Exit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rendered := RenderUSSDResponse(testResponse(tt.userData))
+			if want := "<userdata>" + tt.want + "</userdata>"; !bytes.Contains(rendered, []byte(want)) {
+				t.Errorf("rendered %s, want %s", rendered, want)
+			}
+			if err := xml.Unmarshal(rendered, new(USSDResponse)); err != nil {
+				t.Errorf("rendered invalid XML %s: %v", rendered, err)
+			}
+		})
+	}
+}
+
+func TestTrimMenuText(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"clean", "Welcome&#xA;1. Data", "Welcome&#xA;1. Data"},
+		{"whitespace", "  Welcome\n1. Data \n", "Welcome\n1. Data"},
+		{"trailing newline entity", "Welcome&#xA;1. Data&#xA;", "Welcome&#xA;1. Data"},
+		{"several trailing entities", "Welcome&#xA;1. Data &#10;&#xa;\n&#xD;", "Welcome&#xA;1. Data"},
+		{"only entities", "&#xA;&#xA;", ""},
+		{"inner entities kept", "&#xA;Welcome", "&#xA;Welcome"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trimMenuText(tt.text); got != tt.want {
+				t.Errorf("trimMenuText(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContinueMismatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  string
+		cont     bool
+		mismatch bool
+	}{
+		{"menu continuing", "Welcome&#xA;1. Data&#xA;2. Airtime", true, false},
+		{"prompt continuing", "Enter amount", true, false},
+		{"notification ending", "Thank you. Your bundle is active.", false, false},
+		{"menu ending", "Welcome&#xA;1. Data&#xA;2. Airtime", false, true},
+		{"question ending", "Confirm purchase of 1GB for N500?", false, true},
+		{"notification continuing", "Thank you. Your bundle is active.", true, true},
+		{"options on new lines", "Choose:\n1) Data\n2) Airtime", false, true},
+		{"amount is not an option", "You were charged 100. Goodbye", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := continueMismatch(tt.message, tt.cont); (got != "") != tt.mismatch {
+				t.Errorf("continueMismatch(%q, %v) = %q, want mismatch %v", tt.message, tt.cont, got, tt.mismatch)
+			}
+		})
+	}
+}
+
+func BenchmarkRenderUSSDResponse(b *testing.B) {
+	response := testResponse("Welcome to the menu&#xA;1. Data bundles & offers&#xA;2. Airtime&#xA;3. Exit")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		RenderUSSDResponse(response)
+	}
+}
+
+func TestResponseDCS(t *testing.T) {
+	withConfig(t, func(cfg *Config) {
+		cfg.TelcoDCS = map[string]int{"MTN": 72, "GLO": 17}
+	})
+	req := USSDRequest{RequestID: "DCS1", MSISDN: "2348030000044", DCS: 15}
+	dcs := func(n int) *int { return &n }
+
+	tests := []struct {
+		name    string
+		telco   string
+		menuDCS *int
+		want    int
+	}{
+		{"telco default", "MTN", nil, 72},
+		{"other telco default", "GLO", nil, 17},
+		{"telco without default echoes", "AIRTEL", nil, 15},
+		{"provider overrides", "MTN", dcs(0), 0},
+		{"binary provider DCS ignored", "MTN", dcs(0x44), 72},
+		{"out of range provider DCS ignored", "AIRTEL", dcs(300), 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := responseDCS(req, tt.telco, tt.menuDCS); got != tt.want {
+				t.Errorf("responseDCS = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTelcoDCSValidation(t *testing.T) {
+	cfg := &Config{DefaultProductID: 2, TelcoDCS: map[string]int{"MTN": 15, "GLO": 256, "AIRTEL": 0x44}}
+	var found []string
+	for _, p := range cfg.validate() {
+		if strings.Contains(p.Error(), "telco_dcs") {
+			found = append(found, p.Error())
+		}
+	}
+	if len(found) != 2 {
+		t.Errorf("got %d telco_dcs problems, want 2 (GLO out of range, AIRTEL binary): %v", len(found), found)
+	}
+}
+
+func TestResponseIDModes(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, "Welcome. 1. Balance")
+
+	tests := []struct {
+		mode string
+		id   string
+	}{
+		{responseIDEcho, "RESPID01"},
+		{responseIDGenerate, "RESPID02"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			withConfig(t, func(cfg *Config) { cfg.ResponseID = tt.mode })
+			c := &captureConn{}
+			serve(t, c, testRequest(tt.id, "2348030000053", "123", ""))
+
+			c.mu.Lock()
+			header := append([]byte(nil), c.written.Bytes()[:frameHeaderSize]...)
+			c.mu.Unlock()
+			framed := headerSessionID(header)
+			body := c.lastResponse(t).RequestID
+
+			if framed != body {
+				t.Errorf("frame header carries %q, body requestId %q", framed, body)
+			}
+			if echoed := body == tt.id; echoed != (tt.mode == responseIDEcho) {
+				t.Errorf("requestId %q for request %s in %s mode", body, tt.id, tt.mode)
+			}
+			if body == "" {
+				t.Error("empty requestId")
+			}
+		})
+	}
+}
+
+func TestResponseIDStep(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, "Welcome. 1. Balance")
+	withConfig(t, func(cfg *Config) { cfg.ResponseID = responseIDStep })
+	t.Cleanup(func() { Sessions.End("STEPID1") })
+
+	for i, input := range []string{"", "1", "2"} {
+		c := &captureConn{}
+		serve(t, c, testRequest("STEPID1", "2348030000065", "123", input))
+
+		c.mu.Lock()
+		header := append([]byte(nil), c.written.Bytes()[:frameHeaderSize]...)
+		c.mu.Unlock()
+		if framed := headerSessionID(header); framed != "STEPID1" {
+			t.Errorf("step %d: frame header carries %q, want STEPID1", i+1, framed)
+		}
+		if got, want := c.lastResponse(t).RequestID, fmt.Sprintf("STEPID1_%d", i+1); got != want {
+			t.Errorf("step %d: requestId %q, want %q", i+1, got, want)
+		}
+	}
+}
+
+func TestFitMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		dcs     int
+		marker  string
+		want    string
+	}{
+		{"gsm7 fits", strings.Repeat("a", 182), 15, "...", strings.Repeat("a", 182)},
+		{"gsm7 cut", strings.Repeat("a", 200), 15, "...", strings.Repeat("a", 179) + "..."},
+		{"gsm7 extension counts twice", strings.Repeat("€", 100), 15, "...", strings.Repeat("€", 89) + "..."},
+		{"gsm7 extension marker", strings.Repeat("a", 200), 15, "[+]", strings.Repeat("a", 177) + "[+]"},
+		{"ucs2 fits", strings.Repeat("é", 80), 0x48, "...", strings.Repeat("é", 80)},
+		{"ucs2 cut", strings.Repeat("é", 100), 0x48, "…", strings.Repeat("é", 79) + "…"},
+		{"ucs2 surrogate pairs", strings.Repeat("😀", 50), 0x48, "...", strings.Repeat("😀", 38) + "..."},
+		{"8-bit cut", strings.Repeat("a", 200), 0xF6, "...", strings.Repeat("a", 157) + "..."},
+		{"8-bit counts octets", strings.Repeat("é", 160), 0xF6, "...", strings.Repeat("é", 160)},
+		{"reference counts once", strings.Repeat("a&#xA;", 30), 15, "...", strings.Repeat("a&#xA;", 30)},
+		{"reference never split", "a" + strings.Repeat("&#xA;", 200), 15, "...", "a" + strings.Repeat("&#xA;", 178) + "..."},
+		{"entity never split", strings.Repeat("a", 178) + strings.Repeat("&amp;", 5), 15, "...", strings.Repeat("a", 178) + "&amp;..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fitMessage(tt.message, tt.dcs, tt.marker); got != tt.want {
+				t.Errorf("fitMessage() = %q (%d bytes), want %q (%d bytes)", got, len(got), tt.want, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestClosingMessageCountsReferences(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.ClosingMessage = "Bye" })
+
+	message := strings.Repeat("a&#xA;", 29)
+	if got, want := withClosingMessage("123", message, 15), message+"\nBye"; got != want {
+		t.Errorf("withClosingMessage() = %q, want %q", got, want)
+	}
+	long := strings.Repeat("a", 180)
+	if got := withClosingMessage("123", long, 15); got != long {
+		t.Errorf("withClosingMessage() = %q, want the message alone", got)
+	}
+}
+
+func TestTruncateOverflowingResponse(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, strings.Repeat("Long menu ", 30))
+	withConfig(t, func(cfg *Config) {
+		cfg.MessageOverflow = overflowTruncate
+		cfg.TruncationMarker = "..."
+	})
+
+	c := &captureConn{}
+	serve(t, c, testRequest("TRUNC001", "2348030000055", "123", ""))
+
+	got := c.lastResponse(t).UserData
+	if n := len(got); n != maxUSSDMessageLength {
+		t.Errorf("truncated response is %d characters, want %d", n, maxUSSDMessageLength)
+	}
+	if !strings.HasSuffix(got, "...") {
+		t.Errorf("truncated response %q does not end with the marker", got)
+	}
+}
+
+func TestRenderedXMLLoggedOnError(t *testing.T) {
+	withConfig(t, func(cfg *Config) { cfg.LogXMLOnError = true })
+
+	tests := []struct {
+		name     string
+		id       string
+		userData string
+		conn     net.Conn
+		logged   bool
+	}{
+		{"valid", "XMLGOOD1", "Welcome", &captureConn{}, false},
+		{"invalid character", "XMLBAD01", "Balance\x01", &captureConn{}, true},
+		{"send fails", "XMLBAD02", "Welcome", failingConn{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := testResponse(tt.userData)
+			response.RequestID = tt.id
+			sendUSSDResponse(context.Background(), tt.conn, response)
+
+			logged := strings.Contains(readLog(t, "menu"), "code "+tt.id)
+			if logged != tt.logged {
+				t.Errorf("rendered XML of %s logged %v, want %v", tt.id, logged, tt.logged)
+			}
+		})
+	}
+	if !strings.Contains(readLog(t, "menu"), "code XMLBAD01 is not valid XML") {
+		t.Error("validation failure not named in the log")
+	}
+}
+
+func TestDCSCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		check    string
+		dcs      int
+		userData string
+		wantDCS  int
+	}{
+		{"GSM 7-bit accents", dcsCheckSwitch, 15, "Café à Zürich, Señor", 15},
+		{"emoji switched", dcsCheckSwitch, 15, "Welcome 👋", dcsUCS2},
+		{"accent switched", dcsCheckSwitch, 15, "Olá, escolha", dcsUCS2},
+		{"warn only", dcsCheckWarn, 15, "Welcome 👋", 15},
+		{"off", dcsCheckOff, 15, "Welcome 👋", 15},
+		{"already UCS-2", dcsCheckSwitch, 72, "Welcome 👋", 72},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(cfg *Config) { cfg.DCSCheck = tt.check })
+
+			response := testResponse(tt.userData)
+			response.DCS = tt.dcs
+			c := &captureConn{}
+			if err := sendUSSDResponse(context.Background(), c, response); err != nil {
+				t.Fatal(err)
+			}
+			got := c.lastResponse(t)
+			if got.DCS != tt.wantDCS || got.UserData != tt.userData {
+				t.Errorf("sent %q with DCS %d, want %q with DCS %d", got.UserData, got.DCS, tt.userData, tt.wantDCS)
+			}
+		})
+	}
+}
+
+func TestDCSSwitchTruncatesToUCS2Limit(t *testing.T) {
+	withConfig(t, func(cfg *Config) {
+		cfg.DCSCheck = dcsCheckSwitch
+		cfg.MessageOverflow = overflowTruncate
+		cfg.TruncationMarker = "..."
+	})
+
+	// Fits a GSM 7-bit message but not a UCS-2 one
+	c := &captureConn{}
+	if err := sendUSSDResponse(context.Background(), c, testResponse(strings.Repeat("Olá ", 30))); err != nil {
+		t.Fatal(err)
+	}
+	got := c.lastResponse(t)
+	if got.DCS != dcsUCS2 {
+		t.Errorf("sent with DCS %d, want %d", got.DCS, dcsUCS2)
+	}
+	if n := encodedLength(got.UserData, alphabetUCS2); n != maxMessageUnits(alphabetUCS2) || !strings.HasSuffix(got.UserData, "...") {
+		t.Errorf("sent %q (%d UCS-2 characters), want it cut to %d ending with the marker", got.UserData, n, maxMessageUnits(alphabetUCS2))
+	}
+}
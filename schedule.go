@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // schedules name time zones the host may lack data for
+)
+
+// clock returns the current time. Schedules are evaluated against it, so
+// tests can set the time of day.
+var clock = time.Now
+
+// Schedule splits a route between its provider during business hours and
+// OffHoursProvider the rest of the time. Business hours run from Start to
+// End (past midnight when End is earlier), on Days (every day when empty),
+// in Timezone (UTC when unset).
+type Schedule struct {
+	Timezone         Timezone  `json:"timezone,omitempty"`
+	Start            ClockTime `json:"start"`
+	End              ClockTime `json:"end"`
+	Days             []Weekday `json:"days,omitempty"`
+	OffHoursProvider string    `json:"off_hours_provider"`
+}
+
+// businessHours reports whether t falls within the schedule's business
+// hours. Hours past midnight belong to the day they started on.
+func (s Schedule) businessHours(t time.Time) bool {
+	if s.Timezone.Location != nil {
+		t = t.In(s.Timezone.Location)
+	} else {
+		t = t.UTC()
+	}
+	minute := ClockTime(t.Hour()*60 + t.Minute())
+	day := t.Weekday()
+
+	switch {
+	case s.Start <= s.End:
+		if minute < s.Start || minute >= s.End {
+			return false
+		}
+	case minute >= s.Start:
+	case minute < s.End:
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, d := range s.Days {
+		if time.Weekday(d) == day {
+			return true
+		}
+	}
+	return false
+}
+
+// ClockTime is a time of day written in config files as "HH:MM", held as
+// minutes past midnight
+type ClockTime int
+
+func (c *ClockTime) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("expected a time of day such as \"08:00\": %v", err)
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return fmt.Errorf("expected a time of day such as \"08:00\", got %q", s)
+	}
+	*c = ClockTime(t.Hour()*60 + t.Minute())
+	return nil
+}
+
+// Timezone is a time zone written in config files by its IANA name, such
+// as "Africa/Lagos"
+type Timezone struct {
+	*time.Location
+}
+
+func (z *Timezone) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("expected a time zone name such as \"Africa/Lagos\": %v", err)
+	}
+	location, err := time.LoadLocation(s)
+	if err != nil {
+		return err
+	}
+	z.Location = location
+	return nil
+}
+
+// Weekday is a day of the week written in config files as "mon" to "sun"
+type Weekday time.Weekday
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func (d *Weekday) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("expected a day such as \"mon\": %v", err)
+	}
+	day, ok := weekdayNames[strings.ToLower(s)]
+	if !ok {
+		return fmt.Errorf("expected a day from \"mon\" to \"sun\", got %q", s)
+	}
+	*d = Weekday(day)
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// withClock fixes the time schedules are evaluated against for the rest of
+// the test
+func withClock(t *testing.T, now time.Time) {
+	t.Helper()
+	previous := clock
+	clock = func() time.Time { return now }
+	t.Cleanup(func() { clock = previous })
+}
+
+func TestScheduledProvider(t *testing.T) {
+	withLinkUp(t)
+	backend := func(menu string) string {
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeMenu(w, menu, true)
+		}))
+		t.Cleanup(api.Close)
+		return api.URL
+	}
+
+	var route Route
+	err := json.Unmarshal([]byte(`{
+		"short_code": "321", "product_id": 2, "provider": "office",
+		"schedule": {"timezone": "Africa/Lagos", "start": "08:00", "end": "18:00", "days": ["mon", "tue", "wed", "thu", "fri"], "off_hours_provider": "night"}
+	}`), &route)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withConfig(t, func(cfg *Config) {
+		cfg.Providers = []Provider{
+			{Name: "office", URL: backend("Office menu")},
+			{Name: "night", URL: backend("Night menu")},
+		}
+		cfg.Routes = []Route{route}
+	})
+	if problems := AppConfig().validateProviders(); len(problems) > 0 {
+		t.Fatalf("valid schedule rejected: %v", problems)
+	}
+
+	// Lagos is UTC+1
+	tests := []struct {
+		name string
+		now  time.Time
+		want string
+	}{
+		{"weekday morning", time.Date(2026, 10, 14, 7, 0, 0, 0, time.UTC), "Office menu"},       // Wed 08:00
+		{"weekday evening", time.Date(2026, 10, 14, 17, 0, 0, 0, time.UTC), "Night menu"},       // Wed 18:00
+		{"before opening", time.Date(2026, 10, 14, 6, 59, 0, 0, time.UTC), "Night menu"},        // Wed 07:59
+		{"weekend", time.Date(2026, 10, 17, 10, 0, 0, 0, time.UTC), "Night menu"},               // Sat 11:00
+		{"just before closing", time.Date(2026, 10, 16, 16, 30, 0, 0, time.UTC), "Office menu"}, // Fri 17:30
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withClock(t, tt.now)
+			c := &captureConn{}
+			serve(t, c, testRequest(fmt.Sprintf("SCHED%d", i), "2348030000054", "321", ""))
+			if got := c.lastResponse(t).UserData; got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOvernightSchedule(t *testing.T) {
+	schedule := Schedule{Start: 22 * 60, End: 6 * 60, Days: []Weekday{Weekday(time.Friday)}}
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		{time.Date(2026, 10, 16, 23, 0, 0, 0, time.UTC), true},  // Fri 23:00
+		{time.Date(2026, 10, 17, 5, 59, 0, 0, time.UTC), true},  // Sat 05:59, Friday's night
+		{time.Date(2026, 10, 17, 6, 0, 0, 0, time.UTC), false},  // Sat 06:00
+		{time.Date(2026, 10, 16, 3, 0, 0, 0, time.UTC), false},  // Fri 03:00, Thursday's night
+		{time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC), false}, // Fri noon
+	}
+	for _, tt := range tests {
+		if got := schedule.businessHours(tt.now); got != tt.want {
+			t.Errorf("businessHours(%s) = %v, want %v", tt.now.Format("Mon 15:04"), got, tt.want)
+		}
+	}
+}
+
+func TestScheduleValidation(t *testing.T) {
+	cfg := &Config{
+		Providers: []Provider{{Name: "office", URL: "http://localhost/menu"}},
+		Routes: []Route{
+			{ShortCode: "321", ProductID: 1, Provider: "office", Schedule: &Schedule{Start: 480, End: 1080}},
+			{ShortCode: "322", ProductID: 1, Provider: "office", Schedule: &Schedule{Start: 480, End: 480, OffHoursProvider: "missing"}},
+		},
+	}
+	if problems := cfg.validateProviders(); len(problems) != 3 {
+		t.Errorf("got %d problems, want 3 (missing and unknown off-hours provider, empty hours): %v", len(problems), problems)
+	}
+
+	for _, raw := range []string{`{"start": "8am"}`, `{"days": ["someday"]}`, `{"timezone": "Mars/Olympus"}`} {
+		var s Schedule
+		if err := json.Unmarshal([]byte(raw), &s); err == nil {
+			t.Errorf("%s accepted", raw)
+		}
+	}
+}
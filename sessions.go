@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/session"
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+// startSession records a new session in the store
+func startSession(id, msisdn, shortCode, origin string) session.Session {
+	stats.SessionsStarted.Add(1)
+	return Sessions.Start(id, msisdn, shortCode, origin)
+}
+
+// endSession removes a session from the store, returning false if it was
+// not open
+func endSession(id string) (session.Session, bool) {
+	s, ok := Sessions.End(id)
+	if ok {
+		sessionEnded(s)
+	}
+	return s, ok
+}
+
+// onSessionExpired is called for sessions the aggregator never closed
+func onSessionExpired(s session.Session) {
+	sessionEnded(s)
+	AppLogger.Info("USSD session expired for %s with code %s", s.MSISDN, s.ID)
+}
+
+// IDs of the sessions last evicted from the store, whose continuations are
+// told the session expired
+var evictedSessions *recentIDs
+
+// onSessionEvicted is called for sessions evicted to keep the store within
+// MaxSessions
+func onSessionEvicted(s session.Session) {
+	stats.SessionsEvicted.Add(1)
+	sessionEnded(s)
+	evictedSessions.add(s.ID)
+	AppLogger.Warn("Session store full (%d sessions), evicted session %s of %s idle since %s", AppConfig().MaxSessions, s.ID, s.MSISDN, s.UpdatedAt.Format(time.RFC3339))
+}
+
+// checkEvicted reports whether req, a continuation, should be processed.
+// Continuations of evicted sessions are answered on conn with
+// SessionExpiredMessage, ending them, rather than adopted as new sessions.
+func checkEvicted(ctx context.Context, req USSDRequest, conn net.Conn) bool {
+	if !evictedSessions.take(req.RequestID) {
+		return true
+	}
+
+	AppLogger.Info("Continuation %s from %s is for an evicted session, ending it", req.RequestID, req.MSISDN)
+	response := newUSSDResponse(req, AppConfig().SessionExpiredMessage, false)
+	err := sendUSSDResponse(ctx, conn, response)
+	requestRecordFrom(ctx).responded(response, err)
+	if err != nil {
+		AppLogger.Error("Failed to send session expired response: %v", err)
+	}
+	return false
+}
+
+// recentIDs remembers the last few IDs added, forgetting the oldest beyond
+// its size
+type recentIDs struct {
+	mu    sync.Mutex
+	ids   map[string]bool
+	order []string // ring of the IDs, next overwritten at next
+	next  int
+}
+
+func newRecentIDs(size int) *recentIDs {
+	return &recentIDs{ids: make(map[string]bool), order: make([]string, size)}
+}
+
+// add remembers id
+func (r *recentIDs) add(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.order) == 0 || r.ids[id] {
+		return
+	}
+	delete(r.ids, r.order[r.next])
+	r.order[r.next] = id
+	r.ids[id] = true
+	r.next = (r.next + 1) % len(r.order)
+}
+
+// take reports whether id is remembered, forgetting it
+func (r *recentIDs) take(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.ids[id] {
+		return false
+	}
+	delete(r.ids, id)
+	return true
+}
+
+// sessionEnded records the depth of a session that has ended
+func sessionEnded(s session.Session) {
+	stats.SessionsEnded.Add(1)
+	stats.SessionSteps.Observe(s.Steps)
+	recentRequests.forget(s.ID)
+
+	// Demos are kept out of the monitoring metrics
+	if isSimulation(s.ID) {
+		forgetSimulation(s.ID)
+		return
+	}
+	if channel := os.Getenv("MONITORING_USSD_STEPS"); channel != "" {
+		postMetric(channel, s.Steps, s.MSISDN, s.ID, fmt.Sprint("Short code: ", s.ShortCode))
+	}
+}
+
+// Values for DUPLICATE_SESSION, the policy applied when a request reuses the
+// ID of an open session it cannot belong to
+const (
+	duplicateSessionReplace = "replace" // evict the stale session and start afresh
+	duplicateSessionReject  = "reject"  // keep the open session and drop the request
+)
+
+// sessionConflict returns why req cannot continue the open session s, or
+// nil when it can
+func sessionConflict(s session.Session, req USSDRequest) error {
+	switch {
+	case req.MsgType == msgTypeBegin:
+		return fmt.Errorf("new dial of %s", req.StarCode)
+	case req.MSISDN != s.MSISDN:
+		return fmt.Errorf("msisdn %s does not match %s", req.MSISDN, s.MSISDN)
+	case req.StarCode != s.ShortCode:
+		return fmt.Errorf("short code %s does not match %s", req.StarCode, s.ShortCode)
+	}
+	return nil
+}
+
+// Values for MSISDN_SESSION_LOCK, the policy applied when a subscriber
+// dials while they have a session open under another ID
+const (
+	sessionLockOff    = "off"    // let the sessions overlap
+	sessionLockReset  = "reset"  // end the open session and start afresh
+	sessionLockReject = "reject" // keep the open session and turn the dial away
+)
+
+// applySessionLock enforces SessionLock for req, a new dial, and reports
+// whether req should be processed. Rejected dials are answered on conn
+// with SessionLockedMessage, ending their session.
+func applySessionLock(ctx context.Context, req USSDRequest, conn net.Conn) bool {
+	if AppConfig().SessionLock == sessionLockOff {
+		return true
+	}
+	var open []session.Session
+	for _, s := range Sessions.ByMSISDN(req.MSISDN) {
+		if s.ID != req.RequestID {
+			open = append(open, s)
+		}
+	}
+	if len(open) == 0 {
+		return true
+	}
+
+	if AppConfig().SessionLock == sessionLockReset {
+		for _, s := range open {
+			AppLogger.Info("Ending session %s of %s on %s for their new dial %s", s.ID, s.MSISDN, s.ShortCode, req.RequestID)
+			endSession(s.ID)
+		}
+		return true
+	}
+
+	AppLogger.Warn("Rejecting dial %s from %s, who has session %s open on %s", req.RequestID, req.MSISDN, open[0].ID, open[0].ShortCode)
+	response := newUSSDResponse(req, AppConfig().SessionLockedMessage, false)
+	err := sendUSSDResponse(ctx, conn, response)
+	requestRecordFrom(ctx).responded(response, err)
+	if err != nil {
+		AppLogger.Error("Failed to send session locked response: %v", err)
+	}
+	return false
+}
+
+// msgtype of a USSDRequest that opens a session by dialling a short code
+const msgTypeBegin = 1
+
+// trackSession records req against its session, starting one when needed,
+// and reports whether req should be processed. A continuation we have no
+// record of (e.g. after a restart) is adopted as a new session; a request
+// whose ID collides with an incompatible open session is handled per
+// DuplicateSession.
+func trackSession(req USSDRequest) bool {
+	existing, ok := Sessions.Get(req.RequestID)
+	if !ok {
+		startSession(req.RequestID, req.MSISDN, req.StarCode, session.OriginSubscriber)
+		Sessions.Touch(req.RequestID)
+		return true
+	}
+
+	conflict := sessionConflict(existing, req)
+	if conflict == nil {
+		Sessions.Touch(req.RequestID)
+		return true
+	}
+
+	if AppConfig().DuplicateSession == duplicateSessionReject {
+		AppLogger.Warn("Dropping request reusing open session %s: %v", req.RequestID, conflict)
+		return false
+	}
+	AppLogger.Warn("Replacing stale session %s started %s: %v", req.RequestID, existing.StartedAt.Format(time.RFC3339), conflict)
+	endSession(req.RequestID)
+	startSession(req.RequestID, req.MSISDN, req.StarCode, session.OriginSubscriber)
+	Sessions.Touch(req.RequestID)
+	return true
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/session"
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+func TestDuplicateSessionID(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, "Welcome")
+
+	tests := []struct {
+		name     string
+		policy   string
+		replaced bool
+	}{
+		{"replace", duplicateSessionReplace, true},
+		{"reject", duplicateSessionReject, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withConfig(t, func(cfg *Config) { cfg.DuplicateSession = tt.policy })
+			id := "DUP" + tt.policy
+
+			serve(t, &captureConn{}, testRequest(id, "2348030000014", "123", ""))
+			old, ok := Sessions.Get(id)
+			if !ok {
+				t.Fatal("no session after the first dial")
+			}
+			time.Sleep(10 * time.Millisecond)
+
+			// The aggregator reuses the ID for another subscriber's new dial
+			c := &captureConn{}
+			serve(t, c, testRequest(id, "2348030000015", "456", ""))
+			current, ok := Sessions.Get(id)
+			if !ok {
+				t.Fatal("no session after the second dial")
+			}
+
+			if replaced := current.MSISDN == "2348030000015" && current.StartedAt.After(old.StartedAt); replaced != tt.replaced {
+				t.Errorf("session is %+v, replaced %v, want %v", current, replaced, tt.replaced)
+			}
+			if answered := len(c.responses(t)) > 0; answered != tt.replaced {
+				t.Errorf("second dial answered %v, want %v", answered, tt.replaced)
+			}
+			Sessions.End(id)
+		})
+	}
+}
+
+func TestMSISDNSessionLock(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, "Welcome. 1. Balance")
+
+	tests := []struct {
+		policy string
+		reset  bool
+	}{
+		{sessionLockReset, true},
+		{sessionLockReject, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			withConfig(t, func(cfg *Config) {
+				cfg.SessionLock = tt.policy
+				cfg.SessionLockedMessage = "Finish your open session first"
+			})
+			first, second := "LOCK1"+tt.policy, "LOCK2"+tt.policy
+			t.Cleanup(func() {
+				Sessions.End(first)
+				Sessions.End(second)
+			})
+
+			serve(t, &captureConn{}, testRequest(first, "2348030000057", "123", ""))
+			c := &captureConn{}
+			serve(t, c, testRequest(second, "2348030000057", "456", ""))
+
+			_, firstOpen := Sessions.Get(first)
+			_, secondOpen := Sessions.Get(second)
+			if firstOpen == tt.reset || secondOpen != tt.reset {
+				t.Errorf("first session open %v, second %v after the second dial", firstOpen, secondOpen)
+			}
+
+			resp := c.lastResponse(t)
+			if tt.reset {
+				if resp.UserData != "Welcome. 1. Balance" || resp.EndOfSession != 0 {
+					t.Errorf("second dial answered %q (EndofSession %d), want the menu", resp.UserData, resp.EndOfSession)
+				}
+			} else if resp.UserData != "Finish your open session first" || resp.EndOfSession != 1 {
+				t.Errorf("second dial answered %q (EndofSession %d), want the locked message ending the session", resp.UserData, resp.EndOfSession)
+			}
+		})
+	}
+}
+
+func TestRedialAfterMenuFailureServed(t *testing.T) {
+	withLinkUp(t)
+	var failed atomic.Bool
+	withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		if !failed.Swap(true) {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeMenu(w, "Welcome. 1. Balance", true)
+	})
+	withConfig(t, func(cfg *Config) { cfg.SessionLock = sessionLockReject })
+	t.Cleanup(func() {
+		Sessions.End("FAILDIAL1")
+		Sessions.End("FAILDIAL2")
+	})
+
+	c := &captureConn{}
+	serve(t, c, testRequest("FAILDIAL1", "2348030000076", "123", ""))
+	if resp := c.lastResponse(t); resp.UserData != AppConfig().UnavailableMessage || resp.EndOfSession != 1 {
+		t.Errorf("failed dial answered %q (EndofSession %d), want %q ending the session", resp.UserData, resp.EndOfSession, AppConfig().UnavailableMessage)
+	}
+	if _, open := Sessions.Get("FAILDIAL1"); open {
+		t.Error("session left open after the menu API failed")
+	}
+
+	serve(t, c, testRequest("FAILDIAL2", "2348030000076", "123", ""))
+	if resp := c.lastResponse(t); resp.UserData != "Welcome. 1. Balance" || resp.EndOfSession != 0 {
+		t.Errorf("redial answered %q (EndofSession %d), want the menu", resp.UserData, resp.EndOfSession)
+	}
+}
+
+func TestSessionContinues(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, "Welcome")
+
+	serve(t, &captureConn{}, testRequest("CONTINUE1", "2348030000016", "123", ""))
+	started, _ := Sessions.Get("CONTINUE1")
+	serve(t, &captureConn{}, testRequest("CONTINUE1", "2348030000016", "123", "1"))
+
+	current, ok := Sessions.Get("CONTINUE1")
+	if !ok || !current.StartedAt.Equal(started.StartedAt) {
+		t.Errorf("continuation did not keep the session: %+v, started %+v", current, started)
+	}
+	Sessions.End("CONTINUE1")
+}
+
+func TestSessionSteps(t *testing.T) {
+	withLinkUp(t)
+	// The menu API ends the session when the subscriber enters 0 or dials *0#
+	withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		var req USSDMenuRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		writeMenu(w, "Menu", req.Input != "0" && req.Shortcode != "*0#")
+	})
+	before := stats.SessionSteps.Snapshot()
+
+	for depth := 1; depth <= 3; depth++ {
+		id := fmt.Sprintf("STEPS%d", depth)
+		c := &captureConn{}
+		if depth == 1 {
+			serve(t, c, testRequest(id, "2348030000023", "0", ""))
+		} else {
+			serve(t, c, testRequest(id, "2348030000023", "123", ""))
+			for step := 2; step < depth; step++ {
+				serve(t, c, testRequest(id, "2348030000023", "123", "1"))
+			}
+			if s, _ := Sessions.Get(id); s.Steps != depth-1 {
+				t.Errorf("session %s at %d steps, want %d", id, s.Steps, depth-1)
+			}
+			serve(t, c, testRequest(id, "2348030000023", "123", "0"))
+		}
+		if _, ok := Sessions.Get(id); ok {
+			t.Fatalf("session %s still open", id)
+		}
+	}
+
+	got := stats.SessionSteps.Snapshot().Since(before)
+	for depth := 1; depth <= 3; depth++ {
+		if got.Counts[depth] != 1 {
+			t.Errorf("%d sessions of %d steps, want 1", got.Counts[depth], depth)
+		}
+	}
+	if got.Count != 3 || got.Average != 2 {
+		t.Errorf("%d sessions averaging %g steps, want 3 averaging 2", got.Count, got.Average)
+	}
+}
+
+// Run with -race: snapshots are taken and serialized while sessions churn
+func TestSessionSnapshotWhileChurning(t *testing.T) {
+	Sessions.Start("CHURNBASE", "2348030000049", "770", "subscriber")
+	t.Cleanup(func() { Sessions.End("CHURNBASE") })
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				id := fmt.Sprintf("CHURN%d-%d", w, i%50)
+				Sessions.Start(id, "2348030000049", fmt.Sprintf("77%d", w), "subscriber")
+				Sessions.Touch(id)
+				if i%3 == 0 {
+					Sessions.End(id)
+				}
+			}
+		}(w)
+	}
+	t.Cleanup(func() {
+		for w := 0; w < 4; w++ {
+			for i := 0; i < 50; i++ {
+				Sessions.End(fmt.Sprintf("CHURN%d-%d", w, i))
+			}
+		}
+	})
+
+	for i := 0; i < 200; i++ {
+		snap := Sessions.Snapshot()
+		total := 0
+		for _, n := range snap.ByShortCode {
+			total += n
+		}
+		if total != snap.Active {
+			t.Fatalf("by_short_code adds up to %d, active is %d", total, snap.Active)
+		}
+		if _, err := json.Marshal(snap); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	snap := health(t)["sessions"].(map[string]interface{})
+	if snap["active"].(float64) < 1 || snap["oldest_age_seconds"].(float64) <= 0 {
+		t.Errorf("health sessions = %v, want at least CHURNBASE", snap)
+	}
+}
+
+func TestSessionStepSequence(t *testing.T) {
+	withLinkUp(t)
+	withConfig(t, func(cfg *Config) { cfg.MenuSendStep = true })
+	calls := withMenuRecorder(t, "1. Next")
+
+	steps := func(id string, inputs ...string) []float64 {
+		var got []float64
+		for _, input := range inputs {
+			serve(t, &captureConn{}, testRequest(id, "2348030000064", "123", input))
+			step, _ := calls.lastJSON(t)["step"].(float64)
+			got = append(got, step)
+		}
+		return got
+	}
+
+	if got := steps("STEP1", "", "1", "2"); !reflect.DeepEqual(got, []float64{1, 2, 3}) {
+		t.Errorf("steps of STEP1 %v, want [1 2 3]", got)
+	}
+	if got := requestCompleteLine(t, "STEP1")["step"]; got != float64(1) {
+		t.Errorf("request_complete of STEP1 has step %v, want 1 (the first line logged)", got)
+	}
+	Sessions.End("STEP1")
+
+	// A new session starts over
+	if got := steps("STEP2", "", "1"); !reflect.DeepEqual(got, []float64{1, 2}) {
+		t.Errorf("steps of STEP2 %v, want [1 2]", got)
+	}
+	Sessions.End("STEP2")
+}
+
+func TestSessionCapEvictsLeastRecentlyActive(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "Welcome. 1. Balance")
+	withConfig(t, func(cfg *Config) { cfg.MaxSessions = 3 })
+	store, evicted := Sessions, evictedSessions
+	Sessions = session.NewStore(AppConfig().SessionTTL)
+	Sessions.SetCapacity(AppConfig().MaxSessions, onSessionEvicted)
+	evictedSessions = newRecentIDs(AppConfig().MaxSessions)
+	t.Cleanup(func() { Sessions, evictedSessions = store, evicted })
+
+	for _, id := range []string{"CAP1", "CAP2", "CAP3"} {
+		serve(t, &captureConn{}, testRequest(id, "2348030000068", "123", ""))
+	}
+	// CAP1 is active again, leaving CAP2 the least recently active
+	serve(t, &captureConn{}, testRequest("CAP1", "2348030000068", "123", "1"))
+
+	evictions := stats.SessionsEvicted.Load()
+	serve(t, &captureConn{}, testRequest("CAP4", "2348030000068", "123", ""))
+	if got := stats.SessionsEvicted.Load() - evictions; got != 1 {
+		t.Errorf("sessions evicted %d, want 1", got)
+	}
+	if Sessions.Len() != 3 {
+		t.Errorf("%d sessions open, want the cap of 3", Sessions.Len())
+	}
+	for _, id := range []string{"CAP1", "CAP3", "CAP4"} {
+		if _, ok := Sessions.Get(id); !ok {
+			t.Errorf("session %s evicted, want CAP2", id)
+		}
+	}
+
+	// The evicted session's next step is told it expired, without the
+	// menu API being called
+	called := calls.count()
+	c := &captureConn{}
+	serve(t, c, testRequest("CAP2", "2348030000068", "123", "1"))
+	resp := c.lastResponse(t)
+	if resp.UserData != AppConfig().SessionExpiredMessage || resp.EndOfSession != 1 {
+		t.Errorf("evicted session answered %q (end %d), want %q ending it", resp.UserData, resp.EndOfSession, AppConfig().SessionExpiredMessage)
+	}
+	if calls.count() != called {
+		t.Error("menu API called for an evicted session")
+	}
+	if _, ok := Sessions.Get("CAP2"); ok {
+		t.Error("evicted session adopted again")
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+// shutdownReport summarises what the process did, for the line logged as
+// it exits
+type shutdownReport struct {
+	Uptime            string `json:"uptime"`
+	RequestsReceived  int64  `json:"requests_received"`
+	ResponsesSent     int64  `json:"responses_sent"`
+	Reconnects        int64  `json:"reconnects"`
+	SessionsStarted   int64  `json:"sessions_started"`
+	SessionsEnded     int64  `json:"sessions_ended"`
+	AbandonedSessions int    `json:"abandoned_sessions"` // still open at shutdown
+}
+
+// newShutdownReport builds the report from the counters since start
+func newShutdownReport() shutdownReport {
+	s := stats.Take()
+	report := shutdownReport{
+		Uptime:           time.Since(s.Since).Round(time.Second).String(),
+		RequestsReceived: s.RequestsReceived,
+		ResponsesSent:    s.ResponsesSent,
+		Reconnects:       s.Reconnects,
+		SessionsStarted:  s.SessionsStarted,
+		SessionsEnded:    s.SessionsEnded,
+	}
+	if Sessions != nil {
+		report.AbandonedSessions = Sessions.Len()
+	}
+	return report
+}
+
+// logShutdownReport writes the shutdown_report line to the app log
+func logShutdownReport() {
+	line, err := json.Marshal(newShutdownReport())
+	if err != nil {
+		AppLogger.Error("Failed to encode shutdown_report: %v", err)
+		return
+	}
+	AppLogger.Info("shutdown_report %s", line)
+}
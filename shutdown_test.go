@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+func TestShutdownReport(t *testing.T) {
+	withLinkUp(t)
+	withMenuAPI(t, "Welcome&#xA;1. Data")
+	t.Cleanup(func() { Sessions.End("SHUTDOWN1") })
+
+	before := stats.Take()
+	openBefore := Sessions.Len()
+
+	// One session answered and left open, one answered and closed
+	c := &captureConn{}
+	serve(t, c, testRequest("SHUTDOWN1", "2348030000042", "123", ""))
+	serve(t, c, testRequest("SHUTDOWN2", "2348030000043", "123", ""))
+	end := testRequest("SHUTDOWN2", "2348030000043", "123", "")
+	end.EndOfSession = 1
+	serve(t, c, end)
+	stats.Reconnects.Add(1)
+
+	logShutdownReport()
+
+	matches := regexp.MustCompile(`shutdown_report (\{[^\n]*\})`).FindAllStringSubmatch(readLog(t, "log"), -1)
+	if len(matches) == 0 {
+		t.Fatal("no shutdown_report in the app log")
+	}
+	var report shutdownReport
+	if err := json.Unmarshal([]byte(matches[len(matches)-1][1]), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	want := shutdownReport{
+		Uptime:            report.Uptime,
+		RequestsReceived:  before.RequestsReceived + 3,
+		ResponsesSent:     before.ResponsesSent + 2,
+		Reconnects:        before.Reconnects + 1,
+		SessionsStarted:   before.SessionsStarted + 2,
+		SessionsEnded:     before.SessionsEnded + 1,
+		AbandonedSessions: openBefore + 1,
+	}
+	if report != want {
+		t.Errorf("report %+v, want %+v", report, want)
+	}
+	if report.Uptime == "" {
+		t.Error("report has no uptime")
+	}
+}
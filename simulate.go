@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	simulateController "github.com/abeloha/USSDTCP/pkg/controllers/simulate"
+)
+
+// Client ID and connection label of simulated requests
+const simulatorClientID = "simulator"
+
+// Returned by simulateStep when the pipeline sent nothing back, e.g. for a
+// request it dropped
+var errNoSimulatedResponse = errors.New("no response to simulated request")
+
+// Most simulations kept open at once, so that demos cannot fill the
+// session store up to MAX_SESSIONS
+const maxSimulations = 100
+
+// simulation is a session played through POST /api/simulate
+type simulation struct {
+	mu        sync.Mutex // one step at a time
+	requestID string     // "" until the first step
+}
+
+// Simulations by session token, and the tokens by the request ID of their
+// session
+var (
+	simulationsMu      sync.Mutex
+	simulations        = make(map[string]*simulation)
+	simulationSessions = make(map[string]string)
+)
+
+type simulationKey struct{}
+
+// simulatedResponse is where sendUSSDResponse leaves the response to a
+// simulated request instead of sending it
+type simulatedResponse struct {
+	mu       sync.Mutex
+	response *USSDResponse
+}
+
+// simulated reports whether ctx belongs to a simulated request, which is
+// answered whether or not we are logged on to the server
+func simulated(ctx context.Context) bool {
+	return simulationFrom(ctx) != nil
+}
+
+// simulationFrom returns where the response to the simulated request of
+// ctx goes, or nil when it is not simulated
+func simulationFrom(ctx context.Context) *simulatedResponse {
+	captured, _ := ctx.Value(simulationKey{}).(*simulatedResponse)
+	return captured
+}
+
+// take keeps response as the one to the simulated request
+func (s *simulatedResponse) take(response USSDResponse) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.response = &response
+}
+
+// taken returns the response kept by take
+func (s *simulatedResponse) taken() (USSDResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.response == nil {
+		return USSDResponse{}, errNoSimulatedResponse
+	}
+	return *s.response, nil
+}
+
+// simulateStep plays input as the next step of the simulated session named
+// by token through handleMenuRequest, as if msisdn had sent it to
+// shortCode, and returns the message and continue flag of the response.
+// Responses are taken before they would be sent, so neither the server
+// connection nor its pacing, counters, hooks or acknowledgements are
+// involved. A new session is begun when token has none or its session has
+// ended or expired; with an empty input it dials the short code.
+func simulateStep(token, msisdn, shortCode, input string) (string, bool, error) {
+	simulationsMu.Lock()
+	sim := simulations[token]
+	if sim == nil {
+		if len(simulations) >= maxSimulations {
+			simulationsMu.Unlock()
+			return "", false, simulateController.ErrTooManySimulations
+		}
+		sim = &simulation{}
+		simulations[token] = sim
+	}
+	simulationsMu.Unlock()
+
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+
+	req := USSDRequest{
+		RequestID: sim.requestID,
+		MSISDN:    msisdn,
+		StarCode:  shortCode,
+		ClientID:  simulatorClientID,
+		Phase:     pushPhase,
+		DCS:       pushDCS,
+		MsgType:   4,
+		UserData:  input,
+	}
+	if _, ok := Sessions.Get(sim.requestID); !ok {
+		req.RequestID = generateRequestID()
+		req.MsgType = msgTypeBegin
+		if req.UserData == "" {
+			req.UserData = "*" + shortCode + "#"
+		}
+		simulationsMu.Lock()
+		delete(simulationSessions, sim.requestID)
+		simulationSessions[req.RequestID] = token
+		simulationsMu.Unlock()
+		sim.requestID = req.RequestID
+	}
+
+	conn := &simulatedConn{}
+	labelConn(conn, simulatorClientID)
+	defer connLabels.Delete(conn)
+
+	captured := &simulatedResponse{}
+	ctx := context.WithValue(context.Background(), simulationKey{}, captured)
+	handleMenuRequest(ctx, req, conn)
+
+	response, err := captured.taken()
+	if err != nil || response.EndOfSession == 1 {
+		forgetSimulation(req.RequestID)
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return response.UserData, response.EndOfSession == 0, nil
+}
+
+// isSimulation reports whether the session with requestID is simulated
+func isSimulation(requestID string) bool {
+	simulationsMu.Lock()
+	defer simulationsMu.Unlock()
+	_, ok := simulationSessions[requestID]
+	return ok
+}
+
+// forgetSimulation drops the simulation of the session with requestID, if
+// it is one, e.g. once the session ended or expired
+func forgetSimulation(requestID string) {
+	simulationsMu.Lock()
+	defer simulationsMu.Unlock()
+	if token, ok := simulationSessions[requestID]; ok {
+		delete(simulationSessions, requestID)
+		delete(simulations, token)
+	}
+}
+
+// simulatedConn stands in for the server connection of a simulated
+// request. Nothing is written to it: the response is taken before.
+type simulatedConn struct {
+	net.Conn // nil; only the methods below are used
+}
+
+func (c *simulatedConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (c *simulatedConn) SetWriteDeadline(time.Time) error { return nil }
+func (c *simulatedConn) Close() error                     { return nil }
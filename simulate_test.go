@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/session"
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+func TestSimulateEndpoint(t *testing.T) {
+	// Simulations never touch the server connection, which is down here
+	withMenuHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		var req USSDMenuRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Input == "1" {
+			writeMenu(w, "Your balance is 100", false)
+			return
+		}
+		writeMenu(w, "Welcome. 1. Balance", true)
+	})
+	withConfig(t, func(cfg *Config) { cfg.APIToken = "simulate-token" })
+
+	router := newRouter()
+	step := func(token, input string) (int, map[string]any) {
+		body, _ := json.Marshal(map[string]string{
+			"session_token": "demo-1",
+			"msisdn":        "2348030000056",
+			"short_code":    "123",
+			"input":         input,
+		})
+		req := httptest.NewRequest(http.MethodPost, "/api/simulate", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		var got map[string]any
+		json.Unmarshal(w.Body.Bytes(), &got)
+		return w.Code, got
+	}
+
+	if code, _ := step("wrong", ""); code != http.StatusUnauthorized {
+		t.Errorf("with a wrong token: status %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	code, got := step("simulate-token", "")
+	if code != http.StatusOK || got["message"] != "Welcome. 1. Balance" || got["continue"] != true {
+		t.Fatalf("first step: status %d, %v", code, got)
+	}
+	sim := simulations["demo-1"]
+	if sim == nil {
+		t.Fatal("no simulation kept for the session token")
+	}
+	if _, ok := Sessions.Get(sim.requestID); !ok {
+		t.Errorf("no session open for simulation %s", sim.requestID)
+	}
+
+	code, got = step("simulate-token", "1")
+	if code != http.StatusOK || got["message"] != "Your balance is 100" || got["continue"] != false {
+		t.Fatalf("second step: status %d, %v", code, got)
+	}
+	if _, ok := simulations["demo-1"]; ok {
+		t.Error("simulation kept after its session ended")
+	}
+	if _, ok := Sessions.Get(sim.requestID); ok {
+		t.Errorf("session %s still open after the final step", sim.requestID)
+	}
+}
+
+func TestSimulationSendsNothing(t *testing.T) {
+	withMenuAPI(t, "Welcome. 1. Balance")
+	withConfig(t, func(cfg *Config) { cfg.AckFrame = "USSDAck" })
+	saved := postSendHooks
+	postSendHooks = newHookPool(func(USSDRequest, USSDResponse, responseMeta) error { return nil }, 0, 1)
+	t.Cleanup(func() { postSendHooks = saved })
+
+	sent, bytes := stats.ResponsesSent.Load(), stats.BytesSent.Total()
+	message, cont, err := simulateStep("demo-2", "2348030000072", "123", "")
+	if err != nil || message != "Welcome. 1. Balance" || !cont {
+		t.Fatalf("simulateStep = %q, %v, %v", message, cont, err)
+	}
+	t.Cleanup(func() { endSession(simulations["demo-2"].requestID) })
+
+	if stats.ResponsesSent.Load() != sent || stats.BytesSent.Total() != bytes {
+		t.Error("simulated response counted as sent")
+	}
+	awaitingAcks.mu.Lock()
+	awaiting := len(awaitingAcks.sent)
+	awaitingAcks.mu.Unlock()
+	if awaiting != 0 {
+		t.Error("simulated response awaits an acknowledgement")
+	}
+	if len(postSendHooks.jobs) != 0 {
+		t.Error("post-send hook dispatched for a simulated response")
+	}
+}
+
+func TestSimulationExpiresWithSession(t *testing.T) {
+	withMenuAPI(t, "Welcome. 1. Balance")
+	store := Sessions
+	Sessions = session.NewStore(time.Millisecond)
+	t.Cleanup(func() { Sessions = store })
+
+	if _, _, err := simulateStep("demo-3", "2348030000072", "123", ""); err != nil {
+		t.Fatalf("simulateStep: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	for _, s := range Sessions.Expire() {
+		onSessionExpired(s)
+	}
+
+	simulationsMu.Lock()
+	defer simulationsMu.Unlock()
+	if _, ok := simulations["demo-3"]; ok {
+		t.Error("simulation kept after its session expired")
+	}
+}
@@ -38,6 +38,9 @@ type USSDRequest struct {
 	UserData     string   `xml:"userdata,omitempty"` // Optional field
 	EndOfSession int      `xml:"EndofSession"`
 	ErrorCode    string   `xml:"errorCode,omitempty"` // Optional field
+
+	// Octets of the userdata when DCS marks it as 8-bit binary data
+	Payload []byte `xml:"-"`
 }
 type USSDResponse struct {
 	XMLName      xml.Name `xml:"USSDResponse"`
@@ -50,12 +53,32 @@ type USSDResponse struct {
 	MsgType      int      `xml:"msgtype"`
 	UserData     string   `xml:"userdata"`
 	EndOfSession int      `xml:"EndofSession"`
+
+	// Aggregator-specific elements rendered among the ones above
+	Extra []ResponseField `xml:"-"`
+
+	// Session ID of the frame header, RequestID when empty
+	FrameID string `xml:"-"`
+}
+
+// ResponseField is an extra element of every USSDResponse, named by
+// response_fields in the config file. It follows the standard element
+// named by After, EndofSession when After is empty.
+type ResponseField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	After string `json:"after,omitempty"`
 }
 
 type EnquireLink struct {
 	XMLName xml.Name `xml:"ENQRequest"`
 }
 
+// EnquireLinkResponse acknowledges an enquire-link sent by the server
+type EnquireLinkResponse struct {
+	XMLName xml.Name `xml:"ENQResponse"`
+}
+
 // USSDMenuRequest represents the API request payload
 type USSDMenuRequest struct {
 	Telco      string `json:"telco"`
@@ -64,12 +87,20 @@ type USSDMenuRequest struct {
 	Phone      string `json:"phone"`
 	Input      string `json:"input"`
 	SessionID  string `json:"session_id"`
+	IMSI       string `json:"imsi,omitempty"` // Only sent when the aggregator provides it
+	Step       int    `json:"step,omitempty"` // Only sent with MENU_SEND_STEP
+
+	// "base64" or "hex" when Input carries an 8-bit (binary) payload so
+	// encoded, as the provider's binary_input asks
+	InputEncoding string `json:"input_encoding,omitempty"`
 }
 
 // USSDMenuResponse represents the API response payload
 type USSDMenuResponse struct {
 	Message  string `json:"message"`
-	Continue bool   `json:"continue"`
+	Continue *bool  `json:"continue"`         // nil when the backend omitted the field
+	Locale   string `json:"locale,omitempty"` // language the menu is in, when the backend reports it
+	DCS      *int   `json:"dcs,omitempty"`    // data coding scheme for the response, nil to use the default
 }
 
 
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Telco of MSISDNs no telco_prefixes entry matches, unless DEFAULT_TELCO
+// says otherwise
+const defaultTelco = "MTN"
+
+// TelcoResolver names the network an MSISDN belongs to, as sent to the
+// menu API and used to pick the response DCS
+type TelcoResolver interface {
+	Telco(msisdn string) string
+}
+
+// prefixResolver resolves the telco of an MSISDN by the longest of its
+// prefixes, falling back to a default for numbers none matches
+type prefixResolver struct {
+	root     prefixNode
+	fallback string
+}
+
+// prefixNode is a digit of a prefix; telco is set where a prefix ends
+type prefixNode struct {
+	next  map[byte]*prefixNode
+	telco string
+}
+
+// newPrefixResolver builds the trie of prefixes, which map MSISDN prefixes
+// (digits, in international format) to telco names
+func newPrefixResolver(prefixes map[string]string, fallback string) *prefixResolver {
+	r := &prefixResolver{fallback: fallback}
+	for prefix, telco := range prefixes {
+		node := &r.root
+		for i := 0; i < len(prefix); i++ {
+			if node.next == nil {
+				node.next = make(map[byte]*prefixNode)
+			}
+			child, ok := node.next[prefix[i]]
+			if !ok {
+				child = &prefixNode{}
+				node.next[prefix[i]] = child
+			}
+			node = child
+		}
+		node.telco = telco
+	}
+	return r
+}
+
+// Telco returns the telco of the longest prefix of msisdn, ignoring a
+// leading "+", or the fallback when there is none
+func (r *prefixResolver) Telco(msisdn string) string {
+	msisdn = strings.TrimPrefix(msisdn, "+")
+	telco := r.fallback
+	node := &r.root
+	for i := 0; i < len(msisdn); i++ {
+		node = node.next[msisdn[i]]
+		if node == nil {
+			break
+		}
+		if node.telco != "" {
+			telco = node.telco
+		}
+	}
+	return telco
+}
+
+// telcoFor returns the telco of msisdn per the configured resolver
+func (c *Config) telcoFor(msisdn string) string {
+	if c.Telcos == nil {
+		return c.DefaultTelco
+	}
+	return c.Telcos.Telco(msisdn)
+}
+
+// menuTelco returns the name the menu API knows telco by: its telco_names
+// entry, else telco itself
+func (c *Config) menuTelco(telco string) string {
+	if name, ok := c.TelcoNames[telco]; ok {
+		return name
+	}
+	return telco
+}
+
+// validateTelcoPrefixes checks that each prefix is digits naming a telco
+func validateTelcoPrefixes(prefixes map[string]string) []error {
+	var problems []error
+	for prefix, telco := range prefixes {
+		if prefix == "" || strings.Trim(prefix, "0123456789") != "" {
+			problems = append(problems, fmt.Errorf("telco_prefixes %q: expected digits", prefix))
+		}
+		if telco == "" {
+			problems = append(problems, fmt.Errorf("telco_prefixes %q: no telco", prefix))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestPrefixResolver(t *testing.T) {
+	r := newPrefixResolver(map[string]string{
+		"234803":  "MTN",
+		"2348030": "MTN-LEGACY", // overlaps 234803
+		"234805":  "GLO",
+		"2348059": "AIRTEL", // range of 234805 reassigned to another telco
+	}, "UNKNOWN")
+
+	tests := []struct {
+		msisdn string
+		want   string
+	}{
+		{"2348031234567", "MTN"},
+		{"2348030000001", "MTN-LEGACY"},
+		{"+2348030000001", "MTN-LEGACY"},
+		{"2348051234567", "GLO"},
+		{"2348059000001", "AIRTEL"},
+		{"2347011234567", "UNKNOWN"},
+		{"23480", "UNKNOWN"},
+	}
+	for _, tt := range tests {
+		if got := r.Telco(tt.msisdn); got != tt.want {
+			t.Errorf("Telco(%s) = %q, want %q", tt.msisdn, got, tt.want)
+		}
+	}
+}
+
+func TestMenuRequestTelco(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "Welcome")
+	withConfig(t, func(cfg *Config) {
+		cfg.Telcos = newPrefixResolver(map[string]string{"234805": "GLO"}, "MTN")
+	})
+
+	tests := []struct {
+		id, msisdn, want string
+	}{
+		{"TELCO001", "2348050000059", "GLO"},
+		{"TELCO002", "2348030000059", "MTN"},
+	}
+	for _, tt := range tests {
+		serve(t, &captureConn{}, testRequest(tt.id, tt.msisdn, "123", ""))
+		Sessions.End(tt.id)
+		if got := calls.lastJSON(t)["telco"]; got != tt.want {
+			t.Errorf("menu API got telco %v for %s, want %s", got, tt.msisdn, tt.want)
+		}
+	}
+}
+
+func TestTelcoPrefixValidation(t *testing.T) {
+	problems := validateTelcoPrefixes(map[string]string{"234803": "MTN", "+234": "MTN", "234805": ""})
+	if len(problems) != 2 {
+		t.Errorf("got problems %v, want one for the non-digit prefix and one for the missing telco", problems)
+	}
+}
+
+func TestMenuRequestTelcoNames(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "Welcome")
+	withConfig(t, func(cfg *Config) {
+		cfg.Telcos = newPrefixResolver(map[string]string{"234805": "GLO"}, "MTN")
+		cfg.TelcoNames = map[string]string{"MTN": "mtn-ng"}
+	})
+
+	tests := []struct {
+		id, msisdn, want string
+	}{
+		{"TELNAME1", "2348030000066", "mtn-ng"},
+		{"TELNAME2", "2348050000066", "GLO"}, // no entry, sent as is
+	}
+	for _, tt := range tests {
+		serve(t, &captureConn{}, testRequest(tt.id, tt.msisdn, "123", ""))
+		Sessions.End(tt.id)
+		if got := calls.lastJSON(t)["telco"]; got != tt.want {
+			t.Errorf("menu API got telco %v for %s, want %s", got, tt.msisdn, tt.want)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Values for TRACING_EXPORTER
+const (
+	tracingNone   = "none"   // no spans are recorded
+	tracingStdout = "stdout" // spans are written to stdout as JSON
+)
+
+// Name of the tracer and of the service the spans belong to
+const tracerName = "github.com/abeloha/USSDTCP"
+
+// tracer returns the tracer for the gateway's spans. It is a no-op until
+// setupTracing installs a provider.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// setupTracing installs the span exporter selected by TRACING_EXPORTER and
+// returns a function flushing and stopping it
+func setupTracing(exporter string) (func(context.Context) error, error) {
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case tracingNone:
+		return func(context.Context) error { return nil }, nil
+	case tracingStdout:
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s span exporter: %v", exporter, err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("ussdtcp"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// requestAttributes returns the span attributes describing req
+func requestAttributes(req USSDRequest) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("ussd.request_id", req.RequestID),
+		attribute.String("ussd.msisdn", maskMSISDN(req.MSISDN)),
+		attribute.String("ussd.short_code", req.StarCode),
+		attribute.Int("ussd.msg_type", req.MsgType),
+	}
+}
+
+// injectTraceHeaders adds the trace context in ctx to the headers of an
+// outbound request
+func injectTraceHeaders(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// maskMSISDN hides all but the last four digits of msisdn
+func maskMSISDN(msisdn string) string {
+	if len(msisdn) <= 4 {
+		return strings.Repeat("*", len(msisdn))
+	}
+	return strings.Repeat("*", len(msisdn)-4) + msisdn[len(msisdn)-4:]
+}
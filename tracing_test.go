@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestRequestSpan(t *testing.T) {
+	withLinkUp(t)
+	calls := withMenuRecorder(t, "Welcome")
+
+	savedProvider, savedPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(savedProvider)
+		otel.SetTextMapPropagator(savedPropagator)
+		provider.Shutdown(context.Background())
+	})
+
+	serve(t, &captureConn{}, testRequest("TRACE1", "2348030000013", "123", ""))
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+	}
+	root, ok := spans["ussd.request"]
+	if !ok {
+		t.Fatalf("no ussd.request span among %d spans", len(recorder.Ended()))
+	}
+	attrs := attribute.NewSet(root.Attributes()...)
+	for key, want := range map[attribute.Key]attribute.Value{
+		"ussd.msisdn":     attribute.StringValue("*********0013"),
+		"ussd.short_code": attribute.StringValue("123"),
+		"ussd.msg_type":   attribute.IntValue(1),
+	} {
+		if got, _ := attrs.Value(key); got != want {
+			t.Errorf("%s = %v, want %v", key, got.Emit(), want.Emit())
+		}
+	}
+
+	for _, name := range []string{"menu_api.call", "ussd.response"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("%s span is not a child of ussd.request", name)
+		}
+	}
+
+	if _, headers := calls.last(t); headers.Get("traceparent") == "" {
+		t.Error("menu API request carries no traceparent header")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Values for MESSAGE_OVERFLOW, what to do with a response longer than a
+// USSD message may be in the alphabet of its DCS
+const (
+	overflowSend     = "send"     // send it as is, leaving it to the aggregator
+	overflowTruncate = "truncate" // cut it to fit, ending with TRUNCATION_MARKER
+)
+
+// Alphabets USSD userdata is encoded in, per GSM 03.38
+const (
+	alphabetGSM7 = iota
+	alphabet8Bit
+	alphabetUCS2
+)
+
+// dcsAlphabet returns the alphabet dcs marks the userdata as encoded in
+func dcsAlphabet(dcs int) int {
+	if is8BitDCS(dcs) {
+		return alphabet8Bit
+	}
+	switch {
+	case dcs == 0x11: // UCS-2 preceded by a language indication
+		return alphabetUCS2
+	case dcs&0xC0 == 0x40, dcs&0xF0 == 0x90: // general data coding, with or without header
+		if dcs&0x0C == 0x08 {
+			return alphabetUCS2
+		}
+	}
+	return alphabetGSM7
+}
+
+// maxMessageUnits returns how many units of alphabet fit in the 160 octets
+// of USSD userdata: 7-bit septets, octets or UCS-2 code units
+func maxMessageUnits(alphabet int) int {
+	switch alphabet {
+	case alphabet8Bit:
+		return 160
+	case alphabetUCS2:
+		return 80
+	}
+	return maxUSSDMessageLength
+}
+
+// Characters of the GSM 7-bit extension table, each taking two septets
+const gsm7Extension = "^{}\\[~]|€\f"
+
+// Characters of the GSM 7-bit default alphabet, bar the escape to the
+// extension table
+const gsm7Basic = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+
+// Values for DCS_CHECK, what to do with a response under a GSM 7-bit DCS
+// holding characters that alphabet cannot encode
+const (
+	dcsCheckOff    = "off"    // send it as is
+	dcsCheckWarn   = "warn"   // log a warning and send it as is
+	dcsCheckSwitch = "switch" // send it under dcsUCS2 instead
+)
+
+// DCS responses are switched to by DCS_CHECK=switch: general data coding,
+// uncompressed UCS-2, no message class
+const dcsUCS2 = 0x48
+
+// nonGSM7 returns the first character of s outside the GSM 7-bit alphabet,
+// and false when there is none
+func nonGSM7(s string) (rune, bool) {
+	for _, r := range s {
+		if !strings.ContainsRune(gsm7Basic, r) && !strings.ContainsRune(gsm7Extension, r) {
+			return r, true
+		}
+	}
+	return 0, false
+}
+
+// messageChar returns the character at the start of s and how many bytes
+// of s it takes. A character or entity reference, which escapeText passes
+// through as is, is one character: the one it stands for.
+func messageChar(s string) (rune, int) {
+	if s[0] == '&' {
+		if n := referenceLength(s); n > 0 {
+			return referencedRune(s[:n]), n
+		}
+	}
+	return utf8.DecodeRuneInString(s)
+}
+
+// referencedRune returns the character ref, a reference referenceLength
+// accepts, stands for
+func referencedRune(ref string) rune {
+	name := ref[1 : len(ref)-1]
+	switch name {
+	case "amp":
+		return '&'
+	case "lt":
+		return '<'
+	case "gt":
+		return '>'
+	case "quot":
+		return '"'
+	case "apos":
+		return '\''
+	}
+	digits, base := name[1:], 10
+	if digits[0] == 'x' || digits[0] == 'X' {
+		digits, base = digits[1:], 16
+	}
+	code, _ := strconv.ParseUint(digits, base, 32)
+	if code > unicode.MaxRune {
+		return utf8.RuneError
+	}
+	return rune(code)
+}
+
+// charLength returns the length of r in units of alphabet
+func charLength(r rune, alphabet int) int {
+	switch alphabet {
+	case alphabet8Bit:
+		return 1
+	case alphabetUCS2:
+		if r > 0xFFFF {
+			return 2 // surrogate pair
+		}
+		return 1
+	}
+	if strings.ContainsRune(gsm7Extension, r) {
+		return 2
+	}
+	return 1
+}
+
+// encodedLength returns the length of s in units of alphabet, counting
+// each reference in s as the character it stands for
+func encodedLength(s string, alphabet int) int {
+	n := 0
+	for i := 0; i < len(s); {
+		r, size := messageChar(s[i:])
+		n += charLength(r, alphabet)
+		i += size
+	}
+	return n
+}
+
+// fitsMessage reports whether message fits in a USSD message in the
+// alphabet of dcs
+func fitsMessage(message string, dcs int) bool {
+	alphabet := dcsAlphabet(dcs)
+	return encodedLength(message, alphabet) <= maxMessageUnits(alphabet)
+}
+
+// fitMessage returns message cut to fit in a USSD message in the alphabet
+// of dcs, ending with marker when it had to be cut. The marker counts
+// towards the limit, so the result never exceeds it, and a reference is
+// never cut in two.
+func fitMessage(message string, dcs int, marker string) string {
+	if fitsMessage(message, dcs) {
+		return message
+	}
+
+	alphabet := dcsAlphabet(dcs)
+	budget := maxMessageUnits(alphabet) - encodedLength(marker, alphabet)
+	used := 0
+	for i := 0; i < len(message); {
+		r, size := messageChar(message[i:])
+		n := charLength(r, alphabet)
+		if used+n > budget {
+			return message[:i] + marker
+		}
+		used += n
+		i += size
+	}
+	return message
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/abeloha/USSDTCP/pkg/stats"
+)
+
+// When the listen loop last went round, in Unix nanoseconds; it does at
+// least every readDeadline while it is healthy
+var listenBeat atomic.Int64
+
+// Incremented to retire the running listen loop in favour of a new one
+var listenGeneration atomic.Int64
+
+// Reason given for the reconnect that follows a stalled listen loop
+var errListenStalled = errors.New("listen loop stalled")
+
+// runListenWatchdog checks every quarter of threshold that the listen loop
+// is still going round, until stop is closed
+func runListenWatchdog(threshold time.Duration, stop <-chan struct{}) {
+	listenBeat.CompareAndSwap(0, time.Now().UnixNano())
+	ticker := time.NewTicker(threshold / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			checkListenLoop(threshold)
+		}
+	}
+}
+
+// checkListenLoop restarts the listen loop, on a fresh connection, when it
+// has not gone round for threshold while the link is up, and reports
+// whether it did. The link is down while reconnecting, which the loop
+// itself does, so that is not taken for a stall.
+func checkListenLoop(threshold time.Duration) bool {
+	stalled := time.Since(time.Unix(0, listenBeat.Load()))
+	if !linkUp.Load() || stalled < threshold {
+		return false
+	}
+
+	stats.ListenStalls.Add(1)
+	AppLogger.Error("CRITICAL: listen loop stalled for %s (threshold %s) with the link up, restarting it", stalled.Round(time.Millisecond), threshold)
+	ErrorLogger.Error("CRITICAL: listen loop stalled for %s, restarting it", stalled.Round(time.Millisecond))
+
+	listenBeat.Store(time.Now().UnixNano())
+	listenGeneration.Add(1)
+	go func() {
+		reconnect(errListenStalled)
+		listenToTCPMessages()
+	}()
+	return true
+}